@@ -2,13 +2,37 @@ package api
 
 import (
 	"context"
+	"hxextract/app/dao"
+	"hxextract/app/dao/conn"
 	"hxextract/app/dao/pg"
+	"time"
 )
 
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative api.proto
+
 // NegtServer 对外接口
 type NegtServer interface {
 	Ping(ctx context.Context) error
 	Export(finName string, param pg.QueryParam) error
 	HealthCheck() error
-	CompareTable(finName string, operation int) (int, int, error)
+	Readiness() *dao.Readiness
+	CompareTable(finName string, operation int, operator string) (int, int, error)
+	PreviewExport(finName string, param pg.QueryParam) (*dao.PreviewPlan, error)
+	PreviewCompare(finName string) (*dao.PreviewPlan, error)
+	Reconcile(param dao.ReconcileParam) (*dao.ReconcileReport, error)
+	DerivedStatuses() []dao.DerivedStatus
+	TaskStatuses() []dao.TaskStatus
+	Tables(schemaName string) []dao.TableMeta
+	AuditRecords(q dao.AuditQuery) ([]dao.AuditRecord, error)
+	ExportRuns(q dao.RunQuery) (*dao.RunPage, error)
+	Freshness(schemaName string, tableName string, procType string, maxAge time.Duration) (*dao.Freshness, error)
+	SlaStatuses() []dao.SlaStatus
+	Connections() []conn.Info
+	StartBackfill(param dao.BackfillParam) (*dao.BackfillJob, error)
+	ResumeBackfill(id int64, operator string) (*dao.BackfillJob, error)
+	Backfills() ([]dao.BackfillJob, error)
+	BackfillDetail(id int64) (*dao.BackfillJob, error)
+	Groups() []dao.TableGroup
+	ExportGroup(group string, param pg.QueryParam, parallelism int) (*dao.GroupResult, error)
+	CompareGroup(group string, operation int, operator string, parallelism int) (*dao.GroupResult, error)
 }
@@ -0,0 +1,231 @@
+package auth
+
+/*
+purpose:管理接口的认证和授权，支持静态token和mTLS客户端证书，按角色区分只读、导出和删除数据的权限，
+特权操作记录到审计日志
+*/
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hxextract/app/config"
+	"hxextract/app/log"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// token请求头，与dapr的api token一致，也支持Authorization: Bearer <token>
+const (
+	HeaderToken         = "dapr-api-token"
+	HeaderAuthorization = "Authorization"
+	bearerPrefix        = "Bearer "
+)
+
+// 认证方式
+const (
+	MethodAnonymous = "anonymous" // 未开启认证
+	MethodToken     = "token"
+	MethodMTLS      = "mtls"
+)
+
+// Role 角色，高级别角色拥有低级别角色的全部权限
+type Role int
+
+const (
+	RoleNone   Role = iota
+	RoleRead        // 只读：状态、任务、指标
+	RoleExport      // 导出、补全、对账
+	RoleAdmin       // 删除生产库数据的对比
+)
+
+var roleNames = map[string]Role{"read": RoleRead, "export": RoleExport, "admin": RoleAdmin}
+
+var (
+	ErrUnauthenticated  = errors.New("missing or invalid credentials")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+type (
+	// Identity 调用方身份
+	Identity struct {
+		Name   string
+		Role   Role
+		Method string // 详见：Method*
+	}
+
+	tokenIdentity struct {
+		token []byte
+		Identity
+	}
+
+	// Authenticator 按配置校验调用方身份，为nil或未开启时所有请求均以admin角色放行
+	Authenticator struct {
+		enable  bool
+		tokens  []tokenIdentity
+		clients map[string]Identity
+	}
+)
+
+func (r Role) String() string {
+	for name, role := range roleNames {
+		if role == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+// ParseRole 解析配置中的角色名称
+func ParseRole(name string) (Role, error) {
+	if r, ok := roleNames[strings.ToLower(name)]; ok {
+		return r, nil
+	}
+	return RoleNone, errors.New(fmt.Sprintf("unknown role: %s", name))
+}
+
+// Allow 是否拥有该角色的权限
+func (i Identity) Allow(r Role) bool {
+	return i.Role >= r
+}
+
+//
+//  New
+//  @Description: 创建认证器，校验配置中的token和客户端证书
+//  @param cfg
+//  @return *Authenticator
+//  @return error
+//
+func New(cfg config.AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{enable: cfg.Enable, clients: make(map[string]Identity)}
+	for _, t := range cfg.Tokens {
+		role, err := ParseRole(t.Role)
+		if err != nil {
+			return nil, errors.Wrap(err, t.Name)
+		}
+		if t.Token == "" {
+			return nil, errors.New(fmt.Sprintf("token of %s is empty", t.Name))
+		}
+		a.tokens = append(a.tokens, tokenIdentity{
+			token:    []byte(t.Token),
+			Identity: Identity{Name: t.Name, Role: role, Method: MethodToken},
+		})
+	}
+	for _, c := range cfg.Clients {
+		role, err := ParseRole(c.Role)
+		if err != nil {
+			return nil, errors.Wrap(err, c.CommonName)
+		}
+		a.clients[c.CommonName] = Identity{Name: c.CommonName, Role: role, Method: MethodMTLS}
+	}
+	if a.enable && len(a.tokens) == 0 && len(a.clients) == 0 {
+		return nil, errors.New("auth is enabled but no token or client is configured")
+	}
+	return a, nil
+}
+
+//
+//  Authenticate
+//  @Description: 校验token或已通过tls校验的客户端证书，token优先
+//  @param token
+//  @param certs 客户端证书链，第一个为客户端证书
+//  @return Identity
+//  @return error
+//
+func (a *Authenticator) Authenticate(token string, certs []*x509.Certificate) (Identity, error) {
+	if a == nil || !a.enable {
+		return Identity{Name: MethodAnonymous, Role: RoleAdmin, Method: MethodAnonymous}, nil
+	}
+	if token != "" {
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare(t.token, []byte(token)) == 1 {
+				return t.Identity, nil
+			}
+		}
+		return Identity{}, ErrUnauthenticated
+	}
+	if len(certs) > 0 {
+		if id, ok := a.clients[certs[0].Subject.CommonName]; ok {
+			return id, nil
+		}
+	}
+	return Identity{}, ErrUnauthenticated
+}
+
+// TokenFromHeader 从请求头获取token
+func TokenFromHeader(h http.Header) string {
+	if token := h.Get(HeaderToken); token != "" {
+		return token
+	}
+	return TokenFromAuthorization(h.Get(HeaderAuthorization))
+}
+
+// TokenFromAuthorization 解析Authorization: Bearer <token>
+func TokenFromAuthorization(value string) string {
+	if strings.HasPrefix(value, bearerPrefix) {
+		return strings.TrimSpace(strings.TrimPrefix(value, bearerPrefix))
+	}
+	return ""
+}
+
+//
+//  TLSConfig
+//  @Description: 未配置证书时返回nil，配置ClientCAFile时校验客户端证书（客户端也可以不带证书而使用token）
+//  @param cfg
+//  @return *tls.Config
+//  @return error
+//
+func TLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load server certificate failed")
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.ClientCAFile == "" {
+		return tc, nil
+	}
+	ca, err := ioutil.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read client ca failed")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New(fmt.Sprintf("no certificate found in %s", cfg.ClientCAFile))
+	}
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.VerifyClientCertIfGiven
+	return tc, nil
+}
+
+//
+//  Record
+//  @Description: 记录特权操作（导出、对比、对账）及被拒绝的请求到审计日志
+//  @param id 调用方身份
+//  @param action 请求路径或gRPC方法
+//  @param err 执行结果，为nil时表示成功
+//  @param fields 其他信息，如ip、参数、耗时
+//
+func Record(id Identity, action string, err error, fields ...zap.Field) {
+	if log.Audit == nil {
+		return
+	}
+	fields = append([]zap.Field{
+		zap.String("caller", id.Name),
+		zap.String("role", id.Role.String()),
+		zap.String("auth", id.Method),
+		zap.String("action", action),
+	}, fields...)
+	if err != nil {
+		fields = append(fields, zap.String("result", "failed"), zap.String("err", err.Error()))
+	} else {
+		fields = append(fields, zap.String("result", "success"))
+	}
+	log.Audit.Info("audit", fields...)
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/assert"
+	"hxextract/app/config"
+	"net/http"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	a, err := New(config.AuthConfig{
+		Enable: true,
+		Tokens: []config.TokenConfig{
+			{Name: "dashboard", Token: "read-token", Role: "read"},
+			{Name: "ops", Token: "admin-token", Role: "admin"},
+		},
+		Clients: []config.ClientConfig{{CommonName: "scheduler", Role: "export"}},
+	})
+	assert.NoError(t, err)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "scheduler"}}
+	unknown := &x509.Certificate{Subject: pkix.Name{CommonName: "unknown"}}
+	tests := []struct {
+		name  string
+		token string
+		certs []*x509.Certificate
+		want  Identity
+		err   error
+	}{
+		{name: "read token", token: "read-token", want: Identity{Name: "dashboard", Role: RoleRead, Method: MethodToken}},
+		{name: "admin token", token: "admin-token", want: Identity{Name: "ops", Role: RoleAdmin, Method: MethodToken}},
+		{name: "client cert", certs: []*x509.Certificate{cert}, want: Identity{Name: "scheduler", Role: RoleExport, Method: MethodMTLS}},
+		{name: "wrong token", token: "bad", certs: []*x509.Certificate{cert}, err: ErrUnauthenticated},
+		{name: "unknown cert", certs: []*x509.Certificate{unknown}, err: ErrUnauthenticated},
+		{name: "no credentials", err: ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := a.Authenticate(tt.token, tt.certs)
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.want, id)
+		})
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	a, err := New(config.AuthConfig{})
+	assert.NoError(t, err)
+	id, err := a.Authenticate("", nil)
+	assert.NoError(t, err)
+	assert.True(t, id.Allow(RoleAdmin))
+	id, err = (*Authenticator)(nil).Authenticate("", nil)
+	assert.NoError(t, err)
+	assert.True(t, id.Allow(RoleAdmin))
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := New(config.AuthConfig{Tokens: []config.TokenConfig{{Name: "a", Token: "t", Role: "root"}}})
+	assert.Error(t, err)
+	_, err = New(config.AuthConfig{Tokens: []config.TokenConfig{{Name: "a", Role: "read"}}})
+	assert.Error(t, err)
+	_, err = New(config.AuthConfig{Enable: true})
+	assert.Error(t, err)
+}
+
+func TestRoleAllow(t *testing.T) {
+	assert.True(t, Identity{Role: RoleAdmin}.Allow(RoleExport))
+	assert.True(t, Identity{Role: RoleExport}.Allow(RoleRead))
+	assert.False(t, Identity{Role: RoleExport}.Allow(RoleAdmin))
+	assert.False(t, Identity{}.Allow(RoleRead))
+}
+
+func TestTokenFromHeader(t *testing.T) {
+	h := http.Header{}
+	assert.Equal(t, "", TokenFromHeader(h))
+	h.Set(HeaderAuthorization, "Bearer abc")
+	assert.Equal(t, "abc", TokenFromHeader(h))
+	h.Set(HeaderToken, "def")
+	assert.Equal(t, "def", TokenFromHeader(h))
+}
@@ -2,9 +2,10 @@ package config
 
 import (
 	"flag"
-	"github.com/go-yaml/yaml"
-	"io/ioutil"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -18,11 +19,10 @@ type (
 		Active        int           `yaml:"Active"`        // pool
 		Idle          int           `yaml:"Idle"`          // pool
 		RowLimit      int           `yaml:"RowLimit"`      // limit of row numbers in a process
-		IdleTimeout   time.Duration `yaml:"IdleTimeout"`   // connect max lifetime.
+		IdleTimeout   time.Duration `yaml:"IdleTimeout"`   // connect max idle time.
 		QueryTimeout  time.Duration `yaml:"QueryTimeout"`  // query sql timeout
 		ExecTimeout   time.Duration `yaml:"ExecTimeout"`   // execute sql timeout
-		TranTimeout   time.Duration `yaml:"TranTimeout"`   // transaction sql timeout
-		ExtraDatatype string        `yaml:"ExtraDatatype"` // extra finance datatype (divided by ',' like 262763,262764
+		TranTimeout   time.Duration `yaml:"TranTimeout"`   // transaction timeout
 		// Breaker      *breaker.Config // breaker
 	}
 
@@ -32,46 +32,160 @@ type (
 		MaxIdleConns int    `yaml:"MaxIdleConns"` // max number of idles existed
 		MaxOpenConns int    `yaml:"MaxOpenConns"` // max number of idles opened
 		LogLevel     string `yaml:"LogLevel"`     // log level of pg connection
+		FetchSize    int    `yaml:"FetchSize"`    // rows fetched from a refcursor at a time, default 10000
 	}
 
 	ServiceConfig struct {
-		HttpPort int `yaml:"HttpPort"` // http port
+		HttpPort        int               `yaml:"HttpPort"`        // http port
+		GrpcPort        int               `yaml:"GrpcPort"`        // grpc port, 0 to disable
+		ReferenceDir    string            `yaml:"ReferenceDir"`    // directory of reference files used by reconcile
+		References      []ReferenceConfig `yaml:"References"`      // pg references used by reconcile, referred by name
+		ReadyTimeout    time.Duration     `yaml:"ReadyTimeout"`    // timeout of each readiness check, default 2s
+		ReadyCacheTTL   time.Duration     `yaml:"ReadyCacheTTL"`   // readiness result cache duration, default 5s
+		ShutdownTimeout time.Duration     `yaml:"ShutdownTimeout"` // max wait for running requests and cron tasks on shutdown, default 30s
+	}
+
+	// ReferenceConfig 对账时可使用的参照pg库，请求中只能按名称引用，不接受请求中的dsn和sql
+	ReferenceConfig struct {
+		Name    string            `yaml:"Name"`    // name used by reconcile requests
+		DSN     string            `yaml:"DSN"`     // pg dsn, can be a secret reference
+		Queries map[string]string `yaml:"Queries"` // finname => query of the reference, default to the table's full export sql
+	}
+
+	EventConfig struct {
+		Enable     bool          `yaml:"Enable"`     // publish events through dapr pub/sub
+		PubsubName string        `yaml:"PubsubName"` // dapr pubsub component name
+		Topic      string        `yaml:"Topic"`      // topic of table updated events
+		Timeout    time.Duration `yaml:"Timeout"`    // publish timeout
+	}
+
+	// TriggerConfig 通过dapr pub/sub和输入绑定触发导出
+	TriggerConfig struct {
+		PubsubName string          `yaml:"PubsubName"` // dapr pubsub component name, empty to disable
+		Topic      string          `yaml:"Topic"`      // topic of export requests
+		Bindings   []BindingConfig `yaml:"Bindings"`   // input bindings
+	}
+
+	BindingConfig struct {
+		Name    string `yaml:"Name"`    // input binding component name, also the route
+		FinName string `yaml:"FinName"` // finance name exported when binding payload is empty
+		Type    int    `yaml:"Type"`    // export type exported when binding payload is empty
+	}
+
+	// SecretConfig 凭据引用的解析，支持secret://store/key、env://NAME、file:///path
+	SecretConfig struct {
+		RefreshInterval time.Duration `yaml:"RefreshInterval"` // cached secrets are fetched again after the interval, default 5m
+		Timeout         time.Duration `yaml:"Timeout"`         // timeout of fetching from secret store, default 3s
+	}
+
+	// ConnectionConfig mysql库和pg dsn连接池的检查、空闲回收和重连
+	ConnectionConfig struct {
+		CheckInterval time.Duration `yaml:"CheckInterval"` // interval of pinging connected pools and evicting idle ones, default 1m
+		IdleEvict     time.Duration `yaml:"IdleEvict"`     // pools not in DbNames are closed after idle for the duration, default 30m
+		PingTimeout   time.Duration `yaml:"PingTimeout"`   // timeout of ping after opening a pool, default 3s
+		BackoffMin    time.Duration `yaml:"BackoffMin"`    // first wait before reconnecting a failed pool, doubled on each failure, default 1s
+		BackoffMax    time.Duration `yaml:"BackoffMax"`    // max wait before reconnecting, default 1m
+	}
+
+	// FreshnessConfig 表新鲜度检查，sla配置在topview.FreshnessSla中
+	FreshnessConfig struct {
+		Interval time.Duration `yaml:"Interval"` // check interval, default 1m
+	}
+
+	// BackfillConfig 历史数据回补的默认分块和并发，请求中可覆盖
+	BackfillConfig struct {
+		ChunkMonths    int `yaml:"ChunkMonths"`    // months of each chunk, default 1
+		ChunkCodes     int `yaml:"ChunkCodes"`     // codes of each chunk when codes are given, default 500
+		Parallelism    int `yaml:"Parallelism"`    // chunks exported at the same time, default 4
+		MaxParallelism int `yaml:"MaxParallelism"` // max parallelism a request can ask for, default 16
+	}
+
+	// GroupConfig 按表分组导出和对比时的并发，分组配置在topview.TableGroup中
+	GroupConfig struct {
+		Parallelism    int `yaml:"Parallelism"`    // tables exported or compared at the same time, default 4
+		MaxParallelism int `yaml:"MaxParallelism"` // max parallelism a request can ask for, larger values are capped, default 16
+	}
+
+	// AuthConfig http管理接口的认证和授权
+	AuthConfig struct {
+		Enable  bool           `yaml:"Enable"`  // enable authentication, all requests are allowed when disabled
+		Tokens  []TokenConfig  `yaml:"Tokens"`  // static api tokens
+		Clients []ClientConfig `yaml:"Clients"` // mTLS client certificates
+		TLS     TLSConfig      `yaml:"TLS"`     // serve https when CertFile is set
+	}
+
+	TokenConfig struct {
+		Name  string `yaml:"Name"`  // caller name written to audit log
+		Token string `yaml:"Token"` // token passed by dapr-api-token or Authorization: Bearer header
+		Role  string `yaml:"Role"`  // read/export/admin
+	}
+
+	ClientConfig struct {
+		CommonName string `yaml:"CommonName"` // common name of client certificate
+		Role       string `yaml:"Role"`       // read/export/admin
+	}
+
+	TLSConfig struct {
+		CertFile     string `yaml:"CertFile"`     // server certificate
+		KeyFile      string `yaml:"KeyFile"`      // server private key
+		ClientCAFile string `yaml:"ClientCAFile"` // ca of client certificates, empty to disable mTLS
 	}
 
 	LogConfig struct {
 		LogPath     string `yaml:"LogPath"`     // log file path
 		StatLogPath string `yaml:"StatLogPath"` // status log file path
 		GinLogPath  string `yaml:"GinLogPath"`  // gin log file path
+		AuditPath   string `yaml:"AuditPath"`   // audit log file path of privileged calls
 		LogLevel    string `yaml:"LogLevel"`    // log level
 	}
 
 	Config struct {
-		Mysql   MyConfig      `yaml:"Mysql"`   // mysql configure
-		Pgsql   PgConfig      `yaml:"Pgsql"`   // pgsql configure
-		Service ServiceConfig `yaml:"Service"` // service configure
-		Log     LogConfig     `yaml:"Log"`     // log configure
+		Mysql      MyConfig         `yaml:"Mysql"`      // mysql configure
+		Pgsql      PgConfig         `yaml:"Pgsql"`      // pgsql configure
+		Service    ServiceConfig    `yaml:"Service"`    // service configure
+		Event      EventConfig      `yaml:"Event"`      // event configure
+		Trigger    TriggerConfig    `yaml:"Trigger"`    // trigger configure
+		Auth       AuthConfig       `yaml:"Auth"`       // auth configure
+		Freshness  FreshnessConfig  `yaml:"Freshness"`  // freshness configure
+		Connection ConnectionConfig `yaml:"Connection"` // connection configure
+		Backfill   BackfillConfig   `yaml:"Backfill"`   // backfill configure
+		Group      GroupConfig      `yaml:"Group"`      // table group configure
+		Secret     SecretConfig     `yaml:"Secret"`     // secret configure
+		Log        LogConfig        `yaml:"Log"`        // log configure
 	}
 )
 
 var (
-	cfgFile *string
-	cfg     Config
+	cfgFile     *string
+	printConfig *bool
+	cfg         Config
 )
 
 /*ConfigureInit
- * @Description: 获取配置
+ * @Description: 加载配置，依次为默认值、配置文件、HXEXTRACT_<SECTION>_<FIELD>环境变量，校验失败时退出
  */
 func ConfigureInit() {
-	// TODO: negt-go 配置模块接入
-	// 注释中为线上环境配置
-	//cfgFile = flag.String("f", "/usr/local/conf/conf.yaml", "config file path")
-	cfgFile = flag.String("f", "D:\\workspace\\go\\202203\\hxextract\\conf\\conf.yaml",
-		"config file path")
+	// 未指定-f时使用HXEXTRACT_CONFIG，都未设置时为工作目录下的conf/conf.yaml
+	defaultFile := os.Getenv(EnvPrefix + "_CONFIG")
+	if defaultFile == "" {
+		defaultFile = filepath.Join("conf", "conf.yaml")
+	}
+	cfgFile = flag.String("f", defaultFile, "config file path")
+	printConfig = flag.Bool("print-config", false, "print the effective config with secrets redacted and exit")
 	flag.Parse()
-	content, err := ioutil.ReadFile(*cfgFile)
-	if yaml.Unmarshal(content, &cfg) != nil {
-		log.Fatalf("解析config.yaml出错: %v", err)
+	c, err := Load(*cfgFile)
+	if err != nil {
+		log.Fatalf("加载配置出错: %v", err)
 	}
+	if err = c.Validate(); err != nil {
+		log.Fatalf("配置校验失败: %v", err)
+	}
+	cfg = c
+	if *printConfig {
+		fmt.Print(c.String())
+		os.Exit(0)
+	}
+	log.Printf("config loaded from %s, effective config:\n%s", *cfgFile, c.String())
 }
 
 func GetMysql() MyConfig {
@@ -86,6 +200,48 @@ func GetService() ServiceConfig {
 	return cfg.Service
 }
 
+// GetReference 按名称获取对账参照pg库
+func GetReference(name string) (ReferenceConfig, bool) {
+	for _, ref := range cfg.Service.References {
+		if ref.Name == name {
+			return ref, true
+		}
+	}
+	return ReferenceConfig{}, false
+}
+
+func GetEvent() EventConfig {
+	return cfg.Event
+}
+
+func GetTrigger() TriggerConfig {
+	return cfg.Trigger
+}
+
+func GetAuth() AuthConfig {
+	return cfg.Auth
+}
+
+func GetFreshness() FreshnessConfig {
+	return cfg.Freshness
+}
+
+func GetConnection() ConnectionConfig {
+	return cfg.Connection
+}
+
+func GetBackfill() BackfillConfig {
+	return cfg.Backfill
+}
+
+func GetGroup() GroupConfig {
+	return cfg.Group
+}
+
+func GetSecret() SecretConfig {
+	return cfg.Secret
+}
+
 func GetLog() LogConfig {
 	return cfg.Log
 }
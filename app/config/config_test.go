@@ -0,0 +1,95 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "conf.yaml")
+	content := `
+Mysql:
+  Address: "root:123456@tcp(127.0.0.1:3306)/"
+  DbNames:
+    - indexfinance
+  Active:
+  RowLimit: 5000
+Service:
+  HttpPort: 8080
+`
+	assert.NoError(t, ioutil.WriteFile(file, []byte(content), 0600))
+	os.Setenv("HXEXTRACT_MYSQL_ROWLIMIT", "2000")
+	os.Setenv("HXEXTRACT_MYSQL_DBNAMES", "indexfinance, stockfinance")
+	os.Setenv("HXEXTRACT_SERVICE_SHUTDOWNTIMEOUT", "1m")
+	os.Setenv("HXEXTRACT_AUTH_TLS_CERTFILE", "server.crt")
+	defer func() {
+		for _, key := range []string{"HXEXTRACT_MYSQL_ROWLIMIT", "HXEXTRACT_MYSQL_DBNAMES",
+			"HXEXTRACT_SERVICE_SHUTDOWNTIMEOUT", "HXEXTRACT_AUTH_TLS_CERTFILE"} {
+			os.Unsetenv(key)
+		}
+	}()
+	c, err := Load(file)
+	assert.NoError(t, err)
+	// 环境变量优先于配置文件
+	assert.Equal(t, 2000, c.Mysql.RowLimit)
+	assert.Equal(t, []string{"indexfinance", "stockfinance"}, c.Mysql.DbNames)
+	assert.Equal(t, time.Minute, c.Service.ShutdownTimeout)
+	assert.Equal(t, "server.crt", c.Auth.TLS.CertFile)
+	// 配置文件优先于默认值，未设置和空值使用默认值
+	assert.Equal(t, 8080, c.Service.HttpPort)
+	assert.Equal(t, 50, c.Mysql.Active)
+	assert.Equal(t, "topview", c.Mysql.DefaultDbname)
+	assert.Equal(t, 2*time.Second, c.Service.ReadyTimeout)
+
+	os.Setenv("HXEXTRACT_MYSQL_ROWLIMIT", "many")
+	_, err = Load(file)
+	assert.EqualError(t, err, `invalid environment variable HXEXTRACT_MYSQL_ROWLIMIT="many": strconv.Atoi: parsing "many": invalid syntax`)
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.Mysql.Address = "root:123456@tcp(127.0.0.1:3306)/"
+	assert.NoError(t, c.Validate())
+
+	c.Mysql.RowLimit = 0
+	c.Service.GrpcPort = c.Service.HttpPort
+	c.Auth.Tokens = []TokenConfig{{Name: "ops", Token: "t", Role: "root"}}
+	c.Service.References = []ReferenceConfig{{Name: "replica", DSN: "host=replica"}, {Name: "replica"}}
+	err := c.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Mysql.RowLimit should be in [1, 100000], got 0")
+	assert.Contains(t, err.Error(), "Service.GrpcPort should differ from Service.HttpPort")
+	assert.Contains(t, err.Error(), `Auth.Tokens[0].Role should be one of read,export,admin, got "root"`)
+	assert.Contains(t, err.Error(), "Service.References[1].Name is required and should be unique")
+	assert.Contains(t, err.Error(), "Service.References[1].DSN is required")
+}
+
+func TestRedacted(t *testing.T) {
+	c := Default()
+	c.Mysql.Address = "root:123456@tcp(127.0.0.1:3306)/"
+	c.Pgsql.DefaultDSN = "host=127.0.0.1 user=postgres password=postgres dbname=postgres"
+	c.Auth.Tokens = []TokenConfig{{Name: "ops", Token: "change-me", Role: "admin"}}
+	c.Service.References = []ReferenceConfig{{Name: "replica", DSN: "host=replica password=postgres"}}
+	r := c.Redacted()
+	assert.Equal(t, "root:xxxxx@tcp(127.0.0.1:3306)/", r.Mysql.Address)
+	assert.Equal(t, "host=127.0.0.1 user=postgres password=xxxxx dbname=postgres", r.Pgsql.DefaultDSN)
+	assert.Equal(t, "xxxxx", r.Auth.Tokens[0].Token)
+	assert.Equal(t, "change-me", c.Auth.Tokens[0].Token)
+	assert.Equal(t, "host=replica password=xxxxx", r.Service.References[0].DSN)
+	assert.Equal(t, "host=replica password=postgres", c.Service.References[0].DSN)
+	assert.NotContains(t, c.String(), "123456")
+
+	// 凭据引用不是密码，原样保留
+	c.Mysql.Address = "root:${secret://vault/mysql#password}@tcp(127.0.0.1:3306)/"
+	c.Pgsql.DefaultDSN = "host=127.0.0.1 password=${env://PG_PASSWORD}"
+	r = c.Redacted()
+	assert.Equal(t, c.Mysql.Address, r.Mysql.Address)
+	assert.Equal(t, c.Pgsql.DefaultDSN, r.Pgsql.DefaultDSN)
+}
@@ -0,0 +1,308 @@
+package config
+
+import (
+	"fmt"
+	"github.com/go-yaml/yaml"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix 环境变量覆盖配置的前缀，如HXEXTRACT_MYSQL_ROWLIMIT覆盖Mysql.RowLimit
+const EnvPrefix = "HXEXTRACT"
+
+const redacted = "xxxxx"
+
+var (
+	dsnPassword = regexp.MustCompile(`password=\S*`)
+	logLevels   = map[string]bool{"debug": true, "info": true, "warn": true, "error": true}
+	roles       = map[string]bool{"read": true, "export": true, "admin": true}
+	durationT   = reflect.TypeOf(time.Duration(0))
+)
+
+// Default 默认配置，配置文件和环境变量中未设置或为零值的字段使用默认值
+func Default() Config {
+	return Config{
+		Mysql: MyConfig{
+			Params:        "charset=utf8mb4&parseTime=True&loc=Local",
+			DefaultDbname: "topview",
+			Active:        50,
+			Idle:          10,
+			RowLimit:      10000,
+			IdleTimeout:   4 * time.Hour,
+			QueryTimeout:  30 * time.Second,
+			ExecTimeout:   5 * time.Minute,
+			TranTimeout:   60 * time.Second,
+		},
+		Pgsql: PgConfig{
+			QueryTimeout: 100000,
+			MaxIdleConns: 10,
+			MaxOpenConns: 100,
+			LogLevel:     "info",
+			FetchSize:    10000,
+		},
+		Service: ServiceConfig{
+			HttpPort:        12345,
+			ReferenceDir:    "./reference",
+			ReadyTimeout:    2 * time.Second,
+			ReadyCacheTTL:   5 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Event: EventConfig{
+			PubsubName: "pubsub",
+			Topic:      "hxextract-table-updated",
+			Timeout:    3 * time.Second,
+		},
+		Freshness: FreshnessConfig{Interval: time.Minute},
+		Connection: ConnectionConfig{
+			CheckInterval: time.Minute,
+			IdleEvict:     30 * time.Minute,
+			PingTimeout:   3 * time.Second,
+			BackoffMin:    time.Second,
+			BackoffMax:    time.Minute,
+		},
+		Backfill: BackfillConfig{ChunkMonths: 1, ChunkCodes: 500, Parallelism: 4, MaxParallelism: 16},
+		Group:    GroupConfig{Parallelism: 4, MaxParallelism: 16},
+		Secret:   SecretConfig{RefreshInterval: 5 * time.Minute, Timeout: 3 * time.Second},
+		Log: LogConfig{
+			LogPath:     "./log/extract.log",
+			StatLogPath: "./log/stats_extract.log",
+			GinLogPath:  "./log/gin_extract.log",
+			AuditPath:   "./log/audit_extract.log",
+			LogLevel:    "info",
+		},
+	}
+}
+
+// Load
+// @Description: 依次加载配置文件和环境变量，再用默认值填充零值字段
+// @param path 配置文件路径，为空时只使用默认值和环境变量
+// @return Config
+// @return error
+func Load(path string) (Config, error) {
+	var c Config
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return c, errors.Wrap(err, "read config file")
+		}
+		if err = yaml.Unmarshal(content, &c); err != nil {
+			return c, errors.Wrap(err, fmt.Sprintf("parse config file %s", path))
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&c).Elem(), EnvPrefix, os.LookupEnv); err != nil {
+		return c, err
+	}
+	fillDefaults(reflect.ValueOf(&c).Elem(), reflect.ValueOf(Default()))
+	return c, nil
+}
+
+// applyEnv 按<前缀>_<SECTION>_<FIELD>覆盖字段，字段名为yaml名称的大写，切片用,分隔，结构体切片不支持覆盖
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("yaml")
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		key := prefix + "_" + strings.ToUpper(name)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, key, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := lookup(key)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return errors.New(fmt.Sprintf("invalid environment variable %s=%q: %s", key, value, err.Error()))
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationT {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return errors.New("only string lists can be set by environment variables")
+		}
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return errors.New(fmt.Sprintf("unsupported type %s", field.Type()))
+	}
+	return nil
+}
+
+// fillDefaults 用默认值填充零值字段
+func fillDefaults(v reflect.Value, def reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			fillDefaults(field, def.Field(i))
+			continue
+		}
+		if field.IsZero() {
+			field.Set(def.Field(i))
+		}
+	}
+}
+
+// Validate
+// @Description: 校验必填字段和取值范围，返回所有错误
+// @receiver c
+// @return error
+func (c Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.Mysql.Address != "", "Mysql.Address is required")
+	check(c.Mysql.RowLimit > 0 && c.Mysql.RowLimit <= 100000, "Mysql.RowLimit should be in [1, 100000], got %d", c.Mysql.RowLimit)
+	check(c.Mysql.Active > 0, "Mysql.Active should be positive, got %d", c.Mysql.Active)
+	check(c.Mysql.Idle >= 0 && c.Mysql.Idle <= c.Mysql.Active,
+		"Mysql.Idle should be in [0, Mysql.Active], got %d", c.Mysql.Idle)
+	check(c.Pgsql.QueryTimeout >= 0, "Pgsql.QueryTimeout should not be negative, got %d", c.Pgsql.QueryTimeout)
+	check(c.Pgsql.MaxOpenConns > 0, "Pgsql.MaxOpenConns should be positive, got %d", c.Pgsql.MaxOpenConns)
+	check(c.Pgsql.MaxIdleConns >= 0 && c.Pgsql.MaxIdleConns <= c.Pgsql.MaxOpenConns,
+		"Pgsql.MaxIdleConns should be in [0, Pgsql.MaxOpenConns], got %d", c.Pgsql.MaxIdleConns)
+	check(c.Pgsql.FetchSize > 0, "Pgsql.FetchSize should be positive, got %d", c.Pgsql.FetchSize)
+	check(logLevels[c.Pgsql.LogLevel], "Pgsql.LogLevel should be one of debug,info,warn,error, got %q", c.Pgsql.LogLevel)
+	check(c.Service.HttpPort > 0 && c.Service.HttpPort < 65536, "Service.HttpPort should be in [1, 65535], got %d", c.Service.HttpPort)
+	check(c.Service.GrpcPort >= 0 && c.Service.GrpcPort < 65536, "Service.GrpcPort should be in [0, 65535], got %d", c.Service.GrpcPort)
+	check(c.Service.GrpcPort != c.Service.HttpPort, "Service.GrpcPort should differ from Service.HttpPort")
+	if c.Event.Enable {
+		check(c.Event.PubsubName != "" && c.Event.Topic != "", "Event.PubsubName and Event.Topic are required when Event.Enable")
+	}
+	check(c.Trigger.PubsubName == "" || c.Trigger.Topic != "", "Trigger.Topic is required when Trigger.PubsubName is set")
+	refNames := make(map[string]bool, len(c.Service.References))
+	for i, ref := range c.Service.References {
+		check(ref.Name != "" && !refNames[ref.Name], "Service.References[%d].Name is required and should be unique", i)
+		check(ref.DSN != "", "Service.References[%d].DSN is required", i)
+		refNames[ref.Name] = true
+	}
+	for i, b := range c.Trigger.Bindings {
+		check(b.Name != "", "Trigger.Bindings[%d].Name is required", i)
+	}
+	for i, token := range c.Auth.Tokens {
+		check(token.Token != "", "Auth.Tokens[%d].Token is required", i)
+		check(roles[token.Role], "Auth.Tokens[%d].Role should be one of read,export,admin, got %q", i, token.Role)
+	}
+	for i, client := range c.Auth.Clients {
+		check(client.CommonName != "", "Auth.Clients[%d].CommonName is required", i)
+		check(roles[client.Role], "Auth.Clients[%d].Role should be one of read,export,admin, got %q", i, client.Role)
+	}
+	check((c.Auth.TLS.CertFile == "") == (c.Auth.TLS.KeyFile == ""), "Auth.TLS.CertFile and Auth.TLS.KeyFile should be set together")
+	check(c.Auth.TLS.ClientCAFile == "" || c.Auth.TLS.CertFile != "", "Auth.TLS.ClientCAFile requires Auth.TLS.CertFile")
+	check(c.Freshness.Interval >= time.Second, "Freshness.Interval should be at least 1s, got %s", c.Freshness.Interval)
+	check(c.Connection.CheckInterval >= time.Second, "Connection.CheckInterval should be at least 1s, got %s", c.Connection.CheckInterval)
+	check(c.Connection.BackoffMax >= c.Connection.BackoffMin,
+		"Connection.BackoffMax should not be less than Connection.BackoffMin, got %s < %s", c.Connection.BackoffMax, c.Connection.BackoffMin)
+	check(c.Backfill.ChunkMonths > 0, "Backfill.ChunkMonths should be positive, got %d", c.Backfill.ChunkMonths)
+	check(c.Backfill.ChunkCodes > 0, "Backfill.ChunkCodes should be positive, got %d", c.Backfill.ChunkCodes)
+	check(c.Backfill.Parallelism > 0 && c.Backfill.Parallelism <= c.Backfill.MaxParallelism,
+		"Backfill.Parallelism should be in [1, Backfill.MaxParallelism], got %d", c.Backfill.Parallelism)
+	check(c.Group.Parallelism > 0 && c.Group.Parallelism <= c.Group.MaxParallelism,
+		"Group.Parallelism should be in [1, Group.MaxParallelism], got %d", c.Group.Parallelism)
+	check(logLevels[c.Log.LogLevel], "Log.LogLevel should be one of debug,info,warn,error, got %q", c.Log.LogLevel)
+	check(c.Log.LogPath != "", "Log.LogPath is required")
+	if len(errs) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// Redacted 隐藏密码和token后的配置，用于打印，凭据引用原样保留
+func (c Config) Redacted() Config {
+	c.Mysql.Address = redactAddress(c.Mysql.Address)
+	c.Pgsql.DefaultDSN = RedactDsn(c.Pgsql.DefaultDSN)
+	refs := make([]ReferenceConfig, len(c.Service.References))
+	for i, ref := range c.Service.References {
+		ref.DSN = RedactDsn(ref.DSN)
+		refs[i] = ref
+	}
+	c.Service.References = refs
+	tokens := make([]TokenConfig, len(c.Auth.Tokens))
+	for i, token := range c.Auth.Tokens {
+		token.Token = redacted
+		tokens[i] = token
+	}
+	c.Auth.Tokens = tokens
+	return c
+}
+
+// String 隐藏密码后的yaml格式配置
+func (c Config) String() string {
+	content, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(content)
+}
+
+// RedactDsn 隐藏pg dsn中的密码，支持key=value和url两种格式
+func RedactDsn(dsn string) string {
+	if strings.Contains(dsn, "://") && !strings.Contains(dsn, "${") {
+		if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+			return u.Redacted()
+		}
+	}
+	return dsnPassword.ReplaceAllStringFunc(dsn, func(m string) string {
+		if strings.Contains(m, "://") {
+			return m
+		}
+		return "password=" + redacted
+	})
+}
+
+// redactAddress 隐藏mysql地址user:password@tcp(host:port)/中的密码
+func redactAddress(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address
+	}
+	colon := strings.Index(address[:at], ":")
+	if colon < 0 || strings.Contains(address[colon+1:at], "${") {
+		return address
+	}
+	return address[:colon+1] + redacted + address[at:]
+}
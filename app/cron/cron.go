@@ -1,7 +1,9 @@
 package cron
 
 import (
+	"context"
 	"github.com/robfig/cron/v3"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,6 +15,7 @@ type (
 	Manager       struct {
 		cron           *cron.Cron
 		scheduleDetail map[string]CronEntryInfo
+		running        int32 // 调度器是否已启动，就绪检查会并发读取
 	}
 )
 
@@ -26,10 +29,23 @@ func InitCron() {
 
 func Start() {
 	manager.cron.Start()
+	atomic.StoreInt32(&manager.running, 1)
 }
 
-func Stop() {
-	manager.cron.Stop()
+// Stop 停止调度新任务，返回的ctx在执行中的任务全部结束后done
+func Stop() context.Context {
+	if manager.cron == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+	atomic.StoreInt32(&manager.running, 0)
+	return manager.cron.Stop()
+}
+
+// Running 调度器是否已启动
+func Running() bool {
+	return atomic.LoadInt32(&manager.running) == 1
 }
 
 func AddTask(task string, schedule string, cronFunc func()) error {
@@ -49,6 +65,18 @@ func AddTask(task string, schedule string, cronFunc func()) error {
 	return nil
 }
 
+// Next 获取定时配置在t之后的下一次执行时间
+func Next(schedule string, t time.Time) (time.Time, error) {
+	sched, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if manager.cron != nil {
+		t = t.In(manager.cron.Location())
+	}
+	return sched.Next(t), nil
+}
+
 func RemoveTask(task string) {
 	taskDetail, ok := manager.scheduleDetail[task]
 	if !ok {
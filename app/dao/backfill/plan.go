@@ -0,0 +1,181 @@
+package backfill
+
+/*
+purpose:历史数据回补的分块拆分和进度统计，按表、日期窗口、代码批次依次拆分，不依赖数据库
+*/
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 分块状态，与导出执行记录的状态一致
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+)
+
+// MaxChunks 单个回补任务的最大分块数
+const MaxChunks = 10000
+
+type (
+	// Table 回补的表，UseDate、UseCodes为导出sql是否使用日期、代码参数
+	Table struct {
+		Schema   string
+		Name     string
+		UseDate  bool
+		UseCodes bool
+	}
+
+	// Range 回补的日期和代码范围及分块大小
+	Range struct {
+		StartDate   int
+		EndDate     int
+		Codes       []string // 为空时不按代码拆分
+		ChunkMonths int
+		ChunkCodes  int
+	}
+
+	// Chunk 分块的表和范围，Seq从1开始
+	Chunk struct {
+		Seq       int
+		Schema    string
+		Table     string
+		StartDate int
+		EndDate   int
+		Codes     string // 用','连接的代码
+	}
+
+	// Progress 回补进度
+	Progress struct {
+		Total   int     `json:"total"`
+		Pending int     `json:"pending"`
+		Running int     `json:"running"`
+		Success int     `json:"success"`
+		Failed  int     `json:"failed"`
+		Percent float64 `json:"percent"` // 已结束（成功或失败）的分块占比
+	}
+)
+
+//
+//  Chunks
+//  @Description: 按表、日期窗口、代码批次依次拆分分块，导出sql未使用日期参数时不按日期拆分
+//  @param tables
+//  @param r
+//  @return []Chunk
+//  @return error 日期有误、指定了代码但sql未使用代码参数或分块超过MaxChunks时返回错误
+//
+func Chunks(tables []Table, r Range) ([]Chunk, error) {
+	windows, err := DateWindows(r.StartDate, r.EndDate, r.ChunkMonths)
+	if err != nil {
+		return nil, err
+	}
+	batches := CodeBatches(r.Codes, r.ChunkCodes)
+	var chunks []Chunk
+	for _, table := range tables {
+		if len(r.Codes) > 0 && !table.UseCodes {
+			return nil, errors.New(fmt.Sprintf("sql of %s.%s doesn't use :codes", table.Schema, table.Name))
+		}
+		tableWindows := windows
+		if !table.UseDate {
+			tableWindows = [][2]int{{r.StartDate, r.EndDate}}
+		}
+		for _, w := range tableWindows {
+			for _, codes := range batches {
+				chunks = append(chunks, Chunk{
+					Seq:       len(chunks) + 1,
+					Schema:    table.Schema,
+					Table:     table.Name,
+					StartDate: w[0],
+					EndDate:   w[1],
+					Codes:     codes,
+				})
+			}
+		}
+	}
+	if len(chunks) > MaxChunks {
+		return nil, errors.New(fmt.Sprintf("%d chunks exceed the limit %d, use larger chunk_months or chunk_codes",
+			len(chunks), MaxChunks))
+	}
+	return chunks, nil
+}
+
+// DateWindows 将[start, end]按自然月拆分，每段months个月，首尾两段可能不足months个月
+func DateWindows(start int, end int, months int) ([][2]int, error) {
+	from, err := time.Parse("20060102", strconv.Itoa(start))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid startdate %d", start))
+	}
+	to, err := time.Parse("20060102", strconv.Itoa(end))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid enddate %d", end))
+	}
+	if from.After(to) {
+		return nil, errors.New("enddate should not be earlier than startdate")
+	}
+	if months <= 0 {
+		return nil, errors.New(fmt.Sprintf("invalid chunk_months %d", months))
+	}
+	var ret [][2]int
+	for !from.After(to) {
+		next := time.Date(from.Year(), from.Month()+time.Month(months), 1, 0, 0, 0, 0, time.UTC)
+		last := next.AddDate(0, 0, -1)
+		if last.After(to) {
+			last = to
+		}
+		ret = append(ret, [2]int{dateInt(from), dateInt(last)})
+		from = next
+	}
+	return ret, nil
+}
+
+func dateInt(t time.Time) int {
+	return t.Year()*10000 + int(t.Month())*100 + t.Day()
+}
+
+// CodeBatches 每size个代码为一批，用','连接，没有代码时只有一个空批次
+func CodeBatches(codes []string, size int) []string {
+	if len(codes) == 0 {
+		return []string{""}
+	}
+	if size <= 0 {
+		size = len(codes)
+	}
+	var ret []string
+	for i := 0; i < len(codes); i += size {
+		j := i + size
+		if j > len(codes) {
+			j = len(codes)
+		}
+		ret = append(ret, strings.Join(codes[i:j], ","))
+	}
+	return ret
+}
+
+// Add 按分块状态累加n个分块
+func (p *Progress) Add(status string, n int) {
+	p.Total += n
+	switch status {
+	case StatusPending:
+		p.Pending += n
+	case StatusRunning:
+		p.Running += n
+	case StatusSuccess:
+		p.Success += n
+	case StatusFailed:
+		p.Failed += n
+	}
+}
+
+// Done 计算已结束的分块占比，保留两位小数
+func (p Progress) Done() Progress {
+	if p.Total > 0 {
+		p.Percent = float64((p.Success+p.Failed)*10000/p.Total) / 100
+	}
+	return p
+}
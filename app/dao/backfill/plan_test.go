@@ -0,0 +1,184 @@
+package backfill
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestDateWindows(t *testing.T) {
+	tests := []struct {
+		name   string
+		start  int
+		end    int
+		months int
+		want   [][2]int
+		err    string
+	}{
+		{name: "single day", start: 20220115, end: 20220115, months: 1, want: [][2]int{{20220115, 20220115}}},
+		{name: "partial first and last month", start: 20220115, end: 20220310, months: 1,
+			want: [][2]int{{20220115, 20220131}, {20220201, 20220228}, {20220301, 20220310}}},
+		{name: "whole months", start: 20220101, end: 20220331, months: 1,
+			want: [][2]int{{20220101, 20220131}, {20220201, 20220228}, {20220301, 20220331}}},
+		{name: "leap year", start: 20240201, end: 20240229, months: 1, want: [][2]int{{20240201, 20240229}}},
+		{name: "quarters", start: 20220115, end: 20221010, months: 3,
+			want: [][2]int{{20220115, 20220331}, {20220401, 20220630}, {20220701, 20220930}, {20221001, 20221010}}},
+		{name: "across year", start: 20211115, end: 20220205, months: 2,
+			want: [][2]int{{20211115, 20211231}, {20220101, 20220205}}},
+		{name: "months larger than range", start: 20220110, end: 20220220, months: 12,
+			want: [][2]int{{20220110, 20220220}}},
+		{name: "invalid start", start: 20221301, end: 20221231, months: 1, err: "invalid startdate 20221301"},
+		{name: "invalid end", start: 20220101, end: 2022, months: 1, err: "invalid enddate 2022"},
+		{name: "end before start", start: 20220201, end: 20220101, months: 1,
+			err: "enddate should not be earlier than startdate"},
+		{name: "invalid months", start: 20220101, end: 20220201, months: 0, err: "invalid chunk_months 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			windows, err := DateWindows(tt.start, tt.end, tt.months)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, windows)
+		})
+	}
+}
+
+func TestCodeBatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		codes []string
+		size  int
+		want  []string
+	}{
+		{name: "no codes", codes: nil, size: 2, want: []string{""}},
+		{name: "one batch", codes: []string{"000001", "000002"}, size: 2, want: []string{"000001,000002"}},
+		{name: "partial last batch", codes: []string{"000001", "000002", "000003"}, size: 2,
+			want: []string{"000001,000002", "000003"}},
+		{name: "batch of one", codes: []string{"000001", "000002"}, size: 1, want: []string{"000001", "000002"}},
+		{name: "size zero", codes: []string{"000001", "000002"}, size: 0, want: []string{"000001,000002"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, CodeBatches(tt.codes, tt.size))
+		})
+	}
+}
+
+func TestChunks(t *testing.T) {
+	dated := Table{Schema: "indexfinance", Name: "CashFlow", UseDate: true, UseCodes: true}
+	undated := Table{Schema: "indexfinance", Name: "Static", UseCodes: true}
+	noCodes := Table{Schema: "indexfinance", Name: "Balance", UseDate: true}
+	tests := []struct {
+		name   string
+		tables []Table
+		r      Range
+		want   []Chunk
+		err    string
+	}{
+		{
+			name:   "dates only",
+			tables: []Table{noCodes},
+			r:      Range{StartDate: 20220115, EndDate: 20220310, ChunkMonths: 2, ChunkCodes: 500},
+			want: []Chunk{
+				{Seq: 1, Schema: "indexfinance", Table: "Balance", StartDate: 20220115, EndDate: 20220228},
+				{Seq: 2, Schema: "indexfinance", Table: "Balance", StartDate: 20220301, EndDate: 20220310},
+			},
+		},
+		{
+			name:   "dates and codes",
+			tables: []Table{dated},
+			r: Range{StartDate: 20220115, EndDate: 20220210, Codes: []string{"000001", "000002", "000003"},
+				ChunkMonths: 1, ChunkCodes: 2},
+			want: []Chunk{
+				{Seq: 1, Schema: "indexfinance", Table: "CashFlow", StartDate: 20220115, EndDate: 20220131, Codes: "000001,000002"},
+				{Seq: 2, Schema: "indexfinance", Table: "CashFlow", StartDate: 20220115, EndDate: 20220131, Codes: "000003"},
+				{Seq: 3, Schema: "indexfinance", Table: "CashFlow", StartDate: 20220201, EndDate: 20220210, Codes: "000001,000002"},
+				{Seq: 4, Schema: "indexfinance", Table: "CashFlow", StartDate: 20220201, EndDate: 20220210, Codes: "000003"},
+			},
+		},
+		{
+			name:   "sql without dates",
+			tables: []Table{undated, dated},
+			r: Range{StartDate: 20220115, EndDate: 20220210, Codes: []string{"000001"},
+				ChunkMonths: 1, ChunkCodes: 500},
+			want: []Chunk{
+				{Seq: 1, Schema: "indexfinance", Table: "Static", StartDate: 20220115, EndDate: 20220210, Codes: "000001"},
+				{Seq: 2, Schema: "indexfinance", Table: "CashFlow", StartDate: 20220115, EndDate: 20220131, Codes: "000001"},
+				{Seq: 3, Schema: "indexfinance", Table: "CashFlow", StartDate: 20220201, EndDate: 20220210, Codes: "000001"},
+			},
+		},
+		{
+			name:   "codes not used",
+			tables: []Table{dated, noCodes},
+			r:      Range{StartDate: 20220101, EndDate: 20220101, Codes: []string{"000001"}, ChunkMonths: 1, ChunkCodes: 500},
+			err:    "sql of indexfinance.Balance doesn't use :codes",
+		},
+		{
+			name:   "invalid dates",
+			tables: []Table{dated},
+			r:      Range{StartDate: 20220201, EndDate: 20220101, ChunkMonths: 1, ChunkCodes: 500},
+			err:    "enddate should not be earlier than startdate",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks, err := Chunks(tt.tables, tt.r)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, chunks)
+		})
+	}
+}
+
+func TestChunksLimit(t *testing.T) {
+	codes := make([]string, MaxChunks)
+	for i := range codes {
+		codes[i] = strconv.Itoa(i)
+	}
+	table := Table{Schema: "indexfinance", Name: "CashFlow", UseDate: true, UseCodes: true}
+	// 刚好达到上限
+	chunks, err := Chunks([]Table{table}, Range{StartDate: 20220101, EndDate: 20220131, Codes: codes,
+		ChunkMonths: 1, ChunkCodes: 1})
+	assert.NoError(t, err)
+	assert.Len(t, chunks, MaxChunks)
+	assert.Equal(t, MaxChunks, chunks[MaxChunks-1].Seq)
+	// 两个月时超出上限
+	_, err = Chunks([]Table{table}, Range{StartDate: 20220101, EndDate: 20220228, Codes: codes,
+		ChunkMonths: 1, ChunkCodes: 1})
+	assert.EqualError(t, err, "20000 chunks exceed the limit 10000, use larger chunk_months or chunk_codes")
+}
+
+func TestProgressDone(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses map[string]int
+		want     Progress
+	}{
+		{name: "empty", want: Progress{}},
+		{name: "all pending", statuses: map[string]int{StatusPending: 3},
+			want: Progress{Total: 3, Pending: 3}},
+		{name: "mixed", statuses: map[string]int{StatusPending: 1, StatusRunning: 1, StatusSuccess: 2, StatusFailed: 1},
+			want: Progress{Total: 5, Pending: 1, Running: 1, Success: 2, Failed: 1, Percent: 60}},
+		{name: "two decimals", statuses: map[string]int{StatusSuccess: 1, StatusPending: 2},
+			want: Progress{Total: 3, Pending: 2, Success: 1, Percent: 33.33}},
+		{name: "finished", statuses: map[string]int{StatusSuccess: 2, StatusFailed: 1},
+			want: Progress{Total: 3, Success: 2, Failed: 1, Percent: 100}},
+		{name: "unknown status", statuses: map[string]int{"interrupted": 2, StatusSuccess: 2},
+			want: Progress{Total: 4, Success: 2, Percent: 50}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Progress{}
+			for status, n := range tt.statuses {
+				p.Add(status, n)
+			}
+			assert.Equal(t, tt.want, p.Done())
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package compare
+
+/*
+purpose:按主键流式对比两个有序数据源，内存占用与表大小无关
+*/
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+)
+
+// ErrUnsorted 数据源未按主键升序输出，此时无法得到正确的对比结果
+var ErrUnsorted = errors.New("source is not sorted by key")
+
+type (
+	// Key 主键值，按主键字段顺序排列
+	Key []string
+
+	// Source 按主键升序输出主键的数据源
+	Source interface {
+		// Next 返回下一个主键，数据源结束时ok为false
+		Next() (key Key, ok bool, err error)
+	}
+
+	// Stats 对比结果统计
+	Stats struct {
+		Left       int // 左侧主键数（去重后
+		Right      int // 右侧主键数（去重后
+		Common     int // 两侧都存在的主键数
+		OnlyLeft   int // 仅左侧存在的主键数
+		OnlyRight  int // 仅右侧存在的主键数
+		Duplicates int // 两侧数据源中重复出现的主键数
+	}
+)
+
+// Compare 逐字段按字节序比较两个主键，数据源需要按相同的规则排序
+func Compare(a, b Key) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := strings.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// ordered 校验数据源有序并跳过重复主键
+type ordered struct {
+	src   Source
+	name  string
+	prev  Key
+	count int
+	dup   int
+}
+
+func (o *ordered) next() (Key, bool, error) {
+	for {
+		key, ok, err := o.src.Next()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		if o.prev != nil {
+			c := Compare(key, o.prev)
+			if c < 0 {
+				return nil, false, errors.Wrapf(ErrUnsorted, "%s: %v after %v", o.name, key, o.prev)
+			}
+			if c == 0 {
+				// 重复主键按同一条记录处理，避免重复删除或补全
+				o.dup++
+				continue
+			}
+		}
+		o.prev = key
+		o.count++
+		return key, true, nil
+	}
+}
+
+//
+//  Join
+//  @Description: 对两个按主键升序的数据源做归并，仅一侧存在的主键分别回调onLeft/onRight
+//  @param left
+//  @param right
+//  @param onLeft 仅左侧存在的主键，可为nil
+//  @param onRight 仅右侧存在的主键，可为nil
+//  @return Stats
+//  @return error 数据源无序或回调出错时返回，此时已回调的结果仍然有效
+//
+func Join(left, right Source, onLeft, onRight func(Key) error) (stats Stats, err error) {
+	l := &ordered{src: left, name: "left"}
+	r := &ordered{src: right, name: "right"}
+	defer func() {
+		stats.Left, stats.Right = l.count, r.count
+		stats.Duplicates = l.dup + r.dup
+	}()
+	emit := func(fn func(Key) error, key Key) error {
+		if fn == nil {
+			return nil
+		}
+		return fn(key)
+	}
+	var lk, rk Key
+	var lok, rok bool
+	if lk, lok, err = l.next(); err != nil {
+		return stats, err
+	}
+	if rk, rok, err = r.next(); err != nil {
+		return stats, err
+	}
+	for lok || rok {
+		c := 0
+		switch {
+		case !rok:
+			c = -1
+		case !lok:
+			c = 1
+		default:
+			c = Compare(lk, rk)
+		}
+		if c <= 0 {
+			if c < 0 {
+				stats.OnlyLeft++
+				if err = emit(onLeft, lk); err != nil {
+					return stats, err
+				}
+			} else {
+				stats.Common++
+			}
+			if lk, lok, err = l.next(); err != nil {
+				return stats, err
+			}
+		}
+		if c >= 0 {
+			if c > 0 {
+				stats.OnlyRight++
+				if err = emit(onRight, rk); err != nil {
+					return stats, err
+				}
+			}
+			if rk, rok, err = r.next(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, nil
+}
+
+// SliceSource 以切片作为数据源，切片需要已按主键排序
+type SliceSource struct {
+	keys []Key
+	pos  int
+}
+
+func NewSliceSource(keys []Key) *SliceSource {
+	return &SliceSource{keys: keys}
+}
+
+func (s *SliceSource) Next() (Key, bool, error) {
+	if s.pos >= len(s.keys) {
+		return nil, false, nil
+	}
+	s.pos++
+	return s.keys[s.pos-1], true, nil
+}
+
+// RowsSource 以sql查询结果作为数据源，查询需按主键排序且只包含主键字段
+type RowsSource struct {
+	rows    *sql.Rows
+	values  []sql.NullString
+	scans   []interface{}
+	Skipped int // 主键存在NULL而跳过的记录数，NULL无法按主键定位
+}
+
+func NewRowsSource(rows *sql.Rows) (*RowsSource, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	s := &RowsSource{
+		rows:   rows,
+		values: make([]sql.NullString, len(cols)),
+		scans:  make([]interface{}, len(cols)),
+	}
+	for i := range s.values {
+		s.scans[i] = &s.values[i]
+	}
+	return s, nil
+}
+
+func (s *RowsSource) Next() (Key, bool, error) {
+	for s.rows.Next() {
+		if err := s.rows.Scan(s.scans...); err != nil {
+			return nil, false, err
+		}
+		key := make(Key, len(s.values))
+		valid := true
+		for i, v := range s.values {
+			valid = valid && v.Valid
+			key[i] = v.String
+		}
+		if !valid {
+			s.Skipped++
+			continue
+		}
+		return key, true, nil
+	}
+	return nil, false, s.rows.Err()
+}
+
+// OrderBy 生成与Compare一致的排序子句，按二进制排序以避免mysql排序规则和数值排序的差异
+func OrderBy(cols []string) string {
+	order := make([]string, len(cols))
+	for i, col := range cols {
+		order[i] = fmt.Sprintf("cast(`%s` as binary)", col)
+	}
+	return "order by " + strings.Join(order, ",")
+}
+
+// NewSortedSource 对无序的主键排序后作为数据源，用于无法按主键有序读取的参照数据（如外部文件），内存占用与数据量相关
+func NewSortedSource(keys []Key) *SliceSource {
+	sort.Slice(keys, func(i, j int) bool {
+		return Compare(keys[i], keys[j]) < 0
+	})
+	return NewSliceSource(keys)
+}
+
+//
+//  JoinAll
+//  @Description: 对多个按主键升序的数据源做归并，并非所有数据源都存在的主键回调fn
+//  @param sources
+//  @param fn present[i]表示该主键是否存在于sources[i]
+//  @return Stats Left为去重后的主键总数，Common为所有数据源都存在的主键数，Duplicates为重复主键数
+//  @return error
+//
+func JoinAll(sources []Source, fn func(key Key, present []bool) error) (stats Stats, err error) {
+	srcs := make([]*ordered, len(sources))
+	heads := make([]Key, len(sources))
+	alive := make([]bool, len(sources))
+	for i, src := range sources {
+		srcs[i] = &ordered{src: src, name: fmt.Sprintf("source%d", i)}
+		if heads[i], alive[i], err = srcs[i].next(); err != nil {
+			return stats, err
+		}
+	}
+	defer func() {
+		for _, src := range srcs {
+			stats.Duplicates += src.dup
+		}
+	}()
+	present := make([]bool, len(sources))
+	for {
+		// 找到当前最小的主键
+		var min Key
+		for i, key := range heads {
+			if alive[i] && (min == nil || Compare(key, min) < 0) {
+				min = key
+			}
+		}
+		if min == nil {
+			return stats, nil
+		}
+		all := true
+		for i, key := range heads {
+			present[i] = alive[i] && Compare(key, min) == 0
+			all = all && present[i]
+		}
+		stats.Left++
+		if all {
+			stats.Common++
+		} else if fn != nil {
+			if err = fn(min, present); err != nil {
+				return stats, err
+			}
+		}
+		for i := range heads {
+			if !present[i] {
+				continue
+			}
+			if heads[i], alive[i], err = srcs[i].next(); err != nil {
+				return stats, err
+			}
+		}
+	}
+}
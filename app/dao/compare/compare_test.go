@@ -0,0 +1,250 @@
+package compare
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/writer"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func keys(values ...string) []Key {
+	ret := make([]Key, len(values))
+	for i, v := range values {
+		ret[i] = Key{v}
+	}
+	return ret
+}
+
+func TestJoin(t *testing.T) {
+	tests := []struct {
+		name      string
+		left      []Key
+		right     []Key
+		onlyLeft  []Key
+		onlyRight []Key
+		stats     Stats
+		err       error
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:  "identical",
+			left:  keys("000001", "000002"),
+			right: keys("000001", "000002"),
+			stats: Stats{Left: 2, Right: 2, Common: 2},
+		},
+		{
+			name:     "only left",
+			left:     keys("000001", "000002"),
+			onlyLeft: keys("000001", "000002"),
+			stats:    Stats{Left: 2, OnlyLeft: 2},
+		},
+		{
+			name:      "only right",
+			right:     keys("000001"),
+			onlyRight: keys("000001"),
+			stats:     Stats{Right: 1, OnlyRight: 1},
+		},
+		{
+			name:      "interleaved",
+			left:      keys("1", "3", "5", "7"),
+			right:     keys("2", "3", "4", "7", "8"),
+			onlyLeft:  keys("1", "5"),
+			onlyRight: keys("2", "4", "8"),
+			stats:     Stats{Left: 4, Right: 5, Common: 2, OnlyLeft: 2, OnlyRight: 3},
+		},
+		{
+			name:      "composite key",
+			left:      []Key{{"000001", "20211231"}, {"000001", "20220331"}, {"000002", "20211231"}},
+			right:     []Key{{"000001", "20211231"}, {"000002", "20211231"}, {"000002", "20220331"}},
+			onlyLeft:  []Key{{"000001", "20220331"}},
+			onlyRight: []Key{{"000002", "20220331"}},
+			stats:     Stats{Left: 3, Right: 3, Common: 2, OnlyLeft: 1, OnlyRight: 1},
+		},
+		{
+			name:     "byte order",
+			left:     keys("10", "9"),
+			right:    keys("9"),
+			onlyLeft: keys("10"),
+			stats:    Stats{Left: 2, Right: 1, Common: 1, OnlyLeft: 1},
+		},
+		{
+			name:      "duplicates",
+			left:      keys("1", "1", "2"),
+			right:     keys("2", "2", "3", "3"),
+			onlyLeft:  keys("1"),
+			onlyRight: keys("3"),
+			stats:     Stats{Left: 2, Right: 2, Common: 1, OnlyLeft: 1, OnlyRight: 1, Duplicates: 3},
+		},
+		{
+			name:  "unsorted left",
+			left:  keys("2", "1"),
+			right: keys("1", "2"),
+			err:   ErrUnsorted,
+		},
+		{
+			name:  "unsorted right",
+			left:  keys("1", "2", "3"),
+			right: keys("1", "3", "2"),
+			err:   ErrUnsorted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var onlyLeft, onlyRight []Key
+			stats, err := Join(NewSliceSource(tt.left), NewSliceSource(tt.right),
+				func(k Key) error {
+					onlyLeft = append(onlyLeft, k)
+					return nil
+				},
+				func(k Key) error {
+					onlyRight = append(onlyRight, k)
+					return nil
+				})
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err), "unexpected error: %v", err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.onlyLeft, onlyLeft)
+			assert.Equal(t, tt.onlyRight, onlyRight)
+			assert.Equal(t, tt.stats, stats)
+		})
+	}
+}
+
+func TestJoinCallbackError(t *testing.T) {
+	stop := errors.New("stop")
+	_, err := Join(NewSliceSource(keys("1", "2")), NewSliceSource(nil), func(Key) error {
+		return stop
+	}, nil)
+	assert.Equal(t, stop, err)
+}
+
+func TestJoinAll(t *testing.T) {
+	type diff struct {
+		key     Key
+		present []bool
+	}
+	tests := []struct {
+		name    string
+		sources [][]Key
+		diffs   []diff
+		stats   Stats
+		err     error
+	}{
+		{
+			name:    "identical",
+			sources: [][]Key{keys("1", "2"), keys("1", "2"), keys("1", "2")},
+			stats:   Stats{Left: 2, Common: 2},
+		},
+		{
+			name:    "three way",
+			sources: [][]Key{keys("1", "2", "4"), keys("2", "3", "4"), keys("1", "4")},
+			diffs: []diff{
+				{Key{"1"}, []bool{true, false, true}},
+				{Key{"2"}, []bool{true, true, false}},
+				{Key{"3"}, []bool{false, true, false}},
+			},
+			stats: Stats{Left: 4, Common: 1},
+		},
+		{
+			name:    "one empty",
+			sources: [][]Key{keys("1"), nil},
+			diffs:   []diff{{Key{"1"}, []bool{true, false}}},
+			stats:   Stats{Left: 1},
+		},
+		{
+			name:    "duplicates",
+			sources: [][]Key{keys("1", "1"), keys("1")},
+			stats:   Stats{Left: 1, Common: 1, Duplicates: 1},
+		},
+		{
+			name:    "unsorted",
+			sources: [][]Key{keys("1", "2"), keys("3", "2")},
+			err:     ErrUnsorted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := make([]Source, len(tt.sources))
+			for i, src := range tt.sources {
+				sources[i] = NewSliceSource(src)
+			}
+			var diffs []diff
+			stats, err := JoinAll(sources, func(k Key, present []bool) error {
+				diffs = append(diffs, diff{k, append([]bool(nil), present...)})
+				return nil
+			})
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err), "unexpected error: %v", err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.diffs, diffs)
+			assert.Equal(t, tt.stats, stats)
+		})
+	}
+}
+
+func TestSortedSource(t *testing.T) {
+	var onlyRight []Key
+	_, err := Join(NewSliceSource(keys("1", "3")), NewSortedSource(keys("3", "2", "1")), nil, func(k Key) error {
+		onlyRight = append(onlyRight, k)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, keys("2"), onlyRight)
+}
+
+func TestReadCSVKeys(t *testing.T) {
+	data := "zqdm,money_in,BBRQ\n000002,1.0,20211231\n 000001 ,2.0,20220331\n"
+	got, err := ReadCSVKeys(strings.NewReader(data), []string{"zqdm", "bbrq"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Key{{"000002", "20211231"}, {"000001", "20220331"}}, got)
+
+	_, err = ReadCSVKeys(strings.NewReader(data), []string{"code"})
+	assert.Error(t, err)
+}
+
+func TestReadParquetKeys(t *testing.T) {
+	type row struct {
+		Zqdm    *string `parquet:"name=zqdm, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+		Bbrq    int32   `parquet:"name=BBRQ, type=INT32, convertedtype=DATE"`
+		MoneyIn int64   `parquet:"name=money_in, type=INT64, convertedtype=DECIMAL, scale=2, precision=18"`
+	}
+	path := filepath.Join(t.TempDir(), "keys.parquet")
+	fw, err := local.NewLocalFileWriter(path)
+	assert.NoError(t, err)
+	pw, err := writer.NewParquetWriter(fw, new(row), 1)
+	assert.NoError(t, err)
+	code1, code2 := "000002", "000001"
+	for _, r := range []row{{&code1, 18992, 150}, {nil, 18992, 1}, {&code2, 19082, -5}} {
+		assert.NoError(t, pw.Write(r))
+	}
+	assert.NoError(t, pw.WriteStop())
+	assert.NoError(t, fw.Close())
+
+	fr, err := local.NewLocalFileReader(path)
+	assert.NoError(t, err)
+	defer fr.Close()
+	got, err := ReadParquetKeys(fr, []string{"zqdm", "bbrq", "money_in"})
+	assert.NoError(t, err)
+	day := func(y, m, d int) string {
+		return time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.Local).Format(time.RFC3339Nano)
+	}
+	// zqdm为null的行跳过
+	assert.Equal(t, []Key{{"000002", day(2021, 12, 31), "1.50"}, {"000001", day(2022, 3, 31), "-0.05"}}, got)
+
+	_, err = ReadParquetKeys(fr, []string{"code"})
+	assert.Error(t, err)
+}
+
+func TestOrderBy(t *testing.T) {
+	assert.Equal(t, "order by cast(`zqdm` as binary),cast(`bbrq` as binary)", OrderBy([]string{"zqdm", "bbrq"}))
+}
@@ -0,0 +1,55 @@
+package compare
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+//
+//  ReadCSVKeys
+//  @Description: 读取csv中的主键，首行为字段名，按keyCols的顺序取出主键值
+//  @param r
+//  @param keyCols
+//  @return []Key 顺序与文件一致，需要排序后再对比
+//  @return error
+//
+func ReadCSVKeys(r io.Reader, keyCols []string) ([]Key, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "read csv header failed")
+	}
+	index := make([]int, len(keyCols))
+	for i, col := range keyCols {
+		index[i] = -1
+		for j, name := range header {
+			if strings.EqualFold(strings.TrimSpace(name), col) {
+				index[i] = j
+				break
+			}
+		}
+		if index[i] < 0 {
+			return nil, errors.New(fmt.Sprintf("key column %s not found in csv header", col))
+		}
+	}
+	var keys []Key
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		key := make(Key, len(index))
+		for i, j := range index {
+			key[i] = strings.TrimSpace(record[j])
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,117 @@
+package compare
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+	"math/big"
+	"strings"
+	"time"
+)
+
+//
+//  ReadParquetKeys
+//  @Description: 读取parquet文件中的主键，字段名不区分大小写，只支持顶层字段，主键为null的行跳过（与mysql一致）
+//  @param file
+//  @param keyCols
+//  @return []Key 顺序与文件一致，需要排序后再对比
+//  @return error
+//
+func ReadParquetKeys(file source.ParquetFile, keyCols []string) ([]Key, error) {
+	pr, err := reader.NewParquetColumnReader(file, 1)
+	if err != nil {
+		return nil, errors.Wrap(err, "read parquet footer failed")
+	}
+	defer pr.ReadStop()
+	rows := pr.GetNumRows()
+	columns := make([][]interface{}, len(keyCols))
+	for i, col := range keyCols {
+		path, elem, err := parquetColumn(pr, col)
+		if err != nil {
+			return nil, err
+		}
+		values, _, _, err := pr.ReadColumnByPath(path, rows)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read parquet column %s failed", col)
+		}
+		if int64(len(values)) != rows {
+			return nil, errors.New(fmt.Sprintf("parquet column %s has %d values, expected %d", col, len(values), rows))
+		}
+		columns[i] = make([]interface{}, len(values))
+		for j, v := range values {
+			if columns[i][j], err = parquetValue(v, elem); err != nil {
+				return nil, errors.Wrapf(err, "parquet column %s", col)
+			}
+		}
+	}
+	keys := make([]Key, 0, rows)
+	for j := int64(0); j < rows; j++ {
+		key := make(Key, len(keyCols))
+		valid := true
+		for i := range keyCols {
+			if columns[i][j] == nil {
+				valid = false
+				break
+			}
+			key[i] = columns[i][j].(string)
+		}
+		if valid {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// parquetColumn 按字段名查找顶层的非嵌套字段
+func parquetColumn(pr *reader.ParquetReader, col string) (string, *parquet.SchemaElement, error) {
+	sh := pr.SchemaHandler
+	for _, inPath := range sh.ValueColumns {
+		names := common.StrToPath(sh.InPathToExPath[inPath])
+		if len(names) != 2 || !strings.EqualFold(names[1], col) {
+			continue
+		}
+		elem := sh.SchemaElements[sh.MapIndex[inPath]]
+		if elem.GetRepetitionType() == parquet.FieldRepetitionType_REPEATED {
+			return "", nil, errors.New(fmt.Sprintf("key column %s should not be repeated", col))
+		}
+		return inPath, elem, nil
+	}
+	return "", nil, errors.New(fmt.Sprintf("key column %s not found in parquet schema", col))
+}
+
+// parquetValue 转换为与mysql读取的主键相同的字符串，时间按本地时区以RFC3339格式输出（与parseTime=True时一致），null返回nil
+func parquetValue(v interface{}, elem *parquet.SchemaElement) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch elem.GetConvertedType() {
+	case parquet.ConvertedType_DATE:
+		if days, ok := v.(int32); ok {
+			return time.Date(1970, 1, 1+int(days), 0, 0, 0, 0, time.Local).Format(time.RFC3339Nano), nil
+		}
+	case parquet.ConvertedType_TIMESTAMP_MILLIS:
+		if ms, ok := v.(int64); ok {
+			return time.Unix(0, ms*int64(time.Millisecond)).In(time.Local).Format(time.RFC3339Nano), nil
+		}
+	case parquet.ConvertedType_TIMESTAMP_MICROS:
+		if us, ok := v.(int64); ok {
+			return time.Unix(0, us*int64(time.Microsecond)).In(time.Local).Format(time.RFC3339Nano), nil
+		}
+	case parquet.ConvertedType_DECIMAL:
+		var unscaled *big.Int
+		switch n := v.(type) {
+		case int32:
+			unscaled = big.NewInt(int64(n))
+		case int64:
+			unscaled = big.NewInt(n)
+		default:
+			return nil, errors.New(fmt.Sprintf("unsupported decimal physical type %s", elem.GetType()))
+		}
+		return new(big.Rat).SetFrac(unscaled, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(elem.GetScale())), nil)).
+			FloatString(int(elem.GetScale())), nil
+	}
+	return fmt.Sprint(v), nil
+}
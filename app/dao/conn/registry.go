@@ -0,0 +1,406 @@
+package conn
+
+/*
+purpose:mysql和pg共用的连接池注册表，按key（mysql库名、pg dsn）懒加载连接池，
+首次使用时Ping校验，空闲超时且未被占用时关闭并移除，连接失败后按指数退避重连
+*/
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 连接状态
+const (
+	StatusConnected = "connected" // 连接池可用
+	StatusBackoff   = "backoff"   // 连接失败，等待下次重连
+	StatusIdle      = "idle"      // 未建立连接或已被空闲回收
+)
+
+const (
+	defaultPingTimeout = 3 * time.Second
+	defaultBackoffMin  = time.Second
+	defaultBackoffMax  = time.Minute
+)
+
+type (
+	// Opener 建立key对应的连接池，refresh为true时表示上次连接失败，需要重新获取凭据
+	Opener func(key string, refresh bool) (*sql.DB, error)
+
+	// Options 注册表参数，零值使用默认值
+	Options struct {
+		IdleEvict   time.Duration // 连接池空闲超过该时间后关闭，0为不回收
+		PingTimeout time.Duration // 建立连接后Ping校验的超时
+		BackoffMin  time.Duration // 第一次重连的等待时间，之后每次翻倍
+		BackoffMax  time.Duration // 重连的最长等待时间
+	}
+
+	// Registry 并发安全的连接池注册表
+	Registry struct {
+		sync.Mutex
+		kind    string
+		open    Opener
+		opts    Options
+		pinned  map[string]bool // 不被空闲回收的key，如配置中的库
+		entries map[string]*entry
+		name    func(key string) string // 对外展示的名称，如隐藏密码后的dsn
+		now     func() time.Time
+	}
+
+	// entry 单个key的连接池，mu保证同一key同时只建立一次连接
+	entry struct {
+		mu        sync.Mutex
+		db        *sql.DB
+		openedAt  time.Time
+		lastUsed  time.Time
+		leases    int  // Acquire后未释放的次数，大于0时不回收
+		removed   bool // 已从注册表移除，需要重新获取entry
+		failures  int
+		nextRetry time.Time
+		lastErr   string
+	}
+
+	// Info 连接池状态，用于/debug/connections
+	Info struct {
+		Kind      string     `json:"kind"`
+		Name      string     `json:"name"`
+		Status    string     `json:"status"`
+		Pinned    bool       `json:"pinned"`
+		OpenedAt  *time.Time `json:"opened_at,omitempty"`
+		LastUsed  *time.Time `json:"last_used,omitempty"`
+		Leases    int        `json:"leases"`
+		Failures  int        `json:"failures"`
+		NextRetry *time.Time `json:"next_retry,omitempty"`
+		LastError string     `json:"last_error,omitempty"`
+		Open      int        `json:"open"`
+		InUse     int        `json:"in_use"`
+		Idle      int        `json:"idle"`
+		WaitCount int64      `json:"wait_count"`
+		WaitMs    int64      `json:"wait_ms"`
+	}
+)
+
+// New 创建注册表，kind为mysql或pg，name为空时key原样展示
+func New(kind string, open Opener, opts Options, name func(key string) string) *Registry {
+	if opts.PingTimeout <= 0 {
+		opts.PingTimeout = defaultPingTimeout
+	}
+	if opts.BackoffMin <= 0 {
+		opts.BackoffMin = defaultBackoffMin
+	}
+	if opts.BackoffMax < opts.BackoffMin {
+		opts.BackoffMax = defaultBackoffMax
+		if opts.BackoffMax < opts.BackoffMin {
+			opts.BackoffMax = opts.BackoffMin
+		}
+	}
+	if name == nil {
+		name = func(key string) string { return key }
+	}
+	return &Registry{
+		kind:    kind,
+		open:    open,
+		opts:    opts,
+		pinned:  make(map[string]bool),
+		entries: make(map[string]*entry),
+		name:    name,
+		now:     time.Now,
+	}
+}
+
+// Pin 标记key不被空闲回收
+func (r *Registry) Pin(key string) {
+	r.Lock()
+	defer r.Unlock()
+	r.pinned[key] = true
+}
+
+// lockEntry 获取key对应的entry并加锁，entry已被回收移除时重新获取
+func (r *Registry) lockEntry(key string) *entry {
+	for {
+		r.Lock()
+		e, ok := r.entries[key]
+		if !ok {
+			e = &entry{}
+			r.entries[key] = e
+		}
+		r.Unlock()
+		e.mu.Lock()
+		if !e.removed {
+			return e
+		}
+		e.mu.Unlock()
+	}
+}
+
+//
+//  Get
+//  @Description: 获取key对应的连接池，未建立时建立并Ping校验，处于退避期时直接返回上次的错误。
+//  返回的连接池不被占用，空闲回收后不能再使用，未Pin的key需要使用Acquire
+//  @receiver r
+//  @param key
+//  @return *sql.DB
+//  @return error
+//
+func (r *Registry) Get(key string) (*sql.DB, error) {
+	e := r.lockEntry(key)
+	defer e.mu.Unlock()
+	return r.get(key, e)
+}
+
+//
+//  Acquire
+//  @Description: 获取并占用key对应的连接池，release前不会被空闲回收，release后刷新最后使用时间
+//  @receiver r
+//  @param key
+//  @return *sql.DB
+//  @return func() 释放占用，可以多次调用，出错时为空函数
+//  @return error
+//
+func (r *Registry) Acquire(key string) (*sql.DB, func(), error) {
+	e := r.lockEntry(key)
+	defer e.mu.Unlock()
+	db, err := r.get(key, e)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	e.leases++
+	var once sync.Once
+	return db, func() {
+		once.Do(func() {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			e.leases--
+			e.lastUsed = r.now()
+		})
+	}, nil
+}
+
+// get 调用方持有e.mu，连接失败时也刷新最后使用时间，长期不用的失败key会被回收移除
+func (r *Registry) get(key string, e *entry) (*sql.DB, error) {
+	now := r.now()
+	e.lastUsed = now
+	if e.db != nil {
+		return e.db, nil
+	}
+	if now.Before(e.nextRetry) {
+		return nil, errors.New(fmt.Sprintf("%s connection %s unavailable, retry after %s: %s",
+			r.kind, r.name(key), e.nextRetry.Format(time.RFC3339), e.lastErr))
+	}
+	return r.connect(key, e)
+}
+
+// connect 建立连接池并Ping校验，失败时按失败次数计算下次重连时间，调用方持有e.mu
+func (r *Registry) connect(key string, e *entry) (*sql.DB, error) {
+	db, err := r.open(key, e.failures > 0)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), r.opts.PingTimeout)
+		err = db.PingContext(ctx)
+		cancel()
+		if err != nil {
+			_ = db.Close()
+		}
+	}
+	now := r.now()
+	if err != nil {
+		e.failures++
+		e.lastErr = err.Error()
+		e.nextRetry = now.Add(r.backoff(e.failures))
+		return nil, errors.Wrap(err, fmt.Sprintf("connect %s %s", r.kind, r.name(key)))
+	}
+	e.db, e.openedAt, e.lastUsed = db, now, now
+	e.failures, e.lastErr, e.nextRetry = 0, "", time.Time{}
+	return db, nil
+}
+
+// backoff 第n次失败后的等待时间，从BackoffMin开始翻倍，不超过BackoffMax
+func (r *Registry) backoff(failures int) time.Duration {
+	d := r.opts.BackoffMin
+	for i := 1; i < failures && d < r.opts.BackoffMax; i++ {
+		d *= 2
+	}
+	if d > r.opts.BackoffMax {
+		d = r.opts.BackoffMax
+	}
+	return d
+}
+
+func (r *Registry) snapshot() map[string]*entry {
+	r.Lock()
+	defer r.Unlock()
+	ret := make(map[string]*entry, len(r.entries))
+	for key, e := range r.entries {
+		ret[key] = e
+	}
+	return ret
+}
+
+// Keys 已注册的key
+func (r *Registry) Keys() []string {
+	entries := r.snapshot()
+	ret := make([]string, 0, len(entries))
+	for key := range entries {
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Connected 已建立的连接池，key为注册的key
+func (r *Registry) Connected() map[string]*sql.DB {
+	ret := make(map[string]*sql.DB)
+	for key, e := range r.snapshot() {
+		e.mu.Lock()
+		if e.db != nil {
+			ret[key] = e.db
+		}
+		e.mu.Unlock()
+	}
+	return ret
+}
+
+//
+//  Check
+//  @Description: Ping已建立的连接池，失败时关闭并立即重连，重连失败的进入退避，返回第一个错误
+//  @receiver r
+//  @return error
+//
+func (r *Registry) Check() error {
+	var first error
+	for key, e := range r.snapshot() {
+		if err := r.check(key, e); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (r *Registry) check(key string, e *entry) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.db == nil {
+		// 退避期结束的失败连接在检查时重连，空闲回收的连接等下次使用时再建立
+		if e.failures == 0 || r.now().Before(e.nextRetry) {
+			return nil
+		}
+		_, err := r.connect(key, e)
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.PingTimeout)
+	err := e.db.PingContext(ctx)
+	cancel()
+	if err == nil {
+		return nil
+	}
+	_ = e.db.Close()
+	e.db = nil
+	e.failures, e.lastErr = 1, err.Error()
+	_, err = r.connect(key, e)
+	return err
+}
+
+//
+//  Evict
+//  @Description: 关闭空闲超过IdleEvict、未被Acquire占用且没有使用中连接的连接池，并从注册表移除，
+//  长期未使用的连接失败的key同样移除，Pin的key不回收
+//  @receiver r
+//  @return []string 被回收的连接池的key
+//
+func (r *Registry) Evict() []string {
+	if r.opts.IdleEvict <= 0 {
+		return nil
+	}
+	r.Lock()
+	pinned := make(map[string]bool, len(r.pinned))
+	for key := range r.pinned {
+		pinned[key] = true
+	}
+	r.Unlock()
+	var evicted []string
+	for key, e := range r.snapshot() {
+		if pinned[key] {
+			continue
+		}
+		e.mu.Lock()
+		if e.leases == 0 && r.now().Sub(e.lastUsed) >= r.opts.IdleEvict && (e.db == nil || e.db.Stats().InUse == 0) {
+			if e.db != nil {
+				_ = e.db.Close()
+				e.db = nil
+				evicted = append(evicted, key)
+			}
+			e.removed = true
+			r.Lock()
+			if r.entries[key] == e {
+				delete(r.entries, key)
+			}
+			r.Unlock()
+		}
+		e.mu.Unlock()
+	}
+	sort.Strings(evicted)
+	return evicted
+}
+
+// Close 关闭所有连接池并清空注册表，返回关闭失败的错误
+func (r *Registry) Close() map[string]error {
+	r.Lock()
+	entries := r.entries
+	r.entries = make(map[string]*entry)
+	r.Unlock()
+	errs := make(map[string]error)
+	for key, e := range entries {
+		e.mu.Lock()
+		if e.db != nil {
+			if err := e.db.Close(); err != nil {
+				errs[key] = err
+			}
+			e.db = nil
+		}
+		e.mu.Unlock()
+	}
+	return errs
+}
+
+// Stats 已建立连接池的状态，key为对外展示的名称，用于连接池指标
+func (r *Registry) Stats() map[string]sql.DBStats {
+	ret := make(map[string]sql.DBStats)
+	for key, db := range r.Connected() {
+		ret[r.name(key)] = db.Stats()
+	}
+	return ret
+}
+
+// Infos 所有key的连接状态，按名称排序
+func (r *Registry) Infos() []Info {
+	r.Lock()
+	pinned := make(map[string]bool, len(r.pinned))
+	for key := range r.pinned {
+		pinned[key] = true
+	}
+	r.Unlock()
+	var ret []Info
+	for key, e := range r.snapshot() {
+		e.mu.Lock()
+		info := Info{Kind: r.kind, Name: r.name(key), Status: StatusIdle, Pinned: pinned[key],
+			Leases: e.leases, Failures: e.failures, LastError: e.lastErr}
+		if e.db != nil {
+			s := e.db.Stats()
+			openedAt, lastUsed := e.openedAt, e.lastUsed
+			info.Status, info.OpenedAt, info.LastUsed = StatusConnected, &openedAt, &lastUsed
+			info.Open, info.InUse, info.Idle = s.OpenConnections, s.InUse, s.Idle
+			info.WaitCount, info.WaitMs = s.WaitCount, s.WaitDuration.Milliseconds()
+		} else if e.failures > 0 {
+			nextRetry := e.nextRetry
+			info.Status, info.NextRetry = StatusBackoff, &nextRetry
+		}
+		e.mu.Unlock()
+		ret = append(ret, info)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
@@ -0,0 +1,206 @@
+package conn
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDriver 按dsn记录的状态决定连接和Ping是否成功
+type fakeDriver struct {
+	sync.Mutex
+	down map[string]bool
+}
+
+type fakeConn struct {
+	d   *fakeDriver
+	dsn string
+}
+
+func (d *fakeDriver) Open(dsn string) (driver.Conn, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.down[dsn] {
+		return nil, errors.New("connection refused")
+	}
+	return &fakeConn{d: d, dsn: dsn}, nil
+}
+
+func (d *fakeDriver) setDown(dsn string, down bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.down[dsn] = down
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c *fakeConn) Ping(context.Context) error {
+	c.d.Lock()
+	defer c.d.Unlock()
+	if c.d.down[c.dsn] {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+var fake = &fakeDriver{down: make(map[string]bool)}
+
+func init() {
+	sql.Register("conn-fake", fake)
+}
+
+func newTestRegistry(opts Options) (*Registry, *int32, *time.Time) {
+	var opens int32
+	now := time.Date(2022, 4, 1, 10, 0, 0, 0, time.Local)
+	r := New("mysql", func(key string, refresh bool) (*sql.DB, error) {
+		atomic.AddInt32(&opens, 1)
+		return sql.Open("conn-fake", key)
+	}, opts, nil)
+	r.now = func() time.Time { return now }
+	return r, &opens, &now
+}
+
+func TestGetOpensOnce(t *testing.T) {
+	r, opens, _ := newTestRegistry(Options{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.Get("once")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(opens))
+	assert.Equal(t, []string{"once"}, r.Keys())
+	r.Close()
+}
+
+func TestGetBackoff(t *testing.T) {
+	r, opens, now := newTestRegistry(Options{BackoffMin: time.Second, BackoffMax: 3 * time.Second})
+	fake.setDown("backoff", true)
+	_, err := r.Get("backoff")
+	assert.Error(t, err)
+	// 退避期内不重连
+	_, err = r.Get("backoff")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), *opens)
+	infos := r.Infos()
+	assert.Equal(t, StatusBackoff, infos[0].Status)
+	assert.Equal(t, 1, infos[0].Failures)
+
+	*now = now.Add(time.Second)
+	_, err = r.Get("backoff")
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), *opens)
+	assert.Equal(t, now.Add(2*time.Second), *r.Infos()[0].NextRetry)
+
+	fake.setDown("backoff", false)
+	*now = now.Add(2 * time.Second)
+	db, err := r.Get("backoff")
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+	assert.Equal(t, StatusConnected, r.Infos()[0].Status)
+	assert.Equal(t, 0, r.Infos()[0].Failures)
+	r.Close()
+}
+
+func TestBackoffMax(t *testing.T) {
+	r, _, _ := newTestRegistry(Options{BackoffMin: time.Second, BackoffMax: 5 * time.Second})
+	assert.Equal(t, time.Second, r.backoff(1))
+	assert.Equal(t, 4*time.Second, r.backoff(3))
+	assert.Equal(t, 5*time.Second, r.backoff(4))
+	assert.Equal(t, 5*time.Second, r.backoff(100))
+}
+
+func TestCheckReconnect(t *testing.T) {
+	r, opens, _ := newTestRegistry(Options{})
+	old, err := r.Get("check")
+	assert.NoError(t, err)
+	assert.NoError(t, r.Check())
+
+	// 旧连接池断开时关闭并重建
+	fake.setDown("check", true)
+	assert.Error(t, r.Check())
+	assert.Empty(t, r.Connected())
+	fake.setDown("check", false)
+	_, err = r.Get("check")
+	assert.Error(t, err, "still in backoff")
+	assert.Equal(t, int32(2), *opens)
+	r.now = func() time.Time { return time.Now().Add(time.Hour) }
+	assert.NoError(t, r.Check())
+	db, err := r.Get("check")
+	assert.NoError(t, err)
+	assert.NotEqual(t, old, db)
+	r.Close()
+}
+
+func TestEvict(t *testing.T) {
+	r, _, now := newTestRegistry(Options{IdleEvict: time.Minute})
+	r.Pin("pinned")
+	_, err := r.Get("pinned")
+	assert.NoError(t, err)
+	_, err = r.Get("lazy")
+	assert.NoError(t, err)
+	assert.Empty(t, r.Evict())
+
+	*now = now.Add(time.Minute)
+	assert.Equal(t, []string{"lazy"}, r.Evict())
+	assert.Len(t, r.Connected(), 1)
+	// 回收的key从注册表移除
+	assert.Equal(t, []string{"pinned"}, r.Keys())
+	assert.True(t, r.Infos()[0].Pinned)
+
+	// 回收后再次使用时重新建立
+	_, err = r.Get("lazy")
+	assert.NoError(t, err)
+	assert.Len(t, r.Stats(), 2)
+	r.Close()
+}
+
+func TestEvictLeased(t *testing.T) {
+	r, _, now := newTestRegistry(Options{IdleEvict: time.Minute})
+	db, release, err := r.Acquire("leased")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, r.Infos()[0].Leases)
+
+	// 占用期间不回收，连接池仍可使用
+	*now = now.Add(time.Hour)
+	assert.Empty(t, r.Evict())
+	assert.NoError(t, db.Ping())
+
+	// 释放时刷新最后使用时间，重复释放不影响计数
+	release()
+	release()
+	assert.Equal(t, 0, r.Infos()[0].Leases)
+	assert.Empty(t, r.Evict())
+	*now = now.Add(time.Minute)
+	assert.Equal(t, []string{"leased"}, r.Evict())
+	assert.Empty(t, r.Keys())
+	r.Close()
+}
+
+func TestEvictFailed(t *testing.T) {
+	r, _, now := newTestRegistry(Options{IdleEvict: time.Minute})
+	fake.setDown("missing", true)
+	defer fake.setDown("missing", false)
+	_, release, err := r.Acquire("missing")
+	assert.Error(t, err)
+	release()
+	assert.Equal(t, []string{"missing"}, r.Keys())
+
+	// 连接失败的key长期未使用时移除，不返回为被回收的连接池
+	*now = now.Add(time.Minute)
+	assert.Empty(t, r.Evict())
+	assert.Empty(t, r.Keys())
+	r.Close()
+}
@@ -1,28 +1,77 @@
 package dao
 
 import (
+	"context"
 	"github.com/google/wire"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 	"hxextract/app/cron"
+	"hxextract/app/dao/conn"
 	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	"hxextract/app/metrics"
+	"time"
 )
 
 var Provider = wire.NewSet(New, NewDB)
 
 var pgDao pg.Dao
 
+// ErrFinanceNotFound 财务文件名称不存在
+var ErrFinanceNotFound = errors.New("cant find finance by name")
+
 // Dao dao interface
 type Dao interface {
 	Start() error
 	Export(finName string, param pg.QueryParam) error
 	Close()
+	// 停止定时任务并等待执行中的任务结束
+	Shutdown(ctx context.Context) error
 	HealthCheck() error
+	// 各依赖的就绪检查，结果有缓存
+	Readiness() *Readiness
 	// Ping(ctx context.Context) (err error)
-	CompareTable(finName string, operation int) (int, int, error)
+	// operator为发起方，写入审计记录
+	CompareTable(finName string, operation int, operator string) (int, int, error)
+	// 预览导出/对比将要产生的变更，不修改生产库
+	PreviewExport(finName string, param pg.QueryParam) (*PreviewPlan, error)
+	PreviewCompare(finName string) (*PreviewPlan, error)
+	// 与外部参照源对账
+	Reconcile(param ReconcileParam) (*ReconcileReport, error)
+	// 衍生表规则的执行状态
+	DerivedStatuses() []DerivedStatus
+	// 定时任务节点的执行状态
+	TaskStatuses() []TaskStatus
+	// 财务表信息
+	Tables(schemaName string) []TableMeta
+	// 按表和时间查询审计记录
+	AuditRecords(q AuditQuery) ([]AuditRecord, error)
+	// 导出执行记录及表的新鲜度
+	ExportRuns(q RunQuery) (*RunPage, error)
+	Freshness(schemaName string, tableName string, procType string, maxAge time.Duration) (*Freshness, error)
+	// 新鲜度sla最近一次检查结果
+	SlaStatuses() []SlaStatus
+	// mysql和pg各连接池的状态
+	Connections() []conn.Info
+	// 历史数据回补，在后台按分块执行，可查询进度和恢复执行
+	StartBackfill(param BackfillParam) (*BackfillJob, error)
+	ResumeBackfill(id int64, operator string) (*BackfillJob, error)
+	Backfills() ([]BackfillJob, error)
+	BackfillDetail(id int64) (*BackfillJob, error)
+	// 表分组，导出和对比分组中所有的表并汇总各表结果
+	Groups() []TableGroup
+	ExportGroup(group string, param pg.QueryParam, parallelism int) (*GroupResult, error)
+	CompareGroup(group string, operation int, operator string, parallelism int) (*GroupResult, error)
 }
 
 type dao struct {
-	DB *DB
+	DB      *DB
+	derived derivedRules   // 衍生表规则
+	tasks   taskDag        // 定时任务依赖关系
+	slas    freshnessSlas  // 新鲜度sla
+	ready   readinessCache // 就绪检查结果
+	fills   backfills      // 执行中的回补任务
+	groups  tableGroups    // 表分组
 }
 
 // New new a dao and return.
@@ -35,25 +84,48 @@ func New(db *DB) (d Dao, cf func(), err error) {
 		return
 	}
 	d, cleanupDao, err = newDao(db)
+	// TableInfo中的凭据引用在连接pg时解析
+	pg.SetDsnResolver(db.resolvePgDsn)
+	metrics.RegisterPools(metrics.PoolMysql, db.stats)
+	metrics.RegisterPools(metrics.PoolPg, pgDao.Stats)
 	cf = func() {
-		cleanupPg()
 		cleanupDao()
+		if cleanupPg != nil {
+			cleanupPg()
+		}
 	}
 	return
 }
 
 func newDao(db *DB) (d *dao, cf func(), err error) {
 	d = &dao{
-		db,
+		DB: db,
 	}
 	cf = d.Close
 	return
 }
 
 func (d *dao) Start() error {
-	// 先开启拓展数据导出后开启定时任务
-	d.repExtraExportStart()
-	return d.pgCronInit()
+	// 执行记录表不存在时不影响导出，需在开启定时任务前执行
+	if err := d.exportRunInit(); err != nil {
+		log.Log.Warn("init export runs failed", zap.String("err", err.Error()))
+	}
+	// 先加载衍生表规则后开启定时任务，规则加载失败不影响普通导出
+	if err := d.derivedRuleLoad(); err != nil {
+		log.Log.Warn("load derived rules failed", zap.String("err", err.Error()))
+	}
+	if err := d.pgCronInit(); err != nil {
+		return err
+	}
+	// sla加载失败不影响导出
+	if err := d.freshnessInit(); err != nil {
+		log.Log.Warn("init freshness slas failed", zap.String("err", err.Error()))
+	}
+	// 回补任务表不存在时不影响导出
+	if err := d.backfillInit(); err != nil {
+		log.Log.Warn("init backfills failed", zap.String("err", err.Error()))
+	}
+	return d.connectionInit()
 }
 
 func (d *dao) Export(finName string, param pg.QueryParam) error {
@@ -61,7 +133,7 @@ func (d *dao) Export(finName string, param pg.QueryParam) error {
 	var table TableInfo
 	ok := false
 	if table, ok = d.DB.financeInfo[finName]; !ok {
-		return errors.New("cant find finance by name")
+		return ErrFinanceNotFound
 	}
 	param.TableName = table.tableName
 	param.SchemaName = table.schemaName
@@ -72,6 +144,30 @@ func (d *dao) Close() {
 	cron.Stop()
 }
 
+//
+//  Shutdown
+//  @Description: 停止调度定时任务和分发回补分块，等待执行中的定时任务和回补分块结束
+//  @receiver d
+//  @param ctx 结束时不再等待，返回ctx.Err()
+//  @return error
+//
+func (d *dao) Shutdown(ctx context.Context) error {
+	log.Log.Info("stop cron scheduler, waiting for running tasks")
+	backfillDone := d.fills.stop()
+	select {
+	case <-cron.Stop().Done():
+		log.Log.Info("running cron tasks finished")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-backfillDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (d *dao) HealthCheck() error {
 	err := d.DB.connectCheck()
 	if err != nil {
@@ -80,11 +176,12 @@ func (d *dao) HealthCheck() error {
 	return pgDao.HealthCheck()
 }
 
-func (d *dao) CompareTable(finName string, operation int) (int, int, error) {
+func (d *dao) CompareTable(finName string, operation int, operator string) (int, int, error) {
 	var table TableInfo
 	ok := false
 	if table, ok = d.DB.financeInfo[finName]; !ok {
-		return 0, 0, errors.New("cant find finance by name")
+		return 0, 0, ErrFinanceNotFound
 	}
-	return d.CompareAndUpdateMysql(table.schemaName, table.tableName, operation)
+	return d.CompareAndUpdateMysql(table.schemaName, table.tableName, operation, metrics.GetTriggerType(pg.TrigManual),
+		operator)
 }
@@ -0,0 +1,255 @@
+package dao
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"hxextract/app/dao/orm"
+	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	"hxextract/app/metrics"
+	"strings"
+	"time"
+)
+
+// 审计记录的操作类型
+const (
+	AuditExport        = "export"         // 从pg导出写入生产库
+	AuditCompareDelete = "compare_delete" // 对比后删除生产库多出的数据
+	AuditCompareInsert = "compare_insert" // 对比后补全生产库缺失的数据
+	AuditDerived       = "derived"        // 衍生表更新
+	AuditDelete        = "delete"         // 删除单条数据
+	AuditChangeValid   = "change_valid"   // 修改数据置否信息
+)
+
+const (
+	auditTable        = "AuditLog"
+	auditKeyLimit     = 1000 // 单条审计记录最多保存的主键数，超出部分只记录数量
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+)
+
+type (
+	// AuditRecord 审计记录
+	AuditRecord struct {
+		Id        int64           `json:"id"`
+		Time      time.Time       `json:"time"`
+		Operation string          `json:"operation"` // 详见：Audit*
+		Schema    string          `json:"schema"`
+		Table     string          `json:"table"`
+		Trigger   string          `json:"trigger"`
+		Operator  string          `json:"operator"`
+		Params    json.RawMessage `json:"params,omitempty"`
+		Affected  int64           `json:"affected"`
+		Keys      json.RawMessage `json:"keys,omitempty"`
+		Status    string          `json:"status"`
+		Error     string          `json:"error,omitempty"`
+		CostMs    int64           `json:"cost_ms"`
+	}
+
+	// AuditQuery 审计记录查询条件，为空的条件不过滤，结果按时间倒序
+	AuditQuery struct {
+		SchemaName string
+		TableName  string
+		Operation  string
+		Start      time.Time // 包含
+		End        time.Time // 不包含
+		Limit      int
+		Offset     int
+	}
+
+	// auditKeys 影响的主键，超出auditKeyLimit时只保存前auditKeyLimit个
+	auditKeys struct {
+		Columns   []string   `json:"columns,omitempty"`
+		Values    [][]string `json:"values"`
+		Truncated int        `json:"truncated,omitempty"`
+	}
+
+	// exportParams 导出审计记录的参数
+	exportParams struct {
+		FinName   string `json:"finname,omitempty"`
+		Type      string `json:"type"`
+		StartDate int    `json:"startdate"`
+		EndDate   int    `json:"enddate"`
+		Codes     string `json:"codes,omitempty"`
+	}
+)
+
+// add 追加主键，超出上限时只计数
+func (k *auditKeys) add(keys []orm.FinPrimaryKey) {
+	for _, key := range keys {
+		if len(k.Values) >= auditKeyLimit {
+			k.Truncated++
+			continue
+		}
+		if k.Columns == nil {
+			k.Columns = key.Columns
+		}
+		k.Values = append(k.Values, key.Values)
+	}
+}
+
+func toJson(v interface{}) string {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(content)
+}
+
+//
+//  audit
+//  @Description: 追加审计记录，写入失败只记录日志，不影响数据变更的结果
+//  @receiver d
+//  @param rec
+//  @param err 操作结果
+//
+func (d *dao) audit(rec orm.AuditLog, err error) {
+	if rec.OpTime.IsZero() {
+		rec.OpTime = time.Now()
+	}
+	// 状态与事件一致：success/failed
+	rec.Status, rec.Error = eventStatus(err)
+	db := d.DB.orm()
+	if db == nil {
+		return
+	}
+	if dbErr := db.Table(auditTable).Create(&rec).Error; dbErr != nil {
+		log.Log.Error(fmt.Sprintf("write audit log failed: %s", dbErr.Error()),
+			zap.String("operation", rec.Operation),
+			zap.String("schema", rec.SchemaName),
+			zap.String("table", rec.TableName),
+			zap.String("operator", rec.Operator))
+	}
+}
+
+// auditExport 记录导出审计，stat为nil时表示未读取到数据
+func (d *dao) auditExport(param pg.QueryParam, trigger string, stat *exportStat, startTime time.Time, err error) {
+	rec := orm.AuditLog{
+		OpTime:     startTime,
+		Operation:  AuditExport,
+		SchemaName: param.SchemaName,
+		TableName:  param.TableName,
+		Trigger:    trigger,
+		Operator:   param.Operator,
+		Params: toJson(exportParams{
+			FinName:   param.FinName,
+			Type:      metrics.GetExportType(param.ProcType),
+			StartDate: param.StartDate,
+			EndDate:   param.EndDate,
+			Codes:     param.CodeList,
+		}),
+		CostMs: time.Since(startTime).Milliseconds(),
+	}
+	if stat != nil {
+		rec.Affected = stat.rows
+		if stat.keyRange != nil && stat.keyRange.Min != nil {
+			rec.Keys = toJson(stat.keyRange)
+		}
+	}
+	d.audit(rec, err)
+}
+
+// exportDone 导出结束后发布事件、记录审计和执行历史
+func (d *dao) exportDone(run *exportRun, param pg.QueryParam, trigger string, stat *exportStat, err error) {
+	publishExport(param, trigger, stat, err)
+	d.auditExport(param, trigger, stat, run.startTime(), err)
+	d.finishRun(run, stat, err)
+}
+
+// auditCompare 记录对比删除或补全的审计
+func (d *dao) auditCompare(operation string, schemaName string, tableName string, trigger string, operator string,
+	affected int, keys *auditKeys, startTime time.Time, err error) {
+	rec := orm.AuditLog{
+		OpTime:     startTime,
+		Operation:  operation,
+		SchemaName: schemaName,
+		TableName:  tableName,
+		Trigger:    trigger,
+		Operator:   operator,
+		Affected:   int64(affected),
+		CostMs:     time.Since(startTime).Milliseconds(),
+	}
+	if len(keys.Values) > 0 {
+		rec.Keys = toJson(keys)
+	}
+	d.audit(rec, err)
+}
+
+// auditDerived 记录衍生表更新的审计
+func (d *dao) auditDerived(rule DerivedRule, trigger string, operator string, rows int64, startTime time.Time, err error) {
+	d.audit(orm.AuditLog{
+		OpTime:     startTime,
+		Operation:  AuditDerived,
+		SchemaName: rule.targetSchema,
+		TableName:  rule.targetTable,
+		Trigger:    trigger,
+		Operator:   operator,
+		Params:     toJson(map[string]interface{}{"rule": rule.id, "source": rule.source()}),
+		Affected:   rows,
+		CostMs:     time.Since(startTime).Milliseconds(),
+	}, err)
+}
+
+//
+//  AuditRecords
+//  @Description: 按表和时间查询审计记录
+//  @receiver d
+//  @param q
+//  @return []AuditRecord
+//  @return error
+//
+func (d *dao) AuditRecords(q AuditQuery) ([]AuditRecord, error) {
+	db := d.DB.orm().Table(auditTable)
+	if q.SchemaName != "" {
+		db = db.Where("schema_name = ?", q.SchemaName)
+	}
+	if q.TableName != "" {
+		db = db.Where("table_name = ?", q.TableName)
+	}
+	if q.Operation != "" {
+		db = db.Where("operation = ?", q.Operation)
+	}
+	if !q.Start.IsZero() {
+		db = db.Where("op_time >= ?", q.Start)
+	}
+	if !q.End.IsZero() {
+		db = db.Where("op_time < ?", q.End)
+	}
+	if q.Limit <= 0 {
+		q.Limit = auditDefaultLimit
+	} else if q.Limit > auditMaxLimit {
+		q.Limit = auditMaxLimit
+	}
+	var result []orm.AuditLog
+	if err := db.Order("op_time desc, id desc").Limit(q.Limit).Offset(q.Offset).Find(&result).Error; err != nil {
+		return nil, err
+	}
+	records := make([]AuditRecord, len(result))
+	for i, v := range result {
+		records[i] = AuditRecord{
+			Id:        v.AuditId,
+			Time:      v.OpTime,
+			Operation: v.Operation,
+			Schema:    v.SchemaName,
+			Table:     v.TableName,
+			Trigger:   v.Trigger,
+			Operator:  v.Operator,
+			Params:    rawJson(v.Params),
+			Affected:  v.Affected,
+			Keys:      rawJson(v.Keys),
+			Status:    v.Status,
+			Error:     v.Error,
+			CostMs:    v.CostMs,
+		}
+	}
+	return records, nil
+}
+
+// rawJson 库中的json字段原样返回，为空或不是合法json时忽略
+func rawJson(s string) json.RawMessage {
+	if s = strings.TrimSpace(s); s == "" || !json.Valid([]byte(s)) {
+		return nil
+	}
+	return json.RawMessage(s)
+}
@@ -0,0 +1,607 @@
+package dao
+
+/*
+purpose:历史数据回补：按表、日期和代码范围拆分为分块，限制并发执行导出，分块的执行状态写入BackfillChunk，
+服务重启或分块失败后可恢复执行未成功的分块
+*/
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"hxextract/app/config"
+	"hxextract/app/dao/backfill"
+	"hxextract/app/dao/orm"
+	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 回补任务状态，其余状态同导出执行记录，详见：Run*
+const (
+	BackfillInterrupted = "interrupted"          // 服务退出时未执行完，可恢复执行
+	ChunkPending        = backfill.StatusPending // 分块等待执行
+)
+
+const (
+	backfillTable      = "Backfill"
+	backfillChunkTable = "BackfillChunk"
+	backfillListLimit  = 50
+)
+
+var (
+	// ErrBackfillNotFound 回补任务不存在
+	ErrBackfillNotFound = errors.New("cant find backfill")
+	// ErrBackfillRunning 回补任务正在执行
+	ErrBackfillRunning = errors.New("backfill is running")
+	// ErrInvalidBackfill 回补参数与表的导出sql不匹配
+	ErrInvalidBackfill = errors.New("invalid backfill")
+)
+
+type (
+	// BackfillParam 回补参数，分块和并发为0时使用Backfill配置
+	BackfillParam struct {
+		FinNames    []string
+		Group       string // 表分组，与FinNames合并
+		ProcType    int    // OpBbrq、OpRtime或OpCode
+		StartDate   int
+		EndDate     int
+		Codes       []string // 代码范围，为空时不按代码拆分
+		ChunkMonths int
+		ChunkCodes  int
+		Parallelism int
+		Operator    string
+	}
+
+	// BackfillProgress 回补进度
+	BackfillProgress = backfill.Progress
+
+	// BackfillChunk 回补分块的执行状态
+	BackfillChunk struct {
+		Seq       int        `json:"seq"`
+		Schema    string     `json:"schema"`
+		Table     string     `json:"table"`
+		StartDate int        `json:"startdate"`
+		EndDate   int        `json:"enddate"`
+		CodeCount int        `json:"code_count"`
+		Status    string     `json:"status"`
+		Attempts  int        `json:"attempts"`
+		StartTime *time.Time `json:"start_time,omitempty"`
+		EndTime   *time.Time `json:"end_time,omitempty"`
+		Error     string     `json:"error,omitempty"`
+	}
+
+	// BackfillJob 回补任务及进度，查询单个任务时返回各分块
+	BackfillJob struct {
+		Id          int64            `json:"id"`
+		Tables      []string         `json:"tables"`
+		Type        int              `json:"type"`
+		StartDate   int              `json:"startdate"`
+		EndDate     int              `json:"enddate"`
+		CodeCount   int              `json:"code_count"`
+		ChunkMonths int              `json:"chunk_months"`
+		ChunkCodes  int              `json:"chunk_codes"`
+		Parallelism int              `json:"parallelism"`
+		Operator    string           `json:"operator"`
+		Status      string           `json:"status"`
+		CreateTime  time.Time        `json:"create_time"`
+		UpdateTime  time.Time        `json:"update_time"`
+		Progress    BackfillProgress `json:"progress"`
+		Chunks      []BackfillChunk  `json:"chunks,omitempty"`
+	}
+
+	// backfills 本进程中执行中的回补任务
+	backfills struct {
+		sync.Mutex
+		running  map[int64]bool
+		stopping bool
+		wg       sync.WaitGroup
+	}
+)
+
+//
+//  backfillInit
+//  @Description: 上次退出时仍在执行的回补任务标记为interrupted，分块恢复为pending，需手动恢复执行
+//  @receiver d
+//  @return error
+//
+func (d *dao) backfillInit() error {
+	db := d.DB.orm()
+	result := db.Table(backfillTable).Where("status = ?", RunRunning).
+		Updates(map[string]interface{}{"status": BackfillInterrupted, "update_time": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Log.Warn("mark running backfills as interrupted", zap.Int64("backfills", result.RowsAffected))
+	}
+	return db.Table(backfillChunkTable).Where("status = ?", RunRunning).Update("status", ChunkPending).Error
+}
+
+//
+//  StartBackfill
+//  @Description: 拆分分块并写入回补任务后在后台执行，返回时分块均为pending
+//  @receiver d
+//  @param param
+//  @return *BackfillJob
+//  @return error 财务文件不存在时为ErrFinanceNotFound，参数与导出sql不匹配时为ErrInvalidBackfill
+//
+func (d *dao) StartBackfill(param BackfillParam) (*BackfillJob, error) {
+	cfg := config.GetBackfill()
+	if param.ChunkMonths <= 0 {
+		param.ChunkMonths = cfg.ChunkMonths
+	}
+	if param.ChunkCodes <= 0 {
+		param.ChunkCodes = cfg.ChunkCodes
+	}
+	if param.Parallelism <= 0 {
+		param.Parallelism = cfg.Parallelism
+	}
+	if param.Parallelism > cfg.MaxParallelism {
+		return nil, errors.Wrapf(ErrInvalidBackfill, "parallelism should not exceed %d", cfg.MaxParallelism)
+	}
+	if param.ProcType != pg.OpBbrq && param.ProcType != pg.OpRtime && param.ProcType != pg.OpCode {
+		return nil, errors.Wrapf(ErrInvalidBackfill, "type %d can't be backfilled", param.ProcType)
+	}
+	param.Codes = uniqueCodes(param.Codes)
+	if param.ProcType == pg.OpCode && len(param.Codes) == 0 {
+		return nil, errors.Wrap(ErrInvalidBackfill, "codes is required when type is code")
+	}
+	tables, err := d.backfillTables(param.FinNames, param.Group)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := backfillChunks(tables, param)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(tables))
+	for _, table := range tables {
+		names = append(names, table.schemaName+"."+table.tableName)
+	}
+	now := time.Now()
+	rec := orm.Backfill{
+		Tables:      strings.Join(names, ","),
+		Export:      param.ProcType,
+		StartDate:   param.StartDate,
+		EndDate:     param.EndDate,
+		Codes:       strings.Join(param.Codes, ","),
+		ChunkMonths: param.ChunkMonths,
+		ChunkCodes:  param.ChunkCodes,
+		Parallelism: param.Parallelism,
+		Operator:    param.Operator,
+		Status:      RunRunning,
+		CreateTime:  now,
+		UpdateTime:  now,
+	}
+	ctx, cancel := tranContext()
+	defer cancel()
+	err = d.DB.orm().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(backfillTable).Create(&rec).Error; err != nil {
+			return err
+		}
+		for i := range chunks {
+			chunks[i].BackfillId = rec.BackfillId
+		}
+		return tx.Table(backfillChunkTable).CreateInBatches(chunks, 500).Error
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "save backfill")
+	}
+	if err = d.fills.acquire(rec.BackfillId); err != nil {
+		d.setBackfillStatus(rec.BackfillId, BackfillInterrupted)
+		return nil, err
+	}
+	log.Log.Info("start backfill", zap.Int64("backfill", rec.BackfillId), zap.String("tables", rec.Tables),
+		zap.Int("type", rec.Export), zap.Int("startdate", rec.StartDate), zap.Int("enddate", rec.EndDate),
+		zap.Int("codes", len(param.Codes)), zap.Int("chunks", len(chunks)), zap.String("operator", rec.Operator))
+	job := toBackfillJob(rec, chunkProgress(chunks))
+	go d.execBackfill(rec, chunks)
+	return &job, nil
+}
+
+//
+//  ResumeBackfill
+//  @Description: 将未成功的分块恢复为pending并在后台执行，没有未成功的分块时直接返回
+//  @receiver d
+//  @param id
+//  @param operator 发起恢复的调用方，只记录日志
+//  @return *BackfillJob
+//  @return error 任务不存在时为ErrBackfillNotFound，正在执行时为ErrBackfillRunning
+//
+func (d *dao) ResumeBackfill(id int64, operator string) (*BackfillJob, error) {
+	rec, err := d.backfillRecord(id)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []orm.BackfillChunk
+	db := d.DB.orm()
+	if err = db.Table(backfillChunkTable).Where("backfill_id = ? and status <> ?", id, RunSuccess).Order("seq").
+		Find(&chunks).Error; err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		if rec.Status != RunSuccess {
+			d.setBackfillStatus(id, RunSuccess)
+		}
+		return d.BackfillDetail(id)
+	}
+	if err = d.fills.acquire(id); err != nil {
+		return nil, err
+	}
+	err = db.Table(backfillChunkTable).Where("backfill_id = ? and status <> ?", id, RunSuccess).
+		Update("status", ChunkPending).Error
+	if err == nil {
+		err = db.Table(backfillTable).Where("id = ?", id).
+			Updates(map[string]interface{}{"status": RunRunning, "update_time": time.Now()}).Error
+	}
+	if err != nil {
+		d.fills.release(id)
+		return nil, errors.Wrap(err, "resume backfill")
+	}
+	for i := range chunks {
+		chunks[i].Status = ChunkPending
+	}
+	log.Log.Info("resume backfill", zap.Int64("backfill", id), zap.Int("chunks", len(chunks)),
+		zap.String("operator", operator))
+	go d.execBackfill(*rec, chunks)
+	return d.BackfillDetail(id)
+}
+
+//
+//  Backfills
+//  @Description: 最近的回补任务及进度，按创建时间倒序
+//  @receiver d
+//  @return []BackfillJob
+//  @return error
+//
+func (d *dao) Backfills() ([]BackfillJob, error) {
+	db := d.DB.orm()
+	var recs []orm.Backfill
+	if err := db.Table(backfillTable).Order("id desc").Limit(backfillListLimit).Find(&recs).Error; err != nil {
+		return nil, err
+	}
+	ret := make([]BackfillJob, 0, len(recs))
+	if len(recs) == 0 {
+		return ret, nil
+	}
+	ids := make([]int64, 0, len(recs))
+	for _, rec := range recs {
+		ids = append(ids, rec.BackfillId)
+	}
+	var counts []struct {
+		BackfillId int64
+		Status     string
+		Count      int
+	}
+	err := db.Table(backfillChunkTable).Select("backfill_id, status, count(*) as count").
+		Where("backfill_id in ?", ids).Group("backfill_id, status").Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	progress := make(map[int64]*BackfillProgress, len(recs))
+	for _, c := range counts {
+		p, ok := progress[c.BackfillId]
+		if !ok {
+			p = &BackfillProgress{}
+			progress[c.BackfillId] = p
+		}
+		p.Add(c.Status, c.Count)
+	}
+	for _, rec := range recs {
+		p := BackfillProgress{}
+		if v, ok := progress[rec.BackfillId]; ok {
+			p = *v
+		}
+		ret = append(ret, toBackfillJob(rec, p.Done()))
+	}
+	return ret, nil
+}
+
+//
+//  BackfillDetail
+//  @Description: 回补任务、进度及各分块的执行状态
+//  @receiver d
+//  @param id
+//  @return *BackfillJob
+//  @return error 任务不存在时为ErrBackfillNotFound
+//
+func (d *dao) BackfillDetail(id int64) (*BackfillJob, error) {
+	rec, err := d.backfillRecord(id)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []orm.BackfillChunk
+	if err = d.DB.orm().Table(backfillChunkTable).Where("backfill_id = ?", id).Order("seq").Find(&chunks).Error; err != nil {
+		return nil, err
+	}
+	job := toBackfillJob(*rec, chunkProgress(chunks))
+	job.Chunks = make([]BackfillChunk, 0, len(chunks))
+	for _, c := range chunks {
+		job.Chunks = append(job.Chunks, BackfillChunk{
+			Seq:       c.Seq,
+			Schema:    c.SchemaName,
+			Table:     c.TableName,
+			StartDate: c.StartDate,
+			EndDate:   c.EndDate,
+			CodeCount: len(splitColumns(c.Codes)),
+			Status:    c.Status,
+			Attempts:  c.Attempts,
+			StartTime: c.StartTime,
+			EndTime:   c.EndTime,
+			Error:     c.Error,
+		})
+	}
+	return &job, nil
+}
+
+func (d *dao) backfillRecord(id int64) (*orm.Backfill, error) {
+	var recs []orm.Backfill
+	if err := d.DB.orm().Table(backfillTable).Where("id = ?", id).Limit(1).Find(&recs).Error; err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, ErrBackfillNotFound
+	}
+	return &recs[0], nil
+}
+
+// backfillTables 按财务文件名称和分组查找表，重复的表只回补一次
+func (d *dao) backfillTables(finNames []string, group string) ([]TableInfo, error) {
+	if len(finNames) == 0 && group == "" {
+		return nil, errors.Wrap(ErrInvalidBackfill, "finname or group is required")
+	}
+	var tables, candidates []TableInfo
+	for _, finName := range finNames {
+		table, ok := d.DB.financeInfo[finName]
+		if !ok {
+			return nil, errors.Wrap(ErrFinanceNotFound, finName)
+		}
+		candidates = append(candidates, table)
+	}
+	if group != "" {
+		members, err := d.groupTables(group)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, members...)
+	}
+	seen := make(map[string]bool)
+	for _, table := range candidates {
+		key := table.schemaName + "." + table.tableName
+		if !seen[key] {
+			seen[key] = true
+			tables = append(tables, table)
+		}
+	}
+	return tables, nil
+}
+
+//
+//  backfillChunks
+//  @Description: 按表、日期窗口、代码批次依次拆分分块，导出sql未使用日期参数时不按日期拆分
+//  @param tables
+//  @param param
+//  @return []orm.BackfillChunk
+//  @return error 表未配置该导出方式的sql、指定了代码但sql未使用:codes或分块过多时返回ErrInvalidBackfill
+//
+func backfillChunks(tables []TableInfo, param BackfillParam) ([]orm.BackfillChunk, error) {
+	planned := make([]backfill.Table, 0, len(tables))
+	for _, table := range tables {
+		proc, ok := table.procs[param.ProcType]
+		if reason, rejected := table.rejected[param.ProcType]; rejected {
+			return nil, errors.Wrapf(ErrInvalidBackfill, "%s.%s has invalid sql for type %d: %s", table.schemaName,
+				table.tableName, param.ProcType, reason)
+		}
+		if !ok {
+			return nil, errors.Wrapf(ErrInvalidBackfill, "%s.%s has no sql for type %d", table.schemaName,
+				table.tableName, param.ProcType)
+		}
+		used := make(map[string]bool)
+		for _, name := range proc.tmpl.Used() {
+			used[name] = true
+		}
+		planned = append(planned, backfill.Table{
+			Schema:   table.schemaName,
+			Name:     table.tableName,
+			UseDate:  used[pg.ParamStart] || used[pg.ParamEnd],
+			UseCodes: used[pg.ParamCodes],
+		})
+	}
+	planChunks, err := backfill.Chunks(planned, backfill.Range{
+		StartDate:   param.StartDate,
+		EndDate:     param.EndDate,
+		Codes:       param.Codes,
+		ChunkMonths: param.ChunkMonths,
+		ChunkCodes:  param.ChunkCodes,
+	})
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidBackfill, err.Error())
+	}
+	chunks := make([]orm.BackfillChunk, len(planChunks))
+	for i, c := range planChunks {
+		chunks[i] = orm.BackfillChunk{
+			Seq:        c.Seq,
+			SchemaName: c.Schema,
+			TableName:  c.Table,
+			StartDate:  c.StartDate,
+			EndDate:    c.EndDate,
+			Codes:      c.Codes,
+			Status:     ChunkPending,
+		}
+	}
+	return chunks, nil
+}
+
+// uniqueCodes 去掉空代码和重复代码，保持原有顺序
+func uniqueCodes(codes []string) []string {
+	var ret []string
+	seen := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		if code = strings.TrimSpace(code); code != "" && !seen[code] {
+			seen[code] = true
+			ret = append(ret, code)
+		}
+	}
+	return ret
+}
+
+// execBackfill 按seq顺序分发分块，最多Parallelism个分块同时导出，服务退出时不再分发新的分块
+func (d *dao) execBackfill(rec orm.Backfill, chunks []orm.BackfillChunk) {
+	defer d.fills.release(rec.BackfillId)
+	startTime := time.Now()
+	ch := make(chan *orm.BackfillChunk)
+	var failed int32
+	var wg sync.WaitGroup
+	for i := 0; i < rec.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range ch {
+				if err := d.execBackfillChunk(rec, chunk); err != nil {
+					atomic.AddInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	interrupted := false
+	for i := range chunks {
+		if d.fills.isStopping() {
+			interrupted = true
+			break
+		}
+		ch <- &chunks[i]
+	}
+	close(ch)
+	wg.Wait()
+	status := RunSuccess
+	if interrupted {
+		status = BackfillInterrupted
+	} else if failed > 0 {
+		status = RunFailed
+	}
+	d.setBackfillStatus(rec.BackfillId, status)
+	log.Log.Info("backfill finished", zap.Int64("backfill", rec.BackfillId), zap.String("status", status),
+		zap.Int("chunks", len(chunks)), zap.Int32("failed", failed),
+		zap.Int64("cost_ms", time.Since(startTime).Milliseconds()))
+}
+
+// execBackfillChunk 导出单个分块，执行前后更新分块状态
+func (d *dao) execBackfillChunk(rec orm.Backfill, chunk *orm.BackfillChunk) error {
+	startTime := time.Now()
+	chunk.Status, chunk.Attempts, chunk.StartTime, chunk.EndTime, chunk.Error = RunRunning, chunk.Attempts+1, &startTime, nil, ""
+	d.saveBackfillChunk(chunk)
+	err := d.ExportPgData(pg.QueryParam{
+		SchemaName:  chunk.SchemaName,
+		TableName:   chunk.TableName,
+		StartDate:   chunk.StartDate,
+		EndDate:     chunk.EndDate,
+		CodeList:    chunk.Codes,
+		ProcType:    rec.Export,
+		TriggerType: pg.TrigBackfill,
+		Operator:    fmt.Sprintf("backfill:%d", rec.BackfillId),
+	})
+	endTime := time.Now()
+	chunk.EndTime = &endTime
+	chunk.Status = RunSuccess
+	if err != nil {
+		chunk.Status, chunk.Error = RunFailed, err.Error()
+		log.Log.Warn("backfill chunk failed", zap.Int64("backfill", rec.BackfillId), zap.Int("seq", chunk.Seq),
+			zap.String("schema", chunk.SchemaName), zap.String("table", chunk.TableName),
+			zap.Int("startdate", chunk.StartDate), zap.Int("enddate", chunk.EndDate), zap.String("err", err.Error()))
+	}
+	d.saveBackfillChunk(chunk)
+	return err
+}
+
+// saveBackfillChunk 更新分块状态，失败时只记录日志，恢复执行时该分块会重新执行
+func (d *dao) saveBackfillChunk(chunk *orm.BackfillChunk) {
+	if err := d.DB.orm().Table(backfillChunkTable).Save(chunk).Error; err != nil {
+		log.Log.Error(fmt.Sprintf("update backfill chunk failed: %s", err.Error()),
+			zap.Int64("backfill", chunk.BackfillId), zap.Int("seq", chunk.Seq))
+	}
+}
+
+func (d *dao) setBackfillStatus(id int64, status string) {
+	err := d.DB.orm().Table(backfillTable).Where("id = ?", id).
+		Updates(map[string]interface{}{"status": status, "update_time": time.Now()}).Error
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("update backfill failed: %s", err.Error()), zap.Int64("backfill", id),
+			zap.String("status", status))
+	}
+}
+
+func toBackfillJob(rec orm.Backfill, progress BackfillProgress) BackfillJob {
+	return BackfillJob{
+		Id:          rec.BackfillId,
+		Tables:      splitColumns(rec.Tables),
+		Type:        rec.Export,
+		StartDate:   rec.StartDate,
+		EndDate:     rec.EndDate,
+		CodeCount:   len(splitColumns(rec.Codes)),
+		ChunkMonths: rec.ChunkMonths,
+		ChunkCodes:  rec.ChunkCodes,
+		Parallelism: rec.Parallelism,
+		Operator:    rec.Operator,
+		Status:      rec.Status,
+		CreateTime:  rec.CreateTime,
+		UpdateTime:  rec.UpdateTime,
+		Progress:    progress,
+	}
+}
+
+func chunkProgress(chunks []orm.BackfillChunk) BackfillProgress {
+	p := BackfillProgress{}
+	for _, c := range chunks {
+		p.Add(c.Status, 1)
+	}
+	return p.Done()
+}
+
+// acquire 标记回补任务开始执行，服务退出中或任务已在执行时返回错误
+func (b *backfills) acquire(id int64) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.stopping {
+		return errors.New("service is shutting down")
+	}
+	if b.running[id] {
+		return ErrBackfillRunning
+	}
+	if b.running == nil {
+		b.running = make(map[int64]bool)
+	}
+	b.running[id] = true
+	b.wg.Add(1)
+	return nil
+}
+
+func (b *backfills) release(id int64) {
+	b.Lock()
+	delete(b.running, id)
+	b.Unlock()
+	b.wg.Done()
+}
+
+func (b *backfills) isStopping() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.stopping
+}
+
+// stop 不再分发新的分块，返回的channel在执行中的分块结束后关闭
+func (b *backfills) stop() <-chan struct{} {
+	b.Lock()
+	b.stopping = true
+	b.Unlock()
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	return done
+}
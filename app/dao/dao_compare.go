@@ -1,206 +1,138 @@
 package dao
 
 import (
+	"bytes"
+	"database/sql"
 	"fmt"
 	"github.com/pkg/errors"
-	"sort"
-	"time"
+	"hxextract/app/dao/compare"
+	"hxextract/app/dao/orm"
+	"strings"
 )
 
-type (
-	MapZqdmBbrq map[string][]int32
-)
+// 每次按主键批量请求/删除的记录数，避免sql过长
+const keyBatchSize = 500
 
-func (d *dao) GetZqdmDiffer(tableName string, schemaName string) (*[]string, *[]string, *[]string, error) {
-	// 获取对比库证券代码
-	schemaCompare := "compare_" + schemaName
-	listZqdmCmp, err := d.GetZqdmList(tableName, schemaCompare)
-	if err != nil {
-		return nil, nil, nil, err
+//
+//  getKeyColumns
+//  @Description: 获取表的主键字段，优先使用TableInfo中配置的字段，未配置时从mysql唯一索引获取
+//  @receiver d
+//  @param schemaName
+//  @param tableName
+//  @return []string
+//  @return error
+//
+func (d *dao) getKeyColumns(schemaName string, tableName string) ([]string, error) {
+	if schema, ok := d.DB.gTableInfo[schemaName]; ok {
+		if table, ok := schema[tableName]; ok && len(table.keyColumns) > 0 {
+			return table.keyColumns, nil
+		}
 	}
-	// 获取生产库证券代码
-	listZqdmProd, err := d.GetZqdmList(tableName, schemaName)
-	if err != nil {
-		return nil, nil, nil, err
+	fullName := schemaName + "." + tableName
+	if cols, ok := d.DB.keyColumns.Load(fullName); ok {
+		return cols.([]string), nil
 	}
-	return CompareTwoStringSlices(listZqdmProd, listZqdmCmp)
-}
-
-func (d *dao) GetBbrqDiffer(tableName string, schemaName string, codelist *[]string) (*MapZqdmBbrq, *MapZqdmBbrq, error) {
-	// 获取库证券代码
-	schemaCompare := "compare_" + schemaName
-	mapProd, err := d.GetZqdmBbrqList(tableName, codelist, schemaName)
+	// 取第一个非主键的唯一索引，主键一般为自增id，不能用于对比
+	querySql := "select index_name, column_name from information_schema.statistics " +
+		"where table_schema = ? and table_name = ? and non_unique = 0 and index_name <> 'PRIMARY' " +
+		"order by index_name, seq_in_index"
+	db, err := d.DB.defaultDb()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	mapCmp, err := d.GetZqdmBbrqList(tableName, codelist, schemaCompare)
+	ctx, cancel := queryContext()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, querySql, schemaName, tableName)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	// 执行对比操作
-	// 对比得到不一致的数据
-	mapProdMore := make(MapZqdmBbrq)
-	mapCmpMore := make(MapZqdmBbrq)
-	for k, valProd := range *mapProd {
-		// 查找对比库中是否有相同zqdm
-		valCmp, ok := (*mapCmp)[k]
-		if !ok {
-			continue
+	defer rows.Close()
+	var cols []string
+	var firstIndex string
+	for rows.Next() {
+		var indexName, colName string
+		if err = rows.Scan(&indexName, &colName); err != nil {
+			return nil, err
 		}
-		bbrq1, bbrq2 := CompareTwoIntSlices(&valProd, &valCmp)
-		if bbrq1 != nil && len(*bbrq1) > 0 {
-			mapProdMore[k] = *bbrq1
+		if firstIndex == "" {
+			firstIndex = indexName
 		}
-
-		if bbrq2 != nil && len(*bbrq2) > 0 {
-			mapCmpMore[k] = *bbrq2
+		if indexName != firstIndex {
+			break
 		}
+		cols = append(cols, colName)
 	}
-	return &mapProdMore, &mapCmpMore, nil
+	if len(cols) == 0 {
+		return nil, errors.New(fmt.Sprintf("can't find unique key, schema=%s, table=%s", schemaName, tableName))
+	}
+	d.DB.keyColumns.Store(fullName, cols)
+	return cols, nil
 }
 
-// 获取表内所有zqdm证券代码
-func (d *dao) GetZqdmList(tableName string, schemaName string) (*[]string, error) {
-	dbHandler, err := d.DB.getConn(schemaName)
-	if err != nil {
-		return nil, err
-	}
-	sqlProdZqdm := fmt.Sprintf("select zqdm from %s group by zqdm", tableName)
-	var listZqdm []string
-	for i := 0; i < 3; i++ {
-		rowsZqdm, err := dbHandler.Query(sqlProdZqdm)
-		if err != nil {
-			return nil, err
+// keyCondition 根据主键生成 (`k1`,`k2`) in ((?,?),(?,?)) 形式的条件及其参数
+func keyCondition(keys []orm.FinPrimaryKey) (string, []interface{}) {
+	if len(keys) == 0 {
+		return "", nil
+	}
+	cols := keys[0].Columns
+	cond := bytes.Buffer{}
+	cond.WriteByte('(')
+	for i, col := range cols {
+		if i > 0 {
+			cond.WriteByte(',')
 		}
-		defer rowsZqdm.Close()
-		for rowsZqdm.Next() {
-			var zqdm string
-			rowsZqdm.Scan(&zqdm)
-			listZqdm = append(listZqdm, zqdm)
+		cond.WriteString(fmt.Sprintf("`%s`", col))
+	}
+	cond.WriteString(") in (")
+	holder := "(" + strings.TrimRight(strings.Repeat("?,", len(cols)), ",") + ")"
+	args := make([]interface{}, 0, len(keys)*len(cols))
+	for i, key := range keys {
+		if i > 0 {
+			cond.WriteByte(',')
 		}
-		if len(listZqdm) > 0 {
-			sort.Strings(listZqdm) //升序排序
-			break
+		cond.WriteString(holder)
+		for _, v := range key.Values {
+			args = append(args, v)
 		}
-		time.Sleep(time.Duration(3) * time.Second)
-	}
-	if len(listZqdm) == 0 {
-		return nil, errors.New(fmt.Sprintf("get 0 rows of zqdm, schema=%s, table=%s",
-			schemaName, tableName))
 	}
-	return &listZqdm, nil
+	cond.WriteByte(')')
+	return cond.String(), args
 }
 
-// 获取zqdm证券代码对应报表日期bbrq
-func (d *dao) GetZqdmBbrqList(tableName string, sliceZqdm *[]string, schemaName string) (*MapZqdmBbrq, error) {
-	dbHandler, err := d.DB.getConn(schemaName)
+// keyRows 按compare.OrderBy的顺序查询表内所有主键，结果集Close前占用连接，连接池不会被空闲回收
+func (d *dao) keyRows(tableName string, schemaName string, keyCols []string) (*sql.Rows, error) {
+	dbHandler, release, err := d.DB.getConn(schemaName)
 	if err != nil {
 		return nil, err
 	}
-	mapZqdmBbrq := make(MapZqdmBbrq)
-	cntZqdm := len(*sliceZqdm)
-	var strZqdm string
-	strZqdm = ""
-	for offset, zqdm := range *sliceZqdm {
-		strZqdm = strZqdm + "'" + zqdm + "'"
-		// 避免全表请求，所以每次请求制定个数的zqdm
-		if offset == 500 || offset == cntZqdm-1 {
-			// 从数据库请求记录
-			sqlZqdmBbrq := fmt.Sprintf("select zqdm, bbrq from %s where zqdm in (%s)", tableName, strZqdm)
-			recordCnt := 0
-			for i := 0; i < 3; i++ {
-				rowsZqdm, err := dbHandler.Query(sqlZqdmBbrq)
-				if err != nil {
-					return nil, err
-				}
-				defer rowsZqdm.Close()
-				// 把每个代码的报表日期存入map
-				for rowsZqdm.Next() {
-					recordCnt++
-					var zqdm string
-					var bbrq int32
-					rowsZqdm.Scan(&zqdm, &bbrq)
-					if _, ok := mapZqdmBbrq[zqdm]; ok {
-						mapZqdmBbrq[zqdm] = append(mapZqdmBbrq[zqdm], bbrq)
-					} else {
-						sliceBbrq := make([]int32, 0)
-						sliceBbrq = append(sliceBbrq, bbrq)
-						mapZqdmBbrq[zqdm] = sliceBbrq
-					}
-				}
-				if recordCnt > 0 {
-					break
-				}
-				time.Sleep(time.Duration(3) * time.Second)
-			}
-			if recordCnt == 0 {
-				return nil, errors.New("Get zqdm bbrq failed")
-			}
-			strZqdm = ""
-		} else {
-			strZqdm = strZqdm + ", "
-		}
+	defer release()
+	quoted := make([]string, len(keyCols))
+	for i, col := range keyCols {
+		quoted[i] = fmt.Sprintf("`%s`", col)
 	}
+	sqlKeys := fmt.Sprintf("select %s from `%s` %s", strings.Join(quoted, ","), tableName, compare.OrderBy(keyCols))
+	return dbHandler.Query(sqlKeys)
+}
 
-	return &mapZqdmBbrq, nil
+// keyBatch 缓存对比得到的主键，达到批量大小时统一处理，保证内存占用不随表大小增长
+type keyBatch struct {
+	cols  []string
+	keys  []orm.FinPrimaryKey
+	flush func([]orm.FinPrimaryKey)
 }
 
-// 对比两个slice，获取两者中不一致的元素
-func CompareTwoStringSlices(a, b *[]string) (*[]string, *[]string, *[]string, error) {
-	var slice1 []string
-	var slice2 []string
-	var slice3 []string
-	i, j := 0, 0
-	for i < len(*a) && j < len(*b) {
-		if (*a)[i] > (*b)[j] {
-			slice2 = append(slice2, (*b)[j])
-			j++
-		} else if (*a)[i] < (*b)[j] {
-			slice1 = append(slice1, (*a)[i])
-			i++
-		} else {
-			slice3 = append(slice3, (*a)[i])
-			i++
-			j++
-		}
+func (b *keyBatch) add(key compare.Key) error {
+	b.keys = append(b.keys, orm.FinPrimaryKey{Columns: b.cols, Values: key})
+	if len(b.keys) >= keyBatchSize {
+		b.done()
 	}
-	for i < len(*a) {
-		slice1 = append(slice1, (*a)[i])
-		i++
-	}
-	for j < len(*b) {
-		slice2 = append(slice2, (*b)[j])
-		j++
-	}
-
-	return &slice1, &slice2, &slice3, nil
+	return nil
 }
 
-// 对比两个slice，获取两者中不一致的元素
-func CompareTwoIntSlices(a, b *[]int32) (*[]int32, *[]int32) {
-	var slice1 []int32
-	var slice2 []int32
-	i, j := 0, 0
-	for i < len(*a) && j < len(*b) {
-		if (*a)[i] > (*b)[j] {
-			slice2 = append(slice2, (*b)[j])
-			j++
-		} else if (*a)[i] < (*b)[j] {
-			slice1 = append(slice1, (*a)[i])
-			i++
-		} else {
-			i++
-			j++
-		}
+func (b *keyBatch) done() {
+	if len(b.keys) == 0 {
+		return
 	}
-	for i < len(*a) {
-		slice1 = append(slice1, (*a)[i])
-		i++
-	}
-	for j < len(*b) {
-		slice2 = append(slice2, (*b)[j])
-		j++
-	}
-
-	return &slice1, &slice2
+	b.flush(b.keys)
+	b.keys = make([]orm.FinPrimaryKey, 0, keyBatchSize)
 }
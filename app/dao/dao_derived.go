@@ -0,0 +1,264 @@
+package dao
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hxextract/app/dao/derived"
+	"hxextract/app/dao/orm"
+	"hxextract/app/log"
+	"hxextract/app/metrics"
+	"sync"
+	"time"
+)
+
+// 衍生规则执行状态
+const (
+	DerivedIdle    = "idle"
+	DerivedRunning = "running"
+	DerivedSuccess = "success"
+	DerivedFailed  = "failed"
+)
+
+type (
+	// DerivedRule 衍生表规则
+	DerivedRule struct {
+		id           int
+		targetSchema string
+		targetTable  string
+		sourceSchema string
+		sourceTable  string
+		selectExpr   string
+		filter       string
+	}
+
+	// DerivedStatus 衍生规则最近一次执行情况
+	DerivedStatus struct {
+		RuleId      int       `json:"id"`
+		Source      string    `json:"source"`
+		Target      string    `json:"target"`
+		Status      string    `json:"status"`
+		Rows        int64     `json:"rows"`
+		CostMs      int64     `json:"cost_ms"`
+		LastRun     time.Time `json:"last_run"`
+		LastSuccess time.Time `json:"last_success"`
+		Error       string    `json:"error"`
+	}
+
+	// derivedRules 衍生规则，key为源表schema.table，同一源表的规则按加载顺序执行
+	derivedRules struct {
+		sync.RWMutex
+		bySource map[string][]DerivedRule
+		excluded []DerivedRule // 处于循环依赖中未加载的规则
+		status   map[int]*DerivedStatus
+	}
+)
+
+func fullTableName(schemaName string, tableName string) string {
+	return schemaName + "." + tableName
+}
+
+func (r *DerivedRule) source() string {
+	return fullTableName(r.sourceSchema, r.sourceTable)
+}
+
+func (r *DerivedRule) target() string {
+	return fullTableName(r.targetSchema, r.targetTable)
+}
+
+// sql 衍生表数据使用replace into，保证重复执行结果一致
+func (r *DerivedRule) sql() string {
+	sqlStr := fmt.Sprintf("replace into `%s`.`%s` select %s from `%s`.`%s`",
+		r.targetSchema, r.targetTable, r.selectExpr, r.sourceSchema, r.sourceTable)
+	if r.filter != "" {
+		sqlStr += " where " + r.filter
+	}
+	return sqlStr
+}
+
+//
+//  derivedRuleLoad
+//  @Description: 加载衍生表规则，处于循环依赖中的规则不加载，其余规则正常加载
+//  @receiver d
+//  @return error
+//
+func (d *dao) derivedRuleLoad() error {
+	log.Log.Info("init derived rules")
+	var result []orm.DerivedRule
+	if err := d.DB.orm().Table("DerivedRule").Where("enabled = ?", true).Find(&result).Error; err != nil {
+		return err
+	}
+	rules := make([]DerivedRule, 0, len(result))
+	edges := make([]derived.Edge, 0, len(result))
+	status := make(map[int]*DerivedStatus)
+	for _, v := range result {
+		rule := DerivedRule{
+			id:           v.RuleId,
+			targetSchema: v.TargetSchema,
+			targetTable:  v.TargetTable,
+			sourceSchema: v.SourceSchema,
+			sourceTable:  v.SourceTable,
+			selectExpr:   v.SelectExpr,
+			filter:       v.Filter,
+		}
+		d.DB.allowSchema(rule.targetSchema)
+		rules = append(rules, rule)
+		edges = append(edges, derived.Edge{Source: rule.source(), Target: rule.target()})
+		status[rule.id] = &DerivedStatus{RuleId: rule.id, Source: rule.source(), Target: rule.target(), Status: DerivedIdle}
+	}
+	// 目标表不能直接或间接成为自己的源表，去掉环上的规则
+	cyclic := make(map[int]bool)
+	var excluded []DerivedRule
+	for _, i := range derived.Cycles(edges) {
+		cyclic[i] = true
+		excluded = append(excluded, rules[i])
+		status[rules[i].id].Status = DerivedFailed
+		status[rules[i].id].Error = "not loaded: cycle detected"
+		log.Log.Error("skip derived rule in cycle", zap.Int("rule", rules[i].id),
+			zap.String("source", rules[i].source()), zap.String("target", rules[i].target()))
+	}
+	bySource := make(map[string][]DerivedRule)
+	for i, rule := range rules {
+		if !cyclic[i] {
+			bySource[rule.source()] = append(bySource[rule.source()], rule)
+		}
+	}
+	d.derived.Lock()
+	d.derived.bySource = bySource
+	d.derived.excluded = excluded
+	d.derived.status = status
+	d.derived.Unlock()
+	log.Log.Info("derived rules load finished", zap.Int("rules", len(rules)-len(excluded)),
+		zap.Int("excluded", len(excluded)))
+	return nil
+}
+
+// derivedOrder 按依赖顺序返回源表更新后需要执行的所有规则，一个表的所有上游规则都执行后才执行以它为源表的规则
+func derivedOrder(bySource map[string][]DerivedRule, source string) ([]DerivedRule, error) {
+	var rules []DerivedRule
+	var edges []derived.Edge
+	for _, list := range bySource {
+		for _, rule := range list {
+			rules = append(rules, rule)
+			edges = append(edges, derived.Edge{Source: rule.source(), Target: rule.target()})
+		}
+	}
+	order, err := derived.Order(edges, source)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]DerivedRule, len(order))
+	for i, idx := range order {
+		ret[i] = rules[idx]
+	}
+	return ret, nil
+}
+
+//
+//  runDerived
+//  @Description: 源表导出成功后按依赖顺序执行衍生规则，上游规则失败时跳过依赖它的规则
+//  @receiver d
+//  @param schemaName 源表schema
+//  @param tableName 源表
+//  @param trigger 源表导出的触发方式
+//  @param operator 源表导出的发起方
+//  @return error 所有失败规则的错误
+//
+func (d *dao) runDerived(schemaName string, tableName string, trigger string, operator string) error {
+	d.derived.RLock()
+	rules, err := derivedOrder(d.derived.bySource, fullTableName(schemaName, tableName))
+	d.derived.RUnlock()
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+	failed := make(map[string]bool)
+	var errs []string
+	for _, rule := range rules {
+		if failed[rule.source()] {
+			failed[rule.target()] = true
+			log.Log.Warn("skip derived rule due to failed upstream",
+				zap.Int("rule", rule.id), zap.String("source", rule.source()), zap.String("target", rule.target()))
+			continue
+		}
+		if err := d.execDerived(rule, trigger, operator); err != nil {
+			failed[rule.target()] = true
+			errs = append(errs, fmt.Sprintf("rule %d: %s", rule.id, err.Error()))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(fmt.Sprintf("derived rules failed: %v", errs))
+	}
+	return nil
+}
+
+// execDerived 执行单条衍生规则，记录执行状态和指标
+func (d *dao) execDerived(rule DerivedRule, trigger string, operator string) error {
+	startTime := time.Now()
+	d.setDerivedStatus(rule.id, func(s *DerivedStatus) {
+		s.Status = DerivedRunning
+		s.LastRun = startTime
+	})
+	metrics.QpsMetricsInc(rule.targetSchema, rule.targetTable, trigger, metrics.ExportDerived)
+	log.Log.Info("start to export derived table", zap.Int("rule", rule.id),
+		zap.String("source", rule.source()), zap.String("target", rule.target()))
+	var rows int64
+	db, release, err := d.DB.getConn(rule.targetSchema)
+	if err != nil {
+		metrics.ErrorMetricsInc(trigger, rule.targetSchema, rule.targetTable, metrics.ExportDerived, metrics.ErrorConn)
+	} else if result, execErr := execWithTimeout(db, rule.sql()); execErr != nil {
+		err = execErr
+		metrics.ErrorMetricsInc(trigger, rule.targetSchema, rule.targetTable, metrics.ExportDerived, metrics.ErrorSink)
+	} else {
+		rows, _ = result.RowsAffected()
+	}
+	defer release()
+	cost := time.Since(startTime)
+	metrics.PerfBucketMetricsObserve(rule.targetSchema, rule.targetTable, trigger, metrics.StageAll,
+		metrics.ExportDerived, float64(cost.Milliseconds()))
+	d.setDerivedStatus(rule.id, func(s *DerivedStatus) {
+		s.Rows = rows
+		s.CostMs = cost.Milliseconds()
+		if err != nil {
+			s.Status = DerivedFailed
+			s.Error = err.Error()
+		} else {
+			s.Status = DerivedSuccess
+			s.Error = ""
+			s.LastSuccess = time.Now()
+		}
+	})
+	publishDerived(rule, trigger, rows, err)
+	d.auditDerived(rule, trigger, operator, rows, startTime, err)
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("export derived table failed: %s", err.Error()), zap.Int("rule", rule.id),
+			zap.String("source", rule.source()), zap.String("target", rule.target()))
+		return err
+	}
+	log.Log.Info("export derived table successfully", zap.Int("rule", rule.id), zap.String("target", rule.target()),
+		zap.Int64("affected rows", rows), zap.Duration("cost", cost))
+	return nil
+}
+
+func (d *dao) setDerivedStatus(id int, fn func(s *DerivedStatus)) {
+	d.derived.Lock()
+	defer d.derived.Unlock()
+	if s, ok := d.derived.status[id]; ok {
+		fn(s)
+	}
+}
+
+// DerivedStatuses 获取所有衍生规则的执行状态
+func (d *dao) DerivedStatuses() []DerivedStatus {
+	d.derived.RLock()
+	defer d.derived.RUnlock()
+	ret := make([]DerivedStatus, 0, len(d.derived.status))
+	for _, rules := range d.derived.bySource {
+		for _, rule := range rules {
+			ret = append(ret, *d.derived.status[rule.id])
+		}
+	}
+	for _, rule := range d.derived.excluded {
+		ret = append(ret, *d.derived.status[rule.id])
+	}
+	return ret
+}
@@ -0,0 +1,77 @@
+package dao
+
+import (
+	"hxextract/app/dao/compare"
+	"hxextract/app/dao/pg"
+	"hxextract/app/event"
+	"hxextract/app/metrics"
+)
+
+// exportStat 导出数据统计，用于发布事件和记录执行历史
+type exportStat struct {
+	rows     int64           // 校验通过的行数
+	skipped  int             // 校验未通过的行数
+	written  int64           // 成功写入mysql的行数
+	keyRange *event.KeyRange // 为nil时不统计主键范围
+}
+
+// addKeyRange 将主键加入范围，按与对比相同的字节序比较
+func addKeyRange(r *event.KeyRange, key []string) {
+	if r.Min == nil || compare.Compare(key, r.Min) < 0 {
+		r.Min = append([]string(nil), key...)
+	}
+	if r.Max == nil || compare.Compare(key, r.Max) > 0 {
+		r.Max = append([]string(nil), key...)
+	}
+}
+
+func eventStatus(err error) (string, string) {
+	if err != nil {
+		return event.StatusFailed, err.Error()
+	}
+	return event.StatusSuccess, ""
+}
+
+// publishExport 发布导出完成事件，stat为nil时表示未读取到数据
+func publishExport(param pg.QueryParam, trigger string, stat *exportStat, err error) {
+	e := event.Event{
+		Type:     event.TypeExport,
+		Schema:   param.SchemaName,
+		Table:    param.TableName,
+		ProcType: metrics.GetExportType(param.ProcType),
+		Trigger:  trigger,
+	}
+	if stat != nil {
+		e.Rows, e.Skipped, e.KeyRange = stat.rows, stat.skipped, stat.keyRange
+	}
+	e.Status, e.Error = eventStatus(err)
+	event.Publish(e)
+}
+
+// publishCompare 发布对比完成事件
+func publishCompare(schemaName string, tableName string, trigger string, deletes int, inserts int, err error) {
+	e := event.Event{
+		Type:    event.TypeCompare,
+		Schema:  schemaName,
+		Table:   tableName,
+		Trigger: trigger,
+		Inserts: inserts,
+		Deletes: deletes,
+	}
+	e.Status, e.Error = eventStatus(err)
+	event.Publish(e)
+}
+
+// publishDerived 发布衍生表更新事件
+func publishDerived(rule DerivedRule, trigger string, rows int64, err error) {
+	e := event.Event{
+		Type:    event.TypeDerived,
+		Schema:  rule.targetSchema,
+		Table:   rule.targetTable,
+		Source:  rule.source(),
+		Trigger: trigger,
+		Rows:    rows,
+	}
+	e.Status, e.Error = eventStatus(err)
+	event.Publish(e)
+}
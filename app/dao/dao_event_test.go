@@ -0,0 +1,16 @@
+package dao
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hxextract/app/event"
+	"testing"
+)
+
+func TestAddKeyRange(t *testing.T) {
+	r := &event.KeyRange{Columns: []string{"zqdm", "bbrq"}}
+	for _, key := range [][]string{{"000002", "20211231"}, {"000001", "20220331"}, {"000002", "20220331"}} {
+		addKeyRange(r, key)
+	}
+	assert.Equal(t, []string{"000001", "20220331"}, r.Min)
+	assert.Equal(t, []string{"000002", "20220331"}, r.Max)
+}
@@ -0,0 +1,335 @@
+package dao
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hxextract/app/dao/orm"
+	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	"hxextract/app/metrics"
+	"os"
+	"time"
+)
+
+// 导出执行状态
+const (
+	RunRunning = "running"
+	RunSuccess = "success"
+	RunFailed  = "failed"
+)
+
+const (
+	exportRunTable     = "ExportRun"
+	runDefaultPageSize = 20
+	runMaxPageSize     = 200
+	// DefaultFreshAge 未指定时，最近一次成功导出在该时间内视为新鲜
+	DefaultFreshAge = 24 * time.Hour
+)
+
+// ErrTableNotFound schema.table未在TableInfo中配置
+var ErrTableNotFound = errors.New("cant find table")
+
+// runInstance 本实例的主机名，写入执行记录，重启时只处理本实例的记录
+var runInstance, _ = os.Hostname()
+
+type (
+	// exportRun 执行中的导出，mark为上一阶段结束的时间
+	exportRun struct {
+		rec  orm.ExportRun
+		mark time.Time
+	}
+
+	// ExportRun 导出执行记录
+	ExportRun struct {
+		Id          int64      `json:"id"`
+		Schema      string     `json:"schema"`
+		Table       string     `json:"table"`
+		Trigger     string     `json:"trigger"`
+		Operator    string     `json:"operator"`
+		Instance    string     `json:"instance"`
+		ProcType    string     `json:"proc_type"`
+		StartDate   int        `json:"startdate"`
+		EndDate     int        `json:"enddate"`
+		Codes       string     `json:"codes,omitempty"`
+		StartTime   time.Time  `json:"start_time"`
+		EndTime     *time.Time `json:"end_time,omitempty"`
+		Status      string     `json:"status"` // 详见：Run*
+		RowsRead    int64      `json:"rows_read"`
+		RowsWritten int64      `json:"rows_written"`
+		RowsSkipped int64      `json:"rows_skipped"`
+		ExtractMs   int64      `json:"extract_ms"`
+		TransformMs int64      `json:"transform_ms"`
+		LoadMs      int64      `json:"load_ms"`
+		CostMs      int64      `json:"cost_ms"`
+		Error       string     `json:"error,omitempty"`
+	}
+
+	// RunQuery 执行记录查询条件，为空的条件不过滤，Page从1开始
+	RunQuery struct {
+		SchemaName string
+		TableName  string
+		ProcType   string
+		Status     string
+		Page       int
+		PageSize   int
+	}
+
+	// RunPage 分页的执行记录，按开始时间倒序
+	RunPage struct {
+		Runs     []ExportRun `json:"runs"`
+		Page     int         `json:"page"`
+		PageSize int         `json:"page_size"`
+		Total    int64       `json:"total"`
+	}
+
+	// Freshness 表的新鲜度：最近一次成功导出距今是否在MaxAge内
+	Freshness struct {
+		Schema        string     `json:"schema"`
+		Table         string     `json:"table"`
+		ProcType      string     `json:"proc_type,omitempty"` // 为空时为任意导出方式
+		Fresh         bool       `json:"fresh"`
+		LastSuccess   *time.Time `json:"last_success,omitempty"`
+		AgeSeconds    int64      `json:"age_seconds"` // 从未成功时为-1
+		MaxAgeSeconds int64      `json:"max_age_seconds"`
+		LastRun       *ExportRun `json:"last_run,omitempty"` // 最近一次执行，可能仍在执行或失败
+	}
+)
+
+//
+//  exportRunInit
+//  @Description: 本实例上次退出时仍在执行的导出记录标记为failed，需在定时任务开启前执行，避免误标本次启动后的导出，
+//  多实例部署时其他实例执行中的记录不受影响
+//  @receiver d
+//  @return error
+//
+func (d *dao) exportRunInit() error {
+	now := time.Now()
+	result := d.DB.orm().Table(exportRunTable).Where("status = ? and instance = ?", RunRunning, runInstance).
+		Updates(map[string]interface{}{"status": RunFailed, "end_time": now, "error": "interrupted by restart"})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Log.Warn("mark running export runs as failed", zap.Int64("runs", result.RowsAffected))
+	}
+	return nil
+}
+
+//
+//  startRun
+//  @Description: 写入执行中的记录，写入失败时仍返回记录用于统计，只是不会更新到库中
+//  @receiver d
+//  @param param
+//  @param trigger
+//  @return *exportRun
+//
+func (d *dao) startRun(param pg.QueryParam, trigger string) *exportRun {
+	now := time.Now()
+	run := &exportRun{
+		rec: orm.ExportRun{
+			SchemaName: param.SchemaName,
+			TableName:  param.TableName,
+			Trigger:    trigger,
+			Operator:   param.Operator,
+			Instance:   runInstance,
+			ProcType:   metrics.GetExportType(param.ProcType),
+			StartDate:  param.StartDate,
+			EndDate:    param.EndDate,
+			Codes:      param.CodeList,
+			StartTime:  now,
+			Status:     RunRunning,
+		},
+		mark: now,
+	}
+	if err := d.DB.orm().Table(exportRunTable).Create(&run.rec).Error; err != nil {
+		log.Log.Error(fmt.Sprintf("write export run failed: %s", err.Error()),
+			zap.String("schema", param.SchemaName),
+			zap.String("table", param.TableName))
+	}
+	return run
+}
+
+func (r *exportRun) startTime() time.Time {
+	return r.rec.StartTime
+}
+
+// stageDone 记录阶段耗时并上报阶段指标
+func (r *exportRun) stageDone(stage string) {
+	now := time.Now()
+	cost := now.Sub(r.mark).Milliseconds()
+	r.mark = now
+	switch stage {
+	case metrics.StageExtract:
+		r.rec.ExtractMs = cost
+	case metrics.StageTransform:
+		r.rec.TransformMs = cost
+	case metrics.StageLoad:
+		r.rec.LoadMs = cost
+	}
+	metrics.PerfBucketMetricsObserve(r.rec.SchemaName, r.rec.TableName, r.rec.Trigger, stage, r.rec.ProcType, float64(cost))
+}
+
+//
+//  finishRun
+//  @Description: 更新执行结果，stat为nil时表示未读取到数据
+//  @receiver d
+//  @param run
+//  @param stat
+//  @param err
+//
+func (d *dao) finishRun(run *exportRun, stat *exportStat, err error) {
+	end := time.Now()
+	run.rec.EndTime = &end
+	run.rec.CostMs = end.Sub(run.rec.StartTime).Milliseconds()
+	run.rec.Status = RunSuccess
+	if err != nil {
+		run.rec.Status = RunFailed
+		run.rec.Error = err.Error()
+	}
+	if stat != nil {
+		run.rec.RowsRead = stat.rows + int64(stat.skipped)
+		run.rec.RowsWritten = stat.written
+		run.rec.RowsSkipped = int64(stat.skipped)
+	}
+	if run.rec.RunId == 0 {
+		return
+	}
+	if dbErr := d.DB.orm().Table(exportRunTable).Save(&run.rec).Error; dbErr != nil {
+		log.Log.Error(fmt.Sprintf("update export run failed: %s", dbErr.Error()),
+			zap.Int64("run", run.rec.RunId),
+			zap.String("schema", run.rec.SchemaName),
+			zap.String("table", run.rec.TableName))
+	}
+}
+
+func toExportRun(v orm.ExportRun) ExportRun {
+	return ExportRun{
+		Id:          v.RunId,
+		Schema:      v.SchemaName,
+		Table:       v.TableName,
+		Trigger:     v.Trigger,
+		Operator:    v.Operator,
+		Instance:    v.Instance,
+		ProcType:    v.ProcType,
+		StartDate:   v.StartDate,
+		EndDate:     v.EndDate,
+		Codes:       v.Codes,
+		StartTime:   v.StartTime,
+		EndTime:     v.EndTime,
+		Status:      v.Status,
+		RowsRead:    v.RowsRead,
+		RowsWritten: v.RowsWritten,
+		RowsSkipped: v.RowsSkipped,
+		ExtractMs:   v.ExtractMs,
+		TransformMs: v.TransformMs,
+		LoadMs:      v.LoadMs,
+		CostMs:      v.CostMs,
+		Error:       v.Error,
+	}
+}
+
+//
+//  ExportRuns
+//  @Description: 分页查询导出执行记录
+//  @receiver d
+//  @param q
+//  @return *RunPage
+//  @return error
+//
+func (d *dao) ExportRuns(q RunQuery) (*RunPage, error) {
+	db := d.DB.orm().Table(exportRunTable)
+	if q.SchemaName != "" {
+		db = db.Where("schema_name = ?", q.SchemaName)
+	}
+	if q.TableName != "" {
+		db = db.Where("table_name = ?", q.TableName)
+	}
+	if q.ProcType != "" {
+		db = db.Where("proc_type = ?", q.ProcType)
+	}
+	if q.Status != "" {
+		db = db.Where("status = ?", q.Status)
+	}
+	if q.Page <= 0 {
+		q.Page = 1
+	}
+	if q.PageSize <= 0 {
+		q.PageSize = runDefaultPageSize
+	} else if q.PageSize > runMaxPageSize {
+		q.PageSize = runMaxPageSize
+	}
+	page := &RunPage{Page: q.Page, PageSize: q.PageSize, Runs: make([]ExportRun, 0)}
+	if err := db.Count(&page.Total).Error; err != nil {
+		return nil, err
+	}
+	var result []orm.ExportRun
+	err := db.Order("start_time desc, id desc").Limit(q.PageSize).Offset((q.Page - 1) * q.PageSize).Find(&result).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range result {
+		page.Runs = append(page.Runs, toExportRun(v))
+	}
+	return page, nil
+}
+
+// lastRun 最近一次执行记录，status为空时不过滤状态，没有记录时返回nil
+func (d *dao) lastRun(schemaName string, tableName string, procType string, status string) (*ExportRun, error) {
+	db := d.DB.orm().Table(exportRunTable).Where("schema_name = ? and table_name = ?", schemaName, tableName)
+	if procType != "" {
+		db = db.Where("proc_type = ?", procType)
+	}
+	if status != "" {
+		db = db.Where("status = ?", status)
+	}
+	var result []orm.ExportRun
+	if err := db.Order("start_time desc, id desc").Limit(1).Find(&result).Error; err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	run := toExportRun(result[0])
+	return &run, nil
+}
+
+//
+//  Freshness
+//  @Description: 表的最近一次成功导出距今是否在maxAge内
+//  @receiver d
+//  @param schemaName
+//  @param tableName
+//  @param procType 导出方式名称，如rtime，为空时为任意导出方式
+//  @param maxAge 为0时使用DefaultFreshAge
+//  @return *Freshness
+//  @return error
+//
+func (d *dao) Freshness(schemaName string, tableName string, procType string, maxAge time.Duration) (*Freshness, error) {
+	if _, ok := d.DB.gTableInfo[schemaName][tableName]; !ok {
+		return nil, ErrTableNotFound
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultFreshAge
+	}
+	f := &Freshness{Schema: schemaName, Table: tableName, ProcType: procType, AgeSeconds: -1,
+		MaxAgeSeconds: int64(maxAge.Seconds())}
+	last, err := d.lastRun(schemaName, tableName, procType, "")
+	if err != nil {
+		return nil, err
+	}
+	f.LastRun = last
+	success := last
+	if last != nil && last.Status != RunSuccess {
+		if success, err = d.lastRun(schemaName, tableName, procType, RunSuccess); err != nil {
+			return nil, err
+		}
+	}
+	if success != nil && success.EndTime != nil {
+		age := time.Since(*success.EndTime)
+		f.LastSuccess = success.EndTime
+		f.AgeSeconds = int64(age.Seconds())
+		f.Fresh = age <= maxAge
+	}
+	return f, nil
+}
@@ -0,0 +1,270 @@
+package dao
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hxextract/app/config"
+	"hxextract/app/cron"
+	"hxextract/app/dao/orm"
+	"hxextract/app/dao/pg"
+	"hxextract/app/event"
+	"hxextract/app/log"
+	"hxextract/app/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 新鲜度sla类型
+const (
+	SlaExport = "export" // 距最近一次成功导出的时间
+	SlaData   = "data"   // mysql最新数据时间与pg（或当前时间）的差
+)
+
+const (
+	freshnessTask        = "freshness"
+	freshnessSlaTable    = "FreshnessSla"
+	defaultCheckInterval = time.Minute
+	defaultTimeColumn    = "rtime"
+)
+
+type (
+	// FreshnessSla 表新鲜度sla
+	FreshnessSla struct {
+		id         int
+		schemaName string
+		tableName  string
+		kind       string
+		procType   string
+		maxAge     time.Duration
+		timeColumn string
+		pgSql      string
+	}
+
+	// SlaStatus sla最近一次检查结果
+	SlaStatus struct {
+		SlaId     int       `json:"id"`
+		Schema    string    `json:"schema"`
+		Table     string    `json:"table"`
+		Kind      string    `json:"kind"`
+		ProcType  string    `json:"proc_type,omitempty"`
+		MaxAge    int64     `json:"max_age_seconds"`
+		Staleness int64     `json:"staleness_seconds"` // 从未导出或mysql无数据时为-1
+		Breached  bool      `json:"breached"`
+		CheckedAt time.Time `json:"checked_at"`
+		Error     string    `json:"error,omitempty"`
+	}
+
+	// freshnessSlas 新鲜度sla及检查结果
+	freshnessSlas struct {
+		sync.RWMutex
+		items   []FreshnessSla
+		status  map[int]*SlaStatus
+		running int32 // 检查耗时超过间隔时跳过下一次检查
+	}
+)
+
+//
+//  freshnessInit
+//  @Description: 加载新鲜度sla并按Freshness.Interval定时检查，需在定时任务初始化后调用
+//  @receiver d
+//  @return error
+//
+func (d *dao) freshnessInit() error {
+	if err := d.freshnessSlaLoad(); err != nil {
+		return err
+	}
+	interval := config.GetFreshness().Interval
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+	return cron.AddTask(freshnessTask, fmt.Sprintf("@every %s", interval), d.checkFreshness)
+}
+
+// freshnessSlaLoad 加载新鲜度sla，max_age或kind配置有误的sla不加载
+func (d *dao) freshnessSlaLoad() error {
+	log.Log.Info("init freshness slas")
+	var result []orm.FreshnessSla
+	if err := d.DB.orm().Table(freshnessSlaTable).Where("enabled = ?", true).Find(&result).Error; err != nil {
+		return err
+	}
+	items := make([]FreshnessSla, 0, len(result))
+	status := make(map[int]*SlaStatus)
+	for _, v := range result {
+		sla, err := newFreshnessSla(v)
+		if err != nil {
+			log.Log.Warn(fmt.Sprintf("skip freshness sla: %s", err.Error()), zap.Int("sla", v.SlaId))
+			continue
+		}
+		d.DB.allowSchema(sla.schemaName)
+		items = append(items, sla)
+		status[sla.id] = &SlaStatus{SlaId: sla.id, Schema: sla.schemaName, Table: sla.tableName, Kind: sla.kind,
+			ProcType: sla.procType, MaxAge: int64(sla.maxAge.Seconds())}
+	}
+	d.slas.Lock()
+	d.slas.items = items
+	d.slas.status = status
+	d.slas.Unlock()
+	log.Log.Info("freshness slas load finished", zap.Int("slas", len(items)))
+	return nil
+}
+
+func newFreshnessSla(v orm.FreshnessSla) (FreshnessSla, error) {
+	sla := FreshnessSla{
+		id:         v.SlaId,
+		schemaName: v.SchemaName,
+		tableName:  v.TableName,
+		kind:       v.Kind,
+		procType:   v.ProcType,
+		timeColumn: v.TimeColumn,
+		pgSql:      v.PgSql,
+	}
+	if sla.kind != SlaExport && sla.kind != SlaData {
+		return sla, errors.New(fmt.Sprintf("invalid kind: %s", v.Kind))
+	}
+	maxAge, err := time.ParseDuration(v.MaxAge)
+	if err != nil || maxAge <= 0 {
+		return sla, errors.New(fmt.Sprintf("invalid max_age: %s", v.MaxAge))
+	}
+	sla.maxAge = maxAge
+	if sla.timeColumn == "" {
+		sla.timeColumn = defaultTimeColumn
+	}
+	return sla, nil
+}
+
+// checkFreshness 检查所有sla，更新指标，超出或恢复时发布事件
+func (d *dao) checkFreshness() {
+	if !atomic.CompareAndSwapInt32(&d.slas.running, 0, 1) {
+		log.Log.Warn("last freshness check is still running, skip")
+		return
+	}
+	defer atomic.StoreInt32(&d.slas.running, 0)
+	d.slas.RLock()
+	items := d.slas.items
+	d.slas.RUnlock()
+	for _, sla := range items {
+		staleness, err := d.staleness(sla)
+		// 无法确认新鲜度时视为超出sla
+		breached := err != nil || staleness < 0 || staleness > sla.maxAge
+		seconds := int64(-1)
+		if staleness >= 0 {
+			seconds = int64(staleness.Seconds())
+		}
+		metrics.StalenessSet(sla.schemaName, sla.tableName, sla.kind, float64(seconds), breached)
+		d.slas.Lock()
+		s := d.slas.status[sla.id]
+		changed := s.Breached != breached
+		s.Staleness, s.Breached, s.CheckedAt, s.Error = seconds, breached, time.Now(), ""
+		if err != nil {
+			s.Error = err.Error()
+		}
+		d.slas.Unlock()
+		if breached {
+			log.Log.Warn("table breaches freshness sla", zap.Int("sla", sla.id), zap.String("schema", sla.schemaName),
+				zap.String("table", sla.tableName), zap.String("kind", sla.kind), zap.Int64("staleness", seconds))
+		}
+		if changed {
+			publishFreshness(sla, seconds, breached, err)
+		}
+	}
+}
+
+// staleness 表数据陈旧的时间，从未导出或mysql无数据时返回-1
+func (d *dao) staleness(sla FreshnessSla) (time.Duration, error) {
+	if sla.kind == SlaExport {
+		f, err := d.Freshness(sla.schemaName, sla.tableName, sla.procType, sla.maxAge)
+		if err != nil || f.LastSuccess == nil {
+			return -1, err
+		}
+		return time.Since(*f.LastSuccess), nil
+	}
+	latest, err := d.mysqlLatest(sla)
+	if err != nil || !latest.Valid {
+		return -1, err
+	}
+	reference := float64(time.Now().Unix())
+	if sla.pgSql != "" {
+		pgLatest, err := d.pgLatest(sla)
+		if err != nil {
+			return -1, err
+		}
+		if !pgLatest.Valid {
+			return 0, nil
+		}
+		reference = pgLatest.Float64
+	}
+	if reference <= latest.Float64 {
+		return 0, nil
+	}
+	return time.Duration((reference - latest.Float64) * float64(time.Second)), nil
+}
+
+// mysqlLatest mysql表最新数据的unix时间
+func (d *dao) mysqlLatest(sla FreshnessSla) (latest sql.NullFloat64, err error) {
+	db, release, err := d.DB.getConn(sla.schemaName)
+	if err != nil {
+		return latest, err
+	}
+	defer release()
+	sqlQuery := fmt.Sprintf("select unix_timestamp(max(`%s`)) from `%s`", sla.timeColumn, sla.tableName)
+	ctx, cancel := queryContext()
+	defer cancel()
+	err = db.QueryRowContext(ctx, sqlQuery).Scan(&latest)
+	return latest, err
+}
+
+// pgLatest 按sla配置的sql获取pg最新数据的unix时间
+func (d *dao) pgLatest(sla FreshnessSla) (latest sql.NullFloat64, err error) {
+	table, ok := d.DB.gTableInfo[sla.schemaName][sla.tableName]
+	if !ok {
+		return latest, ErrTableNotFound
+	}
+	rows, err := pgDao.GetRows(pg.QueryParam{DsnInfo: table.dsnInfo, ProcSql: sla.pgSql, SqlType: pg.SqlNormal})
+	if err != nil {
+		return latest, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		err = rows.Scan(&latest)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	return latest, err
+}
+
+// publishFreshness 发布超出或恢复sla的事件
+func publishFreshness(sla FreshnessSla, staleness int64, breached bool, err error) {
+	e := event.Event{
+		Type:      event.TypeFreshness,
+		Schema:    sla.schemaName,
+		Table:     sla.tableName,
+		ProcType:  sla.procType,
+		Trigger:   freshnessTask,
+		Sla:       sla.kind,
+		Staleness: staleness,
+		Status:    event.StatusRecovered,
+	}
+	if breached {
+		e.Status = event.StatusBreached
+		e.Error = fmt.Sprintf("staleness %ds exceeds max age %ds", staleness, int64(sla.maxAge.Seconds()))
+		if err != nil {
+			e.Error = err.Error()
+		}
+	}
+	event.Publish(e)
+}
+
+// SlaStatuses 所有sla最近一次检查结果
+func (d *dao) SlaStatuses() []SlaStatus {
+	d.slas.RLock()
+	defer d.slas.RUnlock()
+	ret := make([]SlaStatus, 0, len(d.slas.items))
+	for _, sla := range d.slas.items {
+		ret = append(ret, *d.slas.status[sla.id])
+	}
+	return ret
+}
@@ -0,0 +1,311 @@
+package dao
+
+/*
+purpose:表分组：按schema、标签或财务文件列表定义，分组配置在topview.TableGroup中，
+导出和对比可按分组限制并发执行并汇总各表结果，定时任务可导出整个分组
+*/
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hxextract/app/config"
+	"hxextract/app/dao/orm"
+	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	"hxextract/app/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tableGroupTable = "TableGroup"
+	// 无需配置的分组：schema:<schema>为该schema下所有的表，tag:<tag>为有该标签的所有表
+	groupSchemaPrefix = "schema:"
+	groupTagPrefix    = "tag:"
+)
+
+// ErrGroupNotFound 分组不存在或不包含任何表
+var ErrGroupNotFound = errors.New("cant find group")
+
+type (
+	// TableGroup 表分组，Members为当前包含的财务文件名称
+	TableGroup struct {
+		Name     string   `json:"name"`
+		Schema   string   `json:"schema,omitempty"`
+		Tag      string   `json:"tag,omitempty"`
+		FinNames []string `json:"finnames,omitempty"`
+		Members  []string `json:"members"`
+	}
+
+	// GroupTableResult 分组中单个表的执行结果，对比时包含删除和补全的行数
+	GroupTableResult struct {
+		FinName string `json:"finname"`
+		Schema  string `json:"schema"`
+		Table   string `json:"table"`
+		Status  string `json:"status"` // success/failed
+		Deletes int    `json:"deletes,omitempty"`
+		Inserts int    `json:"inserts,omitempty"`
+		CostMs  int64  `json:"cost_ms"`
+		Error   string `json:"error,omitempty"`
+	}
+
+	// GroupResult 分组执行结果汇总，Tables按财务文件名称排序
+	GroupResult struct {
+		Group     string             `json:"group"`
+		Total     int                `json:"total"`
+		Succeeded int                `json:"succeeded"`
+		Failed    int                `json:"failed"`
+		CostMs    int64              `json:"cost_ms"`
+		Tables    []GroupTableResult `json:"tables"`
+	}
+
+	// tableGroups 已配置的分组，key为分组名称
+	tableGroups struct {
+		sync.RWMutex
+		items map[string]TableGroup
+	}
+)
+
+// tableGroupLoad 加载表分组，名称为空、重复或含':'以及没有任何条件的分组不加载，需在表信息加载后调用
+func (d *dao) tableGroupLoad() error {
+	log.Log.Info("init table groups")
+	var result []orm.TableGroup
+	if err := d.DB.orm().Table(tableGroupTable).Find(&result).Error; err != nil {
+		return err
+	}
+	items := make(map[string]TableGroup, len(result))
+	for _, v := range result {
+		g := TableGroup{
+			Name:     strings.TrimSpace(v.Name),
+			Schema:   strings.TrimSpace(v.SchemaName),
+			Tag:      strings.TrimSpace(v.Tag),
+			FinNames: splitColumns(v.FinNames),
+		}
+		if _, ok := items[g.Name]; ok || g.Name == "" || strings.Contains(g.Name, ":") {
+			log.Log.Warn(fmt.Sprintf("skip table group with invalid or duplicate name: %q", g.Name), zap.Int("group", v.GroupId))
+			continue
+		}
+		if g.Schema == "" && g.Tag == "" && len(g.FinNames) == 0 {
+			log.Log.Warn("skip empty table group", zap.String("group", g.Name))
+			continue
+		}
+		for _, finName := range g.FinNames {
+			if _, ok := d.DB.financeInfo[finName]; !ok {
+				log.Log.Warn(fmt.Sprintf("unknown finname in table group: %s", finName), zap.String("group", g.Name))
+			}
+		}
+		items[g.Name] = g
+	}
+	d.groups.Lock()
+	d.groups.items = items
+	d.groups.Unlock()
+	log.Log.Info("table groups load finished", zap.Int("groups", len(items)))
+	return nil
+}
+
+//
+//  Groups
+//  @Description: 已配置的表分组及当前包含的表，按名称排序
+//  @receiver d
+//  @return []TableGroup
+//
+func (d *dao) Groups() []TableGroup {
+	d.groups.RLock()
+	ret := make([]TableGroup, 0, len(d.groups.items))
+	for _, g := range d.groups.items {
+		ret = append(ret, g)
+	}
+	d.groups.RUnlock()
+	for i := range ret {
+		ret[i].Members = make([]string, 0)
+		for _, table := range ret[i].tables(d.DB.financeInfo) {
+			ret[i].Members = append(ret[i].Members, table.finName)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+//
+//  groupTables
+//  @Description: 分组当前包含的表，除配置的分组外还可以使用schema:<schema>和tag:<tag>
+//  @receiver d
+//  @param name
+//  @return []TableInfo 按财务文件名称排序
+//  @return error 分组不存在或不包含任何表时为ErrGroupNotFound
+//
+func (d *dao) groupTables(name string) ([]TableInfo, error) {
+	var g TableGroup
+	switch {
+	case strings.HasPrefix(name, groupSchemaPrefix):
+		g = TableGroup{Name: name, Schema: strings.TrimPrefix(name, groupSchemaPrefix)}
+	case strings.HasPrefix(name, groupTagPrefix):
+		g = TableGroup{Name: name, Tag: strings.TrimPrefix(name, groupTagPrefix)}
+	default:
+		d.groups.RLock()
+		v, ok := d.groups.items[name]
+		d.groups.RUnlock()
+		if !ok {
+			return nil, errors.Wrap(ErrGroupNotFound, name)
+		}
+		g = v
+	}
+	tables := g.tables(d.DB.financeInfo)
+	if len(tables) == 0 {
+		return nil, errors.Wrapf(ErrGroupNotFound, "no table in group %s", name)
+	}
+	return tables, nil
+}
+
+// tables fin_names中的表，以及同时满足schema和tag条件的表
+func (g TableGroup) tables(info FinnameInfo) []TableInfo {
+	listed := make(map[string]bool, len(g.FinNames))
+	for _, finName := range g.FinNames {
+		listed[finName] = true
+	}
+	var ret []TableInfo
+	for finName, table := range info {
+		if listed[finName] || g.match(table) {
+			ret = append(ret, table)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].finName < ret[j].finName
+	})
+	return ret
+}
+
+func (g TableGroup) match(table TableInfo) bool {
+	if g.Schema == "" && g.Tag == "" {
+		return false
+	}
+	if g.Schema != "" && table.schemaName != g.Schema {
+		return false
+	}
+	if g.Tag == "" {
+		return true
+	}
+	for _, tag := range table.tags {
+		if tag == g.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+//
+//  ExportGroup
+//  @Description: 导出分组中所有的表，单个表失败不影响其他表
+//  @receiver d
+//  @param group
+//  @param param 导出参数，表信息按分组中的表填充
+//  @param parallelism 同时导出的表数，为0时使用Group.Parallelism
+//  @return *GroupResult
+//  @return error 分组不存在或导出方式有误时返回错误，各表的错误见GroupResult
+//
+func (d *dao) ExportGroup(group string, param pg.QueryParam, parallelism int) (*GroupResult, error) {
+	if err := param.CheckType(); err != nil {
+		return nil, err
+	}
+	return d.eachGroupTable(group, parallelism, func(table TableInfo, r *GroupTableResult) error {
+		p := param
+		p.FinName, p.SchemaName, p.TableName = table.finName, table.schemaName, table.tableName
+		return d.ExportPgData(p)
+	})
+}
+
+//
+//  CompareGroup
+//  @Description: 对比分组中所有的表，单个表失败不影响其他表
+//  @receiver d
+//  @param group
+//  @param operation 详见：CmpAnd*
+//  @param operator
+//  @param parallelism 同时对比的表数，为0时使用Group.Parallelism
+//  @return *GroupResult
+//  @return error 分组不存在时返回错误，各表的错误见GroupResult
+//
+func (d *dao) CompareGroup(group string, operation int, operator string, parallelism int) (*GroupResult, error) {
+	return d.compareGroup(group, operation, metrics.GetTriggerType(pg.TrigManual), operator, parallelism)
+}
+
+func (d *dao) compareGroup(group string, operation int, trigger string, operator string, parallelism int) (*GroupResult, error) {
+	return d.eachGroupTable(group, parallelism, func(table TableInfo, r *GroupTableResult) error {
+		var err error
+		r.Deletes, r.Inserts, err = d.CompareAndUpdateMysql(table.schemaName, table.tableName, operation, trigger, operator)
+		return err
+	})
+}
+
+// eachGroupTable 最多parallelism个表同时执行fn，汇总各表的结果
+func (d *dao) eachGroupTable(group string, parallelism int, fn func(table TableInfo, r *GroupTableResult) error) (*GroupResult, error) {
+	tables, err := d.groupTables(group)
+	if err != nil {
+		return nil, err
+	}
+	startTime := time.Now()
+	res := &GroupResult{Group: group, Total: len(tables), Tables: make([]GroupTableResult, len(tables))}
+	sem := make(chan struct{}, groupParallelism(parallelism))
+	var wg sync.WaitGroup
+	for i, table := range tables {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r *GroupTableResult, table TableInfo) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			begin := time.Now()
+			r.FinName, r.Schema, r.Table = table.finName, table.schemaName, table.tableName
+			r.Status = RunSuccess
+			if err := fn(table, r); err != nil {
+				r.Status, r.Error = RunFailed, err.Error()
+			}
+			r.CostMs = time.Since(begin).Milliseconds()
+		}(&res.Tables[i], table)
+	}
+	wg.Wait()
+	for _, r := range res.Tables {
+		if r.Status == RunSuccess {
+			res.Succeeded++
+		} else {
+			res.Failed++
+		}
+	}
+	res.CostMs = time.Since(startTime).Milliseconds()
+	log.Log.Info("table group finished", zap.String("group", group), zap.Int("tables", res.Total),
+		zap.Int("failed", res.Failed), zap.Int64("cost_ms", res.CostMs))
+	return res, nil
+}
+
+// groupParallelism 为0时使用Group.Parallelism，超出Group.MaxParallelism时按MaxParallelism执行
+func groupParallelism(parallelism int) int {
+	cfg := config.GetGroup()
+	if parallelism <= 0 {
+		parallelism = cfg.Parallelism
+	}
+	if parallelism > cfg.MaxParallelism {
+		parallelism = cfg.MaxParallelism
+	}
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	return parallelism
+}
+
+// Err 有表失败时返回失败的表及原因
+func (r *GroupResult) Err() error {
+	if r.Failed == 0 {
+		return nil
+	}
+	var msgs []string
+	for _, t := range r.Tables {
+		if t.Status == RunFailed {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", t.FinName, t.Error))
+		}
+	}
+	return errors.New(fmt.Sprintf("%d of %d tables failed: %s", r.Failed, r.Total, strings.Join(msgs, "; ")))
+}
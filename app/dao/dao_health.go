@@ -0,0 +1,182 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hxextract/app/config"
+	"hxextract/app/cron"
+	"hxextract/app/dao/conn"
+	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	"sync"
+	"time"
+)
+
+// 依赖检查状态
+const (
+	CheckUp   = "up"
+	CheckDown = "down"
+)
+
+const (
+	defaultReadyTimeout  = 2 * time.Second
+	defaultReadyCacheTTL = 5 * time.Second
+	connectionTask       = "connections"
+)
+
+type (
+	// Check 单个依赖的检查结果
+	Check struct {
+		Name      string `json:"name"` // mysql为库名，pg为隐藏密码后的dsn
+		Kind      string `json:"kind"` // mysql、pg、cron
+		Status    string `json:"status"`
+		Error     string `json:"error,omitempty"`
+		LatencyMs int64  `json:"latency_ms"`
+	}
+
+	// Readiness 就绪检查结果，所有依赖都可用时Ready为true
+	Readiness struct {
+		Ready     bool      `json:"ready"`
+		Checks    []Check   `json:"checks"`
+		CheckedAt time.Time `json:"checked_at"`
+	}
+
+	// readinessCache 缓存最近一次检查结果，检查期间的请求等待同一次检查
+	readinessCache struct {
+		sync.Mutex
+		last    *Readiness
+		expires time.Time
+	}
+
+	// dependency 待检查的依赖
+	dependency struct {
+		name  string
+		kind  string
+		check func(ctx context.Context) error
+	}
+)
+
+//
+//  Readiness
+//  @Description: 检查mysql、pg和定时任务，结果缓存Service.ReadyCacheTTL，每项检查超时为Service.ReadyTimeout
+//  @receiver d
+//  @return *Readiness
+//
+func (d *dao) Readiness() *Readiness {
+	cfg := config.GetService()
+	ttl := cfg.ReadyCacheTTL
+	if ttl <= 0 {
+		ttl = defaultReadyCacheTTL
+	}
+	d.ready.Lock()
+	defer d.ready.Unlock()
+	if d.ready.last != nil && time.Now().Before(d.ready.expires) {
+		return d.ready.last
+	}
+	d.ready.last = checkDependencies(d.dependencies(), cfg.ReadyTimeout)
+	d.ready.expires = time.Now().Add(ttl)
+	return d.ready.last
+}
+
+//
+//  connectionInit
+//  @Description: 按Connection.CheckInterval定时检查已建立的连接，断开的重连，空闲的回收，需在定时任务初始化后调用
+//  @receiver d
+//  @return error
+//
+func (d *dao) connectionInit() error {
+	interval := config.GetConnection().CheckInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return cron.AddTask(connectionTask, fmt.Sprintf("@every %s", interval), func() {
+		_ = d.HealthCheck()
+	})
+}
+
+// Connections mysql各库和pg各dsn的连接状态
+func (d *dao) Connections() []conn.Info {
+	return append(d.DB.mysql.Infos(), pgDao.Connections()...)
+}
+
+// dependencies 默认库、MysqlDbs中的各库、已建立连接的pg及定时任务
+func (d *dao) dependencies() []dependency {
+	deps := []dependency{{name: d.DB.defaultSchema, kind: "mysql", check: func(ctx context.Context) error {
+		db, err := d.DB.defaultDb()
+		if err != nil {
+			return err
+		}
+		return db.PingContext(ctx)
+	}}}
+	for schemaName, db := range d.DB.mysqlDbs() {
+		if schemaName == d.DB.defaultSchema {
+			continue
+		}
+		deps = append(deps, dependency{name: schemaName, kind: "mysql", check: pingMysql(db)})
+	}
+	for _, dsn := range pgDao.Dsns() {
+		dsn := dsn
+		deps = append(deps, dependency{name: pg.RedactDsn(dsn), kind: "pg", check: func(ctx context.Context) error {
+			return pgDao.Ping(ctx, dsn)
+		}})
+	}
+	deps = append(deps, dependency{name: "scheduler", kind: "cron", check: func(ctx context.Context) error {
+		if !cron.Running() {
+			return errors.New("cron scheduler is not running")
+		}
+		return nil
+	}})
+	return deps
+}
+
+func pingMysql(db *sql.DB) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if db == nil {
+			return errors.New("mysql connection not initialized")
+		}
+		return db.PingContext(ctx)
+	}
+}
+
+// checkDependencies 并发检查所有依赖，超时的检查视为不可用
+func checkDependencies(deps []dependency, timeout time.Duration) *Readiness {
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+	ret := &Readiness{Ready: true, Checks: make([]Check, len(deps)), CheckedAt: time.Now()}
+	var wg sync.WaitGroup
+	for i, dep := range deps {
+		wg.Add(1)
+		go func(i int, dep dependency) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			errCh := make(chan error, 1)
+			go func() { errCh <- dep.check(ctx) }()
+			var err error
+			select {
+			case err = <-errCh:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			ret.Checks[i] = Check{Name: dep.name, Kind: dep.kind, Status: CheckUp,
+				LatencyMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				ret.Checks[i].Status, ret.Checks[i].Error = CheckDown, err.Error()
+			}
+		}(i, dep)
+	}
+	wg.Wait()
+	for _, c := range ret.Checks {
+		if c.Status == CheckDown {
+			ret.Ready = false
+			log.Log.Warn("dependency is unavailable", zap.String("kind", c.Kind),
+				zap.String("name", c.Name), zap.String("err", c.Error))
+		}
+	}
+	return ret
+}
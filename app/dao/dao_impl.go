@@ -7,11 +7,12 @@ import (
 	"gorm.io/gorm"
 	"hxextract/app/dao/orm"
 	"hxextract/app/log"
+	"time"
 )
 
 // 导入
 func (d *dao) executeImportSql(db *sql.DB, sqlBytes *bytes.Buffer) error {
-	_, err := db.Exec(sqlBytes.String())
+	_, err := execWithTimeout(db, sqlBytes.String())
 	return err
 }
 
@@ -36,7 +37,7 @@ func (d *dao) executeSqls(db *sql.DB, sqlList []*bytes.Buffer, rCh chan sql.Resu
 	for _, sqlBytes := range sqlList {
 		sqlStr := sqlBytes.String()
 		go func() {
-			res, err := db.Exec(sqlStr)
+			res, err := execWithTimeout(db, sqlStr)
 			if err != nil {
 				log.Log.Error(err.Error())
 				eCh <- err
@@ -74,19 +75,36 @@ func (d *dao) DataUpdate(schemaName string, tableName string, dataRows []interfa
  * @param tableName
  * @param finKey
  * @param flg
+ * @param operator 发起方，写入审计记录
  */
-func (d *dao) DataChangeValid(schemaName string, tableName string, finKey orm.FinPrimaryKey, flg bool) {
+func (d *dao) DataChangeValid(schemaName string, tableName string, finKey orm.FinPrimaryKey, flg bool, operator string) {
 	isvalid := 0
 	if flg {
 		isvalid = 1
 	}
-	db, err := d.DB.getConn(schemaName)
+	rec := orm.AuditLog{
+		OpTime:     time.Now(),
+		Operation:  AuditChangeValid,
+		SchemaName: schemaName,
+		TableName:  tableName,
+		Operator:   operator,
+		Params:     toJson(map[string]int{"isvalid": isvalid}),
+		Keys:       toJson(auditKeys{Columns: finKey.Columns, Values: [][]string{finKey.Values}}),
+	}
+	db, release, err := d.DB.getConn(schemaName)
 	if err != nil {
-		// TODO
+		d.audit(rec, err)
+		return
+	}
+	defer release()
+	cond, args := keyCondition([]orm.FinPrimaryKey{finKey})
+	sqlQuery := fmt.Sprintf("UPDATE `%s` set `isvalid` = %d where %s;", tableName, isvalid, cond)
+	result, err := execWithTimeout(db, sqlQuery, args...)
+	if err == nil {
+		rec.Affected, _ = result.RowsAffected()
 	}
-	sqlQuery := fmt.Sprintf("UPDATE table %s set `isvalid` = %d  where code = '%s' and datetime = %d;",
-		tableName, isvalid, finKey.Code, finKey.Datetime)
-	db.Exec(sqlQuery)
+	rec.CostMs = time.Since(rec.OpTime).Milliseconds()
+	d.audit(rec, err)
 }
 
 /*DataDelete
@@ -94,13 +112,29 @@ func (d *dao) DataChangeValid(schemaName string, tableName string, finKey orm.Fi
  * @param schemaName
  * @param tableName
  * @param finKey
+ * @param operator 发起方，写入审计记录
  */
-func (d *dao) DataDelete(schemaName string, tableName string, finKey orm.FinPrimaryKey) {
-	db, err := d.DB.getConn(schemaName)
+func (d *dao) DataDelete(schemaName string, tableName string, finKey orm.FinPrimaryKey, operator string) {
+	rec := orm.AuditLog{
+		OpTime:     time.Now(),
+		Operation:  AuditDelete,
+		SchemaName: schemaName,
+		TableName:  tableName,
+		Operator:   operator,
+		Keys:       toJson(auditKeys{Columns: finKey.Columns, Values: [][]string{finKey.Values}}),
+	}
+	db, release, err := d.DB.getConn(schemaName)
 	if err != nil {
-		// TODO
+		d.audit(rec, err)
+		return
+	}
+	defer release()
+	cond, args := keyCondition([]orm.FinPrimaryKey{finKey})
+	sqlQuery := fmt.Sprintf("DELETE from `%s` where %s;", tableName, cond)
+	result, err := execWithTimeout(db, sqlQuery, args...)
+	if err == nil {
+		rec.Affected, _ = result.RowsAffected()
 	}
-	sqlQuery := fmt.Sprintf("DELETE from %s where zqdm = '%s' and bbrq = %d;",
-		tableName, finKey.Code, finKey.Datetime)
-	db.Exec(sqlQuery)
+	rec.CostMs = time.Since(rec.OpTime).Milliseconds()
+	d.audit(rec, err)
 }
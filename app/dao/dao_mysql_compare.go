@@ -1,14 +1,15 @@
 package dao
 
 import (
-	"bytes"
+	"database/sql"
 	"errors"
 	"fmt"
 	"go.uber.org/zap"
+	"hxextract/app/dao/compare"
+	"hxextract/app/dao/orm"
 	"hxextract/app/dao/pg"
 	"hxextract/app/log"
-	"strconv"
-	"strings"
+	"time"
 )
 
 const (
@@ -17,105 +18,248 @@ const (
 )
 
 // 需要重点考虑请求pg与mysql超时、写mysql对比表超时，可能发生的删除不该删除数据的场景
-func (d *dao) CompareAndUpdateMysql(schemaName string, tableName string, operation int) (int, int, error) {
-	err := d.CreateCompareTable(schemaName, tableName)
+// operator为发起方，删除和补全分别写入审计记录
+func (d *dao) CompareAndUpdateMysql(schemaName string, tableName string, operation int, trigger string,
+	operator string) (int, int, error) {
+	startTime := time.Now()
+	repair := &compareRepair{
+		schemaName: schemaName,
+		tableName:  tableName,
+		operation:  operation,
+		delete: func(keys []orm.FinPrimaryKey) (int, error) {
+			return d.DeleteMysqlRecord(schemaName, tableName, keys)
+		},
+		insert: func(keys []orm.FinPrimaryKey) (int64, error) {
+			return d.InsertMysqlRecordFromCompare(schemaName, tableName, keys)
+		},
+	}
+	err := repair.result(d.compareWithPg(schemaName, tableName, repair.onDelete, repair.onInsert))
+	publishCompare(schemaName, tableName, trigger, repair.deleteRows, repair.insertRows, err)
+	if operation&CmpAndDelete != 0 {
+		d.auditCompare(AuditCompareDelete, schemaName, tableName, trigger, operator, repair.deleteRows, &repair.deleteKeys,
+			startTime, err)
+	}
+	if operation&CmpAndAdd != 0 {
+		d.auditCompare(AuditCompareInsert, schemaName, tableName, trigger, operator, repair.insertRows, &repair.insertKeys,
+			startTime, err)
+	}
+	return repair.deleteRows, repair.insertRows, err
+}
+
+// compareRepair 按operation删除生产库多余的记录、补全缺失的记录，
+// 同类操作失败后不再执行后续批次，审计只记录执行成功的主键
+type compareRepair struct {
+	schemaName string
+	tableName  string
+	operation  int
+	delete     func([]orm.FinPrimaryKey) (int, error)
+	insert     func([]orm.FinPrimaryKey) (int64, error)
+	deleteRows int
+	insertRows int
+	deleteKeys auditKeys
+	insertKeys auditKeys
+	deleteErr  error
+	insertErr  error
+}
+
+// onDelete 生产库中比对比库多的记录
+func (r *compareRepair) onDelete(keys []orm.FinPrimaryKey) {
+	log.Log.Info(fmt.Sprintf("key compare need delete: key=%v", keyValues(keys)),
+		zap.String("schema", r.schemaName),
+		zap.String("table", r.tableName))
+	if r.operation&CmpAndDelete == 0 || r.deleteErr != nil {
+		return
+	}
+	deleted, err := r.delete(keys)
 	if err != nil {
-		return 0, 0, err
+		r.deleteErr = err
+		return
 	}
-	// 进行对照操作
-	deleteRows := 0
-	insertRows := 0
-	zqdmProd, zqdmCmp, zqdmCommon, err := d.GetZqdmDiffer(tableName, schemaName)
+	r.deleteRows += deleted
+	r.deleteKeys.add(keys)
+}
+
+// onInsert 生产库中比对比库少的记录
+func (r *compareRepair) onInsert(keys []orm.FinPrimaryKey) {
+	log.Log.Info(fmt.Sprintf("key compare need add: key=%v", keyValues(keys)),
+		zap.String("schema", r.schemaName),
+		zap.String("table", r.tableName))
+	if r.operation&CmpAndAdd == 0 || r.insertErr != nil {
+		return
+	}
+	insert, err := r.insert(keys)
+	r.insertRows += int(insert)
 	if err != nil {
-		return 0, 0, err
+		r.insertErr = err
+		return
 	}
-	// 生产库中比对比库多的证券代码
-	if zqdmProd != nil && len(*zqdmProd) > 0 {
-		// 先只输出到日志，不删除
-		log.Log.Info(fmt.Sprintf("zqdm compare need delete: zqdm=%v", *zqdmProd),
-			zap.String("schema", schemaName),
-			zap.String("table", tableName))
+	r.insertKeys.add(keys)
+}
+
+// result 对比出错时返回对比的错误，否则返回删除、补全中的错误
+func (r *compareRepair) result(err error) error {
+	if err == nil {
+		err = r.deleteErr
+	}
+	if err == nil {
+		err = r.insertErr
+	}
+	return err
+}
 
-		if operation&CmpAndDelete != 0 {
-			for _, zqdm := range *zqdmProd {
-				var emptySlice []int32
-				deleteRows += d.DeleteMysqlRecord(schemaName, tableName, zqdm, emptySlice)
-			}
+//
+//  compareWithPg
+//  @Description: 用pg全量数据刷新对比库后，与生产库按主键归并对比，不一致的主键按批回调
+//  @receiver d
+//  @param schemaName
+//  @param tableName
+//  @param onDelete 生产库多出的主键，第一遍对比全部成功后才在第二遍对比中回调，避免数据源无序等错误时误删
+//  @param onInsert 生产库缺少的主键
+//  @return error
+//
+func (d *dao) compareWithPg(schemaName string, tableName string, onDelete, onInsert func([]orm.FinPrimaryKey)) error {
+	keyCols, err := d.getKeyColumns(schemaName, tableName)
+	if err != nil {
+		return err
+	}
+	err = d.CreateCompareTable(schemaName, tableName)
+	if err != nil {
+		return err
+	}
+	// 对比表为空多为pg请求失败，此时不能删除生产库数据
+	if empty, err := d.isTableEmpty("compare_"+schemaName, tableName); err != nil || empty {
+		if err == nil {
+			err = errors.New(fmt.Sprintf("get 0 rows of key, schema=compare_%s, table=%s", schemaName, tableName))
 		}
+		return err
 	}
-	// 生产库中比对比库少的证券代码
-	if zqdmCmp != nil && len(*zqdmCmp) > 0 {
-		log.Log.Info(fmt.Sprintf("zqdm compare need add: zqdm=%v", *zqdmCmp),
-			zap.String("schema", schemaName),
-			zap.String("table", tableName))
-		// todo：补全数据
-		if operation&CmpAndAdd != 0 {
-			for _, val := range *zqdmCmp {
-				insert, err := d.InsertMysqlRecordFromCompare(schemaName, tableName, val, nil)
-				if err != nil {
-					log.Log.Warn("compare insert failed",
-						zap.String("schema", schemaName),
-						zap.String("table", tableName),
-						zap.String("err", err.Error()))
-				}
-				insertRows += int(insert)
-			}
+	// 两侧按主键排序流式读取后归并对比
+	nullKeys := 0
+	open := func() (compare.Source, compare.Source, func(), error) {
+		rowsProd, err := d.keyRows(tableName, schemaName, keyCols)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		rowsCmp, err := d.keyRows(tableName, "compare_"+schemaName, keyCols)
+		if err != nil {
+			rowsProd.Close()
+			return nil, nil, nil, err
+		}
+		closeRows := func() {
+			rowsProd.Close()
+			rowsCmp.Close()
+		}
+		srcProd, err := compare.NewRowsSource(rowsProd)
+		if err != nil {
+			closeRows()
+			return nil, nil, nil, err
 		}
+		srcCmp, err := compare.NewRowsSource(rowsCmp)
+		if err != nil {
+			closeRows()
+			return nil, nil, nil, err
+		}
+		return srcProd, srcCmp, func() {
+			nullKeys = srcProd.Skipped + srcCmp.Skipped
+			closeRows()
+		}, nil
+	}
+	stats, err := mergeKeys(open, keyCols, onDelete, onInsert)
+	if err != nil {
+		return err
 	}
-	// 生产库与对比库一致的证券代码，需要对比判断报表日期
-	if zqdmCommon == nil {
-		return deleteRows, insertRows, nil
+	log.Log.Info("key compare finished",
+		zap.String("schema", schemaName),
+		zap.String("table", tableName),
+		zap.Any("stats", stats),
+		zap.Int("null keys", nullKeys))
+	return nil
+}
+
+// keySources 打开生产库和对比库按主键排序的数据源，done用于关闭数据源
+type keySources func() (prod compare.Source, cmp compare.Source, done func(), err error)
+
+//
+//  mergeKeys
+//  @Description: 第一遍归并按批回调生产库缺少的主键，只统计生产库多出的主键；
+//  第一遍成功且存在多出的主键时再归并一遍按批回调，待删除的主键不在内存中累积，
+//  归并中途出错（如排序不一致）时不会已经删除了部分数据
+//  @param open 每一遍归并重新打开数据源
+//  @param keyCols
+//  @param onDelete 生产库多出的主键
+//  @param onInsert 生产库缺少的主键
+//  @return compare.Stats 第一遍归并的统计
+//  @return error
+//
+func mergeKeys(open keySources, keyCols []string, onDelete, onInsert func([]orm.FinPrimaryKey)) (compare.Stats, error) {
+	prod, cmp, done, err := open()
+	if err != nil {
+		return compare.Stats{}, err
+	}
+	toInsert := &keyBatch{cols: keyCols, flush: onInsert}
+	stats, err := compare.Join(prod, cmp, func(compare.Key) error { return nil }, toInsert.add)
+	done()
+	if err != nil {
+		return stats, err
 	}
-	zqdmCommonCnt := len(*zqdmCommon)
-	if zqdmCommonCnt <= 0 {
-		return deleteRows, insertRows, nil
+	toInsert.done()
+	if stats.OnlyLeft == 0 {
+		return stats, nil
 	}
-	mapBbrqProd, mapBbrqCmp, err := d.GetBbrqDiffer(tableName, schemaName, zqdmCommon)
+	prod, cmp, done, err = open()
 	if err != nil {
-		return deleteRows, insertRows, err
+		return stats, err
 	}
-	if len(*mapBbrqProd) > 0 {
-		for key, val := range *mapBbrqProd {
-			log.Log.Info(fmt.Sprintf("bbrq compare need delete: zqdm=%s, bbrq=%v", key, val),
-				zap.String("schema", schemaName),
-				zap.String("table", tableName))
-			if operation&CmpAndDelete != 0 {
-				deleteRows += d.DeleteMysqlRecord(schemaName, tableName, key, val)
-			}
-		}
+	defer done()
+	toDelete := &keyBatch{cols: keyCols, flush: onDelete}
+	if _, err = compare.Join(prod, cmp, toDelete.add, func(compare.Key) error { return nil }); err != nil {
+		return stats, err
 	}
-	if len(*mapBbrqCmp) > 0 {
-		for key, val := range *mapBbrqCmp {
-			log.Log.Info(fmt.Sprintf("bbrq compare need add: zqdm=%s, bbrq=%v", key, val),
-				zap.String("schema", schemaName),
-				zap.String("table", tableName))
-			// todo：补全数据
-			if operation&CmpAndAdd != 0 {
-				insert, err := d.InsertMysqlRecordFromCompare(schemaName, tableName, key, val)
-				if err != nil {
-					log.Log.Warn("compare insert failed",
-						zap.String("schema", schemaName),
-						zap.String("table", tableName),
-						zap.String("err", err.Error()))
-				}
-				insertRows += int(insert)
-			}
-		}
+	toDelete.done()
+	return stats, nil
+}
+
+// isTableEmpty 判断表中是否有数据
+func (d *dao) isTableEmpty(schemaName string, tableName string) (bool, error) {
+	db, release, err := d.DB.getConn(schemaName)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	var one int
+	ctx, cancel := queryContext()
+	defer cancel()
+	err = db.QueryRowContext(ctx, fmt.Sprintf("select 1 from `%s` limit 1", tableName)).Scan(&one)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	return false, err
+}
+
+// keyValues 提取主键值用于日志输出
+func keyValues(keys []orm.FinPrimaryKey) [][]string {
+	ret := make([][]string, len(keys))
+	for i, key := range keys {
+		ret[i] = key.Values
 	}
-	return deleteRows, insertRows, nil
+	return ret
 }
 
 // 这里只负责往已经存在的表里塞入数据，不负责表的创建
+// 清空或写入失败时返回错误，不完整的对比表不能用于对比，否则会误删生产库数据
 func (d *dao) CreateCompareTable(schemaName string, tableName string) error {
 	// 获取mysql连接，schema需要提前手动创建好
 	schemaCmp := "compare_" + schemaName
-	db, err := d.DB.getConn(schemaCmp)
+	db, release, err := d.DB.getConn(schemaCmp)
 	if err != nil {
 		return err
 	}
+	defer release()
 	// 先把对照表的数据删除
 	sqlDel := fmt.Sprintf("delete from %s", tableName)
-	_, err = db.Exec(sqlDel)
+	if _, err = execWithTimeout(db, sqlDel); err != nil {
+		return errors.New(fmt.Sprintf("clear compare table %s.%s failed: %s", schemaCmp, tableName, err.Error()))
+	}
 
 	// 生成对照表的记录
 	pgParam := pg.QueryParam{
@@ -138,114 +282,111 @@ func (d *dao) CreateCompareTable(schemaName string, tableName string) error {
 	}
 	pgParam.DsnInfo = table.dsnInfo
 	// 生成sql
-	sql, flag, err := d.getProc(pgParam)
+	sql, args, flag, err := d.getProc(pgParam)
 	if err != nil {
 		return err
 	}
-	pgParam.ProcSql = sql
-	pgParam.SqlType = flag
+	pgParam.ProcSql, pgParam.ProcArgs, pgParam.SqlType = sql, args, flag
 	// 导出数据
 	rows, err := pgDao.GetRows(pgParam)
 	if err != nil {
 		return err
 	}
-	sqlList, err := d.rows2sqls(pg.FinanceInfo{SchemaName: schemaName, TableName: tableName}, rows, false)
+	defer rows.Close()
+	sqlList, err := d.rows2sqls(pg.FinanceInfo{SchemaName: schemaName, TableName: tableName}, rows, false, nil)
 	if err != nil {
 		return err
 	}
 	// 通过sql语句更新mysql，这里不创建多个go routine，避免影响mysql的性能
 	for _, sqlBytes := range sqlList {
 		sqlStr := sqlBytes.String()
-		result, unitErr := db.Exec(sqlStr)
+		result, unitErr := execWithTimeout(db, sqlStr)
 		if unitErr != nil {
 			log.Log.Error(unitErr.Error())
-		} else {
-			lastInsertId, _ := result.LastInsertId()
-			affectRows, _ := result.RowsAffected()
-			log.Log.Info("", zap.Int64("Id", lastInsertId), zap.Int64("affected rows", affectRows))
+			return errors.New(fmt.Sprintf("fill compare table %s.%s failed: %s", schemaCmp, tableName, unitErr.Error()))
 		}
+		lastInsertId, _ := result.LastInsertId()
+		affectRows, _ := result.RowsAffected()
+		log.Log.Info("", zap.Int64("Id", lastInsertId), zap.Int64("affected rows", affectRows))
 	}
 	return nil
 }
 
-func (d *dao) DeleteMysqlRecord(schemaName string, tableName string, zqdm string, bbrq []int32) int {
+// DeleteMysqlRecord 按主键删除生产库数据，返回删除的行数
+func (d *dao) DeleteMysqlRecord(schemaName string, tableName string, keys []orm.FinPrimaryKey) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
 	// 获取连接
-	deleteRow := 0
-	db, err := d.DB.getConn(schemaName)
+	db, release, err := d.DB.getConn(schemaName)
 	if err != nil {
-		return deleteRow
+		return 0, err
 	}
+	defer release()
 	// 创建sql
-	sqlDelete := fmt.Sprintf("delete from %s where zqdm = \"%s\"", tableName, zqdm)
-	lenBbrq := len(bbrq)
-	if lenBbrq > 0 {
-		querySql := bytes.Buffer{}
-		for index, val := range bbrq {
-			querySql.WriteString(strconv.Itoa(int(val)))
-			if index < (lenBbrq - 1) {
-				querySql.WriteByte(',')
-			}
-		}
-		sqlDelete = fmt.Sprintf("%s and bbrq in (%s)", sqlDelete, querySql.String())
-	}
+	cond, args := keyCondition(keys)
+	sqlDelete := fmt.Sprintf("delete from `%s` where %s", tableName, cond)
 	// 执行删除操作
-	result, unitErr := db.Exec(sqlDelete)
-	if unitErr != nil {
-		log.Log.Error(unitErr.Error())
-	} else {
-		lastInsertId, _ := result.LastInsertId()
-		deleteRow, _ := result.RowsAffected()
-		log.Log.Info("delete table succeed", zap.String("schema", schemaName), zap.String("table", tableName), zap.String("zqdm", zqdm), zap.Int64("Id", lastInsertId), zap.Int64("affected rows", deleteRow))
+	result, err := execWithTimeout(db, sqlDelete, args...)
+	if err != nil {
+		log.Log.Error(err.Error())
+		return 0, errors.New(fmt.Sprintf("delete %d keys failed: %s", len(keys), err.Error()))
 	}
-	return deleteRow
+	lastInsertId, _ := result.LastInsertId()
+	affectRows, _ := result.RowsAffected()
+	log.Log.Info("delete table succeed", zap.String("schema", schemaName), zap.String("table", tableName), zap.Int("keys", len(keys)), zap.Int64("Id", lastInsertId), zap.Int64("affected rows", affectRows))
+	return int(affectRows), nil
 }
 
-// 补全对比后缺失的数据
-func (d *dao) InsertMysqlRecordFromCompare(schemaName string, tableName string, zqdm string, bbrq []int32) (int64, error) {
+// 补全对比后缺失的数据，返回写入的行数，写入失败时返回已写入的行数和错误
+func (d *dao) InsertMysqlRecordFromCompare(schemaName string, tableName string, keys []orm.FinPrimaryKey) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
 	// 从对比表获取待补全的数据
 	schemaCmp := "compare_" + schemaName
-	dbCmpHandler, err := d.DB.getConn(schemaCmp)
+	dbCmpHandler, releaseCmp, err := d.DB.getConn(schemaCmp)
 	if err != nil {
 		return 0, err
 	}
-	sqlSrc := fmt.Sprintf("select * from %s where zqdm = '%s'", tableName, zqdm)
-	if bbrq != nil && len(bbrq) > 0 {
-		var bbrqList string
-		for _, val := range bbrq {
-			bbrqList += fmt.Sprintf("%d,", val)
-		}
-		bbrqList = strings.TrimRight(bbrqList, ",")
-		sqlSrc += fmt.Sprintf(" and bbrq in (%s)", bbrqList)
-	}
-	rowsSrc, err := dbCmpHandler.Query(sqlSrc)
+	defer releaseCmp()
+	cond, args := keyCondition(keys)
+	sqlSrc := fmt.Sprintf("select * from `%s` where %s", tableName, cond)
+	ctx, cancel := queryContext()
+	defer cancel()
+	rowsSrc, err := dbCmpHandler.QueryContext(ctx, sqlSrc, args...)
 	if err != nil {
 		return 0, err
 	}
 	defer rowsSrc.Close()
-	sqlList, err := d.rows2sqls(pg.FinanceInfo{SchemaName: schemaName, TableName: tableName}, rowsSrc, false)
+	sqlList, err := d.rows2sqls(pg.FinanceInfo{SchemaName: schemaName, TableName: tableName}, rowsSrc, false, nil)
+	if err != nil {
+		return 0, err
+	}
 	// 将待补全的数据写入生产表
-	dbProdHandler, err := d.DB.getConn(schemaName)
+	dbProdHandler, releaseProd, err := d.DB.getConn(schemaName)
 	if err != nil {
 		return 0, err
 	}
+	defer releaseProd()
 	var rowCnt int64
 	rowCnt = 0
 	for _, sqlBytes := range sqlList {
 		sqlStr := sqlBytes.String()
-		result, unitErr := dbProdHandler.Exec(sqlStr)
+		result, unitErr := execWithTimeout(dbProdHandler, sqlStr)
 		if unitErr != nil {
 			log.Log.Error(unitErr.Error())
-		} else {
-			lastInsertId, _ := result.LastInsertId()
-			affectRows, _ := result.RowsAffected()
-			rowCnt += affectRows
-			log.Log.Info("InsertMysqlRecordFromCompare",
-				zap.String("schema", schemaName),
-				zap.String("table", tableName),
-				zap.String("zqdm", zqdm),
-				zap.Int64("Id", lastInsertId),
-				zap.Int64("affected rows", affectRows))
+			return rowCnt, errors.New(fmt.Sprintf("insert %d keys failed: %s", len(keys), unitErr.Error()))
 		}
+		lastInsertId, _ := result.LastInsertId()
+		affectRows, _ := result.RowsAffected()
+		rowCnt += affectRows
+		log.Log.Info("InsertMysqlRecordFromCompare",
+			zap.String("schema", schemaName),
+			zap.String("table", tableName),
+			zap.Int("keys", len(keys)),
+			zap.Int64("Id", lastInsertId),
+			zap.Int64("affected rows", affectRows))
 	}
 	return rowCnt, nil
 }
@@ -0,0 +1,251 @@
+package dao
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"hxextract/app/dao/compare"
+	"hxextract/app/dao/orm"
+	"testing"
+)
+
+var keyCols = []string{"zqdm", "bbrq"}
+
+func compareKeys(values ...string) []compare.Key {
+	ret := make([]compare.Key, len(values))
+	for i, v := range values {
+		ret[i] = compare.Key{v, "20211231"}
+	}
+	return ret
+}
+
+func primaryKeys(values ...string) []orm.FinPrimaryKey {
+	ret := make([]orm.FinPrimaryKey, len(values))
+	for i, v := range values {
+		ret[i] = orm.FinPrimaryKey{Columns: keyCols, Values: []string{v, "20211231"}}
+	}
+	return ret
+}
+
+// sliceSources 每次打开时重新从头输出主键
+func sliceSources(prod, cmp []compare.Key, opens *int) keySources {
+	return func() (compare.Source, compare.Source, func(), error) {
+		*opens++
+		return compare.NewSliceSource(prod), compare.NewSliceSource(cmp), func() {}, nil
+	}
+}
+
+func TestMergeKeys(t *testing.T) {
+	many := make([]string, keyBatchSize+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("%06d", i)
+	}
+	tests := []struct {
+		name    string
+		prod    []compare.Key
+		cmp     []compare.Key
+		deletes []int
+		inserts []int
+		opens   int
+		err     error
+	}{
+		{
+			name:  "identical",
+			prod:  compareKeys("000001", "000002"),
+			cmp:   compareKeys("000001", "000002"),
+			opens: 1,
+		},
+		{
+			name:    "only insert",
+			prod:    compareKeys("000001"),
+			cmp:     compareKeys("000001", "000002"),
+			inserts: []int{1},
+			opens:   1,
+		},
+		{
+			name:    "delete and insert",
+			prod:    compareKeys("000001", "000003"),
+			cmp:     compareKeys("000002", "000003"),
+			deletes: []int{1},
+			inserts: []int{1},
+			opens:   2,
+		},
+		{
+			name:    "batches",
+			prod:    compareKeys(many...),
+			deletes: []int{keyBatchSize, 1},
+			opens:   2,
+		},
+		{
+			name:  "unsorted",
+			prod:  compareKeys("000001", "000003", "000002"),
+			cmp:   compareKeys("000002"),
+			opens: 1,
+			err:   compare.ErrUnsorted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opens := 0
+			var deletes, inserts []int
+			_, err := mergeKeys(sliceSources(tt.prod, tt.cmp, &opens), keyCols,
+				func(keys []orm.FinPrimaryKey) {
+					// 删除只在第二遍归并中执行
+					assert.Equal(t, 2, opens)
+					deletes = append(deletes, len(keys))
+				},
+				func(keys []orm.FinPrimaryKey) {
+					inserts = append(inserts, len(keys))
+				})
+			assert.Equal(t, tt.opens, opens)
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err), "unexpected error: %v", err)
+				assert.Empty(t, deletes)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.deletes, deletes)
+			assert.Equal(t, tt.inserts, inserts)
+		})
+	}
+}
+
+func TestCompareRepair(t *testing.T) {
+	failed := errors.New("failed")
+	// 三批主键，每批两个
+	batches := [][]orm.FinPrimaryKey{
+		primaryKeys("000001", "000002"),
+		primaryKeys("000003", "000004"),
+		primaryKeys("000005", "000006"),
+	}
+	tests := []struct {
+		name        string
+		operation   int
+		deleteErr   error // 第二批删除失败
+		insertErr   error // 第二批写入一行后失败
+		compareErr  error
+		deleteCalls int
+		insertCalls int
+		deleteRows  int
+		insertRows  int
+		deleted     int
+		inserted    int
+		err         error
+	}{
+		{
+			name:        "delete",
+			operation:   CmpAndDelete,
+			deleteCalls: 3,
+			deleteRows:  6,
+			deleted:     6,
+		},
+		{
+			name:        "insert",
+			operation:   CmpAndAdd,
+			insertCalls: 3,
+			insertRows:  6,
+			inserted:    6,
+		},
+		{
+			name:        "delete and insert",
+			operation:   CmpAndDelete | CmpAndAdd,
+			deleteCalls: 3,
+			insertCalls: 3,
+			deleteRows:  6,
+			insertRows:  6,
+			deleted:     6,
+			inserted:    6,
+		},
+		{
+			name:        "delete failed",
+			operation:   CmpAndDelete | CmpAndAdd,
+			deleteErr:   failed,
+			deleteCalls: 2,
+			insertCalls: 3,
+			deleteRows:  2,
+			insertRows:  6,
+			deleted:     2,
+			inserted:    6,
+			err:         failed,
+		},
+		{
+			name:        "insert failed",
+			operation:   CmpAndAdd,
+			insertErr:   failed,
+			insertCalls: 2,
+			insertRows:  3,
+			inserted:    2,
+			err:         failed,
+		},
+		{
+			name:        "compare failed",
+			operation:   CmpAndDelete | CmpAndAdd,
+			deleteErr:   failed,
+			compareErr:  compare.ErrUnsorted,
+			deleteCalls: 2,
+			insertCalls: 3,
+			deleteRows:  2,
+			insertRows:  6,
+			deleted:     2,
+			inserted:    6,
+			err:         compare.ErrUnsorted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deleteCalls, insertCalls := 0, 0
+			repair := &compareRepair{
+				schemaName: "indexfinance",
+				tableName:  "testfinance",
+				operation:  tt.operation,
+				delete: func(keys []orm.FinPrimaryKey) (int, error) {
+					deleteCalls++
+					if deleteCalls == 2 && tt.deleteErr != nil {
+						return 0, tt.deleteErr
+					}
+					return len(keys), nil
+				},
+				insert: func(keys []orm.FinPrimaryKey) (int64, error) {
+					insertCalls++
+					if insertCalls == 2 && tt.insertErr != nil {
+						return 1, tt.insertErr
+					}
+					return int64(len(keys)), nil
+				},
+			}
+			for _, batch := range batches {
+				repair.onDelete(batch)
+				repair.onInsert(batch)
+			}
+			assert.Equal(t, tt.err, repair.result(tt.compareErr))
+			assert.Equal(t, tt.deleteCalls, deleteCalls)
+			assert.Equal(t, tt.insertCalls, insertCalls)
+			assert.Equal(t, tt.deleteRows, repair.deleteRows)
+			assert.Equal(t, tt.insertRows, repair.insertRows)
+			assert.Len(t, repair.deleteKeys.Values, tt.deleted)
+			assert.Len(t, repair.insertKeys.Values, tt.inserted)
+		})
+	}
+}
+
+// TestMergeKeysUnsorted 数据源无序时不删除任何数据
+func TestMergeKeysUnsorted(t *testing.T) {
+	opens := 0
+	deleteCalls := 0
+	repair := &compareRepair{
+		operation: CmpAndDelete | CmpAndAdd,
+		delete: func(keys []orm.FinPrimaryKey) (int, error) {
+			deleteCalls++
+			return len(keys), nil
+		},
+		insert: func(keys []orm.FinPrimaryKey) (int64, error) {
+			return int64(len(keys)), nil
+		},
+	}
+	_, err := mergeKeys(sliceSources(compareKeys("000001", "000003", "000002"), compareKeys("000004"), &opens),
+		keyCols, repair.onDelete, repair.onInsert)
+	err = repair.result(err)
+	assert.True(t, errors.Is(err, compare.ErrUnsorted), "unexpected error: %v", err)
+	assert.Zero(t, deleteCalls)
+	assert.Zero(t, repair.deleteRows)
+}
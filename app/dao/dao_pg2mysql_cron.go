@@ -5,12 +5,13 @@ import (
 	"go.uber.org/zap"
 	"hxextract/app/dao/pg"
 	"hxextract/app/log"
+	"hxextract/app/metrics"
 	"time"
 )
 
 type CronTaskInfo struct {
 	taskinfo    TaskItem
-	processFunc func(pg.QueryParam, int)
+	processFunc func(TaskItem)
 }
 
 var (
@@ -21,29 +22,71 @@ var (
 func (d *CronTaskInfo) CronTasksExport() {
 	log.Log.Info(fmt.Sprintf("start to export finance"),
 		zap.String("table", d.taskinfo.tableName),
-		zap.String("schema", d.taskinfo.schemaName))
+		zap.String("schema", d.taskinfo.schemaName),
+		zap.String("group", d.taskinfo.group))
+	// 同时执行依赖该任务的下游任务
+	d.processFunc(d.taskinfo)
+}
+
+// exportTask 按任务配置导出，导出方式为对比的任务对比并删除、补全数据
+func (d *dao) exportTask(task TaskItem) error {
+	if task.group != "" {
+		return d.exportGroupTask(task)
+	}
+	if task.opType == pg.OpCompare {
+		// 先不重试
+		_, _, err := d.CompareAndUpdateMysql(task.schemaName, task.tableName, CmpAndDelete|CmpAndAdd,
+			metrics.GetTriggerType(pg.TrigCron), task.operator())
+		return err
+	}
 	param := pg.QueryParam{
-		TableName:   d.taskinfo.tableName,
-		SchemaName:  d.taskinfo.schemaName,
-		ProcType:    d.taskinfo.opType,
+		TableName:   task.tableName,
+		SchemaName:  task.schemaName,
+		ProcType:    task.opType,
 		StartDate:   0,
 		EndDate:     0,
 		TriggerType: pg.TrigCron,
+		Operator:    task.operator(),
 	}
-	d.processFunc(param, retryCnt)
 	// 部分sql问题，通过bbrq再导一次
-	// d.processFunc(fin, cronParamBbrq, retryCnt)
+	// d.exportFinCron(cronParamBbrq, retryCnt)
+	return d.exportFinCron(param, retryCnt)
+}
+
+// exportGroupTask 导出分组中所有的表，各表分别重试，有表失败时任务失败
+func (d *dao) exportGroupTask(task TaskItem) error {
+	if task.opType == pg.OpCompare {
+		res, err := d.compareGroup(task.group, CmpAndDelete|CmpAndAdd, metrics.GetTriggerType(pg.TrigCron), task.operator(), 0)
+		if err != nil {
+			return err
+		}
+		return res.Err()
+	}
+	res, err := d.eachGroupTable(task.group, 0, func(table TableInfo, r *GroupTableResult) error {
+		return d.exportFinCron(pg.QueryParam{
+			TableName:   table.tableName,
+			SchemaName:  table.schemaName,
+			FinName:     table.finName,
+			ProcType:    task.opType,
+			TriggerType: pg.TrigCron,
+			Operator:    task.operator(),
+		}, retryCnt)
+	})
+	if err != nil {
+		return err
+	}
+	return res.Err()
 }
 
-func (d *dao) exportFinCron(param pg.QueryParam, retry int) {
+func (d *dao) exportFinCron(param pg.QueryParam, retry int) (err error) {
 	for i := 0; i < retry; i++ {
-		err := d.ExportPgData(param)
+		err = d.ExportPgData(param)
 		if err == nil {
 			log.Log.Info(fmt.Sprintf("export data successfully"),
 				zap.String("finname", param.FinName),
 				zap.String("type", "cron"),
 				zap.Int("retry", i))
-			break
+			return nil
 		}
 		if i == retry-1 {
 			log.Log.Error(fmt.Sprintf("export data failed: %s", err.Error()),
@@ -57,4 +100,5 @@ func (d *dao) exportFinCron(param pg.QueryParam, retry int) {
 		}
 		time.Sleep(time.Duration(5) * time.Second)
 	}
+	return err
 }
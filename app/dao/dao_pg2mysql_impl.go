@@ -9,6 +9,7 @@ import (
 	"hxextract/app/config"
 	"hxextract/app/dao/orm"
 	"hxextract/app/dao/pg"
+	"hxextract/app/event"
 	"hxextract/app/log"
 	"hxextract/app/metrics"
 	"hxextract/app/valuate"
@@ -16,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,85 +41,104 @@ func (d *dao) pgCronInit() error {
 	if err := d.tableinfoDbLoad(); err != nil {
 		return err
 	}
+	// 分组加载失败不影响按表导出，导出分组的定时任务执行时失败
+	if err := d.tableGroupLoad(); err != nil {
+		log.Log.Warn("load table groups failed", zap.String("err", err.Error()))
+	}
 	return d.taskitemsDbLoad()
 }
 
 //ExportPgData
-//  @Description: 从pg导入数据
+//  @Description: 从pg导入数据，导出方式不能为对比，对比需通过CompareAndUpdateMysql执行
 //  @receiver d
 //  @param finName
 //  @param param
 //  @return error
 //
 func (d *dao) ExportPgData(param pg.QueryParam) error {
-	if param.ProcType == pg.OpCompare {
-		deletRecord, insertRecord, err := d.CompareAndUpdateMysql(param.SchemaName, param.TableName, CmpAndDelete|CmpAndAdd)
-		if err != nil {
-			log.Log.Warn(fmt.Sprintf("cmp data failed"),
-				zap.String("schema", param.SchemaName),
-				zap.String("table", param.TableName),
-				zap.String("err", err.Error()))
-		} else {
-			log.Log.Info(fmt.Sprintf("cmp data successfully"),
-				zap.String("schema", param.SchemaName),
-				zap.String("table", param.TableName),
-				zap.Int("delete", deletRecord),
-				zap.Int("insert", insertRecord))
-		}
-		// 先不重试
-		return nil
+	export := metrics.GetExportType(param.ProcType)
+	trigger := metrics.GetTriggerType(param.TriggerType)
+	// 记录执行历史
+	run := d.startRun(param, trigger)
+	if err := param.CheckType(); err != nil {
+		d.finishRun(run, nil, err)
+		return err
 	}
 	// 找到对应的pg数据库信息
 	schema := make(SchemaInfo)
 	var ok bool
 	if schema, ok = d.DB.gTableInfo[param.SchemaName]; !ok {
-		return errors.New("can't find dsn")
+		err := errors.New("can't find dsn")
+		d.finishRun(run, nil, err)
+		return err
 	}
 	var table TableInfo
 	if table, ok = schema[param.TableName]; !ok {
-		return errors.New("can't find dsn")
+		err := errors.New("can't find dsn")
+		d.finishRun(run, nil, err)
+		return err
 	}
 	param.DsnInfo = table.dsnInfo
 	// 生成sql
-	sql, flag, err := d.getProc(param)
+	sql, args, flag, err := d.getProc(param)
 	if err != nil {
-		return errors.New("can't build sql")
+		err = errors.Wrap(err, "can't build sql")
+		d.finishRun(run, nil, err)
+		return err
 	}
-	param.ProcSql = sql
-	param.SqlType = flag
+	param.ProcSql, param.ProcArgs, param.SqlType = sql, args, flag
 	// 获取mysql连接
-	export := metrics.GetExportType(param.ProcType)
-	trigger := metrics.GetTriggerType(param.TriggerType)
 	metrics.QpsMetricsInc(param.SchemaName, param.TableName, trigger, export)
-	startTime := time.Now()
 	log.Log.Info("Start to export data from pg", zap.Any("param", param))
-	db, err := d.DB.getConn(param.SchemaName)
+	db, release, err := d.DB.getConn(param.SchemaName)
 	if err != nil {
 		metrics.ErrorMetricsInc(trigger, param.SchemaName, param.TableName, export, metrics.ErrorConn)
+		d.exportDone(run, param, trigger, nil, err)
 		return err
 	}
+	defer release()
 	// 从pg导出数据
 	rows, err := pgDao.GetRows(param)
+	run.stageDone(metrics.StageExtract)
 	if err != nil {
 		metrics.ErrorMetricsInc(trigger, param.SchemaName, param.TableName, export, metrics.ErrorPg)
+		d.exportDone(run, param, trigger, nil, err)
 		return err
 	}
+	defer rows.Close()
 	// 逐行校验并转成sql语句
-	sqlList, err := d.rows2sqls(pg.FinanceInfo{SchemaName: param.SchemaName, TableName: param.TableName}, rows, true)
+	stat := &exportStat{}
+	if keyCols, keyErr := d.getKeyColumns(param.SchemaName, param.TableName); keyErr == nil && len(keyCols) > 0 {
+		stat.keyRange = &event.KeyRange{Columns: keyCols}
+	}
+	sqlList, err := d.rows2sqls(pg.FinanceInfo{SchemaName: param.SchemaName, TableName: param.TableName}, rows, true, stat)
+	run.stageDone(metrics.StageTransform)
+	if err != nil {
+		metrics.ErrorMetricsInc(trigger, param.SchemaName, param.TableName, export, metrics.ErrorPg)
+		d.exportDone(run, param, trigger, stat, err)
+		return err
+	}
 	// 通过sql语句更新mysql
 	var wg sync.WaitGroup
-	hasErr := false
-	for _, sqlBytes := range sqlList {
+	var failed, written int64
+	rowLimit := int64(config.GetMysql().RowLimit)
+	for i, sqlBytes := range sqlList {
 		sqlStr := sqlBytes.String()
+		// 每条sql最多包含RowLimit行，最后一条为剩余的行
+		batchRows := stat.rows - int64(i)*rowLimit
+		if batchRows > rowLimit {
+			batchRows = rowLimit
+		}
 		wg.Add(1)
 		go func() {
-			result, unitErr := db.Exec(sqlStr)
+			result, unitErr := execWithTimeout(db, sqlStr)
 			if unitErr != nil {
-				hasErr = true
+				atomic.AddInt64(&failed, 1)
 				log.Log.Error("replace mysql failed",
 					zap.String("sql", sqlStr),
 					zap.String("error", unitErr.Error()))
 			} else {
+				atomic.AddInt64(&written, batchRows)
 				lastInsertId, _ := result.LastInsertId()
 				affectRows, _ := result.RowsAffected()
 				log.Log.Info("", zap.Int64("Id", lastInsertId), zap.Int64("affected rows", affectRows))
@@ -127,11 +148,24 @@ func (d *dao) ExportPgData(param pg.QueryParam) error {
 	}
 	// 同步等待所有routine结束
 	wg.Wait()
+	run.stageDone(metrics.StageLoad)
+	stat.written = written
+	hasErr := failed > 0
 	if hasErr {
 		metrics.ErrorMetricsInc(trigger, param.SchemaName, param.TableName, export, metrics.ErrorSink)
 	}
-	timeCost := float64(time.Since(startTime).Milliseconds())
+	timeCost := float64(time.Since(run.startTime()).Milliseconds())
 	metrics.PerfBucketMetricsObserve(param.SchemaName, param.TableName, trigger, metrics.StageAll, export, timeCost)
+	if hasErr {
+		err = errors.New("replace mysql failed")
+		d.exportDone(run, param, trigger, stat, err)
+		return err
+	}
+	d.exportDone(run, param, trigger, stat, nil)
+	// 源表导出成功后更新衍生表
+	if err = d.runDerived(param.SchemaName, param.TableName, trigger, param.Operator); err != nil {
+		log.Log.Error(err.Error(), zap.String("schema", param.SchemaName), zap.String("table", param.TableName))
+	}
 	return nil
 }
 
@@ -156,34 +190,112 @@ func (d *dao) newValue(cols []string) *colValue {
 	return &colValue{colNames: cols, scans: scans, values: values, colsScans: colsScans}
 }
 
+// resultRows 逐行读取的查询结果，pg.Rows和mysql的*sql.Rows都满足
+type resultRows interface {
+	Columns() ([]string, error)
+	ColumnTypes() ([]*sql.ColumnType, error)
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+}
+
 //
 //  rows2sqls
 //  @Description: 将从pg请求的结果转化为入库mysql的sql
 //  @param fin
 //  @param rows
+//  @param stat 不为nil时统计写入的行数和主键范围
 //  @return []*bytes.Buffer
 //  @return error
 //
-func (d *dao) rows2sqls(fin pg.FinanceInfo, rows *sql.Rows, needCheck bool) ([]*bytes.Buffer, error) {
+func (d *dao) rows2sqls(fin pg.FinanceInfo, rows resultRows, needCheck bool, stat *exportStat) ([]*bytes.Buffer, error) {
 	ret := make([]*bytes.Buffer, 0)
-	colNames, err := rows.Columns()
+	rowSlice := make([]*string, 0)
+	var keyIndex []int
+	if stat != nil && stat.keyRange != nil {
+		cols, err := rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+		sinkCols := sinkColumns(cols)
+		for _, key := range stat.keyRange.Columns {
+			if idx := indexOf(sinkCols, key); idx >= 0 {
+				keyIndex = append(keyIndex, idx)
+			}
+		}
+		// 结果中缺少主键字段时不统计主键范围
+		if len(keyIndex) != len(stat.keyRange.Columns) {
+			stat.keyRange = nil
+		}
+	}
+	colNames, skipped, err := d.eachRow(fin, rows, needCheck, func(line string, values []interface{}) error {
+		rowSlice = append(rowSlice, &line)
+		if stat != nil && stat.keyRange != nil {
+			key := make([]string, len(keyIndex))
+			for i, idx := range keyIndex {
+				key[i] = fmt.Sprint(values[idx])
+			}
+			addKeyRange(stat.keyRange, key)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	if stat != nil {
+		stat.rows = int64(len(rowSlice))
+		stat.skipped = skipped
+	}
+	// 生成sql
+	sqlHead := d.getSqlHead(fin.TableName, colNames)
+	querySql := bytes.NewBufferString(sqlHead)
+	rowLimit := config.GetMysql().RowLimit
+	total := len(rowSlice)
+	for index, value := range rowSlice {
+		querySql.WriteString(*value)
+		if (index+1) == total || (index+1)%rowLimit == 0 {
+			querySql.WriteByte(';')
+			ret = append(ret, querySql)
+			querySql = bytes.NewBufferString(sqlHead)
+		} else {
+			querySql.WriteByte(',')
+		}
+	}
+	return ret, err
+}
+
+//
+//  eachRow
+//  @Description: 逐行读取并校验数据，校验通过的行交给fn处理
+//  @param fin
+//  @param rows
+//  @param needCheck 是否执行校验规则
+//  @param fn line为该行格式化后的values，values为入库mysql的各字段值（与sinkColumns对应
+//  @return colNames 查询结果的所有字段名
+//  @return skipped 校验未通过被跳过的行数
+//  @return err
+//
+func (d *dao) eachRow(fin pg.FinanceInfo, rows resultRows, needCheck bool,
+	fn func(line string, values []interface{}) error) (colNames []string, skipped int, err error) {
+	colNames, err = rows.Columns()
+	if err != nil {
+		return nil, 0, err
+	}
 	col := d.newValue(colNames)
 	col.colTypes, err = rows.ColumnTypes()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	sqlFmtStr, err := d.getFormatStr(colNames, fin.SchemaName)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	// 获取该表的校验规则，过滤掉不符合规则的数据
-	dbCheck, err := d.DB.getConn("topview")
+	dbCheck, releaseCheck, err := d.DB.getConn(checkRuleSchema)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	defer releaseCheck()
 	var sliceRule *[]valuate.CheckRule
 	sliceRule = nil
 	if needCheck {
@@ -191,40 +303,39 @@ func (d *dao) rows2sqls(fin pg.FinanceInfo, rows *sql.Rows, needCheck bool) ([]*
 	}
 	// 逐行处理sql
 	// 全量执行时数据量较大可能会有数百万行，因此用Buffer缓冲器和fmt来进行string的拼接，以提升性能
-	rowCnt := 0
+	nSink := len(sinkColumns(colNames))
 	action := valuate.SkipNoRow
-	rowSlice := make([]*string, 0)
 	// next 在校验下面分支条件中用于判断是否到结尾
-	for ; rows.Next(); rowCnt++ {
+	for rows.Next() {
 		strValue := ""
 		strValue, err, action = d.getRowValue(col, sqlFmtStr, rows, sliceRule, fin)
 		if action == valuate.SkipAllRows {
 			err = errors.New("skip all rows due to failed data checking")
 			break
 		} else if action == valuate.SkipThisRow {
+			skipped++
+			err = nil
 			continue
 		}
-		rowSlice = append(rowSlice, &strValue)
+		if err = fn(strValue, col.colsScans[:nSink]); err != nil {
+			break
+		}
 	}
-	if err != nil {
-		return nil, err
+	if err == nil {
+		err = rows.Err()
 	}
-	// 生成sql
-	sqlHead := d.getSqlHead(fin.TableName, colNames)
-	querySql := bytes.NewBufferString(sqlHead)
-	rowLimit := config.GetMysql().RowLimit
-	total := len(rowSlice)
-	for index, value := range rowSlice {
-		querySql.WriteString(*value)
-		if (index+1) == total || (index+1)%rowLimit == 0 {
-			querySql.WriteByte(';')
-			ret = append(ret, querySql)
-			querySql = bytes.NewBufferString(sqlHead)
-		} else {
-			querySql.WriteByte(',')
+	return colNames, skipped, err
+}
+
+// sinkColumns 入库mysql的字段，去掉market、mtime、id
+func sinkColumns(cols []string) []string {
+	var ret []string
+	for _, v := range cols {
+		if v != pg.MARKET && v != pg.MTIME && v != pg.ID {
+			ret = append(ret, v)
 		}
 	}
-	return ret, err
+	return ret
 }
 
 /**
@@ -256,17 +367,10 @@ func (d *dao) getSqlHead(tableName string, cols []string) string {
 func (d *dao) getFormatStr(cols []string, schemaName string) (fmtStr string, err error) {
 	// TODO 有字段对应不上时报错并返回
 	schemaNames := []string{schemaName, "*"}
-	var colsWithoutMarket []string
-	for _, v := range cols {
-		if v != pg.MARKET && v != pg.MTIME && v != pg.ID {
-			colsWithoutMarket = append(colsWithoutMarket, v)
-		}
-	}
+	colsWithoutMarket := sinkColumns(cols)
 	var result []orm.TypeDescribe
-	d.DB.defaultOrm.Table("type_describe").Where("field_schema in ? and field_name in ?",
-		schemaNames, colsWithoutMarket).Find(&result)
-	if d.DB.defaultOrm.Error != nil {
-		err = d.DB.defaultOrm.Error
+	if err = d.DB.orm().Table("type_describe").Where("field_schema in ? and field_name in ?",
+		schemaNames, colsWithoutMarket).Find(&result).Error; err != nil {
 		return
 	}
 	// sql查询结果和cols中字段名排序不能保持一致，因此通过map来保证其位置对应
@@ -295,7 +399,7 @@ func (d *dao) getFormatStr(cols []string, schemaName string) (fmtStr string, err
  * @return string
  * @return error
  */
-func (d *dao) getRowValue(c *colValue, fmtStr string, rows *sql.Rows, rules *[]valuate.CheckRule, fin pg.FinanceInfo) (string, error, uint32) {
+func (d *dao) getRowValue(c *colValue, fmtStr string, rows resultRows, rules *[]valuate.CheckRule, fin pg.FinanceInfo) (string, error, uint32) {
 	err := rows.Scan(c.scans...) // 将scans结构（scans中为values的地址
 	if err != nil {
 		return "", err, valuate.SkipThisRow
@@ -0,0 +1,293 @@
+package dao
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hxextract/app/dao/orm"
+	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	"strings"
+)
+
+// 预览结果中每类变更保留的样例行数
+const previewSampleSize = 20
+
+type (
+	// PreviewPlan 导出/对比的预览结果，预览只读取数据，不修改生产库
+	PreviewPlan struct {
+		SchemaName    string              `json:"schema"`
+		TableName     string              `json:"table"`
+		ProcType      int                 `json:"type"`
+		Inserts       int                 `json:"inserts"`        // 计划新增的行数
+		Updates       int                 `json:"updates"`        // 计划覆盖的行数（主键已存在
+		Deletes       int                 `json:"deletes"`        // 计划删除的行数
+		Skipped       int                 `json:"skipped"`        // 校验未通过不会写入的行数
+		SampleInserts []map[string]string `json:"sample_inserts"` // 新增样例
+		SampleUpdates []map[string]string `json:"sample_updates"` // 覆盖样例
+		SampleDeletes []map[string]string `json:"sample_deletes"` // 删除样例
+	}
+)
+
+func (d *dao) PreviewExport(finName string, param pg.QueryParam) (*PreviewPlan, error) {
+	var table TableInfo
+	ok := false
+	if table, ok = d.DB.financeInfo[finName]; !ok {
+		return nil, ErrFinanceNotFound
+	}
+	param.TableName = table.tableName
+	param.SchemaName = table.schemaName
+	return d.previewExport(param)
+}
+
+func (d *dao) PreviewCompare(finName string) (*PreviewPlan, error) {
+	var table TableInfo
+	ok := false
+	if table, ok = d.DB.financeInfo[finName]; !ok {
+		return nil, ErrFinanceNotFound
+	}
+	return d.previewCompare(table.schemaName, table.tableName)
+}
+
+// preparePgParam 补全pg连接信息和待执行的sql
+func (d *dao) preparePgParam(param *pg.QueryParam) error {
+	schema, ok := d.DB.gTableInfo[param.SchemaName]
+	if !ok {
+		return errors.New("can't find dsn")
+	}
+	table, ok := schema[param.TableName]
+	if !ok {
+		return errors.New("can't find dsn")
+	}
+	param.DsnInfo = table.dsnInfo
+	sql, args, flag, err := d.getProc(*param)
+	if err != nil {
+		return errors.Wrap(err, "can't build sql")
+	}
+	param.ProcSql, param.ProcArgs, param.SqlType = sql, args, flag
+	return nil
+}
+
+//
+//  previewExport
+//  @Description: 执行导出的抽取和校验，按主键判断每行在生产库中是新增还是覆盖
+//  @receiver d
+//  @param param
+//  @return *PreviewPlan
+//  @return error
+//
+func (d *dao) previewExport(param pg.QueryParam) (*PreviewPlan, error) {
+	keyCols, err := d.getKeyColumns(param.SchemaName, param.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.preparePgParam(&param); err != nil {
+		return nil, err
+	}
+	log.Log.Info("Start to preview export", zap.Any("param", param))
+	rows, err := pgDao.GetRows(param)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	colNames, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	sinkCols := sinkColumns(colNames)
+	keyIndex := make([]int, len(keyCols))
+	for i, key := range keyCols {
+		keyIndex[i] = indexOf(sinkCols, key)
+		if keyIndex[i] < 0 {
+			return nil, errors.New(fmt.Sprintf("key column %s not found in pg result", key))
+		}
+	}
+	plan := &PreviewPlan{SchemaName: param.SchemaName, TableName: param.TableName, ProcType: param.ProcType}
+	// 按批查询生产库中已存在的主键
+	var keys []orm.FinPrimaryKey
+	var records []map[string]string
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		exist, err := d.existKeys(param.SchemaName, param.TableName, keys)
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			if exist[strings.Join(key.Values, "\x00")] {
+				plan.Updates++
+				plan.SampleUpdates = appendSample(plan.SampleUpdates, records[i])
+			} else {
+				plan.Inserts++
+				plan.SampleInserts = appendSample(plan.SampleInserts, records[i])
+			}
+		}
+		keys = keys[:0]
+		records = records[:0]
+		return nil
+	}
+	_, plan.Skipped, err = d.eachRow(pg.FinanceInfo{SchemaName: param.SchemaName, TableName: param.TableName}, rows, true,
+		func(_ string, values []interface{}) error {
+			key := orm.FinPrimaryKey{Columns: keyCols, Values: make([]string, len(keyCols))}
+			for i, idx := range keyIndex {
+				key.Values[i] = fmt.Sprint(values[idx])
+			}
+			record := make(map[string]string, len(sinkCols))
+			for i, col := range sinkCols {
+				record[col] = fmt.Sprint(values[i])
+			}
+			keys = append(keys, key)
+			records = append(records, record)
+			if len(keys) < keyBatchSize {
+				return nil
+			}
+			return flush()
+		})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+//
+//  previewCompare
+//  @Description: 刷新对比库并与生产库对比，只统计需要删除和补全的记录，不修改生产库
+//  @receiver d
+//  @param schemaName
+//  @param tableName
+//  @return *PreviewPlan
+//  @return error
+//
+func (d *dao) previewCompare(schemaName string, tableName string) (*PreviewPlan, error) {
+	plan := &PreviewPlan{SchemaName: schemaName, TableName: tableName, ProcType: pg.OpCompare}
+	sample := func(schema string, keys []orm.FinPrimaryKey, samples []map[string]string) []map[string]string {
+		if len(samples) >= previewSampleSize {
+			return samples
+		}
+		if n := previewSampleSize - len(samples); len(keys) > n {
+			keys = keys[:n]
+		}
+		rows, err := d.sampleRows(schema, tableName, keys)
+		if err != nil {
+			log.Log.Warn("preview sample failed", zap.String("schema", schema),
+				zap.String("table", tableName), zap.String("err", err.Error()))
+		}
+		return append(samples, rows...)
+	}
+	onDelete := func(keys []orm.FinPrimaryKey) {
+		plan.Deletes += len(keys)
+		plan.SampleDeletes = sample(schemaName, keys, plan.SampleDeletes)
+	}
+	onInsert := func(keys []orm.FinPrimaryKey) {
+		plan.Inserts += len(keys)
+		plan.SampleInserts = sample("compare_"+schemaName, keys, plan.SampleInserts)
+	}
+	if err := d.compareWithPg(schemaName, tableName, onDelete, onInsert); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// existKeys 查询生产库中已存在的主键，返回值的key为以\x00连接的主键值
+func (d *dao) existKeys(schemaName string, tableName string, keys []orm.FinPrimaryKey) (map[string]bool, error) {
+	db, release, err := d.DB.getConn(schemaName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	cond, args := keyCondition(keys)
+	quoted := make([]string, len(keys[0].Columns))
+	for i, col := range keys[0].Columns {
+		quoted[i] = fmt.Sprintf("`%s`", col)
+	}
+	ctx, cancel := queryContext()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("select %s from `%s` where %s", strings.Join(quoted, ","), tableName, cond), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make([]sql.NullString, len(quoted))
+	scans := make([]interface{}, len(quoted))
+	for i := range values {
+		scans[i] = &values[i]
+	}
+	exist := make(map[string]bool)
+	for rows.Next() {
+		if err = rows.Scan(scans...); err != nil {
+			return nil, err
+		}
+		key := make([]string, len(values))
+		for i, v := range values {
+			key[i] = v.String
+		}
+		exist[strings.Join(key, "\x00")] = true
+	}
+	return exist, rows.Err()
+}
+
+// sampleRows 按主键获取完整记录作为样例
+func (d *dao) sampleRows(schemaName string, tableName string, keys []orm.FinPrimaryKey) ([]map[string]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	db, release, err := d.DB.getConn(schemaName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	cond, args := keyCondition(keys)
+	ctx, cancel := queryContext()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("select * from `%s` where %s", tableName, cond), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]sql.NullString, len(cols))
+	scans := make([]interface{}, len(cols))
+	for i := range values {
+		scans[i] = &values[i]
+	}
+	var ret []map[string]string
+	for rows.Next() {
+		if err = rows.Scan(scans...); err != nil {
+			return ret, err
+		}
+		record := make(map[string]string, len(cols))
+		for i, col := range cols {
+			if values[i].Valid {
+				record[col] = values[i].String
+			} else {
+				record[col] = "NULL"
+			}
+		}
+		ret = append(ret, record)
+	}
+	return ret, rows.Err()
+}
+
+func appendSample(samples []map[string]string, record map[string]string) []map[string]string {
+	if len(samples) >= previewSampleSize {
+		return samples
+	}
+	return append(samples, record)
+}
+
+func indexOf(list []string, target string) int {
+	for i, v := range list {
+		if v == target {
+			return i
+		}
+	}
+	return -1
+}
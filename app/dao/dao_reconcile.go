@@ -0,0 +1,240 @@
+package dao
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/xitongsys/parquet-go-source/local"
+	"go.uber.org/zap"
+	"hxextract/app/config"
+	"hxextract/app/dao/compare"
+	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 参照源类型
+const (
+	RefCsv     = "csv"     //供应商提供的csv快照
+	RefParquet = "parquet" //供应商提供的parquet快照
+	RefPg      = "pg"      //其他pg库（如从库）
+)
+
+// 对账中各数据源名称
+const (
+	sourceMysql     = "mysql"
+	sourcePg        = "pg"
+	sourceReference = "reference"
+)
+
+type (
+	// ReconcileParam 与外部参照源对账的参数
+	ReconcileParam struct {
+		FinName string
+		RefType string // 参照源类型，详见：Ref*
+		RefPath string // 参照文件路径，相对于Service.ReferenceDir
+		RefName string // 参照pg库名称，见Service.References，为空时使用表配置的pg库
+		WithPg  bool   // 是否同时与pg源（compare_库）做三方对比
+	}
+
+	// ReconcileDiff 并非所有数据源都存在的主键
+	ReconcileDiff struct {
+		Key     map[string]string `json:"key"`
+		Sources []string          `json:"sources"` // 存在该主键的数据源
+	}
+
+	// ReconcileReport 对账结果，Plan中Deletes为mysql多出的记录，Inserts为mysql缺少的记录
+	ReconcileReport struct {
+		Plan     *PreviewPlan    `json:"plan"`
+		Sources  []string        `json:"sources"`
+		Keys     int             `json:"keys"`     // 所有数据源去重后的主键数
+		Common   int             `json:"common"`   // 所有数据源都存在的主键数
+		Patterns map[string]int  `json:"patterns"` // 按存在该主键的数据源分组统计
+		Samples  []ReconcileDiff `json:"samples"`
+	}
+)
+
+//
+//  Reconcile
+//  @Description: 将mysql生产库与外部参照源（及pg源）按主键对账，只输出差异，不修改数据
+//  @receiver d
+//  @param param
+//  @return *ReconcileReport
+//  @return error
+//
+func (d *dao) Reconcile(param ReconcileParam) (*ReconcileReport, error) {
+	table, ok := d.DB.financeInfo[param.FinName]
+	if !ok {
+		return nil, ErrFinanceNotFound
+	}
+	schemaName, tableName := table.schemaName, table.tableName
+	keyCols, err := d.getKeyColumns(schemaName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	// 参照源通常无法按主键有序读取，读取后在内存中排序
+	refKeys, err := d.referenceKeys(param, table, keyCols)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{sourceMysql, sourceReference}
+	rowsProd, err := d.keyRows(tableName, schemaName, keyCols)
+	if err != nil {
+		return nil, err
+	}
+	defer rowsProd.Close()
+	srcProd, err := compare.NewRowsSource(rowsProd)
+	if err != nil {
+		return nil, err
+	}
+	sources := []compare.Source{srcProd, compare.NewSortedSource(refKeys)}
+	if param.WithPg {
+		if err = d.CreateCompareTable(schemaName, tableName); err != nil {
+			return nil, err
+		}
+		rowsCmp, err := d.keyRows(tableName, "compare_"+schemaName, keyCols)
+		if err != nil {
+			return nil, err
+		}
+		defer rowsCmp.Close()
+		srcCmp, err := compare.NewRowsSource(rowsCmp)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, sourcePg)
+		sources = append(sources, srcCmp)
+	}
+	report := &ReconcileReport{
+		Plan:     &PreviewPlan{SchemaName: schemaName, TableName: tableName, ProcType: pg.OpCompare},
+		Sources:  names,
+		Patterns: make(map[string]int),
+	}
+	stats, err := compare.JoinAll(sources, func(key compare.Key, present []bool) error {
+		var in []string
+		for i, ok := range present {
+			if ok {
+				in = append(in, names[i])
+			}
+		}
+		report.Patterns[strings.Join(in, ",")]++
+		keyMap := make(map[string]string, len(keyCols))
+		for i, col := range keyCols {
+			keyMap[col] = key[i]
+		}
+		if len(report.Samples) < previewSampleSize {
+			report.Samples = append(report.Samples, ReconcileDiff{Key: keyMap, Sources: in})
+		}
+		// mysql与参照源的差异按对比的格式输出
+		if present[0] && !present[1] {
+			report.Plan.Deletes++
+			report.Plan.SampleDeletes = appendSample(report.Plan.SampleDeletes, keyMap)
+		} else if !present[0] && present[1] {
+			report.Plan.Inserts++
+			report.Plan.SampleInserts = appendSample(report.Plan.SampleInserts, keyMap)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Keys = stats.Left
+	report.Common = stats.Common
+	log.Log.Info("reconcile finished",
+		zap.String("schema", schemaName),
+		zap.String("table", tableName),
+		zap.Strings("sources", names),
+		zap.Any("patterns", report.Patterns))
+	return report, nil
+}
+
+// referenceKeys 读取参照源中的所有主键
+func (d *dao) referenceKeys(param ReconcileParam, table TableInfo, keyCols []string) ([]compare.Key, error) {
+	switch param.RefType {
+	case RefCsv:
+		path, err := referencePath(param.RefPath)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return compare.ReadCSVKeys(file, keyCols)
+	case RefParquet:
+		path, err := referencePath(param.RefPath)
+		if err != nil {
+			return nil, err
+		}
+		file, err := local.NewLocalFileReader(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return compare.ReadParquetKeys(file, keyCols)
+	case RefPg:
+		return d.pgReferenceKeys(param, table, keyCols)
+	}
+	return nil, errors.New(fmt.Sprintf("unknown reference type: %s", param.RefType))
+}
+
+// referencePath 参照文件只允许从配置的目录中读取
+func referencePath(path string) (string, error) {
+	dir := config.GetService().ReferenceDir
+	if dir == "" {
+		return "", errors.New("reference dir is not configured")
+	}
+	full := filepath.Join(dir, filepath.Clean("/"+path))
+	return full, nil
+}
+
+// pgReferenceKeys 从参照pg库读取主键，日期等字段与导出时做相同的转换，保证与mysql中的值一致
+func (d *dao) pgReferenceKeys(param ReconcileParam, table TableInfo, keyCols []string) ([]compare.Key, error) {
+	pgParam := pg.QueryParam{
+		SchemaName: table.schemaName,
+		TableName:  table.tableName,
+		ProcType:   pg.OpAll,
+	}
+	if err := d.preparePgParam(&pgParam); err != nil {
+		return nil, err
+	}
+	if param.RefName != "" {
+		ref, ok := config.GetReference(param.RefName)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("unknown reference: %s", param.RefName))
+		}
+		pgParam.DsnInfo = ref.DSN
+		// 未配置查询时使用表的全量导出sql
+		if query := ref.Queries[table.finName]; query != "" {
+			pgParam.ProcSql, pgParam.ProcArgs, pgParam.SqlType = query, nil, pg.SqlNormal
+		}
+	}
+	rows, err := pgDao.GetRows(pgParam)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	colNames, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	sinkCols := sinkColumns(colNames)
+	keyIndex := make([]int, len(keyCols))
+	for i, key := range keyCols {
+		if keyIndex[i] = indexOf(sinkCols, key); keyIndex[i] < 0 {
+			return nil, errors.New(fmt.Sprintf("key column %s not found in pg result", key))
+		}
+	}
+	var keys []compare.Key
+	_, _, err = d.eachRow(pg.FinanceInfo{SchemaName: table.schemaName, TableName: table.tableName}, rows, false,
+		func(_ string, values []interface{}) error {
+			key := make(compare.Key, len(keyIndex))
+			for i, idx := range keyIndex {
+				key[i] = fmt.Sprint(values[idx])
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	return keys, err
+}
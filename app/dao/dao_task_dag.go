@@ -0,0 +1,276 @@
+package dao
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	"hxextract/app/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 任务节点状态
+const (
+	TaskPending = "pending" // 等待上游任务
+	TaskRunning = "running"
+	TaskSuccess = "success"
+	TaskFailed  = "failed"
+	TaskSkipped = "skipped" // 上游任务失败或跳过
+)
+
+type (
+	// TaskStatus 任务节点最近一次执行情况
+	TaskStatus struct {
+		TaskId      int       `json:"id"`
+		SchemaName  string    `json:"schema"`
+		TableName   string    `json:"table"`
+		Group       string    `json:"group,omitempty"` // 导出分组的任务
+		Export      int       `json:"export"`
+		DependsOn   []int     `json:"depends_on"`
+		Hooks       []string  `json:"hooks"`
+		Cron        []string  `json:"cron"`
+		Status      string    `json:"status"`
+		TriggeredBy int       `json:"triggered_by"` // 触发本次执行的定时任务id
+		LastRun     time.Time `json:"last_run"`
+		LastSuccess time.Time `json:"last_success"`
+		CostMs      int64     `json:"cost_ms"`
+		Error       string    `json:"error"`
+	}
+
+	// taskDag 定时任务依赖关系，key为任务id
+	taskDag struct {
+		sync.RWMutex
+		tasks      map[int]TaskItem
+		downstream map[int][]int
+		status     map[int]*TaskStatus
+	}
+
+	// taskHook 任务导出成功后执行的动作
+	taskHook func(d *dao, task TaskItem) error
+)
+
+// taskHooks 可在TaskItems.hooks中配置的动作
+var taskHooks = map[string]taskHook{
+	// 对比并补全缺失的数据，不删除，导出分组的任务对比分组中所有的表
+	"compare": func(d *dao, task TaskItem) error {
+		if task.group != "" {
+			res, err := d.compareGroup(task.group, CmpAndAdd, metrics.GetTriggerType(pg.TrigCron), task.operator(), 0)
+			if err != nil {
+				return err
+			}
+			return res.Err()
+		}
+		_, _, err := d.CompareAndUpdateMysql(task.schemaName, task.tableName, CmpAndAdd, metrics.GetTriggerType(pg.TrigCron),
+			task.operator())
+		return err
+	},
+}
+
+//
+//  taskDagLoad
+//  @Description: 加载任务依赖关系，存在循环依赖时不加载依赖关系，任务仍按各自的定时执行
+//  @receiver d
+//  @param items
+//  @return error
+//
+func (d *dao) taskDagLoad(items []TaskItem) error {
+	tasks := make(map[int]TaskItem, len(items))
+	status := make(map[int]*TaskStatus, len(items))
+	for _, task := range items {
+		tasks[task.id] = task
+		status[task.id] = &TaskStatus{
+			TaskId:     task.id,
+			SchemaName: task.schemaName,
+			TableName:  task.tableName,
+			Group:      task.group,
+			Export:     task.opType,
+			DependsOn:  task.dependsOn,
+			Hooks:      task.hooks,
+			Cron:       task.cron,
+			Status:     TaskPending,
+		}
+		for _, hook := range task.hooks {
+			if _, ok := taskHooks[hook]; !ok {
+				log.Log.Warn(fmt.Sprintf("unknown task hook: %s", hook), zap.Int("task", task.id))
+			}
+		}
+	}
+	downstream := make(map[int][]int)
+	indegree := make(map[int]int)
+	for _, task := range items {
+		for _, dep := range task.dependsOn {
+			if _, ok := tasks[dep]; !ok {
+				log.Log.Warn(fmt.Sprintf("task dependency not found: %d", dep), zap.Int("task", task.id))
+				continue
+			}
+			downstream[dep] = append(downstream[dep], task.id)
+			indegree[task.id]++
+		}
+	}
+	// 拓扑排序检查循环依赖
+	var queue []int
+	for id := range tasks {
+		if indegree[id] == 0 {
+			queue = append(queue, id)
+		}
+	}
+	processed := 0
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		processed++
+		for _, next := range downstream[id] {
+			if indegree[next]--; indegree[next] == 0 {
+				queue = append(queue, next)
+			}
+		}
+	}
+	var err error
+	if processed < len(tasks) {
+		downstream = make(map[int][]int)
+		err = errors.New("task dependencies: cycle detected")
+	}
+	d.tasks.Lock()
+	d.tasks.tasks = tasks
+	d.tasks.downstream = downstream
+	d.tasks.status = status
+	d.tasks.Unlock()
+	return err
+}
+
+//
+//  runTaskDag
+//  @Description: 执行任务及所有直接或间接依赖它的下游任务，下游任务在本次执行中的上游任务都成功后才执行，
+//  否则跳过；不在本次执行中的上游任务不影响下游任务
+//  @receiver d
+//  @param root 定时触发的任务
+//
+func (d *dao) runTaskDag(root TaskItem) {
+	d.tasks.RLock()
+	run := map[int]TaskItem{root.id: root}
+	stack := []int{root.id}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, next := range d.tasks.downstream[id] {
+			if _, ok := run[next]; !ok {
+				run[next] = d.tasks.tasks[next]
+				stack = append(stack, next)
+			}
+		}
+	}
+	d.tasks.RUnlock()
+
+	done := make(map[int]chan struct{}, len(run))
+	for id := range run {
+		done[id] = make(chan struct{})
+		d.setTaskStatus(id, func(s *TaskStatus) {
+			s.Status = TaskPending
+			s.TriggeredBy = root.id
+		})
+	}
+	var mutex sync.Mutex
+	results := make(map[int]string, len(run))
+	var wg sync.WaitGroup
+	for _, task := range run {
+		wg.Add(1)
+		go func(task TaskItem) {
+			defer wg.Done()
+			defer close(done[task.id])
+			result := TaskSuccess
+			for _, dep := range task.dependsOn {
+				ch, ok := done[dep]
+				if !ok || dep == task.id {
+					continue
+				}
+				<-ch
+				mutex.Lock()
+				if results[dep] != TaskSuccess {
+					result = TaskSkipped
+				}
+				mutex.Unlock()
+			}
+			if result == TaskSkipped {
+				log.Log.Warn("skip task due to failed upstream", zap.Int("task", task.id),
+					zap.String("schema", task.schemaName), zap.String("table", task.tableName))
+				d.setTaskStatus(task.id, func(s *TaskStatus) {
+					s.Status = TaskSkipped
+					s.Error = ""
+				})
+			} else if err := d.execTask(task); err != nil {
+				result = TaskFailed
+			}
+			mutex.Lock()
+			results[task.id] = result
+			mutex.Unlock()
+		}(task)
+	}
+	wg.Wait()
+	if len(run) > 1 {
+		log.Log.Info("task dag finished", zap.Int("root", root.id), zap.Any("results", results))
+	}
+}
+
+// execTask 执行单个任务节点：导出成功后按顺序执行配置的动作，任一步失败则节点失败
+func (d *dao) execTask(task TaskItem) error {
+	startTime := time.Now()
+	d.setTaskStatus(task.id, func(s *TaskStatus) {
+		s.Status = TaskRunning
+		s.LastRun = startTime
+	})
+	err := d.exportTask(task)
+	for _, name := range task.hooks {
+		if err != nil {
+			break
+		}
+		hook, ok := taskHooks[name]
+		if !ok {
+			continue
+		}
+		if err = hook(d, task); err != nil {
+			err = errors.New(fmt.Sprintf("hook %s: %s", name, err.Error()))
+		}
+	}
+	cost := time.Since(startTime).Milliseconds()
+	d.setTaskStatus(task.id, func(s *TaskStatus) {
+		s.CostMs = cost
+		if err != nil {
+			s.Status = TaskFailed
+			s.Error = err.Error()
+		} else {
+			s.Status = TaskSuccess
+			s.Error = ""
+			s.LastSuccess = time.Now()
+		}
+	})
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("task failed: %s", err.Error()), zap.Int("task", task.id),
+			zap.String("schema", task.schemaName), zap.String("table", task.tableName))
+	}
+	return err
+}
+
+func (d *dao) setTaskStatus(id int, fn func(s *TaskStatus)) {
+	d.tasks.Lock()
+	defer d.tasks.Unlock()
+	if s, ok := d.tasks.status[id]; ok {
+		fn(s)
+	}
+}
+
+// TaskStatuses 获取所有定时任务节点的执行状态
+func (d *dao) TaskStatuses() []TaskStatus {
+	d.tasks.RLock()
+	defer d.tasks.RUnlock()
+	ret := make([]TaskStatus, 0, len(d.tasks.status))
+	for _, s := range d.tasks.status {
+		ret = append(ret, *s)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].TaskId < ret[j].TaskId
+	})
+	return ret
+}
@@ -8,6 +8,8 @@ import (
 	"hxextract/app/dao/orm"
 	"hxextract/app/dao/pg"
 	"hxextract/app/log"
+	"hxextract/app/secret"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -23,6 +25,13 @@ type (
 		dbname  string
 		sslmode string
 	}
+	// pgConnRef TableInfo中未解析的pg连接信息，server、user、passwd可以是凭据引用
+	pgConnRef struct {
+		server   string
+		user     string
+		passwd   string
+		database string
+	}
 	TableInfo struct {
 		tableName  string
 		schemaName string
@@ -31,16 +40,42 @@ type (
 		repProc    string
 		finProc    string
 		codeProc   string
+		procKind   string               // sql类型，详见：pg.Proc*
+		procs      map[int]procTemplate // 导出方式=>解析后的sql模板
+		rejected   map[int]string       // sql有误的导出方式=>原因，不能按该方式导出
 		dsnInfo    string
+		keyColumns []string // 主键字段，为空时从mysql唯一索引获取
+		tags       []string // 标签，用于按标签定义表分组
+	}
+	// procTemplate 按proc_kind处理并解析后的导出sql
+	procTemplate struct {
+		tmpl *pg.Template
+		flag int // sql类型，详见：pg.Sql*
 	}
 	TaskItem struct {
+		id         int
 		tableName  string
 		schemaName string
 		opType     int
+		dependsOn  []int    // 依赖的任务id
+		hooks      []string // 导出成功后执行的动作
+		cron       []string // 定时配置，为空时只作为下游任务执行
+		group      string   // 导出的表分组，不为空时导出分组中所有的表
 	}
 
 	SchemaInfo  map[string]TableInfo
 	FinnameInfo map[string]TableInfo
+
+	// TableMeta 对外提供的财务表信息，不包含pg连接信息
+	TableMeta struct {
+		FinName    string         `json:"finname"`
+		SchemaName string         `json:"schema"`
+		TableName  string         `json:"table"`
+		KeyColumns []string       `json:"key_columns"`
+		ProcTypes  []int          `json:"types"`              // 已配置sql的导出方式
+		Rejected   map[int]string `json:"rejected,omitempty"` // sql有误未加载的导出方式及原因
+		Tags       []string       `json:"tags,omitempty"`
+	}
 )
 
 /*getInfo
@@ -76,6 +111,49 @@ func makeDSN(info ConnInfo) string {
 	return pgsqlDSN
 }
 
+//
+//  pgDsn
+//  @Description: 生成表的pg dsn，server、user_name、passwd包含凭据引用时dsn中只有引用，
+//  作为连接的key，连接时由resolvePgDsn解析为实际的dsn
+//  @receiver d
+//  @param ref
+//  @return string
+//
+func (d *DB) pgDsn(ref pgConnRef) string {
+	if !secret.HasRef(ref.server) && !secret.HasRef(ref.user) && !secret.HasRef(ref.passwd) {
+		return makeDSN(getInfo(ref.server, ref.user, ref.passwd, ref.database))
+	}
+	dsn := fmt.Sprintf("server=%s user=%s password=%s dbname=%s", ref.server, ref.user, ref.passwd, ref.database)
+	d.pgRefs.Store(dsn, ref)
+	return dsn
+}
+
+// resolvePgDsn 解析dsn中的凭据引用，refresh为true时重新获取凭据
+func (d *DB) resolvePgDsn(dsn string, refresh bool) (string, error) {
+	v, ok := d.pgRefs.Load(dsn)
+	if !ok {
+		if refresh {
+			secret.Invalidate(dsn)
+		}
+		return secret.Resolve(dsn)
+	}
+	ref := v.(pgConnRef)
+	values := []string{ref.server, ref.user, ref.passwd}
+	for i := range values {
+		if refresh {
+			secret.Invalidate(values[i])
+		}
+		var err error
+		if values[i], err = secret.Resolve(values[i]); err != nil {
+			return "", err
+		}
+	}
+	if !strings.Contains(values[0], ":") {
+		return "", errors.New(fmt.Sprintf("server should be host:port, got %s", ref.server))
+	}
+	return makeDSN(getInfo(values[0], values[1], values[2], ref.database)), nil
+}
+
 /*int2Date
  * @Description: 将整数（YYYYMMDD）形式的日志转化为字符串（YYYYMMDD）形式，如果输入为0则转化为当天日期
  * @param dateInt
@@ -96,6 +174,34 @@ func int2Date(dateInt int) string {
 	return fmt.Sprintf("%02d%02d%02d", yearInt, monInt, dayInt)
 }
 
+/*splitColumns
+ * @Description: 将','分隔的字段名转化为切片，忽略空字段
+ * @param columns
+ * @return []string
+ */
+func splitColumns(columns string) []string {
+	var ret []string
+	for _, v := range strings.Split(columns, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func validProcKind(kind string) bool {
+	switch kind {
+	case pg.ProcAuto, pg.ProcQuery, pg.ProcFunction, pg.ProcRefcursor, pg.ProcRefcursors:
+		return true
+	}
+	return false
+}
+
+// operator 定时任务作为审计记录的发起方
+func (t TaskItem) operator() string {
+	return fmt.Sprintf("task:%d", t.id)
+}
+
 func (t *TableInfo) getSql(op int) string {
 	if op == pg.OpAll {
 		return t.allProc
@@ -109,13 +215,43 @@ func (t *TableInfo) getSql(op int) string {
 	return ""
 }
 
+//
+//  Tables
+//  @Description: 获取财务表信息，主键未配置时从mysql唯一索引获取
+//  @receiver d
+//  @param schemaName 为空时返回所有表
+//  @return []TableMeta
+//
+func (d *dao) Tables(schemaName string) []TableMeta {
+	ret := make([]TableMeta, 0, len(d.DB.financeInfo))
+	for finName, table := range d.DB.financeInfo {
+		if schemaName != "" && table.schemaName != schemaName {
+			continue
+		}
+		meta := TableMeta{FinName: finName, SchemaName: table.schemaName, TableName: table.tableName, Tags: table.tags}
+		meta.KeyColumns, _ = d.getKeyColumns(table.schemaName, table.tableName)
+		for _, op := range []int{pg.OpAll, pg.OpBbrq, pg.OpRtime, pg.OpCode} {
+			if _, ok := table.procs[op]; ok {
+				meta.ProcTypes = append(meta.ProcTypes, op)
+			}
+		}
+		if len(table.rejected) > 0 {
+			meta.Rejected = table.rejected
+		}
+		ret = append(ret, meta)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].FinName < ret[j].FinName
+	})
+	return ret
+}
+
 // 加载财务表信息
 func (d *dao) tableinfoDbLoad() error {
 	log.Log.Info("init table info")
 	var result []orm.TableInfo
-	d.DB.defaultOrm.Table("TableInfo").Find(&result)
-	if d.DB.defaultOrm.Error != nil {
-		return d.DB.defaultOrm.Error
+	if err := d.DB.orm().Table("TableInfo").Find(&result).Error; err != nil {
+		return err
 	}
 	if len(result) == 0 {
 		return errors.New("no table info found")
@@ -124,7 +260,7 @@ func (d *dao) tableinfoDbLoad() error {
 	d.DB.financeInfo = make(FinnameInfo)
 	d.DB.gTableInfo = make(map[string]SchemaInfo)
 	for _, v := range result {
-		dsn := makeDSN(getInfo(v.Server, v.User, v.Passwd, v.Database))
+		dsn := d.DB.pgDsn(pgConnRef{server: v.Server, user: v.User, passwd: v.Passwd, database: v.Database})
 		tableinfo := TableInfo{
 			tableName:  v.TableName,
 			schemaName: v.SchemaName,
@@ -134,9 +270,22 @@ func (d *dao) tableinfoDbLoad() error {
 			repProc:    v.RepProc,
 			finProc:    v.FinProc,
 			codeProc:   v.CodeProc,
+			procKind:   strings.TrimSpace(v.ProcKind),
+			keyColumns: splitColumns(v.KeyColumns),
+			tags:       splitColumns(v.Tags),
+		}
+		if err := tableinfo.parseProcs(); err != nil {
+			log.Log.Error(fmt.Sprintf("skip table with invalid sql: %s", err.Error()),
+				zap.String("schema", v.SchemaName), zap.String("table", v.TableName))
+			continue
+		}
+		for op, reason := range tableinfo.rejected {
+			log.Log.Error(fmt.Sprintf("reject invalid sql: %s", reason),
+				zap.String("schema", v.SchemaName), zap.String("table", v.TableName), zap.Int("type", op))
 		}
 		if _, ok := d.DB.gTableInfo[v.SchemaName]; !ok {
 			d.DB.gTableInfo[v.SchemaName] = make(SchemaInfo)
+			d.DB.allowSchema(v.SchemaName, "compare_"+v.SchemaName)
 		}
 		d.DB.gTableInfo[v.SchemaName][v.TableName] = tableinfo
 		d.DB.financeInfo[v.FinName] = tableinfo
@@ -148,37 +297,65 @@ func (d *dao) tableinfoDbLoad() error {
 func (d *dao) taskitemsDbLoad() error {
 	log.Log.Info("init task items")
 	var result []orm.TaskItems
-	d.DB.defaultOrm.Table("TaskItems").Find(&result)
-	if d.DB.defaultOrm.Error != nil {
-		return d.DB.defaultOrm.Error
+	if err := d.DB.orm().Table("TaskItems").Find(&result).Error; err != nil {
+		return err
 	}
 	if len(result) == 0 {
 		return errors.New("no task items found")
 	}
 	tasks := 0
-	cron.InitCron()
+	items := make([]TaskItem, 0, len(result))
 	for _, v := range result {
 		taskitem := TaskItem{
+			id:         v.TaskId,
 			tableName:  v.TableName,
 			schemaName: v.SchemaName,
 			opType:     v.Export,
+			hooks:      splitColumns(v.Hooks),
+			group:      strings.TrimSpace(v.GroupName),
+		}
+		if taskitem.group != "" {
+			if _, err := d.groupTables(taskitem.group); err != nil {
+				log.Log.Warn(fmt.Sprintf("task group is unavailable: %s", err.Error()), zap.Int("task", v.TaskId))
+			}
 		}
+		for _, val := range strings.Split(v.Cron, ";") {
+			if val != "" {
+				taskitem.cron = append(taskitem.cron, val)
+			}
+		}
+		for _, dep := range splitColumns(v.DependsOn) {
+			id, err := strconv.Atoi(dep)
+			if err != nil {
+				log.Log.Warn(fmt.Sprintf("invalid task dependency: %s", dep), zap.Int("task", v.TaskId))
+				continue
+			}
+			taskitem.dependsOn = append(taskitem.dependsOn, id)
+		}
+		items = append(items, taskitem)
+	}
+	// 依赖关系有误时不影响任务各自的定时执行
+	if err := d.taskDagLoad(items); err != nil {
+		log.Log.Error(fmt.Sprintf("load task dependencies failed: %s", err.Error()))
+	}
+	cron.InitCron()
+	for _, taskitem := range items {
 		croninfo := CronTaskInfo{
 			taskinfo:    taskitem,
-			processFunc: d.exportFinCron,
+			processFunc: d.runTaskDag,
 		}
 		// 获取所有时间
-		times := strings.Split(v.Cron, ";")
-		for _, val := range times {
-			if val == "" {
-				continue
-			}
+		for _, val := range taskitem.cron {
 			taskname := taskitem.schemaName + taskitem.tableName
+			if taskitem.group != "" {
+				taskname = "group:" + taskitem.group
+			}
 			err := cron.AddTask(taskname, val, croninfo.CronTasksExport)
 			if err != nil {
 				log.Log.Warn(fmt.Sprintf("add task failed"),
 					zap.String("table", taskitem.tableName),
 					zap.String("schema", taskitem.schemaName),
+					zap.String("group", taskitem.group),
 					zap.String("crontime", val))
 				continue
 			}
@@ -190,51 +367,140 @@ func (d *dao) taskitemsDbLoad() error {
 	return nil
 }
 
-func (d *dao) getProc(para pg.QueryParam) (string, int, error) {
-	flag := pg.SqlNormal
-	schema := make(SchemaInfo)
-	var ok bool
-	if schema, ok = d.DB.gTableInfo[para.SchemaName]; !ok {
-		return "", flag, errors.New("can't find schema")
-	}
-	var table TableInfo
-	if table, ok = schema[para.TableName]; !ok {
-		return "", flag, errors.New("can't find table")
-	}
-	sql := table.getSql(para.ProcType)
-
-	if para.ProcType == pg.OpBbrq || para.ProcType == pg.OpRtime {
-		sql = strings.Replace(sql, "[start]", int2Date(para.StartDate), 1)
-		sql = strings.Replace(sql, "[end]", int2Date(para.EndDate), 1)
-	} else if para.ProcType == pg.OpCode {
-		codes := strings.Split(para.CodeList, ",")
-		var codelist string
-		for _, v := range codes {
-			codelist += "'" + v + "',"
-		}
-		sql = strings.Replace(sql, "[codelist]", strings.TrimRight(codelist, ","), 1)
-	}
-	// 处理存储过程
-	if strings.Contains(sql, "{") && strings.Contains(sql, "}") {
+// 各导出方式对应的TableInfo字段
+var procColumns = map[int]string{
+	pg.OpAll:   "all_proc",
+	pg.OpBbrq:  "rep_proc",
+	pg.OpRtime: "fin_proc",
+	pg.OpCode:  "code_proc",
+}
+
+// procProvides 各导出方式总会提供的参数，模板中可以不使用，其余参数只能用在可选子句中
+var procProvides = map[int][]string{
+	pg.OpAll:   nil,
+	pg.OpBbrq:  {pg.ParamStart, pg.ParamEnd},
+	pg.OpRtime: {pg.ParamStart, pg.ParamEnd},
+	pg.OpCode:  {pg.ParamCodes},
+}
+
+//
+//  parseProcs
+//  @Description: 按proc_kind处理各导出方式的sql并解析为模板，校验模板必需的参数导出方式总会提供，
+//  sql有误的导出方式记录到rejected，不影响其他导出方式
+//  @receiver t
+//  @return error proc_kind有误时返回错误
+//
+func (t *TableInfo) parseProcs() error {
+	if !validProcKind(t.procKind) {
+		return errors.New(fmt.Sprintf("invalid proc_kind: %s", t.procKind))
+	}
+	t.procs = make(map[int]procTemplate)
+	t.rejected = make(map[int]string)
+	for op, column := range procColumns {
+		sql := t.getSql(op)
+		if sql == "" {
+			continue
+		}
+		sql, flag := procSql(sql, t.procKind)
+		tmpl, err := pg.ParseTemplate(sql)
+		if err == nil {
+			err = tmpl.Validate(procProvides[op]...)
+		}
+		if err != nil {
+			t.rejected[op] = fmt.Sprintf("%s: %s", column, err.Error())
+			continue
+		}
+		t.procs[op] = procTemplate{tmpl: tmpl, flag: flag}
+	}
+	return nil
+}
+
+//
+//  getProc
+//  @Description: 按导出参数渲染sql模板，日期和代码列表绑定为参数
+//  @receiver d
+//  @param para
+//  @return string 使用?占位符的sql
+//  @return []interface{} 占位符对应的参数
+//  @return int sql类型，详见：pg.Sql*
+//  @return error
+//
+func (d *dao) getProc(para pg.QueryParam) (string, []interface{}, int, error) {
+	schema, ok := d.DB.gTableInfo[para.SchemaName]
+	if !ok {
+		return "", nil, pg.SqlNormal, errors.New("can't find schema")
+	}
+	table, ok := schema[para.TableName]
+	if !ok {
+		return "", nil, pg.SqlNormal, errors.New("can't find table")
+	}
+	proc, ok := table.procs[para.ProcType]
+	if reason, rejected := table.rejected[para.ProcType]; rejected {
+		return "", nil, pg.SqlNormal, errors.New(fmt.Sprintf("invalid sql for type %d: %s", para.ProcType, reason))
+	}
+	if !ok {
+		return "", nil, pg.SqlNormal, errors.New(fmt.Sprintf("no sql configured for type %d", para.ProcType))
+	}
+	values := map[string]interface{}{pg.ParamCodes: splitColumns(para.CodeList), pg.ParamStart: "", pg.ParamEnd: ""}
+	// 按日期导出时未指定日期为当天，其余导出方式指定日期时才提供
+	if para.ProcType == pg.OpBbrq || para.ProcType == pg.OpRtime || para.StartDate != 0 {
+		values[pg.ParamStart] = int2Date(para.StartDate)
+	}
+	if para.ProcType == pg.OpBbrq || para.ProcType == pg.OpRtime || para.EndDate != 0 {
+		values[pg.ParamEnd] = int2Date(para.EndDate)
+	}
+	sql, args, err := proc.tmpl.Render(values)
+	if err != nil {
+		return "", nil, proc.flag, err
+	}
+	return sql, args, proc.flag, nil
+}
+
+// procSql 按proc_kind补全函数和存储过程的调用，未配置时按sql内容判断
+func procSql(sql string, kind string) (string, int) {
+	sql = strings.TrimSpace(sql)
+	call := strings.TrimRight(sql, "; ")
+	isSelect := strings.HasPrefix(strings.ToLower(sql), "select")
+	switch kind {
+	case pg.ProcFunction:
+		if !isSelect {
+			sql = "select * from " + call
+		}
+		return sql, pg.SqlNormal
+	case pg.ProcRefcursor:
+		if !isSelect {
+			sql = "select " + call
+		}
+		return sql, pg.SqlStoredProcedure
+	case pg.ProcRefcursors:
+		if !isSelect {
+			sql = "select * from " + call
+		}
+		return sql, pg.SqlRefcursors
+	case pg.ProcAuto:
 		// 财务数据中使用存储过程的sql均为用{}包围且缺select，需要进行处理
-		sql = strings.Replace(sql, "{", "select ", 1)
-		sql = strings.Replace(sql, "}", ";", 1)
-		flag = pg.SqlStoredProcedure
-	} else {
-		// 非存储过程 适配部分sql中有set enable_nestloop=on
-		sqlSplit := strings.Split(sql, ";")
-		for _, unitSql := range sqlSplit {
-			// 去掉首尾冗余空格
-			unitSql = strings.Trim(unitSql, " ")
-			if strings.Contains(unitSql, "select") || strings.Contains(unitSql, "SELECT") {
-				sql = unitSql + ";"
-				break
-			}
-			if unitSql != "" {
-				// 说明存在需要开启索引开关的操作
-				flag = pg.SqlIndex
-			}
+		if strings.Contains(sql, "{") && strings.Contains(sql, "}") {
+			sql = strings.Replace(sql, "{", "select ", 1)
+			sql = strings.Replace(sql, "}", ";", 1)
+			return sql, pg.SqlStoredProcedure
+		}
+	}
+	return indexSql(sql)
+}
+
+// indexSql 适配部分sql中有set enable_nestloop=on，去掉前置语句，改为在事务中开启索引
+func indexSql(sql string) (string, int) {
+	flag := pg.SqlNormal
+	for _, unitSql := range strings.Split(sql, ";") {
+		// 去掉首尾冗余空格
+		unitSql = strings.Trim(unitSql, " ")
+		if strings.Contains(unitSql, "select") || strings.Contains(unitSql, "SELECT") {
+			return unitSql + ";", flag
+		}
+		if unitSql != "" {
+			// 说明存在需要开启索引开关的操作
+			flag = pg.SqlIndex
 		}
 	}
-	return sql, flag, nil
+	return sql, flag
 }
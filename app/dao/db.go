@@ -1,162 +1,184 @@
 package dao
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"gorm.io/gorm/schema"
 	"hxextract/app/config"
+	"hxextract/app/dao/conn"
 	"hxextract/app/log"
+	"hxextract/app/metrics"
+	"hxextract/app/secret"
+	"sync"
+	"time"
 )
 
+// 数据校验规则所在的库
+const checkRuleSchema = "topview"
+
 // DB mysql 连接管理
 type DB struct {
-	// MysqlDbs 用于存储schema=>db的映射关系
-	MysqlDbs map[string]*sql.DB
-	// 默认库连接，用于连接信息库
-	defaultDb *sql.DB
-	// 默认库gorm连接，用于处理type_describe表
+	// mysql 各库的连接池，key为库名，默认库和Mysql.DbNames中的库不被空闲回收
+	mysql *conn.Registry
+	// 默认库gorm连接，用于处理type_describe表，默认库重连后重建
 	defaultOrm *gorm.DB
+	// 创建defaultOrm时的默认库连接池
+	ormConn *sql.DB
+	ormMu   sync.Mutex
 	// 默认库名，用于存储数据信息
 	defaultSchema string
 	// 库表详细信息，key是schema，value是schema下的所有表
 	gTableInfo map[string]SchemaInfo
 	// 财务文件名与mysql财务表的映射关系
 	financeInfo FinnameInfo
+	// 从mysql唯一索引获取的主键字段缓存，key为schema.table，value为[]string
+	keyColumns sync.Map
+	// TableInfo中包含凭据引用的pg连接信息，key为dsn，value为pgConnRef，连接时再解析
+	pgRefs sync.Map
+	// 允许建立连接的mysql库，来自配置、TableInfo、衍生规则和新鲜度sla，避免为请求中的任意库名创建连接池
+	schemas sync.Map
 }
 
 func NewDB() (db *DB, cf func(), err error) {
 	log.Log.Info("init mysql connection")
 	db = new(DB)
-	db.MysqlDbs = make(map[string]*sql.DB)
+	db.mysql = conn.New(metrics.PoolMysql, newDbConnOf, connOptions(), nil)
 	err = db.mysqlConnInit()
 	cf = db.Close
 	return
 }
 
+// connOptions 连接池注册表参数，mysql与pg共用
+func connOptions() conn.Options {
+	cfg := config.GetConnection()
+	return conn.Options{
+		IdleEvict:   cfg.IdleEvict,
+		PingTimeout: cfg.PingTimeout,
+		BackoffMin:  cfg.BackoffMin,
+		BackoffMax:  cfg.BackoffMax,
+	}
+}
+
 /*Close
- * @Description: 关闭所有db连接，并清空map
+ * @Description: 关闭所有db连接
  */
 func (d *DB) Close() {
-	for _, db := range d.MysqlDbs {
-		if db == nil {
-			continue
-		}
-		err := db.Close()
-		if err != nil {
-
-		}
+	for dbname, err := range d.mysql.Close() {
+		log.Log.Error("close mysql connection failed", zap.String("dbname", dbname), zap.Error(err))
 	}
-	d.defaultDb = nil
-	d.defaultSchema = ""
-	d.MysqlDbs = make(map[string]*sql.DB)
+	log.Log.Info("mysql connections closed")
 }
 
 //
 //  mysqlConnInit
-//  @Description: 初始化mysql连接
+//  @Description: 初始化默认库和Mysql.DbNames中各库的连接
 //  @receiver d
 //  @return error
 //
 func (d *DB) mysqlConnInit() error {
 	myCfg := config.GetMysql()
 	d.defaultSchema = myCfg.DefaultDbname
-	orm, err := gorm.Open(mysql.Open(makeDsn(myCfg.Address, myCfg.Params, d.defaultSchema)), &gorm.Config{
+	d.allowSchema(d.defaultSchema, checkRuleSchema)
+	d.allowSchema(myCfg.DbNames...)
+	d.mysql.Pin(d.defaultSchema)
+	if _, err := d.mysql.Get(d.defaultSchema); err != nil {
+		return err
+	}
+	d.orm()
+	for _, dbname := range myCfg.DbNames {
+		d.mysql.Pin(dbname)
+		if _, err := d.mysql.Get(dbname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+//  orm
+//  @Description: 默认库的gorm连接，默认库连接池重建后重新创建，默认库不可用时返回上一次的连接
+//  @receiver d
+//  @return *gorm.DB 从未连接成功时为nil
+//
+func (d *DB) orm() *gorm.DB {
+	if d == nil || d.mysql == nil {
+		return nil
+	}
+	db, err := d.mysql.Get(d.defaultSchema)
+	d.ormMu.Lock()
+	defer d.ormMu.Unlock()
+	if err != nil || db == d.ormConn {
+		return d.defaultOrm
+	}
+	orm, err := gorm.Open(mysql.New(mysql.Config{Conn: db}), &gorm.Config{
 		NamingStrategy: schema.NamingStrategy{
 			TablePrefix:   "",
 			SingularTable: true,
 		},
 		Logger: logger.Default.LogMode(logger.Silent),
 	})
-	if err == nil {
-		d.defaultOrm = orm
-		d.defaultDb, _ = orm.DB()
-	}
-	for _, dbname := range myCfg.DbNames {
-		if db, err := newDbConn(makeDsn(myCfg.Address, myCfg.Params, dbname)); err != nil {
-			return err
-		} else {
-			d.MysqlDbs[dbname] = db
-		}
+	if err != nil {
+		log.Log.Error("create gorm connection failed", zap.String("dbname", d.defaultSchema), zap.Error(err))
+		return d.defaultOrm
 	}
-	d.MysqlDbs[d.defaultSchema] = d.defaultDb
-	return nil
+	d.defaultOrm, d.ormConn = orm, db
+	return orm
 }
 
-// 查看该数据库是否加载连接，如果未加载尝试加载
-func (d *DB) inDataBases(schemaName string) (bool, error) {
-	_, ok := d.MysqlDbs[schemaName]
-	if !ok {
-		myCfg := config.GetMysql()
-		if db, err := newDbConn(makeDsn(myCfg.Address, myCfg.Params, schemaName)); err != nil {
-			return false, err
-		} else {
-			d.MysqlDbs[schemaName] = db
-			return true, nil
-		}
+// defaultDb 默认库连接，用于连接信息库
+func (d *DB) defaultDb() (*sql.DB, error) {
+	return d.mysql.Get(d.defaultSchema)
+}
+
+// allowSchema 允许为这些库建立连接
+func (d *DB) allowSchema(schemaNames ...string) {
+	for _, schemaName := range schemaNames {
+		d.schemas.Store(schemaName, true)
 	}
-	return ok, nil
 }
 
 //
 //  getConn
-//  @Description: 通过库名获取对应连接
+//  @Description: 通过库名获取对应连接，未加载时建立连接，只能获取allowSchema中的库
 //  @receiver d
 //  @param schemaName
-//  @return *gorm.DB
+//  @return *sql.DB
+//  @return func() 释放连接池，释放前不会被空闲回收，使用完后需要调用
 //  @return error
 //
-func (d *DB) getConn(schemaName string) (*sql.DB, error) {
-	ok, err := d.inDataBases(schemaName)
-	if ok {
-		return d.MysqlDbs[schemaName], nil
-	} else {
-		return nil, err
+func (d *DB) getConn(schemaName string) (*sql.DB, func(), error) {
+	if _, ok := d.schemas.Load(schemaName); !ok {
+		return nil, func() {}, errors.New(fmt.Sprintf("unknown mysql schema: %s", schemaName))
 	}
+	return d.mysql.Acquire(schemaName)
+}
+
+// mysqlDbs 已建立连接的库
+func (d *DB) mysqlDbs() map[string]*sql.DB {
+	return d.mysql.Connected()
 }
 
 //
 //  connectCheck
-//  @Description: 检查连接是否正常
+//  @Description: 检查已建立的连接，断开的重新获取凭据后重连，并回收空闲的连接
 //  @receiver d
 //  @return error
 //
 func (d *DB) connectCheck() error {
-	myCfg := config.GetMysql()
-	if d.defaultDb.Ping() != nil {
-		log.Log.Error("mysql connect lost, try to reconnect", zap.String("dbname", d.defaultSchema))
-		orm, err := gorm.Open(mysql.Open(makeDsn(myCfg.Address, myCfg.Params, d.defaultSchema)), &gorm.Config{
-			NamingStrategy: schema.NamingStrategy{
-				TablePrefix:   "",
-				SingularTable: true,
-			},
-			Logger: logger.Default.LogMode(logger.Silent),
-		})
-		if err != nil {
-			log.Log.Error("reconnect mysql connection failed",
-				zap.String("dbname", d.defaultSchema), zap.Error(err))
-			return err
-		}
-		log.Log.Info("reconnect mysql connection successfully",
-			zap.String("dbname", d.defaultSchema))
-		d.defaultOrm = orm
-		d.defaultDb, _ = orm.DB()
-	}
-	for dbname, db := range d.MysqlDbs {
-		if db.Ping() != nil {
-			log.Log.Error("mysql connection lost, try to reconnect", zap.String("dbname", dbname))
-			if db, err := newDbConn(makeDsn(myCfg.Address, myCfg.Params, dbname)); err != nil {
-				log.Log.Error("reconnect mysql connection failed", zap.String("dbname", dbname), zap.Error(err))
-				return err
-			} else {
-				log.Log.Info("reconnect mysql connection successfully", zap.String("dbname", dbname))
-				d.MysqlDbs[dbname] = db
-			}
-		}
+	err := d.mysql.Check()
+	if err != nil {
+		log.Log.Error("reconnect mysql connection failed", zap.Error(err))
 	}
-	return nil
+	for _, dbname := range d.mysql.Evict() {
+		log.Log.Info("close idle mysql connection", zap.String("dbname", dbname))
+	}
+	return err
 }
 
 /*newDbConn
@@ -167,9 +189,76 @@ func (d *DB) connectCheck() error {
  */
 func newDbConn(dsn string) (db *sql.DB, err error) {
 	db, err = sql.Open("mysql", dsn)
+	if err == nil {
+		setPool(db)
+	}
 	return
 }
 
+// setPool 按Mysql.Active、Idle、IdleTimeout设置连接池，空闲超过IdleTimeout的连接被关闭
+func setPool(db *sql.DB) {
+	myCfg := config.GetMysql()
+	db.SetMaxOpenConns(myCfg.Active)
+	db.SetMaxIdleConns(myCfg.Idle)
+	db.SetConnMaxIdleTime(myCfg.IdleTimeout)
+}
+
+// execWithTimeout 执行单条写入语句
+func execWithTimeout(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := execContext()
+	defer cancel()
+	return db.ExecContext(ctx, query, args...)
+}
+
+// queryContext 单次查询的超时，为Mysql.QueryTimeout，流式读取整表的查询不设超时
+func queryContext() (context.Context, context.CancelFunc) {
+	return timeoutContext(config.GetMysql().QueryTimeout)
+}
+
+// execContext 单条写入语句的超时，为Mysql.ExecTimeout
+func execContext() (context.Context, context.CancelFunc) {
+	return timeoutContext(config.GetMysql().ExecTimeout)
+}
+
+// tranContext 事务的超时，为Mysql.TranTimeout
+func tranContext() (context.Context, context.CancelFunc) {
+	return timeoutContext(config.GetMysql().TranTimeout)
+}
+
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// stats 各库连接池的状态，用于连接池指标
+func (d *DB) stats() map[string]sql.DBStats {
+	return d.mysql.Stats()
+}
+
+// newDbConnOf 创建库的mysql连接，refresh为true时重新获取Mysql.Address中的凭据
+func newDbConnOf(dbName string, refresh bool) (*sql.DB, error) {
+	dsn, err := mysqlDsn(dbName, refresh)
+	if err != nil {
+		return nil, err
+	}
+	return newDbConn(dsn)
+}
+
+// mysqlDsn 生成库的dsn，Mysql.Address可以是凭据引用或包含${}形式的引用
+func mysqlDsn(dbName string, refresh bool) (string, error) {
+	myCfg := config.GetMysql()
+	if refresh {
+		secret.Invalidate(myCfg.Address)
+	}
+	address, err := secret.Resolve(myCfg.Address)
+	if err != nil {
+		return "", err
+	}
+	return makeDsn(address, myCfg.Params, dbName), nil
+}
+
 func makeDsn(address string, params string, dbName string) string {
 	return address + dbName + "?" + params
 }
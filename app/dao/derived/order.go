@@ -0,0 +1,140 @@
+package derived
+
+/*
+purpose:衍生规则的依赖排序和循环依赖检测，每条规则为源表到目标表的一条边
+*/
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+// Edge 衍生规则的源表和目标表
+type Edge struct {
+	Source string
+	Target string
+}
+
+//
+//  Order
+//  @Description: 按依赖顺序返回源表更新后需要执行的所有规则，一个表的所有上游规则都执行后才执行以它为源表的规则，
+//  同一源表的规则按edges中的顺序执行
+//  @param edges 所有规则
+//  @param source 更新的源表
+//  @return []int 需要执行的规则在edges中的下标
+//  @return error 源表可达的规则存在循环依赖时返回错误
+//
+func Order(edges []Edge, source string) ([]int, error) {
+	bySource := make(map[string][]int)
+	for i, e := range edges {
+		bySource[e.Source] = append(bySource[e.Source], i)
+	}
+	// 找到源表可达的所有表并统计入度
+	indegree := make(map[string]int)
+	seen := map[string]bool{source: true}
+	stack := []string{source}
+	for len(stack) > 0 {
+		table := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, i := range bySource[table] {
+			target := edges[i].Target
+			indegree[target]++
+			if !seen[target] {
+				seen[target] = true
+				stack = append(stack, target)
+			}
+		}
+	}
+	var order []int
+	processed := 0
+	queue := []string{source}
+	if indegree[source] > 0 {
+		queue = nil
+	}
+	for len(queue) > 0 {
+		table := queue[0]
+		queue = queue[1:]
+		processed++
+		for _, i := range bySource[table] {
+			order = append(order, i)
+			target := edges[i].Target
+			if indegree[target]--; indegree[target] == 0 {
+				queue = append(queue, target)
+			}
+		}
+	}
+	if processed < len(seen) {
+		return nil, errors.New(fmt.Sprintf("derived rules: cycle detected from %s", source))
+	}
+	return order, nil
+}
+
+//
+//  Cycles
+//  @Description: 找出处于循环依赖中的规则，即目标表能直接或间接回到源表的规则，去掉这些规则后不再有循环依赖
+//  @param edges 所有规则
+//  @return []int 处于循环依赖中的规则在edges中的下标，升序
+//
+func Cycles(edges []Edge) []int {
+	// 按强连通分量划分，两端在同一分量中的边处于环上
+	adj := make(map[string][]string)
+	for _, e := range edges {
+		adj[e.Source] = append(adj[e.Source], e.Target)
+	}
+	t := &tarjan{adj: adj, index: make(map[string]int), low: make(map[string]int),
+		onStack: make(map[string]bool), comp: make(map[string]int)}
+	for _, e := range edges {
+		if _, ok := t.index[e.Source]; !ok {
+			t.visit(e.Source)
+		}
+	}
+	var ret []int
+	for i, e := range edges {
+		if t.comp[e.Source] == t.comp[e.Target] {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// tarjan 计算强连通分量，comp为各表所属分量的编号
+type tarjan struct {
+	adj     map[string][]string
+	index   map[string]int
+	low     map[string]int
+	onStack map[string]bool
+	stack   []string
+	comp    map[string]int
+	next    int
+	comps   int
+}
+
+func (t *tarjan) visit(v string) {
+	t.index[v], t.low[v] = t.next, t.next
+	t.next++
+	t.stack = append(t.stack, v)
+	t.onStack[v] = true
+	for _, w := range t.adj[v] {
+		if _, ok := t.index[w]; !ok {
+			t.visit(w)
+			if t.low[w] < t.low[v] {
+				t.low[v] = t.low[w]
+			}
+		} else if t.onStack[w] && t.index[w] < t.low[v] {
+			t.low[v] = t.index[w]
+		}
+	}
+	if t.low[v] != t.index[v] {
+		return
+	}
+	for {
+		w := t.stack[len(t.stack)-1]
+		t.stack = t.stack[:len(t.stack)-1]
+		t.onStack[w] = false
+		t.comp[w] = t.comps
+		if w == v {
+			break
+		}
+	}
+	t.comps++
+}
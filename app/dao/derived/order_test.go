@@ -0,0 +1,79 @@
+package derived
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestOrder(t *testing.T) {
+	// a -> b -> d, a -> c -> d, d -> e, x -> y
+	edges := []Edge{
+		{Source: "a", Target: "b"},
+		{Source: "b", Target: "d"},
+		{Source: "a", Target: "c"},
+		{Source: "c", Target: "d"},
+		{Source: "d", Target: "e"},
+		{Source: "x", Target: "y"},
+	}
+	tests := []struct {
+		name   string
+		source string
+		want   []int
+	}{
+		{name: "diamond", source: "a", want: []int{0, 2, 1, 3, 4}},
+		{name: "middle", source: "b", want: []int{1, 4}},
+		{name: "leaf", source: "e", want: nil},
+		{name: "unknown", source: "z", want: nil},
+		{name: "separate", source: "x", want: []int{5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, err := Order(edges, tt.source)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, order)
+		})
+	}
+}
+
+func TestOrderCycle(t *testing.T) {
+	edges := []Edge{{Source: "a", Target: "b"}, {Source: "b", Target: "c"}, {Source: "c", Target: "b"}}
+	_, err := Order(edges, "a")
+	assert.EqualError(t, err, "derived rules: cycle detected from a")
+	_, err = Order(edges, "b")
+	assert.Error(t, err)
+}
+
+func TestCycles(t *testing.T) {
+	tests := []struct {
+		name  string
+		edges []Edge
+		want  []int
+	}{
+		{name: "no cycle", edges: []Edge{{"a", "b"}, {"b", "c"}, {"a", "c"}}, want: nil},
+		{name: "self", edges: []Edge{{"a", "b"}, {"b", "b"}}, want: []int{1}},
+		{name: "loop", edges: []Edge{{"a", "b"}, {"b", "c"}, {"c", "b"}, {"c", "d"}}, want: []int{1, 2}},
+		{name: "two loops", edges: []Edge{{"a", "b"}, {"b", "a"}, {"x", "y"}, {"y", "z"}, {"z", "x"}, {"a", "x"}},
+			want: []int{0, 1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cycles := Cycles(tt.edges)
+			assert.Equal(t, tt.want, cycles)
+			// 去掉环上的规则后其余规则都能排序
+			var rest []Edge
+			skip := make(map[int]bool)
+			for _, i := range cycles {
+				skip[i] = true
+			}
+			for i, e := range tt.edges {
+				if !skip[i] {
+					rest = append(rest, e)
+				}
+			}
+			for _, e := range rest {
+				_, err := Order(rest, e.Source)
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
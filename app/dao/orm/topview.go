@@ -1,5 +1,7 @@
 package orm
 
+import "time"
+
 // topview库为
 
 // 表数据分市场说明：
@@ -17,10 +19,10 @@ type (
 		FieldSchema   string `gorm:"type:varchar(20);column:field_schema;primary_key"` //所属库database -- 对应一个大市场
 		FieldDescribe string `gorm:"type:varchar(64);column:field_describe"`           //字段描述
 	}
-	// FinPrimaryKey 财务数据主键，包含代码和日期
+	// FinPrimaryKey 财务数据主键，Columns为主键字段名，Values为对应的值，两者按位置一一对应
 	FinPrimaryKey struct {
-		Code     string
-		Datetime int
+		Columns []string
+		Values  []string
 	}
 	// TaskItems
 	TaskItems struct {
@@ -29,6 +31,9 @@ type (
 		SchemaName string `gorm:"type:varchar(20);column:schema_name"`
 		Export     int    `gorm:"type:int;column:export"`
 		Cron       string `gorm:"type:text;column:cron"`
+		DependsOn  string `gorm:"type:varchar(255);column:depends_on"` // 依赖的任务id，多个用','分隔，依赖的任务都成功后执行
+		Hooks      string `gorm:"type:varchar(255);column:hooks"`      // 导出成功后执行的动作，多个用','分隔，按顺序执行
+		GroupName  string `gorm:"type:varchar(64);column:group_name"`  // 导出的表分组，不为空时忽略table_name和schema_name
 	}
 	// TableInfo
 	TableInfo struct {
@@ -40,10 +45,116 @@ type (
 		AllProc    string `gorm:"type:text;column:all_proc"`
 		RepProc    string `gorm:"type:text;column:rep_proc"`
 		CodeProc   string `gorm:"type:text;column:code_proc"`
+		ProcKind   string `gorm:"type:varchar(20);column:proc_kind"` // sql类型：query、function、refcursor、refcursors，为空时按sql内容判断
 		Server     string `gorm:"type:text;column:server"`
 		User       string `gorm:"type:text;column:user_name"`
 		Passwd     string `gorm:"type:text;column:passwd"`
 		Database   string `gorm:"type:text;column:database"`
+		KeyColumns string `gorm:"type:varchar(255);column:key_columns"` // 主键字段，多个用','分隔，为空时从mysql唯一索引获取
+		Tags       string `gorm:"type:varchar(255);column:tags"`        // 标签，多个用','分隔，用于按标签定义表分组
+	}
+	// TableGroup 表分组：fin_names中的表，以及同时满足schema_name和tag（为空的条件不过滤）的表，两者都为空时只包含fin_names
+	TableGroup struct {
+		GroupId    int    `gorm:"type:int unsigned;column:id;primary_key"`
+		Name       string `gorm:"type:varchar(64);column:name"`
+		SchemaName string `gorm:"type:varchar(20);column:schema_name"`
+		Tag        string `gorm:"type:varchar(64);column:tag"`
+		FinNames   string `gorm:"type:text;column:fin_names"` // 财务文件名称，多个用','分隔
+	}
+	// DerivedRule 衍生表规则：源表导出成功后，按规则从源表生成目标表数据
+	DerivedRule struct {
+		RuleId       int    `gorm:"type:int unsigned;column:id;primary_key"`
+		TargetSchema string `gorm:"type:varchar(20);column:target_schema"`
+		TargetTable  string `gorm:"type:varchar(64);column:target_table"`
+		SourceSchema string `gorm:"type:varchar(20);column:source_schema"`
+		SourceTable  string `gorm:"type:varchar(64);column:source_table"`
+		SelectExpr   string `gorm:"type:text;column:select_expr"` // select的字段表达式，需与目标表字段一一对应
+		Filter       string `gorm:"type:text;column:filter"`      // where条件，为空时取源表全部数据
+		Enabled      bool   `gorm:"type:tinyint;column:enabled"`
+	}
+	// AuditLog 生产数据变更审计记录，只追加不修改
+	AuditLog struct {
+		AuditId    int64     `gorm:"type:bigint unsigned;column:id;primary_key;autoIncrement"`
+		OpTime     time.Time `gorm:"type:datetime(3);column:op_time"`
+		Operation  string    `gorm:"type:varchar(20);column:operation"` // 详见：dao.Audit*
+		SchemaName string    `gorm:"type:varchar(20);column:schema_name"`
+		TableName  string    `gorm:"type:varchar(64);column:table_name"`
+		Trigger    string    `gorm:"type:varchar(20);column:trigger_type"`
+		Operator   string    `gorm:"type:varchar(128);column:operator"`    // 发起方：调用方@ip、task:<id>、event:<id>、binding:<name>、backfill:<id>
+		Params     string    `gorm:"type:text;column:params"`              // 请求参数，json
+		Affected   int64     `gorm:"type:bigint;column:affected"`          // 影响的行数
+		Keys       string    `gorm:"type:mediumtext;column:affected_keys"` // 影响的主键或主键范围，json
+		Status     string    `gorm:"type:varchar(10);column:status"`
+		Error      string    `gorm:"type:text;column:error"`
+		CostMs     int64     `gorm:"type:bigint;column:cost_ms"`
+	}
+	// FreshnessSla 表新鲜度sla
+	FreshnessSla struct {
+		SlaId      int    `gorm:"type:int unsigned;column:id;primary_key"`
+		SchemaName string `gorm:"type:varchar(20);column:schema_name"`
+		TableName  string `gorm:"type:varchar(64);column:table_name"`
+		Kind       string `gorm:"type:varchar(10);column:kind"`        // export：距最近一次成功导出的时间；data：mysql与pg最新数据时间的差
+		ProcType   string `gorm:"type:varchar(20);column:proc_type"`   // export时的导出方式，为空时为任意导出方式
+		MaxAge     string `gorm:"type:varchar(20);column:max_age"`     // 允许的最大陈旧时间，如2h、24h
+		TimeColumn string `gorm:"type:varchar(64);column:time_column"` // data时mysql表的时间字段，为空时为rtime
+		PgSql      string `gorm:"type:text;column:pg_sql"`             // data时获取pg最新数据时间的sql，返回unix秒，为空时与当前时间比较
+		Enabled    bool   `gorm:"type:tinyint;column:enabled"`
+	}
+	// ExportRun 导出执行历史，开始时写入，结束时更新结果
+	ExportRun struct {
+		RunId       int64      `gorm:"type:bigint unsigned;column:id;primary_key;autoIncrement"`
+		SchemaName  string     `gorm:"type:varchar(20);column:schema_name"`
+		TableName   string     `gorm:"type:varchar(64);column:table_name"`
+		Trigger     string     `gorm:"type:varchar(20);column:trigger_type"`
+		Operator    string     `gorm:"type:varchar(128);column:operator"`
+		Instance    string     `gorm:"type:varchar(64);column:instance"` // 执行导出的实例，为主机名
+		ProcType    string     `gorm:"type:varchar(20);column:proc_type"`
+		StartDate   int        `gorm:"type:int;column:start_date"`
+		EndDate     int        `gorm:"type:int;column:end_date"`
+		Codes       string     `gorm:"type:text;column:codes"`
+		StartTime   time.Time  `gorm:"type:datetime(3);column:start_time"`
+		EndTime     *time.Time `gorm:"type:datetime(3);column:end_time"` // 执行中为空
+		Status      string     `gorm:"type:varchar(10);column:status"`   // running/success/failed
+		RowsRead    int64      `gorm:"type:bigint;column:rows_read"`     // 从pg读取的行数
+		RowsWritten int64      `gorm:"type:bigint;column:rows_written"`  // 写入mysql的行数
+		RowsSkipped int64      `gorm:"type:bigint;column:rows_skipped"`  // 校验未通过的行数
+		ExtractMs   int64      `gorm:"type:bigint;column:extract_ms"`
+		TransformMs int64      `gorm:"type:bigint;column:transform_ms"`
+		LoadMs      int64      `gorm:"type:bigint;column:load_ms"`
+		CostMs      int64      `gorm:"type:bigint;column:cost_ms"`
+		Error       string     `gorm:"type:text;column:error"`
+	}
+	// Backfill 历史数据回补任务，按日期和代码拆分为分块执行，分块的执行状态见BackfillChunk
+	Backfill struct {
+		BackfillId  int64     `gorm:"type:bigint unsigned;column:id;primary_key;autoIncrement"`
+		Tables      string    `gorm:"type:text;column:tables"` // 回补的表，schema.table，多个用','分隔
+		Export      int       `gorm:"type:int;column:export"`  // 导出方式，详见：pg.Op*
+		StartDate   int       `gorm:"type:int;column:start_date"`
+		EndDate     int       `gorm:"type:int;column:end_date"`
+		Codes       string    `gorm:"type:mediumtext;column:codes"` // 代码范围，多个用','分隔，为空时不按代码拆分
+		ChunkMonths int       `gorm:"type:int;column:chunk_months"` // 每个分块的月数
+		ChunkCodes  int       `gorm:"type:int;column:chunk_codes"`  // 每个分块的代码数
+		Parallelism int       `gorm:"type:int;column:parallelism"`  // 同时执行的分块数
+		Operator    string    `gorm:"type:varchar(128);column:operator"`
+		Status      string    `gorm:"type:varchar(12);column:status"` // running/success/failed/interrupted
+		CreateTime  time.Time `gorm:"type:datetime(3);column:create_time"`
+		UpdateTime  time.Time `gorm:"type:datetime(3);column:update_time"`
+	}
+	// BackfillChunk 回补任务的分块，恢复执行时只执行未成功的分块
+	BackfillChunk struct {
+		ChunkId    int64      `gorm:"type:bigint unsigned;column:id;primary_key;autoIncrement"`
+		BackfillId int64      `gorm:"type:bigint unsigned;column:backfill_id"`
+		Seq        int        `gorm:"type:int;column:seq"` // 执行顺序
+		SchemaName string     `gorm:"type:varchar(20);column:schema_name"`
+		TableName  string     `gorm:"type:varchar(64);column:table_name"`
+		StartDate  int        `gorm:"type:int;column:start_date"`
+		EndDate    int        `gorm:"type:int;column:end_date"`
+		Codes      string     `gorm:"type:text;column:codes"`
+		Status     string     `gorm:"type:varchar(10);column:status"` // pending/running/success/failed
+		Attempts   int        `gorm:"type:int;column:attempts"`       // 已执行的次数
+		StartTime  *time.Time `gorm:"type:datetime(3);column:start_time"`
+		EndTime    *time.Time `gorm:"type:datetime(3);column:end_time"`
+		Error      string     `gorm:"type:text;column:error"`
 	}
 )
 
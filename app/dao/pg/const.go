@@ -9,6 +9,13 @@ const (
 	ENDDATE   = "enddate"
 	CODELIST  = "codelist"
 	TYPE      = "type"
+	DRYRUN    = "dryrun"      //预览，不修改生产库
+	REFTYPE   = "source"      //对账参照源类型
+	REFPATH   = "path"        //对账参照文件
+	REFNAME   = "ref"         //对账参照pg库名称，见Service.References
+	WITHPG    = "withpg"      //对账时是否同时对比pg源
+	GROUP     = "group"       //表分组，替代finname
+	PARALLEL  = "parallelism" //按分组执行时同时执行的表数
 )
 
 // 导出方式，从0-5分别如下
@@ -21,10 +28,13 @@ const (
 	OpCompare        //对比
 )
 
-// 触发方式，从0-1分别如下
+// 触发方式，从0-4分别如下
 const (
-	TrigCron   = iota //定时任务
-	TrigManual        //手动触发
+	TrigCron     = iota //定时任务
+	TrigManual          //手动触发
+	TrigTopic           //dapr pub/sub消息触发
+	TrigBinding         //dapr输入绑定触发
+	TrigBackfill        //历史数据回补
 )
 
 // 部分特殊字段名
@@ -39,7 +49,17 @@ const (
 
 // sql类型
 const (
-	SqlNormal = iota
-	SqlStoredProcedure
-	SqlIndex
+	SqlNormal          = iota
+	SqlStoredProcedure //返回一个游标名的存储过程
+	SqlIndex           //需要开启索引的查询
+	SqlRefcursors      //返回多个游标名的存储过程
+)
+
+// 导出sql的类型，对应TableInfo.proc_kind
+const (
+	ProcAuto       = ""           //按sql内容判断：{}包围的为游标存储过程，含前置set语句的为需要开启索引的查询，其余为普通查询
+	ProcQuery      = "query"      //普通查询
+	ProcFunction   = "function"   //返回结果集的函数，可以只填写函数调用，如fn(:start, :end)
+	ProcRefcursor  = "refcursor"  //返回一个游标名的存储过程，可以只填写函数调用
+	ProcRefcursors = "refcursors" //返回多个游标名（setof refcursor）的存储过程，各游标的字段需一致
 )
@@ -1,16 +1,25 @@
 package pg
 
 import (
+	"context"
 	"database/sql"
 	"github.com/google/wire"
+	"hxextract/app/dao/conn"
 )
 
 var Provider = wire.NewSet(New, NewDB)
 
 type Dao interface {
 	Close()
-	GetRows(param QueryParam) (*sql.Rows, error)
+	GetRows(param QueryParam) (*Rows, error)
 	HealthCheck() error
+	// 已建立连接的dsn及连通性检查，用于就绪检查
+	Dsns() []string
+	Ping(ctx context.Context, dsn string) error
+	// 各dsn连接池的状态，用于连接池指标
+	Stats() map[string]sql.DBStats
+	// 各dsn的连接状态，用于/debug/connections
+	Connections() []conn.Info
 }
 
 type pgDao struct {
@@ -37,3 +46,19 @@ func (d *pgDao) Close() {
 func (d *pgDao) HealthCheck() error {
 	return d.connectCheck()
 }
+
+func (d *pgDao) Dsns() []string {
+	return d.dsns()
+}
+
+func (d *pgDao) Ping(ctx context.Context, dsn string) error {
+	return d.ping(ctx, dsn)
+}
+
+func (d *pgDao) Stats() map[string]sql.DBStats {
+	return d.stats()
+}
+
+func (d *pgDao) Connections() []conn.Info {
+	return d.infos()
+}
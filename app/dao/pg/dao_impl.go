@@ -1,10 +1,13 @@
 package pg
 
 import (
-	"database/sql"
 	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
 	"gorm.io/gorm"
+	"hxextract/app/config"
 	"hxextract/app/log"
+	"time"
 )
 
 type (
@@ -24,10 +27,12 @@ type (
 		EndDate     int
 		CodeList    string
 		ProcType    int
-		TriggerType int //触发方式，详见：pg.Trig*
+		TriggerType int    //触发方式，详见：pg.Trig*
+		Operator    string //发起方，写入审计记录：调用方@ip、task:<id>、event:<id>、binding:<name>、backfill:<id>
 		DsnInfo     string
 		ProcSql     string
-		SqlType     int //sql类型，详见：pg.Sql
+		ProcArgs    []interface{} //ProcSql中?占位符对应的参数
+		SqlType     int           //sql类型，详见：pg.Sql
 	}
 	ExportParam struct {
 		FinName string
@@ -35,40 +40,142 @@ type (
 	}
 )
 
-func (d *pgDao) GetRows(param QueryParam) (*sql.Rows, error) {
-	db, err := d.getDsnDb(param.DsnInfo)
+// FillDefaultDate 日期为0时起始日期为昨天，截止日期为今天
+func (q *QueryParam) FillDefaultDate() {
+	if q.StartDate == 0 {
+		y, m, d := time.Now().AddDate(0, 0, -1).Date()
+		q.StartDate = y*10000 + 100*int(m) + d
+	}
+	if q.EndDate == 0 {
+		y, m, d := time.Now().Date()
+		q.EndDate = y*10000 + 100*int(m) + d
+	}
+}
+
+// CheckType 校验导出方式，对比会删除生产库数据，只能通过对比接口执行，不能作为导出方式
+func (q *QueryParam) CheckType() error {
+	if q.ProcType < OpAll || q.ProcType > OpCode {
+		return errors.New(fmt.Sprintf("invalid type: %d", q.ProcType))
+	}
+	return nil
+}
+
+// Check 校验导出参数
+func (e *ExportParam) Check() error {
+	if e.FinName == "" {
+		return errors.New("finname is empty")
+	}
+	if err := e.QP.CheckType(); err != nil {
+		return err
+	}
+	if e.QP.ProcType == OpCode && e.QP.CodeList == "" {
+		return errors.New("codelist is empty")
+	}
+	return nil
+}
+
+//
+//  GetRows
+//  @Description: 执行导出sql，调用方需要Close返回的结果集
+//  @receiver d
+//  @param param 使用DsnInfo、ProcSql和SqlType
+//  @return *Rows
+//  @return error
+//
+func (d *pgDao) GetRows(param QueryParam) (*Rows, error) {
+	db, release, err := d.getDsnDb(param.DsnInfo)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := execFinSql(db, param.ProcSql, param.ProcArgs, param.SqlType)
 	if err != nil {
+		release()
 		return nil, err
 	}
-	return execFinSql(db, param.ProcSql, param.SqlType)
+	rows.release = release
+	return rows, nil
 }
 
-func execFinSql(db *gorm.DB, sql string, flag int) (*sql.Rows, error) {
-	log.Log.Info(fmt.Sprintf("exec sql: %s", sql))
-	// 处理存储过程
-	if flag == SqlStoredProcedure {
-		// 多段连续要BEGIN END
-		// 获取存储过程的数据需要先执行生成临时缓存之后再通过fetch进一步获取数据
-		db.Exec("BEGIN;")
-		defer db.Exec("END;") //返回前先END
-		row := db.Raw(sql).Row()
-		if err := db.Error; err != nil {
-			return nil, err
-		}
-		var strFetchSql string
-		err := row.Scan(&strFetchSql)
+//
+//  execFinSql
+//  @Description: 存储过程和需要开启索引的sql在独立的事务中执行，会话设置只对该事务生效，
+//  结果集Close时提交事务，出错时回滚
+//  @param db
+//  @param sql
+//  @param args sql中?占位符对应的参数
+//  @param flag sql类型，详见：pg.Sql*
+//  @return *Rows
+//  @return error
+//
+func execFinSql(db *gorm.DB, sql string, args []interface{}, flag int) (*Rows, error) {
+	log.Log.Info(fmt.Sprintf("exec sql: %s", sql), zap.Any("args", args))
+	if flag == SqlNormal {
+		rows, err := db.Raw(sql, args...).Rows()
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrap(err, "query pg")
 		}
-		// fetch all in "strFetchSql"
-		strFetchSql = fmt.Sprintf("fetch all in %q", strFetchSql)
-		return db.Raw(strFetchSql).Rows()
+		return &Rows{rows: rows}, nil
+	}
+	tx := db.Begin()
+	if tx.Error != nil {
+		return nil, errors.Wrap(tx.Error, "begin pg transaction")
+	}
+	ret, err := queryInTx(tx, sql, args, flag)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
 	}
-	// 处理 非存储过程 的select语句
+	ret.end = func() error { return tx.Commit().Error }
+	return ret, nil
+}
+
+func queryInTx(tx *gorm.DB, sql string, args []interface{}, flag int) (*Rows, error) {
 	if flag == SqlIndex {
-		// sql需要开启索引
-		db.Exec("set enable_nestloop = on;")        //开启索引
-		defer db.Exec("set enable_nestloop = off;") //返回前关闭索引
+		// 只在当前事务中开启嵌套循环连接，不影响连接池中的其他连接
+		if err := tx.Exec("set local enable_nestloop = on").Error; err != nil {
+			return nil, errors.Wrap(err, "enable nestloop")
+		}
+		rows, err := tx.Raw(sql, args...).Rows()
+		if err != nil {
+			return nil, errors.Wrap(err, "query pg")
+		}
+		return &Rows{rows: rows}, nil
+	}
+	// 存储过程返回游标名，在同一事务中分批fetch获取数据
+	cursors, err := callProcedure(tx, sql, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(cursors) == 0 {
+		return nil, errors.New("procedure returned no cursor")
+	}
+	if flag == SqlStoredProcedure && len(cursors) > 1 {
+		return nil, errors.New(fmt.Sprintf("procedure returned %d cursors, set proc_kind to %s", len(cursors), ProcRefcursors))
+	}
+	size := config.GetPgsql().FetchSize
+	if size <= 0 {
+		size = defaultFetchSize
+	}
+	return newCursorRows(tx, cursors, size)
+}
+
+// callProcedure 调用存储过程，返回所有游标名
+func callProcedure(tx *gorm.DB, sql string, args []interface{}) ([]string, error) {
+	rows, err := tx.Raw(sql, args...).Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, "call procedure")
+	}
+	defer rows.Close()
+	var cursors []string
+	for rows.Next() {
+		var cursor string
+		if err = rows.Scan(&cursor); err != nil {
+			return nil, errors.Wrap(err, "call procedure")
+		}
+		cursors = append(cursors, cursor)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "call procedure")
 	}
-	return db.Raw(sql).Rows()
+	return cursors, nil
 }
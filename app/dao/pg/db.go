@@ -6,82 +6,198 @@ purpose:pg库信息加载及链接管理
 */
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"gorm.io/gorm/schema"
 	"hxextract/app/config"
+	"hxextract/app/dao/conn"
 	"hxextract/app/log"
-	"sync"
+	"hxextract/app/secret"
+	"strings"
 )
 
+// 连接状态中的连接类型
+const kindPg = "pg"
+
 type (
 	// DB 连接信息管理
 	DB struct {
-		taskDB    map[string]*gorm.DB // 用dsn=>db形式存储pg的连接，以dsn为key
-		mutexTask sync.Mutex
+		taskDB *conn.Registry // 各dsn的连接池，以dsn为key
 	}
 )
 
 func NewDB() (db *DB, cf func(), err error) {
 	log.Log.Info("init pg connection")
+	cfg := config.GetConnection()
 	db = new(DB)
-	db.taskDB = make(map[string]*gorm.DB)
+	db.taskDB = conn.New(kindPg, getConn, conn.Options{
+		IdleEvict:   cfg.IdleEvict,
+		PingTimeout: cfg.PingTimeout,
+		BackoffMin:  cfg.BackoffMin,
+		BackoffMax:  cfg.BackoffMax,
+	}, RedactDsn)
+	cf = db.Close
 	return
 }
 
+// Close 关闭所有pg连接池
+func (d *DB) Close() {
+	for dsn, err := range d.taskDB.Close() {
+		log.Log.Error("close pg connection failed", zap.String("dsn", RedactDsn(dsn)), zap.Error(err))
+	}
+	log.Log.Info("pg connections closed")
+}
+
 //
 // connectCheck
-//  @Description: 检查pg连接是否正常
+//  @Description: 检查pg连接是否正常，断开的重连，并回收空闲的连接
 //  @receiver d
 //
 func (d *DB) connectCheck() error {
-	d.mutexTask.Lock()
-	defer d.mutexTask.Unlock()
-	for dsn, db := range d.taskDB {
-		db_, err := db.DB()
-		if err == nil && db_.Ping() == nil {
-			continue
-		}
-		log.Log.Error("pg connection lost,try to reconnect", zap.String("dsn", dsn))
-		db, err = getConn(dsn)
-		if err != nil {
-			log.Log.Error("reconnect pg connection failed")
-			return err
+	err := d.taskDB.Check()
+	if err != nil {
+		log.Log.Error("reconnect pg connection failed", zap.Error(err))
+	}
+	for _, dsn := range d.taskDB.Evict() {
+		log.Log.Info("close idle pg connection", zap.String("dsn", RedactDsn(dsn)))
+	}
+	return err
+}
+
+// dsns 已建立连接的dsn
+func (d *DB) dsns() []string {
+	ret := make([]string, 0)
+	for dsn := range d.taskDB.Connected() {
+		ret = append(ret, dsn)
+	}
+	return ret
+}
+
+// ping 检查dsn对应连接是否可用，不重连
+func (d *DB) ping(ctx context.Context, dsn string) error {
+	db, ok := d.taskDB.Connected()[dsn]
+	if !ok {
+		return errors.New("pg connection not found")
+	}
+	return db.PingContext(ctx)
+}
+
+// RedactDsn 隐藏dsn中的密码，用于日志和接口输出
+func RedactDsn(dsn string) string {
+	return config.RedactDsn(dsn)
+}
+
+// getDsnDb 获取并占用dsn对应的连接，未建立时建立连接，使用完后需要调用返回的释放函数
+func (d *DB) getDsnDb(dsn string) (*gorm.DB, func(), error) {
+	sqlDb, release, err := d.taskDB.Acquire(dsn)
+	if err != nil {
+		return nil, release, err
+	}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDb}), gormConfig())
+	if err != nil {
+		release()
+		return nil, func() {}, err
+	}
+	return db, release, nil
+}
+
+// DsnResolver 连接时将dsn中的凭据引用解析为实际的dsn，refresh为true时忽略缓存重新获取凭据
+type DsnResolver func(dsn string, refresh bool) (string, error)
+
+var resolveDsn DsnResolver = func(dsn string, refresh bool) (string, error) {
+	if refresh {
+		secret.Invalidate(dsn)
+	}
+	return secret.Resolve(dsn)
+}
+
+// SetDsnResolver 替换dsn的解析方式，默认解析dsn中${}形式的凭据引用
+func SetDsnResolver(r DsnResolver) {
+	resolveDsn = r
+}
+
+// getConn 获取pg库连接，refresh为true或连接失败时凭据可能已轮换，重新获取凭据后再试一次
+func getConn(dsn string, refresh bool) (*sql.DB, error) {
+	resolved, err := resolveDsn(dsn, refresh)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openConn(resolved)
+	if err != nil && !refresh {
+		if fresh, rerr := resolveDsn(dsn, true); rerr == nil && fresh != resolved {
+			log.Log.Info("pg credentials changed, reconnect", zap.String("dsn", RedactDsn(dsn)))
+			db, err = openConn(fresh)
 		}
-		d.taskDB[dsn] = db
 	}
-	return nil
+	return db, err
 }
 
-func (d *DB) getDsnDb(dsn string) (*gorm.DB, error) {
-	d.mutexTask.Lock()
-	defer d.mutexTask.Unlock()
-	if db, ok := d.taskDB[dsn]; ok {
-		return db, nil
+// openConn 建立连接池，statement_timeout作为连接参数对池中所有连接生效
+func openConn(dsn string) (*sql.DB, error) {
+	pgCfg := config.GetPgsql()
+	db, err := gorm.Open(postgres.Open(withStatementTimeout(dsn, pgCfg.QueryTimeout)), gormConfig())
+	if err != nil {
+		return nil, err
 	}
-	dbNew, err := getConn(dsn)
+	sqlDb, err := db.DB()
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
-	d.taskDB[dsn] = dbNew
-	return dbNew, nil
+	sqlDb.SetMaxOpenConns(pgCfg.MaxOpenConns)
+	sqlDb.SetMaxIdleConns(pgCfg.MaxIdleConns)
+	return sqlDb, nil
 }
 
-// getConn 获取pg库连接
-func getConn(dsn string) (db *gorm.DB, err error) {
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{
+func gormConfig() *gorm.Config {
+	return &gorm.Config{
 		NamingStrategy: schema.NamingStrategy{
 			TablePrefix:   "",
 			SingularTable: true,
 		},
-		Logger: logger.Default.LogMode(logger.Silent),
-	})
-	if err == nil {
-		sqlExec := fmt.Sprintf("set statement_timeout to %d", config.GetPgsql().QueryTimeout)
-		db.Exec(sqlExec)
+		Logger: logger.Default.LogMode(logLevel(config.GetPgsql().LogLevel)),
 	}
-	return
+}
+
+// withStatementTimeout 在dsn中加入statement_timeout（毫秒），为0时不限制
+func withStatementTimeout(dsn string, timeout int) string {
+	if timeout <= 0 || strings.Contains(dsn, "statement_timeout") {
+		return dsn
+	}
+	if strings.Contains(dsn, "://") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		return fmt.Sprintf("%s%sstatement_timeout=%d", dsn, sep, timeout)
+	}
+	return fmt.Sprintf("%s statement_timeout=%d", dsn, timeout)
+}
+
+// logLevel gorm日志级别，debug输出所有sql，info和warn输出慢查询和告警，error只输出错误
+func logLevel(level string) logger.LogLevel {
+	switch level {
+	case "debug":
+		return logger.Info
+	case "info", "warn":
+		return logger.Warn
+	case "error":
+		return logger.Error
+	}
+	return logger.Silent
+}
+
+// stats 各dsn连接池的状态，key为隐藏密码后的dsn
+func (d *DB) stats() map[string]sql.DBStats {
+	return d.taskDB.Stats()
+}
+
+// infos 各dsn的连接状态
+func (d *DB) infos() []conn.Info {
+	return d.taskDB.Infos()
 }
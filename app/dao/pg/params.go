@@ -0,0 +1,41 @@
+package pg
+
+/*
+purpose:导出sql模板中的参数名及数组参数
+*/
+
+import (
+	"database/sql/driver"
+	"strings"
+)
+
+// 导出sql中可以使用的参数名
+const (
+	ParamStart = "start" // 起始日期，yyyymmdd
+	ParamEnd   = "end"   // 截止日期，yyyymmdd
+	ParamCodes = "codes" // 证券代码列表，为text[]，如zqdm = any(:codes)
+)
+
+// TextArray 绑定为pg的text[]参数，作为一个参数传递而不是展开为多个参数
+type TextArray []string
+
+// Value 转为pg数组字面量，如{"000001","600000"}
+func (a TextArray) Value() (driver.Value, error) {
+	if a == nil {
+		return nil, nil
+	}
+	items := make([]string, len(a))
+	for i, v := range a {
+		v = strings.ReplaceAll(v, `\`, `\\`)
+		items[i] = `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+	}
+	return "{" + strings.Join(items, ",") + "}", nil
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNamePart(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,15 @@
+package pg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTextArray(t *testing.T) {
+	v, err := TextArray{"000001", `a"b`, `c\d`}.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"000001","a\"b","c\\d"}`, v)
+	v, err = TextArray(nil).Value()
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+}
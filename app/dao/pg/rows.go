@@ -0,0 +1,137 @@
+package pg
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"strings"
+)
+
+// 未配置Pgsql.FetchSize时每次从游标获取的行数
+const defaultFetchSize = 10000
+
+type (
+	// Rows pg查询结果，游标的数据分批fetch，多个游标的数据依次返回，Close时结束查询会话，释放会话占用的连接
+	Rows struct {
+		rows    *sql.Rows
+		fetch   func(read int) (*sql.Rows, error) // 当前批次读完后获取下一批，返回nil时没有更多数据
+		read    int                               // 当前批次已读取的行数
+		err     error
+		end     func() error
+		release func() // 释放连接池的占用，Close前连接池不会被空闲回收
+	}
+
+	// cursorFetcher 在同一事务中依次从各游标分批获取数据
+	cursorFetcher struct {
+		tx      *gorm.DB
+		cursors []string
+		idx     int
+		size    int
+		columns []string
+	}
+)
+
+// newCursorRows 获取第一个游标的第一批数据
+func newCursorRows(tx *gorm.DB, cursors []string, size int) (*Rows, error) {
+	f := &cursorFetcher{tx: tx, cursors: cursors, size: size}
+	rows, err := f.fetchCursor()
+	if err != nil {
+		return nil, err
+	}
+	if f.columns, err = rows.Columns(); err != nil {
+		_ = rows.Close()
+		return nil, err
+	}
+	return &Rows{rows: rows, fetch: f.next}, nil
+}
+
+func (f *cursorFetcher) fetchCursor() (*sql.Rows, error) {
+	cursor := f.cursors[f.idx]
+	rows, err := f.tx.Raw(fmt.Sprintf("fetch %d from %q", f.size, cursor)).Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("fetch cursor %s", cursor))
+	}
+	return rows, nil
+}
+
+// next 上一批不足size行时当前游标已读完，切换到下一个游标，各游标的字段需与第一个游标一致
+func (f *cursorFetcher) next(read int) (*sql.Rows, error) {
+	if read < f.size {
+		if f.idx++; f.idx >= len(f.cursors) {
+			return nil, nil
+		}
+	}
+	rows, err := f.fetchCursor()
+	if err != nil {
+		return nil, err
+	}
+	columns, err := rows.Columns()
+	if err == nil && strings.Join(columns, ",") != strings.Join(f.columns, ",") {
+		err = errors.New(fmt.Sprintf("columns of cursor %s (%s) differ from cursor %s (%s)", f.cursors[f.idx],
+			strings.Join(columns, ","), f.cursors[0], strings.Join(f.columns, ",")))
+	}
+	if err != nil {
+		_ = rows.Close()
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (r *Rows) Columns() ([]string, error) {
+	return r.rows.Columns()
+}
+
+func (r *Rows) ColumnTypes() ([]*sql.ColumnType, error) {
+	return r.rows.ColumnTypes()
+}
+
+// Next 当前批次读完后自动获取下一批
+func (r *Rows) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	for {
+		if r.rows.Next() {
+			r.read++
+			return true
+		}
+		if r.err = r.rows.Err(); r.err != nil || r.fetch == nil {
+			return false
+		}
+		_ = r.rows.Close()
+		rows, err := r.fetch(r.read)
+		if err != nil || rows == nil {
+			r.err, r.fetch = err, nil
+			return false
+		}
+		r.rows, r.read = rows, 0
+	}
+}
+
+func (r *Rows) Scan(dest ...interface{}) error {
+	return r.rows.Scan(dest...)
+}
+
+func (r *Rows) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.rows.Err()
+}
+
+// Close 关闭结果集并提交查询会话的事务，可重复调用
+func (r *Rows) Close() error {
+	err := r.rows.Close()
+	if r.end != nil {
+		if endErr := r.end(); err == nil {
+			err = endErr
+		}
+		r.end = nil
+	}
+	if r.release != nil {
+		r.release()
+		r.release = nil
+	}
+	return err
+}
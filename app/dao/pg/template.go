@@ -0,0 +1,315 @@
+package pg
+
+/*
+purpose:导出sql模板，参数按名称和类型绑定为pg占位符，支持数组参数和可选子句，
+TableInfo加载时校验模板使用的参数与导出方式提供的参数一致
+*/
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ParamType 模板参数类型
+type ParamType int
+
+// 参数类型
+const (
+	TypeDate      ParamType = iota // 日期，yyyymmdd字符串，绑定为文本，可用于to_date(:start, 'yyyymmdd')或与date列比较
+	TypeTextArray                  // 文本数组，绑定为text[]，如zqdm = any(:codes)
+)
+
+// 模板片段类型
+const (
+	partText   = iota // 原样输出的sql
+	partParam         // 绑定为一个占位符的参数
+	partList          // 数组参数展开为多个占位符，兼容[codelist]
+	partInline        // 引号中的[start]、[end]，替换为校验后的日期
+)
+
+type (
+	// Template 解析后的导出sql模板
+	Template struct {
+		parts    []part
+		required map[string]bool // 可选子句外使用的参数，渲染时必须提供
+		used     map[string]bool // 所有使用的参数
+	}
+
+	part struct {
+		kind     int
+		text     string
+		name     string
+		optional int // 所在可选子句的序号，-1为不在可选子句中
+	}
+)
+
+// paramTypes 模板中可以使用的参数及其类型
+var paramTypes = map[string]ParamType{
+	ParamStart: TypeDate,
+	ParamEnd:   TypeDate,
+	ParamCodes: TypeTextArray,
+}
+
+// legacyParams 旧版的文本替换参数
+var legacyParams = map[string]string{
+	"[start]":    ParamStart,
+	"[end]":      ParamEnd,
+	"[codelist]": ParamCodes,
+}
+
+var datePattern = regexp.MustCompile(`^\d{8}$`)
+
+//
+//  ParseTemplate
+//  @Description: 解析导出sql模板：:name为参数，[[ ... ]]为可选子句（子句中的参数都提供时才保留），
+//  兼容[start]、[end]、[codelist]，引号中的内容和::类型转换不作为参数
+//  @param sql
+//  @return *Template
+//  @return error 使用了未知参数、可选子句未闭合或嵌套时返回错误
+//
+func ParseTemplate(sql string) (*Template, error) {
+	t := &Template{required: make(map[string]bool), used: make(map[string]bool)}
+	var text strings.Builder
+	optional, clauses := -1, 0
+	flush := func() {
+		if text.Len() > 0 {
+			t.parts = append(t.parts, part{kind: partText, text: text.String(), optional: optional})
+			text.Reset()
+		}
+	}
+	add := func(kind int, name string) error {
+		if _, ok := paramTypes[name]; !ok {
+			return errors.New(fmt.Sprintf("unknown sql parameter :%s", name))
+		}
+		if kind == partInline && paramTypes[name] != TypeDate {
+			return errors.New(fmt.Sprintf("parameter %s can't be used in quotes", name))
+		}
+		flush()
+		t.parts = append(t.parts, part{kind: kind, name: name, optional: optional})
+		t.used[name] = true
+		if optional < 0 {
+			t.required[name] = true
+		}
+		return nil
+	}
+	var quote byte
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		if legacy, name := legacyAt(sql, i); legacy != "" {
+			kind := partParam
+			if quote != 0 {
+				kind = partInline
+			} else if name == ParamCodes {
+				kind = partList
+			}
+			if err := add(kind, name); err != nil {
+				return nil, err
+			}
+			i += len(legacy) - 1
+			continue
+		}
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			text.WriteByte(c)
+			continue
+		}
+		switch {
+		case c == '\'' || c == '"':
+			quote = c
+		case strings.HasPrefix(sql[i:], "[["):
+			if optional >= 0 {
+				return nil, errors.New("nested optional clause")
+			}
+			flush()
+			optional, clauses = clauses, clauses+1
+			i++
+			continue
+		case strings.HasPrefix(sql[i:], "]]") && optional >= 0:
+			flush()
+			optional = -1
+			i++
+			continue
+		case c == ':' && i+1 < len(sql) && sql[i+1] == ':':
+			// ::类型转换
+			text.WriteString("::")
+			i++
+			continue
+		case c == ':' && i+1 < len(sql) && isNameStart(sql[i+1]):
+			j := i + 1
+			for j < len(sql) && isNamePart(sql[j]) {
+				j++
+			}
+			if err := add(partParam, sql[i+1:j]); err != nil {
+				return nil, err
+			}
+			i = j - 1
+			continue
+		}
+		text.WriteByte(c)
+	}
+	if optional >= 0 {
+		return nil, errors.New("optional clause is not closed")
+	}
+	flush()
+	return t, nil
+}
+
+func legacyAt(sql string, i int) (string, string) {
+	if sql[i] != '[' {
+		return "", ""
+	}
+	for legacy, name := range legacyParams {
+		if strings.HasPrefix(sql[i:], legacy) {
+			return legacy, name
+		}
+	}
+	return "", ""
+}
+
+// Required 可选子句外使用的参数
+func (t *Template) Required() []string {
+	return sortedKeys(t.required)
+}
+
+// Used 模板使用的所有参数
+func (t *Template) Used() []string {
+	return sortedKeys(t.used)
+}
+
+//
+//  Validate
+//  @Description: 校验模板与导出方式的参数，模板必需的参数导出方式需总会提供，导出方式提供但模板未使用的参数忽略，
+//  如只使用[start]的按rtime导出sql
+//  @receiver t
+//  @param provides 导出方式总会提供的参数
+//  @return error
+//
+func (t *Template) Validate(provides ...string) error {
+	provided := make(map[string]bool, len(provides))
+	for _, name := range provides {
+		provided[name] = true
+	}
+	for _, name := range t.Required() {
+		if !provided[name] {
+			return errors.New(fmt.Sprintf("parameter :%s is not always provided, use it in an optional clause [[ ... ]]", name))
+		}
+	}
+	return nil
+}
+
+//
+//  Render
+//  @Description: 按参数类型校验并绑定参数，参数都提供的可选子句保留，否则去掉
+//  @receiver t
+//  @param values 日期为yyyymmdd字符串，数组为[]string，空字符串和空数组视为未提供
+//  @return string 使用?占位符的sql，由gorm按pg的$n占位符绑定
+//  @return []interface{} 占位符对应的参数
+//  @return error 参数类型不符或必需的参数未提供时返回错误
+//
+func (t *Template) Render(values map[string]interface{}) (string, []interface{}, error) {
+	typed := make(map[string]interface{})
+	for name, v := range values {
+		tv, err := typedValue(name, v)
+		if err != nil {
+			return "", nil, err
+		}
+		if tv != nil {
+			typed[name] = tv
+		}
+	}
+	for name := range t.required {
+		if _, ok := typed[name]; !ok {
+			return "", nil, errors.New(fmt.Sprintf("parameter :%s is required", name))
+		}
+	}
+	dropped := make(map[int]bool)
+	for _, p := range t.parts {
+		if p.kind != partText && p.optional >= 0 {
+			if _, ok := typed[p.name]; !ok {
+				dropped[p.optional] = true
+			}
+		}
+	}
+	var b strings.Builder
+	var args []interface{}
+	for _, p := range t.parts {
+		if p.optional >= 0 && dropped[p.optional] {
+			continue
+		}
+		switch p.kind {
+		case partText:
+			b.WriteString(p.text)
+		case partParam:
+			b.WriteByte('?')
+			args = append(args, typed[p.name])
+		case partInline:
+			// 日期已校验为8位数字
+			b.WriteString(typed[p.name].(string))
+		case partList:
+			codes := typed[p.name].(TextArray)
+			b.WriteString(strings.TrimSuffix(strings.Repeat("?, ", len(codes)), ", "))
+			for _, code := range codes {
+				args = append(args, code)
+			}
+		}
+	}
+	return b.String(), args, nil
+}
+
+// typedValue 按参数类型转换，值为空时返回nil
+func typedValue(name string, v interface{}) (interface{}, error) {
+	typ, ok := paramTypes[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown sql parameter :%s", name))
+	}
+	switch typ {
+	case TypeDate:
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("parameter :%s should be a date string", name))
+		}
+		if s == "" {
+			return nil, nil
+		}
+		if _, err := time.Parse("20060102", s); err != nil || !datePattern.MatchString(s) {
+			return nil, errors.New(fmt.Sprintf("parameter :%s should be yyyymmdd, got %q", name, s))
+		}
+		return s, nil
+	case TypeTextArray:
+		var items []string
+		switch a := v.(type) {
+		case []string:
+			items = a
+		case TextArray:
+			items = a
+		default:
+			return nil, errors.New(fmt.Sprintf("parameter :%s should be a string list", name))
+		}
+		var ret TextArray
+		for _, item := range items {
+			if item = strings.TrimSpace(item); item != "" {
+				ret = append(ret, item)
+			}
+		}
+		if len(ret) == 0 {
+			return nil, nil
+		}
+		return ret, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported type of parameter :%s", name))
+}
+
+func sortedKeys(m map[string]bool) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,81 @@
+package pg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTemplateRender(t *testing.T) {
+	tmpl, err := ParseTemplate("select zqdm, rtime::date from t where rtime >= to_date(:start, 'yyyymmdd') " +
+		"and rtime <= timestamp '20220331 23:59:59' and bbrq <= to_date(:end, 'yyyymmdd') and zqdm = any(:codes) " +
+		"and name <> ':start' and bbrq > to_date(:start, 'yyyymmdd')")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ParamCodes, ParamEnd, ParamStart}, tmpl.Required())
+	sql, args, err := tmpl.Render(map[string]interface{}{ParamStart: "20220101", ParamEnd: "20220331",
+		ParamCodes: []string{"000001"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "select zqdm, rtime::date from t where rtime >= to_date(?, 'yyyymmdd') "+
+		"and rtime <= timestamp '20220331 23:59:59' and bbrq <= to_date(?, 'yyyymmdd') and zqdm = any(?) "+
+		"and name <> ':start' and bbrq > to_date(?, 'yyyymmdd')", sql)
+	assert.Equal(t, []interface{}{"20220101", "20220331", TextArray{"000001"}, "20220101"}, args)
+
+	_, _, err = tmpl.Render(map[string]interface{}{ParamStart: "20220101", ParamEnd: "20220331"})
+	assert.EqualError(t, err, "parameter :codes is required")
+	_, _, err = tmpl.Render(map[string]interface{}{ParamStart: "20221301", ParamEnd: "20220331",
+		ParamCodes: []string{"000001"}})
+	assert.EqualError(t, err, `parameter :start should be yyyymmdd, got "20221301"`)
+
+	_, err = ParseTemplate("select * from t where zqdm = any(:code)")
+	assert.EqualError(t, err, "unknown sql parameter :code")
+}
+
+func TestTemplateOptional(t *testing.T) {
+	tmpl, err := ParseTemplate("select * from t where bbrq >= :start [[and zqdm = any(:codes)]] order by zqdm")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ParamStart}, tmpl.Required())
+	assert.Equal(t, []string{ParamCodes, ParamStart}, tmpl.Used())
+
+	sql, args, err := tmpl.Render(map[string]interface{}{ParamStart: "20220101", ParamCodes: []string{" ", ""}})
+	assert.NoError(t, err)
+	assert.Equal(t, "select * from t where bbrq >= ?  order by zqdm", sql)
+	assert.Equal(t, []interface{}{"20220101"}, args)
+
+	sql, args, err = tmpl.Render(map[string]interface{}{ParamStart: "20220101", ParamCodes: []string{"000001", "600000"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "select * from t where bbrq >= ? and zqdm = any(?) order by zqdm", sql)
+	assert.Equal(t, []interface{}{"20220101", TextArray{"000001", "600000"}}, args)
+
+	_, err = ParseTemplate("select * from t where [[bbrq >= :start [[and zqdm = any(:codes)]]]]")
+	assert.EqualError(t, err, "nested optional clause")
+	_, err = ParseTemplate("select * from t where [[bbrq >= :start")
+	assert.EqualError(t, err, "optional clause is not closed")
+}
+
+func TestTemplateLegacy(t *testing.T) {
+	tmpl, err := ParseTemplate("select * from t where rtime >= to_date('[start]', 'yyyymmdd') and " +
+		"rtime <= date_trunc('second', timestamp '[end] 23:59:59') and bbrq >= [start] and zqdm in ([codelist])")
+	assert.NoError(t, err)
+	sql, args, err := tmpl.Render(map[string]interface{}{ParamStart: "20220101", ParamEnd: "20220331",
+		ParamCodes: []string{"000001", "60'0000"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "select * from t where rtime >= to_date('20220101', 'yyyymmdd') and "+
+		"rtime <= date_trunc('second', timestamp '20220331 23:59:59') and bbrq >= ? and zqdm in (?, ?)", sql)
+	assert.Equal(t, []interface{}{"20220101", "000001", "60'0000"}, args)
+
+	_, err = ParseTemplate("select * from t where zqdm in ('[codelist]')")
+	assert.EqualError(t, err, "parameter codes can't be used in quotes")
+}
+
+func TestTemplateValidate(t *testing.T) {
+	tmpl, err := ParseTemplate("select * from t where bbrq >= :start and bbrq <= :end [[and zqdm = any(:codes)]]")
+	assert.NoError(t, err)
+	assert.NoError(t, tmpl.Validate(ParamStart, ParamEnd))
+	assert.EqualError(t, tmpl.Validate(ParamCodes), "parameter :end is not always provided, use it in an optional clause [[ ... ]]")
+	assert.NoError(t, tmpl.Validate(ParamStart, ParamEnd, ParamCodes))
+	all, err := ParseTemplate("select * from t")
+	assert.NoError(t, err)
+	assert.NoError(t, all.Validate(ParamCodes))
+	rtime, err := ParseTemplate("select * from t where rtime >= '[start]'")
+	assert.NoError(t, err)
+	assert.NoError(t, rtime.Validate(ParamStart, ParamEnd))
+}
@@ -1,30 +1,133 @@
 package di
 
 import (
+	"context"
 	"github.com/dapr/go-sdk/service/common"
+	"go.uber.org/zap"
+	"hxextract/app/config"
+	"hxextract/app/log"
+	"hxextract/app/server/grpc"
 	"hxextract/app/service"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// 未配置Service.ShutdownTimeout时等待执行中任务的时间
+const defaultShutdownTimeout = 30 * time.Second
+
 //go:generate wire
 type App struct {
 	svc     *service.Service
 	httpSvc common.Service
+	grpcSvc *grpc.Server
+	// Shutdown已执行，服务已按Service.ShutdownTimeout停止
+	shutdown bool
+	// 所有请求和任务均在超时前结束，此时才能关闭连接池
+	drained bool
+}
+
+// shutdowner 支持在超时前等待处理中请求结束的http服务
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
 }
 
-func NewApp(svc *service.Service, h common.Service) (app *App, closeFunc func(), err error) {
+func NewApp(svc *service.Service, h common.Service, g *grpc.Server) (app *App, closeFunc func(), err error) {
 	app = &App{
 		svc:     svc,
 		httpSvc: h,
+		grpcSvc: g,
 	}
+	// Shutdown已在超时内停止服务时不再无限期等待
 	closeFunc = func() {
+		if app.shutdown {
+			return
+		}
+		g.Stop()
 		err = h.Stop()
 	}
 	return
 }
 
+// Start 启动服务，阻塞直到收到SIGINT/SIGTERM并完成优雅退出，或http服务异常退出
 func (a *App) Start() error {
 	if err := a.svc.Start(); err != nil {
 		return err
 	}
-	return a.httpSvc.Start()
+	// gRPC服务与http服务一同对外提供
+	go func() {
+		if err := a.grpcSvc.Start(); err != nil {
+			log.Log.Error("grpc server stopped: " + err.Error())
+		}
+	}()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- a.httpSvc.Start()
+	}()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	select {
+	case err := <-errCh:
+		return err
+	case sig := <-sigCh:
+		log.Log.Info("received signal, shutting down", zap.String("signal", sig.String()))
+	}
+	a.Shutdown()
+	return <-errCh
+}
+
+//
+//  Shutdown
+//  @Description: 同时停止接收http、gRPC请求和调度定时任务，
+//  等待处理中的请求和执行中的定时任务结束，最多等待Service.ShutdownTimeout，连接池由cleanup关闭
+//  @receiver a
+//
+func (a *App) Shutdown() {
+	a.shutdown = true
+	timeout := config.GetService().ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	log.Log.Info("shutdown started", zap.Duration("timeout", timeout))
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stops := map[string]func(ctx context.Context) error{
+		"http": a.shutdownHttp,
+		"grpc": a.grpcSvc.Shutdown,
+		"cron": a.svc.Shutdown,
+	}
+	var wg sync.WaitGroup
+	var timeouts int32
+	for name, stop := range stops {
+		wg.Add(1)
+		go func(name string, stop func(ctx context.Context) error) {
+			defer wg.Done()
+			if err := stop(ctx); err != nil {
+				atomic.AddInt32(&timeouts, 1)
+				log.Log.Warn("stop "+name+" before finishing running jobs", zap.String("err", err.Error()))
+				return
+			}
+			log.Log.Info(name+" stopped", zap.Duration("cost", time.Since(start)))
+		}(name, stop)
+	}
+	wg.Wait()
+	a.drained = timeouts == 0
+	log.Log.Info("shutdown finished", zap.Duration("cost", time.Since(start)), zap.Bool("drained", a.drained))
+}
+
+// Drained 退出时所有请求和任务均已结束，超时后被中断的请求和任务可能仍在使用连接池
+func (a *App) Drained() bool {
+	return a.drained
+}
+
+func (a *App) shutdownHttp(ctx context.Context) error {
+	if s, ok := a.httpSvc.(shutdowner); ok {
+		return s.Shutdown(ctx)
+	}
+	return a.httpSvc.Stop()
 }
@@ -7,10 +7,11 @@ import (
 	"github.com/google/wire"
 	"hxextract/app/dao"
 	"hxextract/app/server/dapr"
+	"hxextract/app/server/grpc"
 	"hxextract/app/service"
 )
 
 //go:generate wire
 func InitApp() (*App, func(), error) {
-	panic(wire.Build(dao.Provider, service.Provider, dapr.New, NewApp))
+	panic(wire.Build(dao.Provider, service.Provider, dapr.New, grpc.New, NewApp))
 }
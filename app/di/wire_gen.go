@@ -8,6 +8,7 @@ package di
 import (
 	"hxextract/app/dao"
 	"hxextract/app/server/dapr"
+	"hxextract/app/server/grpc"
 	"hxextract/app/service"
 )
 
@@ -37,7 +38,14 @@ func InitApp() (*App, func(), error) {
 		cleanup()
 		return nil, nil, err
 	}
-	app, cleanup4, err := NewApp(serviceService, commonService)
+	server, err := grpc.New(serviceService)
+	if err != nil {
+		cleanup3()
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	app, cleanup4, err := NewApp(serviceService, commonService, server)
 	if err != nil {
 		cleanup3()
 		cleanup2()
@@ -0,0 +1,169 @@
+package event
+
+/*
+purpose:导出、对比、衍生表更新完成后通过dapr pub/sub发布事件，下游服务无需轮询mysql即可得知表已更新
+*/
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"hxextract/app/config"
+	"hxextract/app/log"
+	"hxextract/pkg/go-sdk/client"
+	"sync"
+	"time"
+)
+
+// 事件类型
+const (
+	TypeExport  = "export"
+	TypeCompare = "compare"
+	TypeDerived = "derived"
+	// TypeFreshness 表超出或恢复新鲜度sla
+	TypeFreshness = "freshness"
+)
+
+// 事件状态
+const (
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+	// 新鲜度事件的状态
+	StatusBreached  = "breached"
+	StatusRecovered = "recovered"
+)
+
+// 未配置pub/sub时内存中保留的事件数
+const memoryCapacity = 1000
+
+// 未配置超时时间时发布事件的超时时间
+const defaultTimeout = 3 * time.Second
+
+type (
+	// KeyRange 本次写入数据的主键范围，按与对比相同的字节序比较
+	KeyRange struct {
+		Columns []string `json:"columns"`
+		Min     []string `json:"min"`
+		Max     []string `json:"max"`
+	}
+
+	// Event 表数据更新事件，作为CloudEvent的data发布
+	Event struct {
+		Type     string    `json:"type"` // 详见：Type*
+		Schema   string    `json:"schema"`
+		Table    string    `json:"table"`
+		Source   string    `json:"source,omitempty"` // 衍生表的源表schema.table
+		ProcType string    `json:"proc_type,omitempty"`
+		Trigger  string    `json:"trigger"`
+		Rows     int64     `json:"rows"`    // 写入的行数
+		Skipped  int       `json:"skipped"` // 校验未通过的行数
+		Inserts  int       `json:"inserts"` // 对比补全的行数
+		Deletes  int       `json:"deletes"` // 对比删除的行数
+		KeyRange *KeyRange `json:"key_range,omitempty"`
+		// 新鲜度事件的sla类型和陈旧的秒数
+		Sla       string    `json:"sla,omitempty"`
+		Staleness int64     `json:"staleness_seconds,omitempty"`
+		Status    string    `json:"status"` // 详见：Status*
+		Error     string    `json:"error,omitempty"`
+		Time      time.Time `json:"time"`
+	}
+
+	// Publisher 事件发布接口
+	Publisher interface {
+		Publish(ctx context.Context, e Event) error
+		Close()
+	}
+
+	daprPublisher struct {
+		client client.Client
+		pubsub string
+		topic  string
+	}
+
+	// MemoryPublisher 将事件保存在内存中，用于未配置pub/sub的本地环境和测试
+	MemoryPublisher struct {
+		sync.Mutex
+		events []Event
+	}
+)
+
+var (
+	mutex     sync.RWMutex
+	publisher Publisher = &MemoryPublisher{}
+	timeout             = defaultTimeout
+)
+
+func (p *daprPublisher) Publish(ctx context.Context, e Event) error {
+	return p.client.PublishEventfromCustomContent(ctx, p.pubsub, p.topic, e)
+}
+
+func (p *daprPublisher) Close() {
+	p.client.Close()
+}
+
+func (m *MemoryPublisher) Publish(_ context.Context, e Event) error {
+	m.Lock()
+	defer m.Unlock()
+	if len(m.events) >= memoryCapacity {
+		m.events = m.events[1:]
+	}
+	m.events = append(m.events, e)
+	return nil
+}
+
+func (m *MemoryPublisher) Close() {}
+
+// Events 获取已发布的事件
+func (m *MemoryPublisher) Events() []Event {
+	m.Lock()
+	defer m.Unlock()
+	return append([]Event(nil), m.events...)
+}
+
+// Init 按配置初始化事件发布，未开启或连接dapr失败时使用内存发布
+func Init() {
+	cfg := config.GetEvent()
+	if cfg.Timeout > 0 {
+		timeout = cfg.Timeout
+	}
+	if !cfg.Enable {
+		log.Log.Info("event publish is disabled, use memory publisher")
+		return
+	}
+	c, err := client.NewClient()
+	if err != nil {
+		log.Log.Error("create dapr client failed, use memory publisher", zap.String("err", err.Error()))
+		return
+	}
+	SetPublisher(&daprPublisher{client: c, pubsub: cfg.PubsubName, topic: cfg.Topic})
+	log.Log.Info("event publisher initialized", zap.String("pubsub", cfg.PubsubName), zap.String("topic", cfg.Topic))
+}
+
+// SetPublisher 替换事件发布实现
+func SetPublisher(p Publisher) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	publisher = p
+}
+
+// Close 关闭事件发布
+func Close() {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	publisher.Close()
+}
+
+// Publish 发布事件，发布失败只记录日志，不影响导出结果
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	mutex.RLock()
+	p := publisher
+	mutex.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := p.Publish(ctx, e); err != nil {
+		log.Log.Error("publish event failed", zap.String("err", err.Error()), zap.String("type", e.Type),
+			zap.String("schema", e.Schema), zap.String("table", e.Table))
+	}
+}
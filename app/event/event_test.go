@@ -0,0 +1,19 @@
+package event
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMemoryPublisher(t *testing.T) {
+	m := &MemoryPublisher{}
+	SetPublisher(m)
+	defer SetPublisher(&MemoryPublisher{})
+	for i := 0; i < memoryCapacity+1; i++ {
+		Publish(Event{Type: TypeExport, Schema: "indexfinance", Table: "CashFlow", Rows: int64(i)})
+	}
+	events := m.Events()
+	assert.Len(t, events, memoryCapacity)
+	assert.Equal(t, int64(1), events[0].Rows)
+	assert.False(t, events[0].Time.IsZero())
+}
@@ -17,6 +17,7 @@ import (
 
 var Log *zap.Logger
 var Status *zap.Logger
+var Audit *zap.Logger
 
 var logConfig zapcore.EncoderConfig
 
@@ -45,6 +46,7 @@ func InitLog() {
 	level := LevelParse(logCfg.LogLevel)
 	Log = NewLog(logCfg.LogPath, level)
 	Status = NewStatus(logCfg.StatLogPath)
+	Audit = NewStatus(logCfg.AuditPath)
 }
 
 // NewLog
@@ -3,18 +3,19 @@ package log
 import (
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"path/filepath"
 	"testing"
 )
 
 func TestNewLog(t *testing.T) {
-	log := NewLog("./newlog.log", zapcore.InfoLevel)
+	log := NewLog(filepath.Join(t.TempDir(), "newlog.log"), zapcore.InfoLevel)
 	log.Info("hello world")
 	log.Debug("hello world")
 	log.Error("error world")
 }
 
 func TestNewStatus(t *testing.T) {
-	log := NewStatus("./newstatus.log")
+	log := NewStatus(filepath.Join(t.TempDir(), "newstatus.log"))
 	log.Info("hello world",
 		zap.Int("count", 100),
 		zap.Int("cost", 200))
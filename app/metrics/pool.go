@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"database/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+// 连接池类型
+const (
+	PoolMysql = "mysql"
+	PoolPg    = "pg"
+)
+
+// PoolStats 获取连接池状态，key为mysql库名或隐藏密码后的pg dsn
+type PoolStats func() map[string]sql.DBStats
+
+// poolCollector 采集时读取连接池状态，连接重建后无需重新注册
+type poolCollector struct {
+	sync.RWMutex
+	sources map[string]PoolStats
+
+	open         *prometheus.Desc
+	inUse        *prometheus.Desc
+	idle         *prometheus.Desc
+	maxOpen      *prometheus.Desc
+	waitCount    *prometheus.Desc
+	waitDuration *prometheus.Desc
+}
+
+var pools = newPoolCollector()
+
+func newPoolCollector() *poolCollector {
+	labels := []string{"kind", "name"}
+	return &poolCollector{
+		sources:      make(map[string]PoolStats),
+		open:         prometheus.NewDesc("db_pool_open_connections", "Established connections, in use and idle.", labels, nil),
+		inUse:        prometheus.NewDesc("db_pool_in_use_connections", "Connections currently in use.", labels, nil),
+		idle:         prometheus.NewDesc("db_pool_idle_connections", "Idle connections.", labels, nil),
+		maxOpen:      prometheus.NewDesc("db_pool_max_open_connections", "Maximum number of open connections.", labels, nil),
+		waitCount:    prometheus.NewDesc("db_pool_wait_count_total", "Total number of connections waited for.", labels, nil),
+		waitDuration: prometheus.NewDesc("db_pool_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", labels, nil),
+	}
+}
+
+func (p *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.open
+	ch <- p.inUse
+	ch <- p.idle
+	ch <- p.maxOpen
+	ch <- p.waitCount
+	ch <- p.waitDuration
+}
+
+func (p *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	p.RLock()
+	defer p.RUnlock()
+	for kind, source := range p.sources {
+		for name, s := range source() {
+			ch <- prometheus.MustNewConstMetric(p.open, prometheus.GaugeValue, float64(s.OpenConnections), kind, name)
+			ch <- prometheus.MustNewConstMetric(p.inUse, prometheus.GaugeValue, float64(s.InUse), kind, name)
+			ch <- prometheus.MustNewConstMetric(p.idle, prometheus.GaugeValue, float64(s.Idle), kind, name)
+			ch <- prometheus.MustNewConstMetric(p.maxOpen, prometheus.GaugeValue, float64(s.MaxOpenConnections), kind, name)
+			ch <- prometheus.MustNewConstMetric(p.waitCount, prometheus.CounterValue, float64(s.WaitCount), kind, name)
+			ch <- prometheus.MustNewConstMetric(p.waitDuration, prometheus.CounterValue, s.WaitDuration.Seconds(), kind, name)
+		}
+	}
+}
+
+// RegisterPools 注册连接池状态来源，kind相同时替换
+func RegisterPools(kind string, source PoolStats) {
+	pools.Lock()
+	defer pools.Unlock()
+	pools.sources[kind] = source
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"database/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPoolCollector(t *testing.T) {
+	p := newPoolCollector()
+	p.sources[PoolMysql] = func() map[string]sql.DBStats {
+		return map[string]sql.DBStats{"indexfinance": {OpenConnections: 5, InUse: 3, Idle: 2, MaxOpenConnections: 50,
+			WaitCount: 7, WaitDuration: 1500 * time.Millisecond}}
+	}
+	reg := prometheus.NewRegistry()
+	assert.NoError(t, reg.Register(p))
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	values := make(map[string]float64)
+	for _, f := range families {
+		m := f.GetMetric()[0]
+		assert.Equal(t, "kind", m.GetLabel()[0].GetName())
+		assert.Equal(t, PoolMysql, m.GetLabel()[0].GetValue())
+		if m.GetGauge() != nil {
+			values[f.GetName()] = m.GetGauge().GetValue()
+		} else {
+			values[f.GetName()] = m.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"db_pool_open_connections":            5,
+		"db_pool_in_use_connections":          3,
+		"db_pool_idle_connections":            2,
+		"db_pool_max_open_connections":        50,
+		"db_pool_wait_count_total":            7,
+		"db_pool_wait_duration_seconds_total": 1.5,
+	}, values)
+}
@@ -16,10 +16,16 @@ var exportTypeDict = map[int]string{
 	pg.OpCode:  "code",  //按代码导出
 }
 
+// ExportDerived 衍生表导出，由源表导出成功后触发
+const ExportDerived = "derived"
+
 // 触发方式
 var trigTypeDict = map[int]string{
-	pg.TrigCron:   "cron",   //全量导出
-	pg.TrigManual: "manual", //按日期导出
+	pg.TrigCron:     "cron",     //定时任务
+	pg.TrigManual:   "manual",   //手动触发
+	pg.TrigTopic:    "topic",    //pub/sub消息触发
+	pg.TrigBinding:  "binding",  //输入绑定触发
+	pg.TrigBackfill: "backfill", //历史数据回补
 }
 
 // 错误阶段
@@ -104,6 +110,25 @@ var (
 		[]string{"trigger", "schema", "table", "export", "statuscode"},
 	)
 
+	// 表数据陈旧的秒数
+	// sla: export data
+	stalenessGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "table_staleness_seconds",
+			Help: "Seconds since the table was last refreshed.",
+		},
+		[]string{"schema", "table", "sla"},
+	)
+
+	// 表是否超出新鲜度sla，1为超出
+	slaBreachedGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "table_sla_breached",
+			Help: "Whether the table breaches its freshness SLA.",
+		},
+		[]string{"schema", "table", "sla"},
+	)
+
 	// 处理函数
 	promHttpHandler = gin.WrapH(promhttp.Handler())
 )
@@ -131,6 +156,9 @@ func InitMetrics() {
 	prometheus.MustRegister(qpsConterVec)
 	prometheus.MustRegister(perfReqBucketVec)
 	prometheus.MustRegister(errorConterVec)
+	prometheus.MustRegister(stalenessGaugeVec)
+	prometheus.MustRegister(slaBreachedGaugeVec)
+	prometheus.MustRegister(pools)
 }
 
 // 指标结果获取接口
@@ -166,3 +194,13 @@ func PerfBucketMetricsObserve(schema string, table string, trigger string, stage
 func ErrorMetricsInc(trigger string, schema string, table string, export string, errorcode string) {
 	errorConterVec.WithLabelValues(trigger, schema, table, export, errorcode).Inc()
 }
+
+// 新鲜度统计接口
+func StalenessSet(schema string, table string, sla string, seconds float64, breached bool) {
+	stalenessGaugeVec.WithLabelValues(schema, table, sla).Set(seconds)
+	if breached {
+		slaBreachedGaugeVec.WithLabelValues(schema, table, sla).Set(1)
+	} else {
+		slaBreachedGaugeVec.WithLabelValues(schema, table, sla).Set(0)
+	}
+}
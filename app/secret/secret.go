@@ -0,0 +1,287 @@
+package secret
+
+/*
+purpose:解析配置和TableInfo中的凭据引用，支持dapr secret store、环境变量和文件，
+解析结果缓存RefreshInterval，过期后重新获取以支持凭据轮换
+*/
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hxextract/app/config"
+	"hxextract/app/log"
+	"hxextract/pkg/go-sdk/client"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 引用的scheme
+const (
+	SchemeSecret = "secret" // secret://store/key[#field]，通过dapr secret store获取
+	SchemeEnv    = "env"    // env://NAME，本地运行时从环境变量获取
+	SchemeFile   = "file"   // file:///path/to/file，本地运行时从文件获取，去掉首尾空白
+)
+
+const (
+	defaultRefreshInterval = 5 * time.Minute
+	defaultTimeout         = 3 * time.Second
+)
+
+// 内嵌在字符串中的引用，如root:${secret://vault/mysql#password}@tcp(127.0.0.1:3306)/
+var embedded = regexp.MustCompile(`\$\{((?:secret|env|file)://[^}]+)\}`)
+
+type (
+	// Ref 解析后的凭据引用
+	Ref struct {
+		Scheme string
+		Store  string // secret时为secret store名称
+		Key    string // secret时为key，env时为变量名，file时为路径
+		Field  string // secret store返回多个值时取的字段
+	}
+
+	// Provider 按引用获取凭据
+	Provider interface {
+		Get(ctx context.Context, ref Ref) (string, error)
+	}
+
+	// Resolver 解析并缓存凭据
+	Resolver struct {
+		sync.Mutex
+		providers map[string]Provider
+		refresh   time.Duration
+		timeout   time.Duration
+		cache     map[string]cached
+	}
+
+	cached struct {
+		value   string
+		fetched time.Time
+	}
+
+	daprProvider struct {
+		sync.Mutex
+		client client.Client
+	}
+
+	envProvider  struct{}
+	fileProvider struct{}
+)
+
+var defaultResolver = NewResolver(defaultRefreshInterval, defaultTimeout)
+
+// IsRef 是否为完整的凭据引用
+func IsRef(value string) bool {
+	for _, scheme := range []string{SchemeSecret, SchemeEnv, SchemeFile} {
+		if strings.HasPrefix(value, scheme+"://") {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRef 是否为凭据引用或包含${}形式的引用
+func HasRef(value string) bool {
+	return IsRef(value) || embedded.MatchString(value)
+}
+
+// ParseRef 解析凭据引用
+func ParseRef(value string) (ref Ref, err error) {
+	idx := strings.Index(value, "://")
+	if idx < 0 {
+		return ref, errors.New(fmt.Sprintf("invalid secret reference: %s", value))
+	}
+	ref.Scheme, ref.Key = value[:idx], value[idx+3:]
+	switch ref.Scheme {
+	case SchemeSecret:
+		slash := strings.Index(ref.Key, "/")
+		if slash <= 0 || slash == len(ref.Key)-1 {
+			return ref, errors.New(fmt.Sprintf("secret reference should be secret://store/key: %s", value))
+		}
+		ref.Store, ref.Key = ref.Key[:slash], ref.Key[slash+1:]
+		if hash := strings.Index(ref.Key, "#"); hash >= 0 {
+			ref.Key, ref.Field = ref.Key[:hash], ref.Key[hash+1:]
+		}
+	case SchemeEnv, SchemeFile:
+	default:
+		return ref, errors.New(fmt.Sprintf("unsupported secret scheme: %s", ref.Scheme))
+	}
+	if ref.Key == "" {
+		return ref, errors.New(fmt.Sprintf("empty secret key: %s", value))
+	}
+	return ref, nil
+}
+
+// NewResolver 创建解析器，默认支持secret、env、file三种引用
+func NewResolver(refresh time.Duration, timeout time.Duration) *Resolver {
+	if refresh <= 0 {
+		refresh = defaultRefreshInterval
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Resolver{
+		providers: map[string]Provider{
+			SchemeSecret: &daprProvider{},
+			SchemeEnv:    envProvider{},
+			SchemeFile:   fileProvider{},
+		},
+		refresh: refresh,
+		timeout: timeout,
+		cache:   make(map[string]cached),
+	}
+}
+
+// SetProvider 替换scheme对应的实现
+func (r *Resolver) SetProvider(scheme string, p Provider) {
+	r.Lock()
+	defer r.Unlock()
+	r.providers[scheme] = p
+}
+
+//
+//  Resolve
+//  @Description: 解析value中的凭据引用，value本身为引用时返回凭据，包含${引用}时替换为凭据，不含引用时原样返回
+//  @receiver r
+//  @param value
+//  @return string
+//  @return error
+//
+func (r *Resolver) Resolve(value string) (string, error) {
+	if IsRef(value) {
+		return r.lookup(value)
+	}
+	var err error
+	ret := embedded.ReplaceAllStringFunc(value, func(m string) string {
+		if err != nil {
+			return m
+		}
+		var v string
+		v, err = r.lookup(embedded.FindStringSubmatch(m)[1])
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+	return ret, nil
+}
+
+// Invalidate 清除value中引用的缓存，连接认证失败时调用，下次解析重新获取以支持凭据轮换
+func (r *Resolver) Invalidate(value string) {
+	refs := []string{value}
+	if !IsRef(value) {
+		refs = refs[:0]
+		for _, m := range embedded.FindAllStringSubmatch(value, -1) {
+			refs = append(refs, m[1])
+		}
+	}
+	r.Lock()
+	defer r.Unlock()
+	for _, ref := range refs {
+		delete(r.cache, ref)
+	}
+}
+
+// lookup 缓存未过期时直接返回，过期后重新获取，获取失败时继续使用过期的值
+func (r *Resolver) lookup(value string) (string, error) {
+	r.Lock()
+	c, ok := r.cache[value]
+	r.Unlock()
+	if ok && time.Since(c.fetched) < r.refresh {
+		return c.value, nil
+	}
+	ref, err := ParseRef(value)
+	if err != nil {
+		return "", err
+	}
+	r.Lock()
+	p := r.providers[ref.Scheme]
+	r.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	v, err := p.Get(ctx, ref)
+	if err != nil {
+		if ok {
+			log.Log.Warn("refresh secret failed, use cached value", zap.String("ref", value), zap.Error(err))
+			return c.value, nil
+		}
+		return "", errors.Wrap(err, fmt.Sprintf("resolve %s", value))
+	}
+	r.Lock()
+	r.cache[value] = cached{value: v, fetched: time.Now()}
+	r.Unlock()
+	return v, nil
+}
+
+func (p *daprProvider) Get(ctx context.Context, ref Ref) (string, error) {
+	p.Lock()
+	if p.client == nil {
+		c, err := client.NewClient()
+		if err != nil || c == nil {
+			p.Unlock()
+			return "", errors.New("dapr client is not available")
+		}
+		p.client = c
+	}
+	c := p.client
+	p.Unlock()
+	data, err := c.GetSecret(ctx, ref.Store, ref.Key, nil)
+	if err != nil {
+		return "", err
+	}
+	return pickField(data, ref)
+}
+
+// pickField 未指定字段时优先取与key同名的值，secret只有一个值时直接返回
+func pickField(data map[string]string, ref Ref) (string, error) {
+	field := ref.Field
+	if field == "" {
+		field = ref.Key
+	}
+	if v, ok := data[field]; ok {
+		return v, nil
+	}
+	if ref.Field == "" && len(data) == 1 {
+		for _, v := range data {
+			return v, nil
+		}
+	}
+	return "", errors.New(fmt.Sprintf("field %s not found in secret %s/%s", field, ref.Store, ref.Key))
+}
+
+func (envProvider) Get(_ context.Context, ref Ref) (string, error) {
+	v, ok := os.LookupEnv(ref.Key)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("environment variable %s is not set", ref.Key))
+	}
+	return v, nil
+}
+
+func (fileProvider) Get(_ context.Context, ref Ref) (string, error) {
+	data, err := ioutil.ReadFile(ref.Key)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Init 按配置设置默认解析器的刷新间隔和超时
+func Init() {
+	cfg := config.GetSecret()
+	defaultResolver = NewResolver(cfg.RefreshInterval, cfg.Timeout)
+}
+
+// Resolve 使用默认解析器解析凭据引用
+func Resolve(value string) (string, error) {
+	return defaultResolver.Resolve(value)
+}
+
+// Invalidate 清除默认解析器中value引用的缓存
+func Invalidate(value string) {
+	defaultResolver.Invalidate(value)
+}
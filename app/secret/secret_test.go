@@ -0,0 +1,106 @@
+package secret
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeProvider struct {
+	values map[string]string
+	calls  int
+}
+
+func (f *fakeProvider) Get(_ context.Context, ref Ref) (string, error) {
+	f.calls++
+	v, ok := f.values[ref.Store+"/"+ref.Key]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return pickField(map[string]string{ref.Key: v}, ref)
+}
+
+func TestParseRef(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Ref
+		err   bool
+	}{
+		{value: "secret://vault/pg-finance", want: Ref{Scheme: SchemeSecret, Store: "vault", Key: "pg-finance"}},
+		{value: "secret://vault/mysql#password", want: Ref{Scheme: SchemeSecret, Store: "vault", Key: "mysql", Field: "password"}},
+		{value: "env://PG_PASSWORD", want: Ref{Scheme: SchemeEnv, Key: "PG_PASSWORD"}},
+		{value: "file:///run/secrets/pg", want: Ref{Scheme: SchemeFile, Key: "/run/secrets/pg"}},
+		{value: "secret://vault", err: true},
+		{value: "env://", err: true},
+		{value: "vault://a/b", err: true},
+	}
+	for _, tt := range tests {
+		ref, err := ParseRef(tt.value)
+		if tt.err {
+			assert.Error(t, err, tt.value)
+			continue
+		}
+		assert.NoError(t, err, tt.value)
+		assert.Equal(t, tt.want, ref)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	os.Setenv("HXEXTRACT_TEST_PASSWORD", "p@ss")
+	defer os.Unsetenv("HXEXTRACT_TEST_PASSWORD")
+	file := filepath.Join(t.TempDir(), "user")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("root\n"), 0600))
+	r := NewResolver(time.Minute, time.Second)
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "postgres", want: "postgres"},
+		{value: "env://HXEXTRACT_TEST_PASSWORD", want: "p@ss"},
+		{value: "file://" + file, want: "root"},
+		{value: "${file://" + file + "}:${env://HXEXTRACT_TEST_PASSWORD}@tcp(127.0.0.1:3306)/",
+			want: "root:p@ss@tcp(127.0.0.1:3306)/"},
+	}
+	for _, tt := range tests {
+		got, err := r.Resolve(tt.value)
+		assert.NoError(t, err, tt.value)
+		assert.Equal(t, tt.want, got)
+	}
+	_, err := r.Resolve("env://HXEXTRACT_TEST_MISSING")
+	assert.Error(t, err)
+}
+
+func TestResolveCacheAndRefresh(t *testing.T) {
+	p := &fakeProvider{values: map[string]string{"vault/pg": "old"}}
+	r := NewResolver(time.Hour, time.Second)
+	r.SetProvider(SchemeSecret, p)
+	for i := 0; i < 3; i++ {
+		v, err := r.Resolve("secret://vault/pg")
+		assert.NoError(t, err)
+		assert.Equal(t, "old", v)
+	}
+	assert.Equal(t, 1, p.calls)
+	// 凭据轮换后清除缓存，重新获取
+	p.values["vault/pg"] = "new"
+	r.Invalidate("host=127.0.0.1 password=${secret://vault/pg}")
+	v, err := r.Resolve("secret://vault/pg")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", v)
+	assert.Equal(t, 2, p.calls)
+}
+
+func TestPickField(t *testing.T) {
+	v, err := pickField(map[string]string{"password": "x", "user": "y"}, Ref{Key: "mysql", Field: "password"})
+	assert.NoError(t, err)
+	assert.Equal(t, "x", v)
+	v, err = pickField(map[string]string{"value": "z"}, Ref{Key: "pg"})
+	assert.NoError(t, err)
+	assert.Equal(t, "z", v)
+	_, err = pickField(map[string]string{"password": "x", "user": "y"}, Ref{Key: "mysql"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,95 @@
+package dapr
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hxextract/app/auth"
+	"net/http"
+	"time"
+)
+
+// identityKey gin上下文中调用方身份的key
+const identityKey = "identity"
+
+// 认证失败的错误码
+const (
+	CodeUnauthenticated  = "unauthenticated"
+	CodePermissionDenied = "permission_denied"
+)
+
+// authenticator 在New中按配置创建，为nil时不校验
+var authenticator *auth.Authenticator
+
+//
+//  authRequired
+//  @Description: 认证并校验角色，export及以上角色的请求记录到审计日志
+//  @param role 接口需要的最低角色
+//  @return gin.HandlerFunc
+//
+func authRequired(role auth.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var certs []*x509.Certificate
+		if c.Request.TLS != nil {
+			certs = c.Request.TLS.PeerCertificates
+		}
+		id, err := authenticator.Authenticate(auth.TokenFromHeader(c.Request.Header), certs)
+		if err != nil {
+			auth.Record(auth.Identity{Name: c.ClientIP()}, c.Request.URL.Path, err, zap.String("ip", c.ClientIP()))
+			abortWithError(c, http.StatusUnauthorized, &ApiError{Code: CodeUnauthenticated, Message: err.Error()})
+			return
+		}
+		c.Set(identityKey, id)
+		if !permit(c, role) {
+			return
+		}
+		if role < auth.RoleExport {
+			return
+		}
+		start := time.Now()
+		c.Next()
+		if c.IsAborted() && c.Writer.Status() == http.StatusForbidden {
+			// 在处理函数中被拒绝的请求已记录
+			return
+		}
+		var result error
+		if c.Writer.Status() >= http.StatusBadRequest {
+			result = errors.New(fmt.Sprintf("status %d", c.Writer.Status()))
+		}
+		auth.Record(id, c.Request.URL.Path, result,
+			zap.String("ip", c.ClientIP()),
+			zap.String("method", c.Request.Method),
+			zap.String("query", c.Request.URL.RawQuery),
+			zap.String("form", c.Request.PostForm.Encode()),
+			zap.Int("status", c.Writer.Status()),
+			zap.Duration("cost", time.Since(start)))
+	}
+}
+
+// permit 校验调用方是否拥有该角色，没有权限时返回403并记录审计日志
+func permit(c *gin.Context, role auth.Role) bool {
+	id := identity(c)
+	if id.Allow(role) {
+		return true
+	}
+	err := errors.New(fmt.Sprintf("%s: %s role required", auth.ErrPermissionDenied.Error(), role))
+	auth.Record(id, c.Request.URL.Path, err, zap.String("ip", c.ClientIP()))
+	abortWithError(c, http.StatusForbidden, &ApiError{Code: CodePermissionDenied, Message: err.Error()})
+	return false
+}
+
+// operator 审计记录的发起方：调用方@ip
+func operator(c *gin.Context) string {
+	return identity(c).Name + "@" + c.ClientIP()
+}
+
+// identity 获取调用方身份，未经过认证中间件时为未开启认证的身份
+func identity(c *gin.Context) auth.Identity {
+	if v, ok := c.Get(identityKey); ok {
+		return v.(auth.Identity)
+	}
+	id, _ := (*auth.Authenticator)(nil).Authenticate("", nil)
+	return id
+}
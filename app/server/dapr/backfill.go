@@ -0,0 +1,165 @@
+package dapr
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"hxextract/app/dao"
+	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	"net/http"
+	"strconv"
+)
+
+// BackfillRequest 回补请求，分块和并发为0时使用Backfill配置
+type BackfillRequest struct {
+	FinName     string   `json:"finname"`
+	FinNames    []string `json:"finnames"`  // 与finname合并
+	Group       string   `json:"group"`     // 表分组，与finname、finnames合并
+	Type        *int     `json:"type"`      // 1按bbrq，2按rtime，4按代码，为空时指定了codes按代码，否则按bbrq
+	StartDate   int      `json:"startdate"` // YYYYMMDD
+	EndDate     int      `json:"enddate"`   // YYYYMMDD
+	Codes       []string `json:"codes"`     // 代码范围，为空时不按代码拆分
+	ChunkMonths int      `json:"chunk_months"`
+	ChunkCodes  int      `json:"chunk_codes"`
+	Parallelism int      `json:"parallelism"`
+}
+
+// 可回补的导出方式
+var backfillTypes = map[int]bool{pg.OpBbrq: true, pg.OpRtime: true, pg.OpCode: true}
+
+// toParam 校验回补请求并转换为回补参数
+func (r *BackfillRequest) toParam() (dao.BackfillParam, *ApiError) {
+	param := dao.BackfillParam{FinNames: r.FinNames, Group: r.Group}
+	if r.FinName != "" {
+		param.FinNames = append([]string{r.FinName}, param.FinNames...)
+	}
+	if len(param.FinNames) == 0 && param.Group == "" {
+		return param, invalidArgument("finnames", "finname, finnames or group is required")
+	}
+	for _, finName := range param.FinNames {
+		if finName == "" {
+			return param, invalidArgument("finnames", "finname should not be empty")
+		}
+	}
+	param.ProcType = pg.OpBbrq
+	if r.Type != nil {
+		param.ProcType = *r.Type
+	} else if len(r.Codes) > 0 {
+		param.ProcType = pg.OpCode
+	}
+	if !backfillTypes[param.ProcType] {
+		return param, invalidArgument("type", "type should be one of 1,2,4")
+	}
+	if r.StartDate == 0 {
+		return param, invalidArgument("startdate", "startdate is required")
+	}
+	if r.EndDate == 0 {
+		return param, invalidArgument("enddate", "enddate is required")
+	}
+	if e := checkDate("startdate", r.StartDate); e != nil {
+		return param, e
+	}
+	if e := checkDate("enddate", r.EndDate); e != nil {
+		return param, e
+	}
+	if r.StartDate > r.EndDate {
+		return param, invalidArgument("enddate", "enddate should not be earlier than startdate")
+	}
+	if e := checkCodes(r.Codes); e != nil {
+		return param, e
+	}
+	if param.ProcType == pg.OpCode && len(r.Codes) == 0 {
+		return param, invalidArgument("codes", "codes is required when type is 4")
+	}
+	if r.ChunkMonths < 0 {
+		return param, invalidArgument("chunk_months", "chunk_months should not be negative")
+	}
+	if r.ChunkCodes < 0 {
+		return param, invalidArgument("chunk_codes", "chunk_codes should not be negative")
+	}
+	if r.Parallelism < 0 {
+		return param, invalidArgument("parallelism", "parallelism should not be negative")
+	}
+	param.StartDate, param.EndDate, param.Codes = r.StartDate, r.EndDate, r.Codes
+	param.ChunkMonths, param.ChunkCodes, param.Parallelism = r.ChunkMonths, r.ChunkCodes, r.Parallelism
+	return param, nil
+}
+
+// backfillId 路径中的回补任务id
+func backfillId(c *gin.Context) (int64, *ApiError) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, invalidArgument("id", "id should be a positive integer")
+	}
+	return id, nil
+}
+
+//curl 127.0.0.1:12345/v1/backfills -H "Content-Type: application/json" -d '{"finnames":["testfinance"],"type":1,"startdate":20200101,"enddate":20211231}'
+// 任务在后台执行，返回202及任务id，通过/v1/backfills/:id查询进度
+func v1BackfillHandler(c *gin.Context) {
+	var req BackfillRequest
+	if e := bindJSON(c, &req); e != nil {
+		abortWithError(c, http.StatusBadRequest, e)
+		return
+	}
+	param, e := req.toParam()
+	if e != nil {
+		abortWithError(c, http.StatusBadRequest, e)
+		return
+	}
+	param.Operator = operator(c)
+	job, err := svc.StartBackfill(param)
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("start backfill failed: %s", err.Error()),
+			zap.Strings("finnames", param.FinNames),
+			zap.Int("type", param.ProcType))
+		abortWithServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, job)
+}
+
+//curl -X POST 127.0.0.1:12345/v1/backfills/1/resume
+// 重新执行失败和未执行的分块，已成功的分块不再执行
+func v1BackfillResumeHandler(c *gin.Context) {
+	id, e := backfillId(c)
+	if e != nil {
+		abortWithError(c, http.StatusBadRequest, e)
+		return
+	}
+	job, err := svc.ResumeBackfill(id, operator(c))
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("resume backfill failed: %s", err.Error()), zap.Int64("backfill", id))
+		abortWithServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, job)
+}
+
+//curl 127.0.0.1:12345/v1/backfills
+func v1BackfillsHandler(c *gin.Context) {
+	jobs, err := svc.Backfills()
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("query backfills failed: %s", err.Error()))
+		abortWithServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"backfills": jobs})
+}
+
+//curl 127.0.0.1:12345/v1/backfills/1
+func v1BackfillDetailHandler(c *gin.Context) {
+	id, e := backfillId(c)
+	if e != nil {
+		abortWithError(c, http.StatusBadRequest, e)
+		return
+	}
+	job, err := svc.BackfillDetail(id)
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("query backfill failed: %s", err.Error()), zap.Int64("backfill", id))
+		abortWithServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,63 @@
+package dapr
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"hxextract/app/dao/pg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBackfillValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	initV1Route(r)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		field  string
+	}{
+		{name: "missing finname", path: "/v1/backfills", body: `{"startdate":20200101,"enddate":20201231}`, field: "finnames"},
+		{name: "invalid type", path: "/v1/backfills", body: `{"finname":"a","type":0,"startdate":20200101,"enddate":20201231}`, field: "type"},
+		{name: "missing startdate", path: "/v1/backfills", body: `{"finname":"a","enddate":20201231}`, field: "startdate"},
+		{name: "bad enddate", path: "/v1/backfills", body: `{"finname":"a","startdate":20200101,"enddate":20201232}`, field: "enddate"},
+		{name: "start after end", path: "/v1/backfills", body: `{"finname":"a","startdate":20200201,"enddate":20200101}`, field: "enddate"},
+		{name: "codes required", path: "/v1/backfills", body: `{"finname":"a","type":4,"startdate":20200101,"enddate":20201231}`, field: "codes"},
+		{name: "invalid code", path: "/v1/backfills", body: `{"finname":"a","startdate":20200101,"enddate":20201231,"codes":["1,2"]}`, field: "codes"},
+		{name: "negative parallelism", path: "/v1/backfills", body: `{"finname":"a","startdate":20200101,"enddate":20201231,"parallelism":-1}`, field: "parallelism"},
+		{name: "resume bad id", path: "/v1/backfills/x/resume", field: "id"},
+		{name: "detail bad id", method: http.MethodGet, path: "/v1/backfills/0", field: "id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(method, tt.path, strings.NewReader(tt.body)))
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			var env ErrorEnvelope
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &env))
+			assert.Equal(t, tt.field, env.Error.Field)
+		})
+	}
+}
+
+func TestBackfillRequestType(t *testing.T) {
+	req := BackfillRequest{FinName: "a", FinNames: []string{"b"}, StartDate: 20200101, EndDate: 20201231}
+	param, e := req.toParam()
+	assert.Nil(t, e)
+	assert.Equal(t, pg.OpBbrq, param.ProcType)
+	assert.Equal(t, []string{"a", "b"}, param.FinNames)
+
+	req.Codes = []string{"000001"}
+	param, e = req.toParam()
+	assert.Nil(t, e)
+	assert.Equal(t, pg.OpCode, param.ProcType)
+}
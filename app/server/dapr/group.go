@@ -0,0 +1,100 @@
+package dapr
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"hxextract/app/auth"
+	"hxextract/app/dao"
+	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	"net/http"
+	"strconv"
+)
+
+// groupHttpStatus 全部表成功时返回200，部分或全部失败时返回207，各表结果见响应
+func groupHttpStatus(res *dao.GroupResult) int {
+	if res.Failed > 0 {
+		return http.StatusMultiStatus
+	}
+	return http.StatusOK
+}
+
+// formParallelism 表单中的并发数，为空时为0，即使用Group.Parallelism
+func formParallelism(c *gin.Context) (int, error) {
+	value := c.PostForm(pg.PARALLEL)
+	if value == "" {
+		return 0, nil
+	}
+	parallelism, err := strconv.Atoi(value)
+	if err != nil || parallelism < 0 {
+		return 0, fmt.Errorf("parallelism should be a non-negative integer")
+	}
+	return parallelism, nil
+}
+
+//curl 127.0.0.1:12345/groups
+// 已配置的分组，不包含schema:<schema>和tag:<tag>
+func groupsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"groups": svc.Groups()})
+}
+
+//curl 127.0.0.1:12345/export -d "group=finance&type=1&startdate=20211231&enddate=20211231&parallelism=4"
+// group: 分组名称，也可以是schema:<schema>或tag:<tag>
+// parallelism: 同时导出的表数，为空时使用Group.Parallelism
+func exportGroupHandler(c *gin.Context, group string) {
+	if isDryRun(c) {
+		c.String(400, "dryrun is not supported for group")
+		return
+	}
+	parallelism, err := formParallelism(c)
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	qp, err := getQueryParas(c)
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	res, err := svc.ExportGroup(group, qp, parallelism)
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("export group failed: %s", err.Error()),
+			zap.String("group", group),
+			zap.String("type", "manual"))
+		c.String(400, err.Error())
+		return
+	}
+	c.JSON(groupHttpStatus(res), res)
+}
+
+//curl 127.0.0.1:12345/compare -d "group=finance&operation=2&parallelism=4"
+// group: 分组名称，也可以是schema:<schema>或tag:<tag>
+// parallelism: 同时对比的表数，为空时使用Group.Parallelism
+func compareGroupHandler(c *gin.Context, group string) {
+	if isDryRun(c) {
+		c.String(400, "dryrun is not supported for group")
+		return
+	}
+	oper, _ := strconv.Atoi(c.PostForm("operation"))
+	if oper == 0 {
+		log.Log.Error("cmp handler recv no operation", zap.String("group", group))
+		c.String(400, "cmp handler recv no operation")
+		return
+	}
+	parallelism, err := formParallelism(c)
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	if oper&dao.CmpAndDelete != 0 && !permit(c, auth.RoleAdmin) {
+		return
+	}
+	res, err := svc.CompareGroup(group, oper, operator(c), parallelism)
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("compare group error: %s", err.Error()), zap.String("group", group), zap.Int("operation", oper))
+		c.String(400, err.Error())
+		return
+	}
+	c.JSON(groupHttpStatus(res), res)
+}
@@ -0,0 +1,35 @@
+package dapr
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGroupFormValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	initRoute(r)
+	tests := []struct {
+		name string
+		path string
+		form string
+	}{
+		{name: "compare type", path: "/export", form: "group=schema:indexfinance&type=5"},
+		{name: "invalid type", path: "/export", form: "group=finance&type=x"},
+		{name: "dry run", path: "/export", form: "group=finance&dryrun=1"},
+		{name: "negative parallelism", path: "/export", form: "group=finance&parallelism=-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package dapr
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"hxextract/app/dao"
+	"hxextract/app/log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 执行记录可按导出方式过滤
+var runProcTypes = map[string]bool{"all": true, "bbrq": true, "rtime": true, "real": true, "code": true}
+
+var runStatuses = map[string]bool{dao.RunRunning: true, dao.RunSuccess: true, dao.RunFailed: true}
+
+// splitTable table参数可以是schema.table，也可以与schema参数分开传
+func splitTable(c *gin.Context) (schemaName string, tableName string) {
+	schemaName, tableName = c.Query("schema"), c.Query("table")
+	if idx := strings.Index(tableName, "."); idx > 0 && schemaName == "" {
+		schemaName, tableName = tableName[:idx], tableName[idx+1:]
+	}
+	return
+}
+
+// runQuery 校验查询参数并转换为执行记录查询条件
+func runQuery(c *gin.Context) (q dao.RunQuery, e *ApiError) {
+	q.SchemaName, q.TableName = splitTable(c)
+	if q.ProcType = c.Query("type"); q.ProcType != "" && !runProcTypes[q.ProcType] {
+		return q, invalidArgument("type", "type should be one of all,bbrq,rtime,real,code")
+	}
+	if q.Status = c.Query("status"); q.Status != "" && !runStatuses[q.Status] {
+		return q, invalidArgument("status", "status should be one of running,success,failed")
+	}
+	if q.Page, e = parseInt("page", c.Query("page")); e != nil {
+		return
+	}
+	q.PageSize, e = parseInt("page_size", c.Query("page_size"))
+	return
+}
+
+//curl "127.0.0.1:12345/runs?table=indexfinance.zjlx&status=failed&page=1&page_size=20"
+func runsHandler(c *gin.Context) {
+	q, e := runQuery(c)
+	if e != nil {
+		abortWithError(c, http.StatusBadRequest, e)
+		return
+	}
+	page, err := svc.ExportRuns(q)
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("query export runs failed: %s", err.Error()))
+		abortWithServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+//curl "127.0.0.1:12345/runs/fresh?table=indexfinance.zjlx&type=rtime&max_age=2h"
+// 最近一次成功导出在max_age（默认24h）内时返回200，否则返回503，响应内容相同
+func freshHandler(c *gin.Context) {
+	schemaName, tableName := splitTable(c)
+	if schemaName == "" || tableName == "" {
+		abortWithError(c, http.StatusBadRequest, invalidArgument("table", "table should be schema.table"))
+		return
+	}
+	procType := c.Query("type")
+	if procType != "" && !runProcTypes[procType] {
+		abortWithError(c, http.StatusBadRequest, invalidArgument("type", "type should be one of all,bbrq,rtime,real,code"))
+		return
+	}
+	var maxAge time.Duration
+	if v := c.Query("max_age"); v != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(v); err != nil || maxAge <= 0 {
+			abortWithError(c, http.StatusBadRequest, invalidArgument("max_age", "max_age should be a duration like 2h"))
+			return
+		}
+	}
+	f, err := svc.Freshness(schemaName, tableName, procType, maxAge)
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("query freshness failed: %s", err.Error()))
+		abortWithServiceError(c, err)
+		return
+	}
+	status := http.StatusOK
+	if !f.Fresh {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, f)
+}
+
+//curl "127.0.0.1:12345/readiness/freshness"
+// 所有表都在新鲜度sla内时返回200，否则返回503，响应内容为各sla最近一次检查结果
+func slaHandler(c *gin.Context) {
+	slas := svc.SlaStatuses()
+	status := http.StatusOK
+	for _, s := range slas {
+		if s.Breached {
+			status = http.StatusServiceUnavailable
+			break
+		}
+	}
+	c.JSON(status, gin.H{"slas": slas})
+}
@@ -0,0 +1,57 @@
+package dapr
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRunsValidation(t *testing.T) {
+	r := gin.New()
+	r.GET("/runs", runsHandler)
+	r.GET("/runs/fresh", freshHandler)
+	tests := []struct {
+		name  string
+		url   string
+		field string
+	}{
+		{name: "unknown type", url: "/runs?type=daily", field: "type"},
+		{name: "unknown status", url: "/runs?status=ok", field: "status"},
+		{name: "bad page", url: "/runs?page=x", field: "page"},
+		{name: "bad page size", url: "/runs?page_size=-5", field: "page_size"},
+		{name: "fresh without schema", url: "/runs/fresh?table=zjlx", field: "table"},
+		{name: "fresh bad max age", url: "/runs/fresh?table=indexfinance.zjlx&max_age=2", field: "max_age"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			var env ErrorEnvelope
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &env))
+			assert.Equal(t, tt.field, env.Error.Field)
+		})
+	}
+}
+
+func TestSplitTable(t *testing.T) {
+	tests := []struct {
+		query  string
+		schema string
+		table  string
+	}{
+		{"table=indexfinance.zjlx", "indexfinance", "zjlx"},
+		{"schema=indexfinance&table=zjlx", "indexfinance", "zjlx"},
+		{"table=zjlx", "", "zjlx"},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/runs?"+tt.query, nil)
+		schema, table := splitTable(c)
+		assert.Equal(t, tt.schema, schema)
+		assert.Equal(t, tt.table, table)
+	}
+}
@@ -6,14 +6,15 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 	"hxextract/api"
+	"hxextract/app/auth"
 	"hxextract/app/config"
+	"hxextract/app/dao"
 	"hxextract/app/dao/pg"
 	"hxextract/app/log"
 	"hxextract/app/metrics"
 	negt "hxextract/pkg/go-sdk/service/http"
 	"net/http"
 	"strconv"
-	"time"
 )
 
 var svc api.NegtServer
@@ -31,20 +32,48 @@ func New(s api.NegtServer) (srv common.Service, err error) {
 	// 设置路由句柄
 	initRoute(r)
 	mux.Handle("/", r)
-	// 启动服务
-	srv = negt.NewServiceWithMux(fmt.Sprintf(":%d", config.GetService().HttpPort), mux)
+	// 认证和授权
+	if authenticator, err = auth.New(config.GetAuth()); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := auth.TLSConfig(config.GetAuth().TLS)
+	if err != nil {
+		return nil, err
+	}
+	// 启动服务，配置证书时使用https
+	addr := fmt.Sprintf(":%d", config.GetService().HttpPort)
+	if tlsConfig != nil {
+		srv = negt.NewServiceWithTLS(addr, mux, tlsConfig)
+	} else {
+		srv = negt.NewServiceWithMux(addr, mux)
+	}
 	svc = s // 给包变量svc赋值为初始化后的service
+	// 注册pub/sub和输入绑定触发的导出
+	err = initSubscription(srv)
 	return srv, err
 }
 
 // initRoute http请求路由设置
 func initRoute(r *gin.Engine) {
+	// 探活和指标采集不需要认证
+	r.GET("/healthz", healthzHandler)
+	r.GET("/readyz", readyzHandler)
 	r.GET("/readiness", healthCheckHandler)
-	r.POST("/export", exportHandler)
+	r.GET("/readiness/freshness", slaHandler) // 表新鲜度sla，超出时返回503
 	r.GET("/ping", pingHandler)
-	r.GET("/cmd", cmdHandler)
 	r.GET("/metrics", metrics.GetMetrics) // prometheus指标采集接口
-	r.POST("/compare", compareHandler)    // 对比并删除数据
+	read, export, admin := authRequired(auth.RoleRead), authRequired(auth.RoleExport), authRequired(auth.RoleAdmin)
+	r.GET("/cmd", read, cmdHandler)
+	r.GET("/derived", read, derivedHandler)                // 衍生表规则执行状态
+	r.GET("/tasks", read, tasksHandler)                    // 定时任务节点执行状态
+	r.GET("/runs", read, runsHandler)                      // 导出执行记录
+	r.GET("/runs/fresh", read, freshHandler)               // 表的新鲜度
+	r.GET("/groups", read, groupsHandler)                  // 表分组及包含的表
+	r.POST("/export", export, exportHandler)               // 导出，可按分组导出
+	r.POST("/compare", export, compareHandler)             // 对比并删除数据，删除数据需要admin角色，可按分组对比
+	r.POST("/reconcile", export, reconcileHandler)         // 与外部参照源对账
+	r.GET("/debug/connections", admin, connectionsHandler) // mysql和pg连接池状态
+	initV1Route(r)                                         // v1版本json接口
 }
 
 // cmdHandler 管理命令url
@@ -59,15 +88,45 @@ func pingHandler(c *gin.Context) {
 	c.JSON(200, "pong")
 }
 
+// healthCheckHandler 兼容旧的探活接口，新接入请使用/readyz
 func healthCheckHandler(c *gin.Context) {
 	log.Log.Debug("service health check")
-	if svc.HealthCheck() != nil {
-		log.Log.Fatal("service unhealthy")
+	if !svc.Readiness().Ready {
+		c.String(http.StatusServiceUnavailable, "unready")
+		return
 	}
-	c.String(0, "ok")
+	c.String(http.StatusOK, "ok")
 }
 
+//curl 127.0.0.1:12345/healthz
+// 进程存活即返回200，不检查依赖
+func healthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "alive"})
+}
+
+//curl 127.0.0.1:12345/readyz
+// 所有依赖可用时返回200，否则返回503，响应为各依赖的检查结果
+func readyzHandler(c *gin.Context) {
+	ready := svc.Readiness()
+	status := http.StatusOK
+	if !ready.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, ready)
+}
+
+//curl 127.0.0.1:12345/debug/connections
+// 各mysql库和pg dsn的连接状态、失败次数、下次重连时间及连接池统计，pg dsn隐藏密码
+func connectionsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"connections": svc.Connections()})
+}
+
+// exportHandler 兼容旧的表单接口，新接入请使用/v1/exports
 func exportHandler(c *gin.Context) {
+	if group := c.PostForm(pg.GROUP); group != "" {
+		exportGroupHandler(c, group)
+		return
+	}
 	ep, err := getExportParas(c)
 
 	if err != nil {
@@ -77,6 +136,18 @@ func exportHandler(c *gin.Context) {
 		c.String(400, err.Error())
 		return
 	}
+	if isDryRun(c) {
+		plan, err := svc.PreviewExport(ep.FinName, ep.QP)
+		if err != nil {
+			log.Log.Error(fmt.Sprintf("preview export failed: %s", err.Error()),
+				zap.String("finname", ep.FinName),
+				zap.String("type", "manual"))
+			c.String(400, err.Error())
+			return
+		}
+		c.JSON(200, plan)
+		return
+	}
 	err = svc.Export(ep.FinName, ep.QP)
 	if err != nil {
 		log.Log.Error(fmt.Sprintf("export data failed: %s", err.Error()),
@@ -87,7 +158,7 @@ func exportHandler(c *gin.Context) {
 		log.Log.Info(fmt.Sprintf("data successfully"),
 			zap.String("finname", ep.FinName),
 			zap.String("type", "manual"))
-		c.String(0, "export succeed")
+		c.String(200, "export succeed")
 	}
 
 }
@@ -97,41 +168,112 @@ func getExportParas(c *gin.Context) (ep pg.ExportParam, err error) {
 		err = fmt.Errorf("finname is empty")
 		return
 	}
-	if ep.QP.StartDate, _ = strconv.Atoi(c.PostForm(pg.STARTDATE)); ep.QP.StartDate == 0 {
-		y, m, d := time.Now().AddDate(0, 0, -1).Date()
-		ep.QP.StartDate = y*10000 + 100*int(m) + d
-	}
-	if ep.QP.EndDate, _ = strconv.Atoi(c.PostForm(pg.ENDDATE)); ep.QP.EndDate == 0 {
-		y, m, d := time.Now().Date()
-		ep.QP.EndDate = y*10000 + 100*int(m) + d
+	if ep.QP, err = getQueryParas(c); err != nil {
+		return
 	}
+	err = ep.Check()
+	return
+}
+
+// getQueryParas 表单中的导出方式、日期和代码，导出方式不能为对比
+func getQueryParas(c *gin.Context) (qp pg.QueryParam, err error) {
+	qp.StartDate, _ = strconv.Atoi(c.PostForm(pg.STARTDATE))
+	qp.EndDate, _ = strconv.Atoi(c.PostForm(pg.ENDDATE))
+	qp.FillDefaultDate()
 	if c.PostForm(pg.TYPE) == "" {
-		ep.QP.ProcType = pg.OpRtime
-	} else {
-		ep.QP.ProcType, _ = strconv.Atoi(c.PostForm(pg.TYPE))
+		qp.ProcType = pg.OpRtime
+	} else if qp.ProcType, err = strconv.Atoi(c.PostForm(pg.TYPE)); err != nil {
+		err = fmt.Errorf("invalid type: %s", c.PostForm(pg.TYPE))
+		return
 	}
-	ep.QP.CodeList = c.PostForm(pg.CODELIST)
-	ep.QP.TriggerType = pg.TrigManual
+	qp.CodeList = c.PostForm(pg.CODELIST)
+	qp.TriggerType = pg.TrigManual
+	qp.Operator = operator(c)
+	err = qp.CheckType()
 	return
 }
 
+// isDryRun 是否为预览请求，dryrun=1或true时只返回计划变更
+func isDryRun(c *gin.Context) bool {
+	dryRun, _ := strconv.ParseBool(c.PostForm(pg.DRYRUN))
+	return dryRun
+}
+
 //curl 127.0.0.1:12345/compare -d "finname=testfinance&operation=2"
 // finname: 财务文件名称
-// operation： 是否执行删除操作，1不删除，2删除
+// operation： 1删除生产库多余数据，2补全缺失数据，3两者都执行
+// dryrun: 为1时只返回需要删除和补全的记录，此时不需要operation
+// 兼容旧的表单接口，新接入请使用/v1/compares
 func compareHandler(c *gin.Context) {
+	if group := c.PostForm(pg.GROUP); group != "" {
+		compareGroupHandler(c, group)
+		return
+	}
 	finname := c.PostForm("finname")
+	if finname != "" && isDryRun(c) {
+		plan, err := svc.PreviewCompare(finname)
+		if err != nil {
+			log.Log.Error(fmt.Sprintf("preview compare error: %s", err.Error()), zap.String("finname", finname))
+			c.String(400, err.Error())
+			return
+		}
+		c.JSON(200, plan)
+		return
+	}
 	oper, _ := strconv.Atoi(c.PostForm("operation"))
 	if finname == "" || oper == 0 {
 		log.Log.Error("cmp handler recv no finame/operation")
 		c.String(400, "cmp handler recv no finame/operation")
 		return
 	}
-	delete, insert, err := svc.CompareTable(finname, oper)
+	if oper&dao.CmpAndDelete != 0 && !permit(c, auth.RoleAdmin) {
+		return
+	}
+	delete, insert, err := svc.CompareTable(finname, oper, operator(c))
 	if err != nil {
 		log.Log.Error(fmt.Sprintf("compare error: %s", err.Error()), zap.String("finname", finname), zap.Int("operation", oper))
 		c.String(400, err.Error())
 	} else {
 		log.Log.Info(fmt.Sprintf("compare success"), zap.String("finname", finname), zap.Int("operation", oper))
-		c.String(0, fmt.Sprintf("compare succeed, delete %d rows, insert %d rows", delete, insert))
+		c.String(200, fmt.Sprintf("compare succeed, delete %d rows, insert %d rows", delete, insert))
 	}
 }
+
+//curl 127.0.0.1:12345/reconcile -d "finname=testfinance&source=csv&path=testfinance.csv&withpg=1"
+// finname: 财务文件名称
+// source: 参照源类型，csv/parquet/pg
+// path: 参照文件路径，相对于配置的ReferenceDir
+// ref: 参照pg库名称，只能使用Service.References中配置的参照库，为空时使用表配置的pg库和全量导出sql
+// withpg: 为1时同时与pg源三方对比
+func reconcileHandler(c *gin.Context) {
+	param := dao.ReconcileParam{
+		FinName: c.PostForm(pg.FINNAME),
+		RefType: c.PostForm(pg.REFTYPE),
+		RefPath: c.PostForm(pg.REFPATH),
+		RefName: c.PostForm(pg.REFNAME),
+	}
+	param.WithPg, _ = strconv.ParseBool(c.PostForm(pg.WITHPG))
+	if param.FinName == "" || param.RefType == "" {
+		log.Log.Error("reconcile handler recv no finame/source")
+		c.String(400, "reconcile handler recv no finame/source")
+		return
+	}
+	report, err := svc.Reconcile(param)
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("reconcile error: %s", err.Error()), zap.String("finname", param.FinName),
+			zap.String("source", param.RefType))
+		c.String(400, err.Error())
+		return
+	}
+	c.JSON(200, report)
+}
+
+//curl 127.0.0.1:12345/derived
+func derivedHandler(c *gin.Context) {
+	c.JSON(200, svc.DerivedStatuses())
+}
+
+//curl 127.0.0.1:12345/tasks
+func tasksHandler(c *gin.Context) {
+	c.JSON(200, svc.TaskStatuses())
+}
@@ -0,0 +1,183 @@
+package dapr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dapr/go-sdk/service/common"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hxextract/app/config"
+	"hxextract/app/dao"
+	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	negt "hxextract/pkg/go-sdk/service/http"
+	"os"
+)
+
+// exportTopicRoute pub/sub导出请求的路由
+const exportTopicRoute = "/events/export"
+
+type (
+	// exportRequest 通过pub/sub或输入绑定请求导出，字段与http导出接口的参数一致
+	exportRequest struct {
+		FinName   string `json:"finname"`
+		StartDate int    `json:"startdate"`
+		EndDate   int    `json:"enddate"`
+		CodeList  string `json:"codelist"`
+		Type      *int   `json:"type"` // 为空时按rtime导出
+	}
+
+	// bindingResponse 输入绑定的处理结果
+	bindingResponse struct {
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}
+)
+
+// initSubscription 按配置注册pub/sub和输入绑定的导出处理，只接受dapr sidecar的请求：
+// 设置了APP_API_TOKEN时校验dapr-api-token请求头，否则只接受本机的请求
+func initSubscription(srv common.Service) error {
+	cfg := config.GetTrigger()
+	if (cfg.PubsubName != "" && cfg.Topic != "") || len(cfg.Bindings) > 0 {
+		restrictToDapr(srv)
+	}
+	if cfg.PubsubName != "" && cfg.Topic != "" {
+		sub := &common.Subscription{PubsubName: cfg.PubsubName, Topic: cfg.Topic, Route: exportTopicRoute}
+		if err := srv.AddTopicEventHandler(sub, exportTopicHandler); err != nil {
+			return err
+		}
+		log.Log.Info("subscribe export topic", zap.String("pubsub", cfg.PubsubName), zap.String("topic", cfg.Topic))
+	}
+	for _, b := range cfg.Bindings {
+		if err := (&pg.QueryParam{ProcType: b.Type}).CheckType(); err != nil {
+			return errors.Wrapf(err, "binding %s", b.Name)
+		}
+		if err := srv.AddBindingInvocationHandler(b.Name, exportBindingHandler(b)); err != nil {
+			return err
+		}
+		log.Log.Info("register export binding", zap.String("binding", b.Name), zap.String("finname", b.FinName))
+	}
+	return nil
+}
+
+// restrictToDapr pub/sub和输入绑定的路由不经过认证中间件，只允许dapr sidecar调用
+func restrictToDapr(srv common.Service) {
+	s, ok := srv.(*negt.Server)
+	if !ok {
+		return
+	}
+	token := os.Getenv(negt.AppAPITokenEnvVar)
+	if token == "" {
+		log.Log.Warn(fmt.Sprintf("%s is not set, export triggers only accept requests from local dapr sidecar", negt.AppAPITokenEnvVar))
+	}
+	s.RestrictToDapr(token)
+}
+
+// toParam 校验请求并转换为导出参数，导出方式不能为对比，日期和导出方式的默认值与http导出接口一致
+func (r *exportRequest) toParam(trigger int) (ep pg.ExportParam, err error) {
+	ep.FinName = r.FinName
+	ep.QP.StartDate, ep.QP.EndDate = r.StartDate, r.EndDate
+	ep.QP.FillDefaultDate()
+	ep.QP.ProcType = pg.OpRtime
+	if r.Type != nil {
+		ep.QP.ProcType = *r.Type
+	}
+	ep.QP.CodeList = r.CodeList
+	ep.QP.TriggerType = trigger
+	return ep, ep.Check()
+}
+
+// decodeTopicData 解析消息内容，内容可以是json对象或json字符串
+func decodeTopicData(data interface{}, req *exportRequest) error {
+	var content []byte
+	switch v := data.(type) {
+	case string:
+		content = []byte(v)
+	case []byte:
+		content = v
+	default:
+		var err error
+		if content, err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(content, req)
+}
+
+//
+//  exportTopicHandler
+//  @Description: 处理pub/sub导出请求，请求有误或财务文件不存在时丢弃消息，导出失败时由dapr重试
+//  @param ctx
+//  @param e
+//  @return retry
+//  @return err
+//
+func exportTopicHandler(ctx context.Context, e *common.TopicEvent) (retry bool, err error) {
+	var req exportRequest
+	if err = decodeTopicData(e.Data, &req); err != nil {
+		log.Log.Error(fmt.Sprintf("drop export event: %s", err.Error()), zap.String("id", e.ID))
+		return false, err
+	}
+	ep, err := req.toParam(pg.TrigTopic)
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("drop export event: %s", err.Error()), zap.String("id", e.ID))
+		return false, err
+	}
+	ep.QP.Operator = "event:" + e.ID
+	if err = svc.Export(ep.FinName, ep.QP); err != nil {
+		retry = !errors.Is(err, dao.ErrFinanceNotFound)
+		log.Log.Error(fmt.Sprintf("export data failed: %s", err.Error()),
+			zap.String("finname", ep.FinName),
+			zap.String("type", "topic"),
+			zap.String("id", e.ID),
+			zap.Bool("retry", retry))
+		return retry, err
+	}
+	log.Log.Info("export data successfully",
+		zap.String("finname", ep.FinName),
+		zap.String("type", "topic"),
+		zap.String("id", e.ID))
+	return false, nil
+}
+
+//
+//  exportBindingHandler
+//  @Description: 处理输入绑定的导出请求，绑定内容为空时（如cron绑定）按配置导出；
+//  请求有误时返回DROP确认消息，导出失败时返回错误由绑定组件重试
+//  @param b
+//  @return func(ctx context.Context, in *common.BindingEvent) (out []byte, err error)
+//
+func exportBindingHandler(b config.BindingConfig) func(ctx context.Context, in *common.BindingEvent) (out []byte, err error) {
+	return func(ctx context.Context, in *common.BindingEvent) (out []byte, err error) {
+		req := exportRequest{FinName: b.FinName, Type: &b.Type}
+		if len(in.Data) > 0 {
+			req = exportRequest{}
+			err = json.Unmarshal(in.Data, &req)
+		}
+		var ep pg.ExportParam
+		if err == nil {
+			ep, err = req.toParam(pg.TrigBinding)
+			ep.QP.Operator = "binding:" + b.Name
+		}
+		if err != nil {
+			log.Log.Error(fmt.Sprintf("drop export binding: %s", err.Error()), zap.String("binding", b.Name))
+			return json.Marshal(bindingResponse{Status: common.SubscriptionResponseStatusDrop, Error: err.Error()})
+		}
+		if err = svc.Export(ep.FinName, ep.QP); err != nil {
+			log.Log.Error(fmt.Sprintf("export data failed: %s", err.Error()),
+				zap.String("finname", ep.FinName),
+				zap.String("type", "binding"),
+				zap.String("binding", b.Name))
+			if errors.Is(err, dao.ErrFinanceNotFound) {
+				return json.Marshal(bindingResponse{Status: common.SubscriptionResponseStatusDrop, Error: err.Error()})
+			}
+			return nil, err
+		}
+		log.Log.Info("export data successfully",
+			zap.String("finname", ep.FinName),
+			zap.String("type", "binding"),
+			zap.String("binding", b.Name))
+		return json.Marshal(bindingResponse{Status: common.SubscriptionResponseStatusSuccess})
+	}
+}
@@ -0,0 +1,78 @@
+package dapr
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hxextract/app/dao/pg"
+	"testing"
+)
+
+func TestExportRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  interface{}
+		proc  int
+		codes string
+		err   bool
+	}{
+		{
+			name: "json object",
+			data: map[string]interface{}{"finname": "testfinance", "type": 4, "codelist": "000001,000002"},
+			proc: pg.OpCode, codes: "000001,000002",
+		},
+		{
+			name: "json string",
+			data: `{"finname":"testfinance","type":1,"startdate":20211231,"enddate":20211231}`,
+			proc: pg.OpBbrq,
+		},
+		{
+			name: "default type",
+			data: map[string]interface{}{"finname": "testfinance"},
+			proc: pg.OpRtime,
+		},
+		{
+			name: "no finname",
+			data: map[string]interface{}{"type": 0},
+			err:  true,
+		},
+		{
+			name: "no codelist",
+			data: map[string]interface{}{"finname": "testfinance", "type": 4},
+			err:  true,
+		},
+		{
+			name: "invalid type",
+			data: map[string]interface{}{"finname": "testfinance", "type": 9},
+			err:  true,
+		},
+		{
+			name: "compare type",
+			data: map[string]interface{}{"finname": "testfinance", "type": 5},
+			err:  true,
+		},
+		{
+			name: "invalid json",
+			data: "finname=testfinance",
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req exportRequest
+			err := decodeTopicData(tt.data, &req)
+			var ep pg.ExportParam
+			if err == nil {
+				ep, err = req.toParam(pg.TrigTopic)
+			}
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "testfinance", ep.FinName)
+			assert.Equal(t, tt.proc, ep.QP.ProcType)
+			assert.Equal(t, tt.codes, ep.QP.CodeList)
+			assert.Equal(t, pg.TrigTopic, ep.QP.TriggerType)
+			assert.NotZero(t, ep.QP.StartDate)
+		})
+	}
+}
@@ -0,0 +1,436 @@
+package dapr
+
+/*
+purpose:v1版本json接口，请求和响应均为json，参数校验失败时返回出错的字段，错误统一为{"error":{"code","message","field"}}
+*/
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hxextract/app/auth"
+	"hxextract/app/dao"
+	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 错误码
+const (
+	CodeInvalidArgument = "invalid_argument" // 请求参数有误
+	CodeNotFound        = "not_found"        // 财务文件不存在
+	CodeConflict        = "conflict"         // 与执行中的操作冲突
+	CodeInternal        = "internal"         // 执行失败
+)
+
+//go:embed openapi.json
+var openapiDoc []byte
+
+type (
+	// ApiError 错误信息
+	ApiError struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		Field   string `json:"field,omitempty"` // 出错的请求字段
+	}
+
+	// ErrorEnvelope 错误响应
+	ErrorEnvelope struct {
+		Error ApiError `json:"error"`
+	}
+
+	// ExportRequest 导出请求
+	ExportRequest struct {
+		FinName     string   `json:"finname"`
+		Group       string   `json:"group"`     // 表分组，与finname只能指定一个，也可以是schema:<schema>或tag:<tag>
+		Type        *int     `json:"type"`      // 导出方式，为空时按rtime导出
+		StartDate   int      `json:"startdate"` // YYYYMMDD，为空时为昨天
+		EndDate     int      `json:"enddate"`   // YYYYMMDD，为空时为今天
+		Codes       []string `json:"codes"`     // 按代码导出时的代码列表
+		DryRun      bool     `json:"dry_run"`
+		Parallelism int      `json:"parallelism"` // 按分组导出时同时导出的表数，为0时使用Group.Parallelism
+	}
+
+	// ExportResponse 导出结果，dry_run时只返回plan，按分组导出时各表结果见result
+	ExportResponse struct {
+		FinName string           `json:"finname,omitempty"`
+		Group   string           `json:"group,omitempty"`
+		Type    int              `json:"type"`
+		Status  string           `json:"status"`
+		Plan    *dao.PreviewPlan `json:"plan,omitempty"`
+		Result  *dao.GroupResult `json:"result,omitempty"`
+	}
+
+	// CompareRequest 对比请求
+	CompareRequest struct {
+		FinName     string `json:"finname"`
+		Group       string `json:"group"`     // 表分组，与finname只能指定一个
+		Operation   int    `json:"operation"` // 1删除生产库多出的数据，2补全缺失的数据，3两者都执行，dry_run时不需要
+		DryRun      bool   `json:"dry_run"`
+		Parallelism int    `json:"parallelism"` // 按分组对比时同时对比的表数，为0时使用Group.Parallelism
+	}
+
+	// CompareResponse 对比结果，dry_run时只返回plan，按分组对比时deletes、inserts为各表合计
+	CompareResponse struct {
+		FinName string           `json:"finname,omitempty"`
+		Group   string           `json:"group,omitempty"`
+		Status  string           `json:"status"`
+		Deletes int              `json:"deletes"`
+		Inserts int              `json:"inserts"`
+		Plan    *dao.PreviewPlan `json:"plan,omitempty"`
+		Result  *dao.GroupResult `json:"result,omitempty"`
+	}
+)
+
+// v1支持的审计操作类型
+var v1AuditOperations = map[string]bool{dao.AuditExport: true, dao.AuditCompareDelete: true, dao.AuditCompareInsert: true,
+	dao.AuditDerived: true, dao.AuditDelete: true, dao.AuditChangeValid: true}
+
+// v1支持的导出方式
+var v1ExportTypes = map[int]bool{pg.OpAll: true, pg.OpBbrq: true, pg.OpRtime: true, pg.OpCode: true}
+
+func initV1Route(r *gin.Engine) {
+	v1 := r.Group("/v1")
+	v1.POST("/exports", authRequired(auth.RoleExport), v1ExportHandler)
+	v1.POST("/compares", authRequired(auth.RoleExport), v1CompareHandler)
+	v1.GET("/audits", authRequired(auth.RoleRead), v1AuditHandler)
+	v1.POST("/backfills", authRequired(auth.RoleExport), v1BackfillHandler)
+	v1.POST("/backfills/:id/resume", authRequired(auth.RoleExport), v1BackfillResumeHandler)
+	v1.GET("/backfills", authRequired(auth.RoleRead), v1BackfillsHandler)
+	v1.GET("/backfills/:id", authRequired(auth.RoleRead), v1BackfillDetailHandler)
+	v1.GET("/openapi.json", authRequired(auth.RoleRead), func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", openapiDoc)
+	})
+}
+
+func invalidArgument(field string, format string, args ...interface{}) *ApiError {
+	return &ApiError{Code: CodeInvalidArgument, Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+func abortWithError(c *gin.Context, status int, e *ApiError) {
+	c.AbortWithStatusJSON(status, ErrorEnvelope{Error: *e})
+}
+
+// abortWithServiceError 财务文件、表、分组或回补任务不存在时返回404，回补参数有误返回400，回补任务执行中返回409，其他错误返回500
+func abortWithServiceError(c *gin.Context, err error) {
+	if errors.Is(err, dao.ErrInvalidBackfill) {
+		abortWithError(c, http.StatusBadRequest, invalidArgument("", "%s", err.Error()))
+		return
+	}
+	if errors.Is(err, dao.ErrBackfillNotFound) {
+		abortWithError(c, http.StatusNotFound, &ApiError{Code: CodeNotFound, Field: "id", Message: err.Error()})
+		return
+	}
+	if errors.Is(err, dao.ErrBackfillRunning) {
+		abortWithError(c, http.StatusConflict, &ApiError{Code: CodeConflict, Field: "id", Message: err.Error()})
+		return
+	}
+	if errors.Is(err, dao.ErrFinanceNotFound) {
+		abortWithError(c, http.StatusNotFound, &ApiError{Code: CodeNotFound, Field: "finname", Message: err.Error()})
+		return
+	}
+	if errors.Is(err, dao.ErrGroupNotFound) {
+		abortWithError(c, http.StatusNotFound, &ApiError{Code: CodeNotFound, Field: "group", Message: err.Error()})
+		return
+	}
+	if errors.Is(err, dao.ErrTableNotFound) {
+		abortWithError(c, http.StatusNotFound, &ApiError{Code: CodeNotFound, Field: "table", Message: err.Error()})
+		return
+	}
+	abortWithError(c, http.StatusInternalServerError, &ApiError{Code: CodeInternal, Message: err.Error()})
+}
+
+// bindJSON 严格解析json请求体，未知字段和类型错误均返回出错的字段
+func bindJSON(c *gin.Context, v interface{}) *ApiError {
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		return nil
+	}
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == io.EOF:
+		return invalidArgument("", "request body is empty")
+	case errors.As(err, &typeErr):
+		return invalidArgument(typeErr.Field, "%s should be %s", typeErr.Field, typeErr.Type.String())
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return invalidArgument(field, "unknown field %s", field)
+	}
+	return invalidArgument("", "invalid json: %s", err.Error())
+}
+
+// checkDate 校验YYYYMMDD格式的日期，0表示使用默认值
+func checkDate(field string, date int) *ApiError {
+	if date == 0 {
+		return nil
+	}
+	if _, err := time.Parse("20060102", fmt.Sprintf("%08d", date)); err != nil {
+		return invalidArgument(field, "%s should be a date like 20220101", field)
+	}
+	return nil
+}
+
+// checkCodes 代码不能为空，不能包含','和'
+func checkCodes(codes []string) *ApiError {
+	for _, code := range codes {
+		if strings.TrimSpace(code) == "" || strings.ContainsAny(code, ",'") {
+			return invalidArgument("codes", "invalid code: %q", code)
+		}
+	}
+	return nil
+}
+
+// checkTarget finname和group只能指定一个，按分组执行时不支持dry_run
+func checkTarget(finName string, group string, dryRun bool, parallelism int) *ApiError {
+	if finName == "" && group == "" {
+		return invalidArgument("finname", "finname or group is required")
+	}
+	if finName != "" && group != "" {
+		return invalidArgument("group", "finname and group should not both be set")
+	}
+	if group != "" && dryRun {
+		return invalidArgument("dry_run", "dry_run is not supported for group")
+	}
+	if parallelism < 0 {
+		return invalidArgument("parallelism", "parallelism should not be negative")
+	}
+	return nil
+}
+
+// groupStatus 按分组执行时，全部表成功为succeeded，否则为failed
+func groupStatus(res *dao.GroupResult) string {
+	if res.Failed > 0 {
+		return "failed"
+	}
+	return "succeeded"
+}
+
+// toParam 校验导出请求并转换为导出参数
+func (r *ExportRequest) toParam() (pg.ExportParam, *ApiError) {
+	ep := pg.ExportParam{FinName: r.FinName}
+	if e := checkTarget(r.FinName, r.Group, r.DryRun, r.Parallelism); e != nil {
+		return ep, e
+	}
+	ep.QP.ProcType = pg.OpRtime
+	if r.Type != nil {
+		ep.QP.ProcType = *r.Type
+	}
+	if !v1ExportTypes[ep.QP.ProcType] {
+		return ep, invalidArgument("type", "type should be one of 0,1,2,4")
+	}
+	if e := checkDate("startdate", r.StartDate); e != nil {
+		return ep, e
+	}
+	if e := checkDate("enddate", r.EndDate); e != nil {
+		return ep, e
+	}
+	ep.QP.StartDate, ep.QP.EndDate = r.StartDate, r.EndDate
+	ep.QP.FillDefaultDate()
+	if ep.QP.StartDate > ep.QP.EndDate {
+		return ep, invalidArgument("enddate", "enddate should not be earlier than startdate")
+	}
+	if e := checkCodes(r.Codes); e != nil {
+		return ep, e
+	}
+	if ep.QP.ProcType == pg.OpCode && len(r.Codes) == 0 {
+		return ep, invalidArgument("codes", "codes is required when type is 4")
+	}
+	ep.QP.CodeList = strings.Join(r.Codes, ",")
+	ep.QP.TriggerType = pg.TrigManual
+	return ep, nil
+}
+
+func (r *CompareRequest) check() *ApiError {
+	if e := checkTarget(r.FinName, r.Group, r.DryRun, r.Parallelism); e != nil {
+		return e
+	}
+	if !r.DryRun && (r.Operation < dao.CmpAndDelete || r.Operation > dao.CmpAndDelete|dao.CmpAndAdd) {
+		return invalidArgument("operation", "operation should be one of 1,2,3")
+	}
+	return nil
+}
+
+//curl 127.0.0.1:12345/v1/exports -H "Content-Type: application/json" -d '{"finname":"testfinance","type":1,"startdate":20211231,"enddate":20211231}'
+func v1ExportHandler(c *gin.Context) {
+	var req ExportRequest
+	if e := bindJSON(c, &req); e != nil {
+		abortWithError(c, http.StatusBadRequest, e)
+		return
+	}
+	ep, e := req.toParam()
+	if e != nil {
+		abortWithError(c, http.StatusBadRequest, e)
+		return
+	}
+	ep.QP.Operator = operator(c)
+	if req.Group != "" {
+		v1ExportGroup(c, req, ep.QP)
+		return
+	}
+	resp := ExportResponse{FinName: ep.FinName, Type: ep.QP.ProcType}
+	var err error
+	if req.DryRun {
+		resp.Status = "planned"
+		resp.Plan, err = svc.PreviewExport(ep.FinName, ep.QP)
+	} else {
+		resp.Status = "succeeded"
+		err = svc.Export(ep.FinName, ep.QP)
+	}
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("export data failed: %s", err.Error()),
+			zap.String("finname", ep.FinName),
+			zap.String("type", "manual"),
+			zap.Bool("dryrun", req.DryRun))
+		abortWithServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+//curl 127.0.0.1:12345/v1/compares -H "Content-Type: application/json" -d '{"finname":"testfinance","operation":3}'
+func v1CompareHandler(c *gin.Context) {
+	var req CompareRequest
+	if e := bindJSON(c, &req); e != nil {
+		abortWithError(c, http.StatusBadRequest, e)
+		return
+	}
+	if e := req.check(); e != nil {
+		abortWithError(c, http.StatusBadRequest, e)
+		return
+	}
+	if !req.DryRun && req.Operation&dao.CmpAndDelete != 0 && !permit(c, auth.RoleAdmin) {
+		return
+	}
+	if req.Group != "" {
+		v1CompareGroup(c, req)
+		return
+	}
+	resp := CompareResponse{FinName: req.FinName}
+	var err error
+	if req.DryRun {
+		resp.Status = "planned"
+		if resp.Plan, err = svc.PreviewCompare(req.FinName); err == nil {
+			resp.Deletes, resp.Inserts = resp.Plan.Deletes, resp.Plan.Inserts
+		}
+	} else {
+		resp.Status = "succeeded"
+		resp.Deletes, resp.Inserts, err = svc.CompareTable(req.FinName, req.Operation, operator(c))
+	}
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("compare error: %s", err.Error()),
+			zap.String("finname", req.FinName),
+			zap.Int("operation", req.Operation),
+			zap.Bool("dryrun", req.DryRun))
+		abortWithServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// v1ExportGroup 导出分组中所有的表，部分表失败时返回207
+func v1ExportGroup(c *gin.Context, req ExportRequest, qp pg.QueryParam) {
+	res, err := svc.ExportGroup(req.Group, qp, req.Parallelism)
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("export group failed: %s", err.Error()),
+			zap.String("group", req.Group),
+			zap.String("type", "manual"))
+		abortWithServiceError(c, err)
+		return
+	}
+	c.JSON(groupHttpStatus(res), ExportResponse{Group: req.Group, Type: qp.ProcType, Status: groupStatus(res), Result: res})
+}
+
+// v1CompareGroup 对比分组中所有的表，部分表失败时返回207
+func v1CompareGroup(c *gin.Context, req CompareRequest) {
+	res, err := svc.CompareGroup(req.Group, req.Operation, operator(c), req.Parallelism)
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("compare group error: %s", err.Error()),
+			zap.String("group", req.Group),
+			zap.Int("operation", req.Operation))
+		abortWithServiceError(c, err)
+		return
+	}
+	resp := CompareResponse{Group: req.Group, Status: groupStatus(res), Result: res}
+	for _, t := range res.Tables {
+		resp.Deletes += t.Deletes
+		resp.Inserts += t.Inserts
+	}
+	c.JSON(groupHttpStatus(res), resp)
+}
+
+// parseTime 解析RFC3339时间或YYYYMMDD日期，日期按本地时区的0点，endOfDay为true时取次日0点
+func parseTime(field string, value string, endOfDay bool) (time.Time, *ApiError) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("20060102", value, time.Local)
+	if err != nil {
+		return t, invalidArgument(field, "%s should be RFC3339 time or a date like 20220101", field)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// parseInt 解析非负整数，为空时返回0
+func parseInt(field string, value string) (int, *ApiError) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, invalidArgument(field, "%s should be a non-negative integer", field)
+	}
+	return n, nil
+}
+
+// auditQuery 校验查询参数并转换为审计记录查询条件
+func auditQuery(c *gin.Context) (q dao.AuditQuery, e *ApiError) {
+	q.SchemaName, q.TableName, q.Operation = c.Query("schema"), c.Query("table"), c.Query("operation")
+	if q.Operation != "" && !v1AuditOperations[q.Operation] {
+		return q, invalidArgument("operation", "unknown operation %s", q.Operation)
+	}
+	if q.Start, e = parseTime("start", c.Query("start"), false); e != nil {
+		return
+	}
+	if q.End, e = parseTime("end", c.Query("end"), true); e != nil {
+		return
+	}
+	if !q.Start.IsZero() && !q.End.IsZero() && !q.Start.Before(q.End) {
+		return q, invalidArgument("end", "end should be later than start")
+	}
+	if q.Limit, e = parseInt("limit", c.Query("limit")); e != nil {
+		return
+	}
+	q.Offset, e = parseInt("offset", c.Query("offset"))
+	return
+}
+
+//curl "127.0.0.1:12345/v1/audits?schema=indexfinance&table=zjlx&start=20220101&end=20220131&limit=100"
+func v1AuditHandler(c *gin.Context) {
+	q, e := auditQuery(c)
+	if e != nil {
+		abortWithError(c, http.StatusBadRequest, e)
+		return
+	}
+	records, err := svc.AuditRecords(q)
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("query audit records failed: %s", err.Error()))
+		abortWithServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"records": records})
+}
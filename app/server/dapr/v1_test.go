@@ -0,0 +1,133 @@
+package dapr
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"hxextract/app/auth"
+	"hxextract/app/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestV1Validation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	initV1Route(r)
+	tests := []struct {
+		name  string
+		path  string
+		body  string
+		field string
+	}{
+		{name: "empty body", path: "/v1/exports", body: "", field: ""},
+		{name: "unknown field", path: "/v1/exports", body: `{"finname":"a","codelist":"1"}`, field: "codelist"},
+		{name: "wrong type", path: "/v1/exports", body: `{"finname":"a","type":"1"}`, field: "type"},
+		{name: "missing finname", path: "/v1/exports", body: `{"type":1}`, field: "finname"},
+		{name: "invalid type", path: "/v1/exports", body: `{"finname":"a","type":3}`, field: "type"},
+		{name: "compare type", path: "/v1/exports", body: `{"finname":"a","type":5}`, field: "type"},
+		{name: "bad date", path: "/v1/exports", body: `{"finname":"a","startdate":20211301}`, field: "startdate"},
+		{name: "start after end", path: "/v1/exports", body: `{"finname":"a","startdate":20220102,"enddate":20220101}`, field: "enddate"},
+		{name: "codes required", path: "/v1/exports", body: `{"finname":"a","type":4}`, field: "codes"},
+		{name: "compare missing finname", path: "/v1/compares", body: `{"operation":1}`, field: "finname"},
+		{name: "compare operation", path: "/v1/compares", body: `{"finname":"a","operation":4}`, field: "operation"},
+		{name: "finname and group", path: "/v1/exports", body: `{"finname":"a","group":"g"}`, field: "group"},
+		{name: "group dry run", path: "/v1/exports", body: `{"group":"g","dry_run":true}`, field: "dry_run"},
+		{name: "negative parallelism", path: "/v1/exports", body: `{"group":"g","parallelism":-1}`, field: "parallelism"},
+		{name: "compare finname and group", path: "/v1/compares", body: `{"finname":"a","group":"g","operation":1}`, field: "group"},
+		{name: "compare group operation", path: "/v1/compares", body: `{"group":"g","operation":0}`, field: "operation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			r.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			var env ErrorEnvelope
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &env))
+			assert.Equal(t, CodeInvalidArgument, env.Error.Code)
+			assert.Equal(t, tt.field, env.Error.Field)
+			assert.NotEmpty(t, env.Error.Message)
+		})
+	}
+}
+
+func TestV1OpenAPI(t *testing.T) {
+	r := gin.New()
+	initV1Route(r)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/openapi.json", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var doc map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Contains(t, doc["paths"], "/v1/exports")
+}
+
+func TestV1Auth(t *testing.T) {
+	var err error
+	authenticator, err = auth.New(config.AuthConfig{
+		Enable: true,
+		Tokens: []config.TokenConfig{
+			{Name: "dashboard", Token: "read-token", Role: "read"},
+			{Name: "scheduler", Token: "export-token", Role: "export"},
+		},
+	})
+	assert.NoError(t, err)
+	defer func() { authenticator = nil }()
+	r := gin.New()
+	initV1Route(r)
+	tests := []struct {
+		name   string
+		token  string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{name: "no token", path: "/v1/exports", body: `{}`, status: http.StatusUnauthorized, code: CodeUnauthenticated},
+		{name: "bad token", token: "bad", path: "/v1/exports", body: `{}`, status: http.StatusUnauthorized, code: CodeUnauthenticated},
+		{name: "read export", token: "read-token", path: "/v1/exports", body: `{}`, status: http.StatusForbidden, code: CodePermissionDenied},
+		{name: "export reaches validation", token: "export-token", path: "/v1/exports", body: `{}`, status: http.StatusBadRequest, code: CodeInvalidArgument},
+		{name: "export deletes", token: "export-token", path: "/v1/compares", body: `{"finname":"a","operation":1}`, status: http.StatusForbidden, code: CodePermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			req.Header.Set(auth.HeaderToken, tt.token)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.status, w.Code)
+			var env ErrorEnvelope
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &env))
+			assert.Equal(t, tt.code, env.Error.Code)
+		})
+	}
+}
+
+func TestV1AuditValidation(t *testing.T) {
+	r := gin.New()
+	initV1Route(r)
+	tests := []struct {
+		name  string
+		query string
+		field string
+	}{
+		{name: "unknown operation", query: "operation=drop", field: "operation"},
+		{name: "bad start", query: "start=2022-01-01", field: "start"},
+		{name: "end before start", query: "start=20220102&end=20220101", field: "end"},
+		{name: "bad limit", query: "limit=-1", field: "limit"},
+		{name: "bad offset", query: "offset=a", field: "offset"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/audits?"+tt.query, nil))
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			var env ErrorEnvelope
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &env))
+			assert.Equal(t, tt.field, env.Error.Field)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package grpc
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"hxextract/app/auth"
+	"time"
+)
+
+type identityKey struct{}
+
+// methodRoles 各方法需要的最低角色，未列出的方法不需要认证
+var methodRoles = map[string]auth.Role{
+	"/hxextract.api.Extract/Export":        auth.RoleExport,
+	"/hxextract.api.Extract/Compare":       auth.RoleExport, // 删除数据需要admin角色，在Compare中校验
+	"/hxextract.api.Extract/JobStatus":     auth.RoleRead,
+	"/hxextract.api.Extract/ListSchedules": auth.RoleRead,
+	"/hxextract.api.Extract/ListTables":    auth.RoleRead,
+}
+
+// credentialsFromContext 从metadata获取token，从tls连接获取客户端证书
+func credentialsFromContext(ctx context.Context) (token string, certs []*x509.Certificate) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(auth.HeaderToken); len(v) > 0 {
+			token = v[0]
+		} else if v = md.Get("authorization"); len(v) > 0 {
+			token = auth.TokenFromAuthorization(v[0])
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			certs = info.State.PeerCertificates
+		}
+	}
+	return
+}
+
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+//
+//  authInterceptor
+//  @Description: 认证并校验角色，export及以上角色的请求记录到审计日志
+//
+func (s *Server) authInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	role, ok := methodRoles[info.FullMethod]
+	if !ok {
+		return handler(ctx, req)
+	}
+	id, err := s.authenticator.Authenticate(credentialsFromContext(ctx))
+	if err != nil {
+		auth.Record(auth.Identity{Name: peerAddr(ctx)}, info.FullMethod, err, zap.String("ip", peerAddr(ctx)))
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	ctx = context.WithValue(ctx, identityKey{}, id)
+	if err = permit(ctx, info.FullMethod, role); err != nil {
+		return nil, err
+	}
+	if role < auth.RoleExport {
+		return handler(ctx, req)
+	}
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	if status.Code(err) != codes.PermissionDenied {
+		auth.Record(id, info.FullMethod, err,
+			zap.String("ip", peerAddr(ctx)),
+			zap.Any("request", req),
+			zap.Duration("cost", time.Since(start)))
+	}
+	return resp, err
+}
+
+// identity 获取调用方身份，未经过认证拦截器时为未开启认证的身份
+func identity(ctx context.Context) auth.Identity {
+	if id, ok := ctx.Value(identityKey{}).(auth.Identity); ok {
+		return id
+	}
+	id, _ := (*auth.Authenticator)(nil).Authenticate("", nil)
+	return id
+}
+
+// operator 审计记录的发起方：调用方@ip
+func operator(ctx context.Context) string {
+	return identity(ctx).Name + "@" + peerAddr(ctx)
+}
+
+// permit 校验调用方是否拥有该角色，没有权限时返回PermissionDenied并记录审计日志
+func permit(ctx context.Context, method string, role auth.Role) error {
+	id := identity(ctx)
+	if id.Allow(role) {
+		return nil
+	}
+	err := errors.New(fmt.Sprintf("%s: %s role required", auth.ErrPermissionDenied.Error(), role))
+	auth.Record(id, method, err, zap.String("ip", peerAddr(ctx)))
+	return status.Error(codes.PermissionDenied, err.Error())
+}
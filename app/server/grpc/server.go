@@ -0,0 +1,310 @@
+package grpc
+
+/*
+purpose:gRPC服务，与http服务一同启动，提供与http接口相同的能力
+*/
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"hxextract/api"
+	"hxextract/app/auth"
+	"hxextract/app/config"
+	"hxextract/app/cron"
+	"hxextract/app/dao"
+	"hxextract/app/dao/pg"
+	"hxextract/app/log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Server gRPC服务
+type Server struct {
+	api.UnimplementedExtractServer
+	svc           api.NegtServer
+	gs            *grpc.Server
+	port          int
+	authenticator *auth.Authenticator
+}
+
+// New 创建gRPC服务，Service.GrpcPort为0时不启动，认证和证书配置与http服务相同
+func New(s api.NegtServer) (*Server, error) {
+	authenticator, err := auth.New(config.GetAuth())
+	if err != nil {
+		return nil, err
+	}
+	srv := &Server{svc: s, port: config.GetService().GrpcPort, authenticator: authenticator}
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(logInterceptor, srv.authInterceptor)}
+	tlsConfig, err := auth.TLSConfig(config.GetAuth().TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	srv.gs = grpc.NewServer(opts...)
+	api.RegisterExtractServer(srv.gs, srv)
+	// 便于使用grpcurl等工具调试
+	reflection.Register(srv.gs)
+	return srv, nil
+}
+
+// Start 启动服务，阻塞直到服务停止
+func (s *Server) Start() error {
+	if s.port == 0 {
+		log.Log.Info("grpc server is disabled")
+		return nil
+	}
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return err
+	}
+	log.Log.Info("grpc server start", zap.Int("port", s.port))
+	return s.gs.Serve(lis)
+}
+
+// Stop 停止服务，等待处理中的请求结束
+func (s *Server) Stop() {
+	s.gs.GracefulStop()
+}
+
+// Shutdown 停止服务，ctx结束时仍未处理完的请求被强制中断
+func (s *Server) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.gs.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.gs.Stop()
+		return ctx.Err()
+	}
+}
+
+// logInterceptor 记录失败的请求
+func logInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err != nil {
+		log.Log.Error(fmt.Sprintf("grpc request failed: %s", err.Error()), zap.String("method", info.FullMethod))
+	}
+	return resp, err
+}
+
+// toStatus 将错误转换为gRPC状态码
+func toStatus(err error) error {
+	if errors.Is(err, dao.ErrFinanceNotFound) || errors.Is(err, dao.ErrTableNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func int32s(values []int) []int32 {
+	ret := make([]int32, len(values))
+	for i, v := range values {
+		ret[i] = int32(v)
+	}
+	return ret
+}
+
+// rejected 导出方式转为int32，为空时返回nil
+func rejected(values map[int]string) map[int32]string {
+	if len(values) == 0 {
+		return nil
+	}
+	ret := make(map[int32]string, len(values))
+	for op, reason := range values {
+		ret[int32(op)] = reason
+	}
+	return ret
+}
+
+func toRecords(samples []map[string]string) []*api.Record {
+	ret := make([]*api.Record, len(samples))
+	for i, v := range samples {
+		ret[i] = &api.Record{Fields: v}
+	}
+	return ret
+}
+
+func toPlan(plan *dao.PreviewPlan) *api.Plan {
+	return &api.Plan{
+		Schema:        plan.SchemaName,
+		Table:         plan.TableName,
+		Type:          int32(plan.ProcType),
+		Inserts:       int32(plan.Inserts),
+		Updates:       int32(plan.Updates),
+		Deletes:       int32(plan.Deletes),
+		Skipped:       int32(plan.Skipped),
+		SampleInserts: toRecords(plan.SampleInserts),
+		SampleUpdates: toRecords(plan.SampleUpdates),
+		SampleDeletes: toRecords(plan.SampleDeletes),
+	}
+}
+
+func (s *Server) Ping(ctx context.Context, _ *api.PingRequest) (*api.PingReply, error) {
+	if err := s.svc.Ping(ctx); err != nil {
+		return nil, toStatus(err)
+	}
+	return &api.PingReply{Message: "pong"}, nil
+}
+
+func (s *Server) Export(ctx context.Context, req *api.ExportRequest) (*api.ExportReply, error) {
+	ep := pg.ExportParam{
+		FinName: req.Finname,
+		QP: pg.QueryParam{
+			StartDate:   int(req.StartDate),
+			EndDate:     int(req.EndDate),
+			CodeList:    strings.Join(req.Codes, ","),
+			ProcType:    pg.OpRtime,
+			TriggerType: pg.TrigManual,
+			Operator:    operator(ctx),
+		},
+	}
+	// 未设置导出方式时与表单接口一致按rtime导出，0为全量导出
+	if req.Type != nil {
+		ep.QP.ProcType = int(*req.Type)
+	}
+	ep.QP.FillDefaultDate()
+	if err := ep.Check(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.DryRun {
+		plan, err := s.svc.PreviewExport(ep.FinName, ep.QP)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		return &api.ExportReply{Plan: toPlan(plan)}, nil
+	}
+	if err := s.svc.Export(ep.FinName, ep.QP); err != nil {
+		return nil, toStatus(err)
+	}
+	return &api.ExportReply{}, nil
+}
+
+func (s *Server) Compare(ctx context.Context, req *api.CompareRequest) (*api.CompareReply, error) {
+	if req.Finname == "" {
+		return nil, status.Error(codes.InvalidArgument, "finname is empty")
+	}
+	if !req.DryRun && (req.Operation <= 0 || req.Operation > dao.CmpAndDelete|dao.CmpAndAdd) {
+		return nil, status.Error(codes.InvalidArgument, "operation should be one of 1,2,3")
+	}
+	if !req.DryRun && req.Operation&dao.CmpAndDelete != 0 {
+		if err := permit(ctx, "/hxextract.api.Extract/Compare", auth.RoleAdmin); err != nil {
+			return nil, err
+		}
+	}
+	if req.DryRun {
+		plan, err := s.svc.PreviewCompare(req.Finname)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		return &api.CompareReply{Deletes: int32(plan.Deletes), Inserts: int32(plan.Inserts), Plan: toPlan(plan)}, nil
+	}
+	deletes, inserts, err := s.svc.CompareTable(req.Finname, int(req.Operation), operator(ctx))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &api.CompareReply{Deletes: int32(deletes), Inserts: int32(inserts)}, nil
+}
+
+func (s *Server) JobStatus(_ context.Context, req *api.JobStatusRequest) (*api.JobStatusReply, error) {
+	reply := &api.JobStatusReply{}
+	for _, t := range s.svc.TaskStatuses() {
+		if req.TaskId != 0 && int32(t.TaskId) != req.TaskId {
+			continue
+		}
+		reply.Tasks = append(reply.Tasks, &api.TaskStatus{
+			Id:          int32(t.TaskId),
+			Schema:      t.SchemaName,
+			Table:       t.TableName,
+			Type:        int32(t.Export),
+			DependsOn:   int32s(t.DependsOn),
+			Hooks:       t.Hooks,
+			Status:      t.Status,
+			TriggeredBy: int32(t.TriggeredBy),
+			LastRun:     timestamp(t.LastRun),
+			LastSuccess: timestamp(t.LastSuccess),
+			CostMs:      t.CostMs,
+			Error:       t.Error,
+		})
+	}
+	if req.TaskId != 0 {
+		if len(reply.Tasks) == 0 {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("task %d not found", req.TaskId))
+		}
+		return reply, nil
+	}
+	for _, r := range s.svc.DerivedStatuses() {
+		reply.Derived = append(reply.Derived, &api.DerivedStatus{
+			Id:          int32(r.RuleId),
+			Source:      r.Source,
+			Target:      r.Target,
+			Status:      r.Status,
+			Rows:        r.Rows,
+			CostMs:      r.CostMs,
+			LastRun:     timestamp(r.LastRun),
+			LastSuccess: timestamp(r.LastSuccess),
+			Error:       r.Error,
+		})
+	}
+	return reply, nil
+}
+
+func (s *Server) ListSchedules(_ context.Context, _ *api.ListSchedulesRequest) (*api.ListSchedulesReply, error) {
+	reply := &api.ListSchedulesReply{}
+	now := time.Now()
+	for _, t := range s.svc.TaskStatuses() {
+		schedule := &api.Schedule{
+			TaskId:    int32(t.TaskId),
+			Schema:    t.SchemaName,
+			Table:     t.TableName,
+			Type:      int32(t.Export),
+			Cron:      t.Cron,
+			DependsOn: int32s(t.DependsOn),
+		}
+		var next time.Time
+		for _, c := range t.Cron {
+			if n, err := cron.Next(c, now); err == nil && (next.IsZero() || n.Before(next)) {
+				next = n
+			}
+		}
+		schedule.NextRun = timestamp(next)
+		reply.Schedules = append(reply.Schedules, schedule)
+	}
+	return reply, nil
+}
+
+func (s *Server) ListTables(_ context.Context, req *api.ListTablesRequest) (*api.ListTablesReply, error) {
+	reply := &api.ListTablesReply{}
+	for _, t := range s.svc.Tables(req.Schema) {
+		reply.Tables = append(reply.Tables, &api.TableMeta{
+			Finname:    t.FinName,
+			Schema:     t.SchemaName,
+			Table:      t.TableName,
+			KeyColumns: t.KeyColumns,
+			Types:      int32s(t.ProcTypes),
+			Rejected:   rejected(t.Rejected),
+		})
+	}
+	return reply, nil
+}
@@ -0,0 +1,102 @@
+package grpc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"hxextract/api"
+	"hxextract/app/dao"
+	"hxextract/app/dao/pg"
+	"testing"
+)
+
+// exportRecorder 记录导出参数，其余接口不会被调用
+type exportRecorder struct {
+	api.NegtServer
+	param pg.QueryParam
+}
+
+func (e *exportRecorder) Export(_ string, param pg.QueryParam) error {
+	e.param = param
+	return nil
+}
+
+func (e *exportRecorder) CompareTable(string, int, string) (int, int, error) {
+	return 0, 0, nil
+}
+
+func (e *exportRecorder) Tables(string) []dao.TableMeta {
+	return []dao.TableMeta{
+		{FinName: "testfinance", ProcTypes: []int{pg.OpAll}, Rejected: map[int]string{pg.OpRtime: "fin_proc: invalid"}},
+		{FinName: "testindex", ProcTypes: []int{pg.OpAll, pg.OpBbrq}},
+	}
+}
+
+func TestExportInvalidArgument(t *testing.T) {
+	s := &Server{}
+	tests := []struct {
+		name string
+		req  *api.ExportRequest
+	}{
+		{"no finname", &api.ExportRequest{Type: proto.Int32(0)}},
+		{"invalid type", &api.ExportRequest{Finname: "testfinance", Type: proto.Int32(9)}},
+		{"compare type", &api.ExportRequest{Finname: "testfinance", Type: proto.Int32(5)}},
+		{"no codes", &api.ExportRequest{Finname: "testfinance", Type: proto.Int32(4)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Export(context.Background(), tt.req)
+			assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		})
+	}
+}
+
+func TestExportType(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *api.ExportRequest
+		want int
+	}{
+		{"unset", &api.ExportRequest{Finname: "testfinance"}, pg.OpRtime},
+		{"all", &api.ExportRequest{Finname: "testfinance", Type: proto.Int32(0)}, pg.OpAll},
+		{"bbrq", &api.ExportRequest{Finname: "testfinance", Type: proto.Int32(1)}, pg.OpBbrq},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &exportRecorder{}
+			_, err := (&Server{svc: rec}).Export(context.Background(), tt.req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, rec.param.ProcType)
+		})
+	}
+}
+
+func TestListTablesRejected(t *testing.T) {
+	reply, err := (&Server{svc: &exportRecorder{}}).ListTables(context.Background(), &api.ListTablesRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[int32]string{pg.OpRtime: "fin_proc: invalid"}, reply.Tables[0].Rejected)
+	assert.Equal(t, []int32{pg.OpAll, pg.OpBbrq}, reply.Tables[1].Types)
+	assert.Nil(t, reply.Tables[1].Rejected)
+}
+
+func TestCompareInvalidArgument(t *testing.T) {
+	s := &Server{svc: &exportRecorder{}}
+	tests := []struct {
+		name string
+		req  *api.CompareRequest
+	}{
+		{"no finname", &api.CompareRequest{Operation: dao.CmpAndAdd}},
+		{"no operation", &api.CompareRequest{Finname: "testfinance"}},
+		{"invalid operation", &api.CompareRequest{Finname: "testfinance", Operation: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Compare(context.Background(), tt.req)
+			assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		})
+	}
+	_, err := s.Compare(context.Background(), &api.CompareRequest{Finname: "testfinance", Operation: dao.CmpAndAdd})
+	assert.NoError(t, err)
+}
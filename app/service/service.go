@@ -5,7 +5,9 @@ import (
 	"github.com/google/wire"
 	"hxextract/api"
 	"hxextract/app/dao"
+	"hxextract/app/dao/conn"
 	"hxextract/app/dao/pg"
+	"time"
 )
 
 var Provider = wire.NewSet(New, wire.Bind(new(api.NegtServer), new(*Service)))
@@ -19,6 +21,8 @@ func New(d dao.Dao) (s *Service, cf func(), err error) {
 	s = &Service{
 		dao: d,
 	}
+	// dao由dao.New返回的cleanup关闭
+	cf = func() {}
 	return
 }
 
@@ -31,6 +35,10 @@ func (s *Service) Close() {
 	s.dao.Close()
 }
 
+func (s *Service) Shutdown(ctx context.Context) error {
+	return s.dao.Shutdown(ctx)
+}
+
 func (s *Service) Ping(ctx context.Context) error {
 	return nil
 }
@@ -43,6 +51,82 @@ func (s *Service) HealthCheck() error {
 	return s.dao.HealthCheck()
 }
 
-func (s *Service) CompareTable(finName string, operation int) (int, int, error) {
-	return s.dao.CompareTable(finName, operation)
+func (s *Service) Readiness() *dao.Readiness {
+	return s.dao.Readiness()
+}
+
+func (s *Service) CompareTable(finName string, operation int, operator string) (int, int, error) {
+	return s.dao.CompareTable(finName, operation, operator)
+}
+
+func (s *Service) PreviewExport(finName string, param pg.QueryParam) (*dao.PreviewPlan, error) {
+	return s.dao.PreviewExport(finName, param)
+}
+
+func (s *Service) PreviewCompare(finName string) (*dao.PreviewPlan, error) {
+	return s.dao.PreviewCompare(finName)
+}
+
+func (s *Service) Reconcile(param dao.ReconcileParam) (*dao.ReconcileReport, error) {
+	return s.dao.Reconcile(param)
+}
+
+func (s *Service) DerivedStatuses() []dao.DerivedStatus {
+	return s.dao.DerivedStatuses()
+}
+
+func (s *Service) TaskStatuses() []dao.TaskStatus {
+	return s.dao.TaskStatuses()
+}
+
+func (s *Service) Tables(schemaName string) []dao.TableMeta {
+	return s.dao.Tables(schemaName)
+}
+
+func (s *Service) AuditRecords(q dao.AuditQuery) ([]dao.AuditRecord, error) {
+	return s.dao.AuditRecords(q)
+}
+
+func (s *Service) ExportRuns(q dao.RunQuery) (*dao.RunPage, error) {
+	return s.dao.ExportRuns(q)
+}
+
+func (s *Service) Freshness(schemaName string, tableName string, procType string, maxAge time.Duration) (*dao.Freshness, error) {
+	return s.dao.Freshness(schemaName, tableName, procType, maxAge)
+}
+
+func (s *Service) SlaStatuses() []dao.SlaStatus {
+	return s.dao.SlaStatuses()
+}
+
+func (s *Service) Connections() []conn.Info {
+	return s.dao.Connections()
+}
+
+func (s *Service) StartBackfill(param dao.BackfillParam) (*dao.BackfillJob, error) {
+	return s.dao.StartBackfill(param)
+}
+
+func (s *Service) ResumeBackfill(id int64, operator string) (*dao.BackfillJob, error) {
+	return s.dao.ResumeBackfill(id, operator)
+}
+
+func (s *Service) Backfills() ([]dao.BackfillJob, error) {
+	return s.dao.Backfills()
+}
+
+func (s *Service) BackfillDetail(id int64) (*dao.BackfillJob, error) {
+	return s.dao.BackfillDetail(id)
+}
+
+func (s *Service) Groups() []dao.TableGroup {
+	return s.dao.Groups()
+}
+
+func (s *Service) ExportGroup(group string, param pg.QueryParam, parallelism int) (*dao.GroupResult, error) {
+	return s.dao.ExportGroup(group, param, parallelism)
+}
+
+func (s *Service) CompareGroup(group string, operation int, operator string, parallelism int) (*dao.GroupResult, error) {
+	return s.dao.CompareGroup(group, operation, operator, parallelism)
 }
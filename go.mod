@@ -3,7 +3,7 @@ module hxextract
 go 1.16
 
 require (
-	github.com/Knetic/govaluate v3.0.0+incompatible // indirect
+	github.com/Knetic/govaluate v3.0.0+incompatible
 	github.com/dapr/go-sdk v1.2.0
 	github.com/gin-gonic/gin v1.7.4
 	github.com/go-yaml/yaml v2.1.0+incompatible
@@ -15,6 +15,8 @@ require (
 	github.com/prometheus/tsdb v0.7.1 // indirect
 	github.com/robfig/cron/v3 v3.0.1
 	github.com/stretchr/testify v1.7.0
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
 	go.uber.org/zap v1.20.0
 	google.golang.org/grpc v1.41.0
 	google.golang.org/protobuf v1.27.1
@@ -3,13 +3,17 @@ package main
 import (
 	"hxextract/app/config"
 	"hxextract/app/di"
+	"hxextract/app/event"
 	lg "hxextract/app/log"
+	"hxextract/app/secret"
 )
 
 func main() {
 	config.ConfigureInit()
 	lg.InitLog()
 	lg.Log.Info("Start up")
+	secret.Init()
+	event.Init()
 	app, cleanup, err := di.InitApp()
 	if err != nil {
 		lg.Log.Fatal(err.Error())
@@ -18,5 +22,14 @@ func main() {
 	if err != nil {
 		lg.Log.Fatal(err.Error())
 	}
+	// 收到退出信号并等待执行中的任务结束后，关闭连接池和事件发布；
+	// 超时后仍在执行的请求和任务会继续使用连接池，此时不关闭，连接随进程退出释放
+	if !app.Drained() {
+		lg.Log.Warn("requests or tasks still running after shutdown timeout, exit without closing connections")
+		return
+	}
+	lg.Log.Info("close connections")
 	cleanup()
+	event.Close()
+	lg.Log.Info("Shut down")
 }
@@ -90,3 +90,26 @@ func TestBindingHandlerErrors(t *testing.T) {
 	s.mux.ServeHTTP(resp, req)
 	assert.Equal(t, http.StatusInternalServerError, resp.Code)
 }
+
+func TestRestrictToDapr(t *testing.T) {
+	s := newServer("", nil)
+	err := s.AddBindingInvocationHandler("/test", func(ctx context.Context, in *common.BindingEvent) (out []byte, err error) {
+		return nil, nil
+	})
+	assert.NoError(t, err)
+	newReq := func(remote, token string) *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, "/test", nil)
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set(appAPITokenHeader, token)
+		}
+		return req
+	}
+	testRequest(t, s, newReq("10.0.0.1:1234", ""), http.StatusOK)
+	s.RestrictToDapr("")
+	testRequest(t, s, newReq("10.0.0.1:1234", ""), http.StatusUnauthorized)
+	testRequest(t, s, newReq("127.0.0.1:1234", ""), http.StatusOK)
+	s.RestrictToDapr("secret")
+	testRequest(t, s, newReq("127.0.0.1:1234", ""), http.StatusUnauthorized)
+	testRequest(t, s, newReq("10.0.0.1:1234", "secret"), http.StatusOK)
+}
@@ -1,11 +1,23 @@
 package http
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net"
 	"net/http"
 
 	"github.com/dapr/go-sdk/service/common"
 )
 
+const (
+	// AppAPITokenEnvVar is the environment variable holding the token Dapr sends to the app
+	AppAPITokenEnvVar = "APP_API_TOKEN"
+	// appAPITokenHeader is the header Dapr uses to send the app API token
+	appAPITokenHeader = "dapr-api-token"
+)
+
 // NewService creates new Service
 func NewService(address string) common.Service {
 	return newServer(address, nil)
@@ -16,6 +28,14 @@ func NewServiceWithMux(address string, mux *http.ServeMux) common.Service {
 	return newServer(address, mux)
 }
 
+// NewServiceWithTLS creates new Service serving https with existing http mux,
+// certificates and client auth are taken from tlsConfig
+func NewServiceWithTLS(address string, mux *http.ServeMux, tlsConfig *tls.Config) common.Service {
+	s := newServer(address, mux)
+	s.tlsConfig = tlsConfig
+	return s
+}
+
 func newServer(address string, mux *http.ServeMux) *Server {
 	if mux == nil {
 		mux = http.NewServeMux()
@@ -24,6 +44,10 @@ func newServer(address string, mux *http.ServeMux) *Server {
 		address:            address,
 		mux:                mux,
 		topicSubscriptions: make([]*common.Subscription, 0),
+		httpServer: &http.Server{
+			Addr:    address,
+			Handler: mux,
+		},
 	}
 }
 
@@ -32,22 +56,76 @@ type Server struct {
 	address            string
 	mux                *http.ServeMux
 	topicSubscriptions []*common.Subscription
+	tlsConfig          *tls.Config
+	httpServer         *http.Server
+	daprOnly           bool
+	appToken           string
+}
+
+// RestrictToDapr makes topic and binding handlers accept only requests sent by the Dapr sidecar:
+// requests must carry the dapr-api-token header equal to token, or come from loopback when token is empty
+func (s *Server) RestrictToDapr(token string) {
+	s.daprOnly = true
+	s.appToken = token
+}
+
+// checkCaller returns an error when the request is not sent by the Dapr sidecar
+func (s *Server) checkCaller(r *http.Request) error {
+	if s.appToken != "" {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(appAPITokenHeader)), []byte(s.appToken)) != 1 {
+			return errors.New("invalid dapr api token")
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.New("only the local dapr sidecar is allowed")
+	}
+	return nil
+}
+
+// daprHandler rejects callers other than the Dapr sidecar once RestrictToDapr is called
+func (s *Server) daprHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.daprOnly {
+			if err := s.checkCaller(r); err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
 }
 
-// Start starts the HTTP handler. Blocks while serving
+// Start starts the HTTP handler. Blocks while serving,
+// returns nil once the service is stopped by Stop or Shutdown
 func (s *Server) Start() error {
 	s.registerSubscribeHandler()
-	server := http.Server{
-		Addr:    s.address,
-		Handler: s.mux,
+	var err error
+	if s.tlsConfig != nil {
+		s.httpServer.TLSConfig = s.tlsConfig
+		err = s.httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = s.httpServer.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
 	}
-	return server.ListenAndServe()
+	return err
 }
 
-// Stop stops previously started HTTP service
+// Stop stops previously started HTTP service, waits for in-flight requests without a deadline
 func (s *Server) Stop() error {
-	// TODO: implement service stop
-	return nil
+	return s.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting new connections and waits for in-flight requests
+// until they finish or ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
 }
 
 func setOptions(w http.ResponseWriter, r *http.Request) {
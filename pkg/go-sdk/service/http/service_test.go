@@ -1,9 +1,11 @@
 package http
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -15,6 +17,22 @@ func TestStoppingUnstartedService(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestStartReturnsAfterShutdown(t *testing.T) {
+	s := newServer("127.0.0.1:0", nil)
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Start() }()
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("start did not return after shutdown")
+	}
+}
+
 func TestSettingOptions(t *testing.T) {
 	req, err := http.NewRequest(http.MethodOptions, "/", nil)
 	assert.NoErrorf(t, err, "error creating request")
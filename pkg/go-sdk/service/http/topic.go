@@ -58,7 +58,7 @@ func (s *Server) AddTopicEventHandler(sub *common.Subscription, fn func(ctx cont
 
 	s.topicSubscriptions = append(s.topicSubscriptions, sub)
 
-	s.mux.Handle(sub.Route, optionsHandler(http.HandlerFunc(
+	s.mux.Handle(sub.Route, optionsHandler(s.daprHandler(http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			// check for post with no data
 			if r.ContentLength == 0 {
@@ -94,7 +94,7 @@ func (s *Server) AddTopicEventHandler(sub *common.Subscription, fn func(ctx cont
 			}
 
 			writeStatus(w, common.SubscriptionResponseStatusDrop)
-		})))
+		}))))
 
 	return nil
 }